@@ -0,0 +1,122 @@
+// Command archive searches archive files of compressed logs, printing the
+// logs matching a time, template and source filter as JSON lines.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/log-zero/log-zero/internal/models"
+	"github.com/log-zero/log-zero/internal/storage/archive"
+)
+
+// parseTime parses an RFC 3339 time, or returns the zero time for "".
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// splitList splits a comma-separated list, dropping empty fields.
+func splitList(s string) []string {
+	var values []string
+	for _, field := range strings.Split(s, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			values = append(values, field)
+		}
+	}
+	return values
+}
+
+// printBlocks lists the index of an archive.
+func printBlocks(reader *archive.Reader, filter *archive.Filter) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SOURCE\tTEMPLATE ID\tROWS\tBYTES\tFROM\tTO\tTEMPLATE")
+	for _, block := range reader.Blocks() {
+		if len(filter.Sources) > 0 && !contains(filter.Sources, block.Source) ||
+			len(filter.TemplateIDs) > 0 && !contains(filter.TemplateIDs, block.TemplateID) {
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\t%s\t%s\n",
+			block.Source, block.TemplateID, block.Rows, block.Length,
+			time.Unix(0, block.MinTime).UTC().Format(time.RFC3339),
+			time.Unix(0, block.MaxTime).UTC().Format(time.RFC3339),
+			block.Template)
+	}
+	tw.Flush()
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func main() {
+	from := flag.String("from", "", "Only logs at or after this RFC 3339 time")
+	to := flag.String("to", "", "Only logs at or before this RFC 3339 time")
+	templates := flag.String("template", "", "Comma-separated template IDs to match")
+	sources := flag.String("source", "", "Comma-separated sources to match")
+	limit := flag.Int("limit", 0, "Maximum number of logs to print (0 for all)")
+	blocks := flag.Bool("blocks", false, "List the archive index instead of logs")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] file ...\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	filter := archive.Filter{
+		TemplateIDs: splitList(*templates),
+		Sources:     splitList(*sources),
+	}
+	var err error
+	if filter.Start, err = parseTime(*from); err != nil {
+		fmt.Fprintf(os.Stderr, "-from: %v\n", err)
+		os.Exit(2)
+	}
+	if filter.End, err = parseTime(*to); err != nil {
+		fmt.Fprintf(os.Stderr, "-to: %v\n", err)
+		os.Exit(2)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	printed := 0
+	for _, path := range flag.Args() {
+		reader, err := archive.Open(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to open %s: %v\n", path, err)
+			os.Exit(1)
+		}
+
+		if *blocks {
+			printBlocks(reader, &filter)
+		} else {
+			err = reader.Scan(filter, func(log *models.CompressedLog) error {
+				if *limit > 0 && printed >= *limit {
+					return archive.ErrStop
+				}
+				printed++
+				return encoder.Encode(log)
+			})
+		}
+		reader.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to scan %s: %v\n", path, err)
+			os.Exit(1)
+		}
+	}
+}
@@ -3,16 +3,28 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"io/fs"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/log-zero/log-zero/internal/compression/codec"
 	"github.com/log-zero/log-zero/internal/compression/drain"
 	"github.com/log-zero/log-zero/internal/compression/pii"
+	"github.com/log-zero/log-zero/internal/compression/tune"
+	"github.com/log-zero/log-zero/internal/models"
+	"github.com/log-zero/log-zero/internal/pipeline"
 	"go.uber.org/zap"
 )
 
@@ -23,86 +35,685 @@ type Config struct {
 	MetricsPort string
 	WorkerCount int
 	DrainConfig drain.Config
+
+	// SourceConfigs overrides DrainConfig for individual sources.
+	SourceConfigs map[string]drain.SourceConfig
+
+	// SnapshotPath is where Drain state is checkpointed; empty disables it.
+	SnapshotPath     string
+	SnapshotInterval time.Duration
+
+	// Tokenizer, if set, replaces PII with deterministic tokens instead of
+	// placeholders. DetokenizeTokens maps responder identities to the
+	// bearer tokens that authorize reversing tokens through its vault;
+	// empty disables detokenization.
+	Tokenizer        *pii.Tokenizer
+	DetokenizeTokens map[string]string
+
+	// AdminTokens maps operator identities to the bearer tokens that
+	// authorize template merge, split, pin and rename requests. Empty
+	// disables those endpoints.
+	AdminTokens map[string]string
 }
 
 // CompressionService handles log compression.
 type CompressionService struct {
-	config    Config
-	drainTree *drain.DrainTree
-	redactor  *pii.Redactor
-	logger    *zap.Logger
+	config   Config
+	registry *drain.Registry
+	redactor *pii.Redactor
+	logger   *zap.Logger
+
+	auditMu sync.Mutex
+	audit   []AuditEntry
+
+	events *eventHub
+
+	encoders sync.Pool // *codec.Encoder
 }
 
 // NewCompressionService creates a new compression service.
 func NewCompressionService(config Config, logger *zap.Logger) *CompressionService {
-	drainTree := drain.NewDrainTree(config.DrainConfig)
-	redactor := pii.NewRedactor(pii.DefaultRedactorConfig())
+	redactorConfig := pii.DefaultRedactorConfig()
+	redactorConfig.Tokenizer = config.Tokenizer
+	redactor := pii.NewRedactor(redactorConfig)
+	config.DrainConfig.RedactSample = redactor.RedactSample
+	registry := drain.NewRegistry(config.DrainConfig, config.SourceConfigs)
+
+	registry.OnEvict(func(source string, cluster drain.ClusterInfo) {
+		logger.Info("Template evicted",
+			zap.String("source", source),
+			zap.String("template_id", cluster.ID),
+			zap.String("template", cluster.Template),
+			zap.Int64("log_count", cluster.Size),
+		)
+	})
+	events := newEventHub()
+	registry.OnEvent(events.publish)
+
+	if config.SnapshotPath != "" {
+		if err := registry.LoadSnapshot(config.SnapshotPath); err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				logger.Warn("Failed to restore Drain snapshot, starting empty",
+					zap.String("path", config.SnapshotPath),
+					zap.Error(err),
+				)
+			}
+		} else {
+			logger.Info("Restored Drain snapshot",
+				zap.String("path", config.SnapshotPath),
+				zap.Int("sources", len(registry.Sources())),
+				zap.Int("templates", registry.ClusterCount()),
+			)
+		}
+	}
 
 	return &CompressionService{
-		config:    config,
-		drainTree: drainTree,
-		redactor:  redactor,
-		logger:    logger,
+		config:   config,
+		registry: registry,
+		redactor: redactor,
+		logger:   logger,
+		events:   events,
+	}
+}
+
+// eventBuffer is the number of template events queued per stream
+// subscriber. A subscriber that falls further behind misses events and is
+// told how many.
+const eventBuffer = 256
+
+// eventSubscriber is one open template event stream.
+type eventSubscriber struct {
+	events  chan drain.Event
+	dropped atomic.Int64
+}
+
+// eventHub fans template events out to stream subscribers.
+type eventHub struct {
+	mu          sync.Mutex
+	subscribers map[*eventSubscriber]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subscribers: make(map[*eventSubscriber]struct{})}
+}
+
+// publish delivers event to every subscriber without blocking.
+func (h *eventHub) publish(event drain.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.subscribers {
+		select {
+		case sub.events <- event:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+// subscribe registers a new subscriber; call the returned func to remove it.
+func (h *eventHub) subscribe() (*eventSubscriber, func()) {
+	sub := &eventSubscriber{events: make(chan drain.Event, eventBuffer)}
+	h.mu.Lock()
+	h.subscribers[sub] = struct{}{}
+	h.mu.Unlock()
+
+	return sub, func() {
+		h.mu.Lock()
+		delete(h.subscribers, sub)
+		h.mu.Unlock()
+	}
+}
+
+// streamEvents writes template events to w as server-sent events until the
+// client disconnects. Empty source and types match everything.
+func (s *CompressionService) streamEvents(w http.ResponseWriter, r *http.Request, source string, types map[drain.EventType]bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	sub, unsubscribe := s.events.subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case event := <-sub.events:
+			if dropped := sub.dropped.Swap(0); dropped > 0 {
+				fmt.Fprintf(w, "event: dropped\ndata: {\"count\":%d}\n\n", dropped)
+			}
+			if (source != "" && event.Source != source) || (len(types) > 0 && !types[event.Type]) {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %s/%d\nevent: %s\ndata: %s\n\n", event.Source, event.Seq, event.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// RunCheckpoints periodically writes Drain snapshots until ctx is done,
+// then writes a final one.
+func (s *CompressionService) RunCheckpoints(ctx context.Context) {
+	if s.config.SnapshotPath == "" || s.config.SnapshotInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(s.config.SnapshotInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.checkpoint()
+		case <-ctx.Done():
+			s.checkpoint()
+			return
+		}
 	}
 }
 
+// checkpoint writes a single Drain snapshot.
+func (s *CompressionService) checkpoint() {
+	if err := s.registry.SaveSnapshot(s.config.SnapshotPath); err != nil {
+		s.logger.Error("Failed to write Drain snapshot",
+			zap.String("path", s.config.SnapshotPath),
+			zap.Error(err),
+		)
+		return
+	}
+	s.logger.Debug("Wrote Drain snapshot", zap.String("path", s.config.SnapshotPath))
+}
+
 // CompressLog compresses a single log entry.
 func (s *CompressionService) CompressLog(content string, source string, timestamp int64) (*CompressedLog, error) {
-	// Parse log using Drain algorithm
-	result, err := s.drainTree.Parse(content, timestamp)
+	// Redact secrets while their context is still next to them; once
+	// parsed, a bearer token is just a variable
+	line, _ := s.redactor.RedactSecrets(content)
+
+	// Parse log using the Drain tree for its source
+	result, err := s.registry.Parse(source, line, timestamp)
 	if err != nil {
 		return nil, err
 	}
 
 	// Redact PII from variables
 	redactedVars := s.redactor.RedactVariables(result.Variables)
+	encoded := s.encode(&codec.Record{
+		TemplateID: result.TemplateID,
+		Timestamp:  timestamp,
+		Variables:  redactedVars,
+	})
 
 	return &CompressedLog{
-		TemplateID:     result.TemplateID,
-		Template:       result.Template,
-		Variables:      redactedVars,
-		Source:         source,
-		Timestamp:      timestamp,
-		IsNewTemplate:  result.IsNew,
-		OriginalSize:   len(content),
-		CompressedSize: len(result.TemplateID) + estimateVariablesSize(redactedVars),
+		TemplateID:    result.TemplateID,
+		Template:      result.Template,
+		Variables:     redactedVars,
+		NumVariables:  drain.NumericVariables(redactedVars),
+		Types:         result.Types,
+		Fields:        result.Fields,
+		Source:        source,
+		Timestamp:     timestamp,
+		IsNewTemplate: result.IsNew,
+		OriginalSize:  len(content),
+		Encoded:       encoded,
+		RecordSize:    len(encoded),
 	}, nil
 }
 
 // CompressedLog represents a compressed log entry.
 type CompressedLog struct {
-	TemplateID     string
-	Template       string
-	Variables      map[string]string
-	Source         string
-	Timestamp      int64
-	IsNewTemplate  bool
-	OriginalSize   int
-	CompressedSize int
+	TemplateID    string
+	Template      string
+	Variables     map[string]string
+	NumVariables  map[string]float64 // Variables that parse as numbers; durations in milliseconds
+	Types         map[string]drain.SlotType
+	Fields        map[string]string
+	Source        string
+	Timestamp     int64
+	IsNewTemplate bool
+	OriginalSize  int    // Bytes of the raw log line
+	Encoded       []byte // Self-contained codec encoding of the record
+	RecordSize    int    // Bytes of Encoded alone; records in a block share a dictionary and take less
 }
 
-// estimateVariablesSize estimates the storage size of variables.
-func estimateVariablesSize(vars map[string]string) int {
-	size := 0
-	for k, v := range vars {
-		size += len(k) + len(v)
+// encode returns the codec encoding of record on its own, decodable with a
+// fresh codec.Decoder. Records written to a block share dictionaries and
+// usually take fewer bytes there.
+func (s *CompressionService) encode(record *codec.Record) []byte {
+	enc, ok := s.encoders.Get().(*codec.Encoder)
+	if !ok {
+		enc = codec.NewEncoder(codec.DefaultMaxDictionary)
 	}
-	return size
+	defer s.encoders.Put(enc)
+
+	enc.Reset()
+	return enc.Append(nil, record)
 }
 
-// GetStats returns compression statistics.
+// GetStats returns compression statistics across all sources.
 func (s *CompressionService) GetStats() drain.Stats {
-	return s.drainTree.GetStats()
+	return s.registry.GetStats()
+}
+
+// GetStatsBySource returns compression statistics per source.
+func (s *CompressionService) GetStatsBySource() map[string]drain.Stats {
+	return s.registry.StatsBySource()
 }
 
-// GetTemplates returns all templates.
+// GetTemplates returns all templates of every source.
 func (s *CompressionService) GetTemplates() []*drain.LogCluster {
-	return s.drainTree.GetAllClusters()
+	var clusters []*drain.LogCluster
+	for _, source := range s.registry.Sources() {
+		clusters = append(clusters, s.registry.Tree(source).GetAllClusters()...)
+	}
+	return clusters
 }
 
-// GetTemplate returns a template by ID.
+// GetTemplate returns a template by ID, searching every source.
 func (s *CompressionService) GetTemplate(id string) (*drain.LogCluster, bool) {
-	return s.drainTree.GetCluster(id)
+	_, cluster, ok := s.registry.FindCluster(id)
+	return cluster, ok
+}
+
+// TemplateInfo is a template together with the source it belongs to.
+type TemplateInfo struct {
+	Source string `json:"source"`
+	drain.ClusterInfo
+}
+
+// GetTemplateInfos returns a copy of the templates of source, or of every
+// source if it is empty, including their samples.
+func (s *CompressionService) GetTemplateInfos(source string) []TemplateInfo {
+	sources := s.registry.Sources()
+	if source != "" {
+		sources = []string{source}
+	}
+
+	var infos []TemplateInfo
+	for _, src := range sources {
+		tree, ok := s.registry.Lookup(src)
+		if !ok {
+			continue
+		}
+		for _, cluster := range tree.GetAllClusters() {
+			infos = append(infos, TemplateInfo{Source: src, ClusterInfo: cluster.Info()})
+		}
+	}
+	return infos
+}
+
+// GetTemplateAliases returns retired template IDs mapped to their current
+// IDs, across all sources.
+func (s *CompressionService) GetTemplateAliases() map[string]string {
+	aliases := make(map[string]string)
+	for _, source := range s.registry.Sources() {
+		for alias, id := range s.registry.Tree(source).IDMappings() {
+			aliases[alias] = id
+		}
+	}
+	return aliases
+}
+
+// treeFor returns the tree for source, or the tree owning template id if
+// source is empty.
+func (s *CompressionService) treeFor(source, id string) (*drain.DrainTree, error) {
+	if source == "" {
+		found, _, ok := s.registry.FindCluster(id)
+		if !ok {
+			return nil, fmt.Errorf("unknown template %s", id)
+		}
+		source = found
+	}
+	tree, ok := s.registry.Lookup(source)
+	if !ok {
+		return nil, fmt.Errorf("unknown source %s", source)
+	}
+	return tree, nil
+}
+
+// maxAuditEntries bounds the in-memory template audit trail.
+const maxAuditEntries = 1000
+
+// AuditEntry records a manual change to the template tree.
+type AuditEntry struct {
+	Time        time.Time `json:"time"`
+	Actor       string    `json:"actor"`
+	Action      string    `json:"action"`
+	Source      string    `json:"source,omitempty"`
+	TemplateIDs []string  `json:"template_ids"`
+	ResultID    string    `json:"result_id,omitempty"`
+	Detail      string    `json:"detail,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// recordAudit logs an admin action and appends it to the audit trail.
+func (s *CompressionService) recordAudit(entry AuditEntry) {
+	entry.Time = time.Now()
+	s.logger.Info("Template admin action",
+		zap.String("actor", entry.Actor),
+		zap.String("action", entry.Action),
+		zap.String("source", entry.Source),
+		zap.Strings("template_ids", entry.TemplateIDs),
+		zap.String("result_id", entry.ResultID),
+		zap.String("detail", entry.Detail),
+		zap.String("error", entry.Error),
+	)
+
+	s.auditMu.Lock()
+	defer s.auditMu.Unlock()
+	s.audit = append(s.audit, entry)
+	if len(s.audit) > maxAuditEntries {
+		s.audit = append([]AuditEntry(nil), s.audit[len(s.audit)-maxAuditEntries:]...)
+	}
+}
+
+// GetAuditTrail returns the recorded admin actions, oldest first.
+func (s *CompressionService) GetAuditTrail() []AuditEntry {
+	s.auditMu.Lock()
+	defer s.auditMu.Unlock()
+	return append([]AuditEntry(nil), s.audit...)
+}
+
+// MergeTemplates merges templates of source by ID on behalf of actor. If
+// source is empty it is taken from the first template.
+func (s *CompressionService) MergeTemplates(actor, source string, ids []string) (*drain.LogCluster, error) {
+	var cluster *drain.LogCluster
+	var err error
+	if len(ids) == 0 {
+		err = fmt.Errorf("no templates to merge")
+	} else {
+		var tree *drain.DrainTree
+		if tree, err = s.treeFor(source, ids[0]); err == nil {
+			cluster, err = tree.MergeClusters(ids)
+		}
+	}
+	s.recordAudit(auditEntry(actor, "merge", source, ids, cluster, "", err))
+	return cluster, err
+}
+
+// SplitTemplate splits logs with value at position out of a template on
+// behalf of actor.
+func (s *CompressionService) SplitTemplate(actor, source, id string, position int, value string) (*drain.LogCluster, error) {
+	tree, err := s.treeFor(source, id)
+	var cluster *drain.LogCluster
+	if err == nil {
+		cluster, err = tree.SplitCluster(id, position, value, time.Now().UnixNano())
+	}
+	detail := fmt.Sprintf("position=%d value=%q", position, value)
+	s.recordAudit(auditEntry(actor, "split", source, []string{id}, cluster, detail, err))
+	return cluster, err
+}
+
+// PinTemplate pins or unpins a template on behalf of actor.
+func (s *CompressionService) PinTemplate(actor, source, id string, pinned bool) (*drain.LogCluster, error) {
+	tree, err := s.treeFor(source, id)
+	var cluster *drain.LogCluster
+	if err == nil {
+		cluster, err = tree.PinCluster(id, pinned)
+	}
+	action := "pin"
+	if !pinned {
+		action = "unpin"
+	}
+	s.recordAudit(auditEntry(actor, action, source, []string{id}, cluster, "", err))
+	return cluster, err
+}
+
+// RenameSlot renames a variable slot of a template on behalf of actor. An
+// empty name restores the derived name.
+func (s *CompressionService) RenameSlot(actor, source, id, slot, name string) (*drain.LogCluster, error) {
+	tree, err := s.treeFor(source, id)
+	var cluster *drain.LogCluster
+	if err == nil {
+		cluster, err = tree.RenameSlot(id, slot, name)
+	}
+	detail := fmt.Sprintf("slot=%q name=%q", slot, name)
+	s.recordAudit(auditEntry(actor, "rename_slot", source, []string{id}, cluster, detail, err))
+	return cluster, err
+}
+
+// maxTuneLines bounds the sample a tune request may replay.
+const maxTuneLines = 50000
+
+// maxTuneBodyBytes bounds the body of a tune request.
+const maxTuneBodyBytes = 32 << 20
+
+// TuneSource recommends Drain parameters for source by replaying logs
+// under grid, starting from the source's current config. Missing grid
+// dimensions use the defaults. Without logs it replays the sample lines
+// its templates have kept.
+func (s *CompressionService) TuneSource(source string, logs []string, grid tune.Grid, minSlotEntropy float64) (*tune.Report, error) {
+	if len(logs) > maxTuneLines {
+		return nil, fmt.Errorf("too many lines to replay: %d (max %d)", len(logs), maxTuneLines)
+	}
+	if len(logs) == 0 {
+		tree, ok := s.registry.Lookup(source)
+		if !ok {
+			return nil, fmt.Errorf("unknown source %s", source)
+		}
+		for _, cluster := range tree.GetAllClusters() {
+			logs = append(logs, cluster.Samples()...)
+		}
+	}
+	defaults := tune.DefaultGrid()
+	if len(grid.SimThresholds) == 0 {
+		grid.SimThresholds = defaults.SimThresholds
+	}
+	if len(grid.MaxDepths) == 0 {
+		grid.MaxDepths = defaults.MaxDepths
+	}
+	// Every cell replays the whole sample, so allow no more than the default grid
+	maxCells := len(defaults.SimThresholds) * len(defaults.MaxDepths)
+	if cells := len(grid.SimThresholds) * len(grid.MaxDepths); cells > maxCells {
+		return nil, fmt.Errorf("grid too large: %d configurations (max %d)", cells, maxCells)
+	}
+	return tune.Tune(logs, s.registry.ConfigFor(source), grid, minSlotEntropy)
+}
+
+// auditEntry builds the audit record for an admin operation.
+func auditEntry(actor, action, source string, ids []string, result *drain.LogCluster, detail string, err error) AuditEntry {
+	entry := AuditEntry{
+		Actor:       actor,
+		Action:      action,
+		Source:      source,
+		TemplateIDs: ids,
+		Detail:      detail,
+	}
+	if result != nil {
+		entry.ResultID = result.Info().ID
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	return entry
+}
+
+// parseIdentityTokens parses a comma-separated list of identity=token pairs.
+// Pairs without an identity or a token are skipped.
+func parseIdentityTokens(spec string) map[string]string {
+	tokens := make(map[string]string)
+	for _, pair := range strings.Split(spec, ",") {
+		identity, token, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if ok && identity != "" && token != "" {
+			tokens[identity] = token
+		}
+	}
+	return tokens
+}
+
+// authorizeToken checks the request's bearer token against tokens, a map
+// of identities to tokens, and returns the identity it belongs to.
+func authorizeToken(r *http.Request, tokens map[string]string) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return "", false
+	}
+	actor := ""
+	for identity, secret := range tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1 {
+			actor = identity
+		}
+	}
+	return actor, actor != ""
+}
+
+// adminHandler wraps a template admin handler. Requests must use method
+// and carry an admin token; the identity the token belongs to is passed on
+// as the audit actor. Rejected requests are audited under their remote
+// address.
+func (s *CompressionService) adminHandler(method, action string, handle func(w http.ResponseWriter, r *http.Request, actor string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if len(s.config.AdminTokens) == 0 {
+			http.Error(w, "Template admin not enabled", http.StatusNotFound)
+			return
+		}
+		actor, ok := authorizeToken(r, s.config.AdminTokens)
+		if !ok {
+			s.recordAudit(auditEntry(r.RemoteAddr, action, "", nil, nil, "", fmt.Errorf("unauthorized")))
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handle(w, r, actor)
+	}
+}
+
+// writeTemplateResult writes the outcome of an admin operation.
+func writeTemplateResult(w http.ResponseWriter, cluster *drain.LogCluster, err error) {
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cluster.Info())
+}
+
+// RehydratedLog is a stored log regenerated from its template.
+type RehydratedLog struct {
+	LogID      string    `json:"log_id"`
+	TemplateID string    `json:"template_id"`
+	Timestamp  time.Time `json:"timestamp"`
+	Source     string    `json:"source"`
+	Raw        string    `json:"raw,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// RehydrateLogs regenerates raw lines for compressed logs, such as the
+// result of a ClickHouse QueryLogs call. Redacted variables stay redacted.
+func (s *CompressionService) RehydrateLogs(logs []models.CompressedLog) []RehydratedLog {
+	rehydrated := make([]RehydratedLog, 0, len(logs))
+	for _, log := range logs {
+		entry := RehydratedLog{
+			LogID:      log.LogID,
+			TemplateID: log.TemplateID,
+			Timestamp:  log.Timestamp,
+			Source:     log.Source,
+		}
+
+		// Prefer the tree, which knows renamed slots, when it has the template
+		var raw string
+		var err error
+		tree, ok := s.registry.Lookup(log.Source)
+		if ok {
+			_, ok = tree.TemplateByID(log.TemplateID)
+		}
+		if ok {
+			raw, err = tree.ReconstructLog(log.TemplateID, log.Variables)
+		} else if log.Template != "" {
+			raw, err = drain.Reconstruct(log.Template, log.Variables)
+		} else {
+			err = fmt.Errorf("unknown template %s for source %s", log.TemplateID, log.Source)
+		}
+		// Structured lines were clustered on their message field alone
+		if _, structured := log.Attributes[pipeline.LayoutKey]; err == nil && structured {
+			raw, err = pipeline.Rebuild(raw, log.Attributes)
+		}
+		if err != nil {
+			entry.Error = err.Error()
+		} else {
+			entry.Raw = raw
+		}
+
+		rehydrated = append(rehydrated, entry)
+	}
+	return rehydrated
+}
+
+// maxDetokenizeTokens bounds a detokenize request, so responders reverse
+// the specific tokens they need rather than bulk exports.
+const maxDetokenizeTokens = 100
+
+// DetokenizeResult holds the values revealed for a detokenize request.
+type DetokenizeResult struct {
+	Values  map[string]string `json:"values"`
+	Unknown []string          `json:"unknown,omitempty"`
+}
+
+// detokenizeEnabled reports whether tokens can be reversed through the API.
+func (s *CompressionService) detokenizeEnabled() bool {
+	return len(s.config.DetokenizeTokens) > 0 && s.config.Tokenizer != nil && s.config.Tokenizer.Vault() != nil
+}
+
+// Detokenize reveals the values behind PII tokens on behalf of actor,
+// recording who asked, why and for which tokens in the audit trail.
+func (s *CompressionService) Detokenize(actor, reason string, tokens []string) (*DetokenizeResult, error) {
+	result := &DetokenizeResult{Values: make(map[string]string, len(tokens))}
+	var err error
+	switch {
+	case !s.detokenizeEnabled():
+		err = fmt.Errorf("detokenization is not enabled")
+	case reason == "":
+		err = fmt.Errorf("a reason is required")
+	case len(tokens) == 0 || len(tokens) > maxDetokenizeTokens:
+		err = fmt.Errorf("between 1 and %d tokens are required", maxDetokenizeTokens)
+	default:
+		vault := s.config.Tokenizer.Vault()
+		for _, token := range tokens {
+			value, _, revealErr := vault.Reveal(token)
+			if errors.Is(revealErr, pii.ErrUnknownToken) {
+				result.Unknown = append(result.Unknown, token)
+				continue
+			}
+			if revealErr != nil {
+				err = revealErr
+				break
+			}
+			result.Values[token] = value
+		}
+	}
+
+	s.recordAudit(auditEntry(actor, "detokenize", "", nil, nil,
+		fmt.Sprintf("reason: %s; tokens: %s", reason, strings.Join(tokens, ",")), err))
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
 // StartHTTPServer starts the HTTP API server.
@@ -122,6 +733,209 @@ func (s *CompressionService) StartHTTPServer(ctx context.Context) error {
 		w.Write([]byte(`{"total_clusters":` + string(rune(stats.TotalClusters)) + `,"total_logs":` + string(rune(stats.TotalLogs)) + `}`))
 	})
 
+	// Per-source stats
+	mux.HandleFunc("/stats/sources", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"sources": s.GetStatsBySource(),
+		})
+	})
+
+	// Templates with sample logs, optionally filtered by ?source=
+	mux.HandleFunc("/templates", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"templates": s.GetTemplateInfos(r.URL.Query().Get("source")),
+		})
+	})
+
+	mux.HandleFunc("/templates/", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/templates/")
+		cluster, ok := s.GetTemplate(id)
+		if !ok {
+			http.Error(w, "Template not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cluster.Info())
+	})
+
+	// Template admin operations. Require an admin token as a bearer token;
+	// its identity is recorded in the audit trail.
+	mux.HandleFunc("/templates/merge", s.adminHandler(http.MethodPost, "merge", func(w http.ResponseWriter, r *http.Request, actor string) {
+		var req struct {
+			Source string   `json:"source"`
+			IDs    []string `json:"ids"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		cluster, err := s.MergeTemplates(actor, req.Source, req.IDs)
+		writeTemplateResult(w, cluster, err)
+	}))
+
+	mux.HandleFunc("/templates/split", s.adminHandler(http.MethodPost, "split", func(w http.ResponseWriter, r *http.Request, actor string) {
+		var req struct {
+			Source   string `json:"source"`
+			ID       string `json:"id"`
+			Position int    `json:"position"`
+			Value    string `json:"value"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		cluster, err := s.SplitTemplate(actor, req.Source, req.ID, req.Position, req.Value)
+		writeTemplateResult(w, cluster, err)
+	}))
+
+	mux.HandleFunc("/templates/pin", s.adminHandler(http.MethodPost, "pin", func(w http.ResponseWriter, r *http.Request, actor string) {
+		var req struct {
+			Source string `json:"source"`
+			ID     string `json:"id"`
+			Pinned bool   `json:"pinned"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		cluster, err := s.PinTemplate(actor, req.Source, req.ID, req.Pinned)
+		writeTemplateResult(w, cluster, err)
+	}))
+
+	mux.HandleFunc("/templates/rename-slot", s.adminHandler(http.MethodPost, "rename_slot", func(w http.ResponseWriter, r *http.Request, actor string) {
+		var req struct {
+			Source string `json:"source"`
+			ID     string `json:"id"`
+			Slot   string `json:"slot"`
+			Name   string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		cluster, err := s.RenameSlot(actor, req.Source, req.ID, req.Slot, req.Name)
+		writeTemplateResult(w, cluster, err)
+	}))
+
+	// Recommend a similarity threshold and depth for a source. Replays are
+	// CPU-heavy, so this requires an admin token too.
+	mux.HandleFunc("/templates/tune", s.adminHandler(http.MethodPost, "tune", func(w http.ResponseWriter, r *http.Request, actor string) {
+		r.Body = http.MaxBytesReader(w, r.Body, maxTuneBodyBytes)
+		var req struct {
+			Source         string   `json:"source"`
+			Logs           []string `json:"logs"`
+			MinSlotEntropy float64  `json:"min_slot_entropy"`
+			tune.Grid
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		report, err := s.TuneSource(req.Source, req.Logs, req.Grid, req.MinSlotEntropy)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	}))
+
+	// The audit trail names operators and what they changed, so reading it
+	// requires an admin token as well
+	mux.HandleFunc("/templates/audit", s.adminHandler(http.MethodGet, "read_audit", func(w http.ResponseWriter, r *http.Request, actor string) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"entries": s.GetAuditTrail(),
+		})
+	}))
+
+	// Stream template created/updated/merged/evicted events as server-sent
+	// events, optionally filtered by ?source= and ?type=created,merged
+	mux.HandleFunc("/templates/events", func(w http.ResponseWriter, r *http.Request) {
+		var types map[drain.EventType]bool
+		if param := r.URL.Query().Get("type"); param != "" {
+			types = make(map[drain.EventType]bool)
+			for _, t := range strings.Split(param, ",") {
+				types[drain.EventType(strings.TrimSpace(t))] = true
+			}
+		}
+		s.streamEvents(w, r, r.URL.Query().Get("source"), types)
+	})
+
+	// Template ID aliases, for reconciling stored template_id values
+	mux.HandleFunc("/templates/aliases", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"aliases": s.GetTemplateAliases(),
+		})
+	})
+
+	// Rehydrate raw lines for a QueryLogs result
+	mux.HandleFunc("/logs/rehydrate", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			Logs []models.CompressedLog `json:"logs"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"logs": s.RehydrateLogs(req.Logs),
+		})
+	})
+
+	// Reverse PII tokens through the vault. Requires a detokenize token as a
+	// bearer token and a reason; the identity the token belongs to and the
+	// reason are audited.
+	mux.HandleFunc("/pii/detokenize", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !s.detokenizeEnabled() {
+			http.Error(w, "Detokenization not enabled", http.StatusNotFound)
+			return
+		}
+		actor, ok := authorizeToken(r, s.config.DetokenizeTokens)
+		if !ok {
+			s.recordAudit(auditEntry(r.RemoteAddr, "detokenize", "", nil, nil, "", fmt.Errorf("unauthorized")))
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req struct {
+			Tokens []string `json:"tokens"`
+			Reason string   `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		result, err := s.Detokenize(actor, req.Reason, req.Tokens)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+
 	server := &http.Server{
 		Addr:    ":" + s.config.HTTPPort,
 		Handler: mux,
@@ -165,6 +979,10 @@ func main() {
 	httpPort := flag.String("http-port", "8091", "HTTP server port")
 	metricsPort := flag.String("metrics-port", "8092", "Metrics server port")
 	workerCount := flag.Int("workers", 100, "Number of worker goroutines")
+	snapshotPath := flag.String("snapshot-path", "", "File to checkpoint Drain state to (empty disables)")
+	snapshotInterval := flag.Duration("snapshot-interval", time.Minute, "Interval between Drain checkpoints")
+	sourceConfigPath := flag.String("drain-sources", "", "JSON file of per-source Drain config overrides")
+	vaultPath := flag.String("pii-vault", "", "File of encrypted PII values behind tokens (requires "+pii.TokenKeyEnv+" and "+pii.VaultKeyEnv+")")
 	flag.Parse()
 
 	// Initialize logger
@@ -174,6 +992,26 @@ func main() {
 	}
 	defer logger.Sync()
 
+	var sourceConfigs map[string]drain.SourceConfig
+	if *sourceConfigPath != "" {
+		sourceConfigs, err = drain.LoadSourceConfigs(*sourceConfigPath)
+		if err != nil {
+			logger.Fatal("Failed to load per-source Drain config", zap.Error(err))
+		}
+	}
+
+	// Tokenize PII instead of redacting it when a token key is set
+	tokenizer, err := pii.LoadTokenizer(*vaultPath)
+	if err != nil {
+		logger.Fatal("Failed to load PII tokenizer", zap.Error(err))
+	}
+	if tokenizer != nil {
+		defer tokenizer.Close()
+		tokenizer.OnVaultError(func(err error) {
+			logger.Warn("Failed to store PII token in vault", zap.Error(err))
+		})
+	}
+
 	// Create config
 	config := Config{
 		GRPCPort:    *grpcPort,
@@ -181,6 +1019,19 @@ func main() {
 		MetricsPort: *metricsPort,
 		WorkerCount: *workerCount,
 		DrainConfig: drain.DefaultConfig(),
+
+		SourceConfigs: sourceConfigs,
+
+		SnapshotPath:     *snapshotPath,
+		SnapshotInterval: *snapshotInterval,
+
+		Tokenizer:        tokenizer,
+		DetokenizeTokens: parseIdentityTokens(os.Getenv("LOGZERO_DETOKENIZE_TOKENS")),
+		AdminTokens:      parseIdentityTokens(os.Getenv("LOGZERO_ADMIN_TOKENS")),
+	}
+
+	if os.Getenv("LOGZERO_DETOKENIZE_SECRET") != "" {
+		logger.Warn("LOGZERO_DETOKENIZE_SECRET is no longer used; set per-responder tokens in LOGZERO_DETOKENIZE_TOKENS")
 	}
 
 	// Create service
@@ -207,6 +1058,12 @@ func main() {
 		}
 	}()
 
+	checkpointsDone := make(chan struct{})
+	go func() {
+		service.RunCheckpoints(ctx)
+		close(checkpointsDone)
+	}()
+
 	logger.Info("Compression service started",
 		zap.String("grpc_port", config.GRPCPort),
 		zap.String("http_port", config.HTTPPort),
@@ -216,4 +1073,5 @@ func main() {
 	<-sigterm
 	logger.Info("Shutting down...")
 	cancel()
+	<-checkpointsDone
 }
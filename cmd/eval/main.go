@@ -0,0 +1,82 @@
+// Command eval scores Drain against LogHub-style labeled datasets and prints
+// grouping accuracy, parsing accuracy, F1 and throughput per dataset.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/log-zero/log-zero/internal/compression/drain"
+	"github.com/log-zero/log-zero/internal/compression/eval"
+)
+
+func main() {
+	defaults := drain.DefaultConfig()
+	simThreshold := flag.Float64("sim", defaults.SimThreshold, "Similarity threshold for template matching")
+	maxDepth := flag.Int("depth", defaults.MaxDepth, "Maximum depth of the parse tree")
+	maxChildren := flag.Int("max-children", defaults.MaxChildren, "Maximum children per node")
+	extraDelimiter := flag.String("extra-delimiter", "", "Additional delimiter characters for tokenization")
+	asJSON := flag.Bool("json", false, "Print results as JSON")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] dir|file.csv ...\n\nEvaluates every *_structured.csv in each directory, or each CSV file given.\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var datasets []*eval.Dataset
+	for _, path := range flag.Args() {
+		info, err := os.Stat(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		if info.IsDir() {
+			loaded, err := eval.LoadDir(path)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to load %s: %v\n", path, err)
+				os.Exit(1)
+			}
+			datasets = append(datasets, loaded...)
+			continue
+		}
+		dataset, err := eval.LoadCSV(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to load %s: %v\n", path, err)
+			os.Exit(1)
+		}
+		datasets = append(datasets, dataset)
+	}
+
+	config := defaults
+	config.SimThreshold = *simThreshold
+	config.MaxDepth = *maxDepth
+	config.MaxChildren = *maxChildren
+	config.ExtraDelimiter = *extraDelimiter
+
+	results := eval.EvaluateAll(datasets, config)
+	mean := eval.Mean(results)
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(map[string]interface{}{"results": results, "average": mean}); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to encode results: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	for _, result := range results {
+		fmt.Println(result)
+	}
+	if len(results) > 1 {
+		fmt.Println(mean)
+	}
+}
@@ -98,6 +98,7 @@ func (g *Gateway) SetupRoutes() {
 	// Metrics endpoints
 	api.Get("/metrics/sustainability", g.handleSustainabilityMetrics)
 	api.Get("/metrics/mttr", g.handleMTTRMetrics)
+	api.Get("/metrics/pii", g.handlePIIAudit)
 
 	// WebSocket for live updates
 	g.app.Get("/ws", websocket.New(g.handleWebSocket))
@@ -299,6 +300,20 @@ func (g *Gateway) handleMTTRMetrics(c *fiber.Ctx) error {
 	})
 }
 
+func (g *Gateway) handlePIIAudit(c *fiber.Ctx) error {
+	resp, err := g.proxyRequest("GET", g.config.IngestionService+"/pii/audit", nil)
+	if err != nil {
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"error": "Ingestion service unavailable",
+		})
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	return c.Status(resp.StatusCode).Send(body)
+}
+
 // WebSocket handler
 
 func (g *Gateway) handleWebSocket(c *websocket.Conn) {
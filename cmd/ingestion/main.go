@@ -3,10 +3,18 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
+	"io/fs"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -14,6 +22,7 @@ import (
 	"github.com/log-zero/log-zero/internal/compression/drain"
 	"github.com/log-zero/log-zero/internal/compression/pii"
 	"github.com/log-zero/log-zero/internal/pipeline"
+	"github.com/log-zero/log-zero/internal/storage/clickhouse"
 	"go.uber.org/zap"
 )
 
@@ -23,21 +32,93 @@ type Config struct {
 	WorkerCount int
 	BufferSize  int
 	DrainConfig drain.Config
+
+	// SourceConfigs overrides DrainConfig for individual sources.
+	SourceConfigs map[string]drain.SourceConfig
+
+	// Multiline groups stack traces and other continuation lines into one
+	// event before parsing; MultilineSources overrides it per source.
+	Multiline        pipeline.MultilineConfig
+	MultilineSources map[string]pipeline.MultilineConfig
+	StackFrames      int // Top frames used to key stack trace templates
+
+	// SnapshotPath is where Drain state is checkpointed; empty disables it.
+	SnapshotPath     string
+	SnapshotInterval time.Duration
+
+	// Tokenizer, if set, replaces PII with deterministic tokens instead of
+	// placeholders.
+	Tokenizer *pii.Tokenizer
+
+	// PIIAuditInterval is the window of each PII audit report; reports are
+	// also written to PIIAuditDir if it is set.
+	PIIAuditInterval time.Duration
+	PIIAuditDir      string
+
+	// TemplateStore, if set, receives the templates and template ID aliases
+	// of every source each TemplateSyncInterval and on shutdown.
+	TemplateStore        TemplateStore
+	TemplateSyncInterval time.Duration
+}
+
+// TemplateStore persists templates and template ID aliases, such as the
+// ClickHouse templates and template_aliases tables.
+type TemplateStore interface {
+	InsertTemplates(ctx context.Context, templates []*clickhouse.TemplateRecord) error
+	InsertTemplateAliases(ctx context.Context, aliases map[string]string) error
 }
 
 // IngestionService handles log ingestion.
 type IngestionService struct {
 	config     Config
-	drainTree  *drain.DrainTree
+	registry   *drain.Registry
 	redactor   *pii.Redactor
 	workerPool *pipeline.WorkerPool
+	aggregator *pipeline.MultilineAggregator
 	logger     *zap.Logger
+
+	audit           *pii.Audit
+	auditMu         sync.Mutex
+	lastAuditReport *pii.AuditReport // Last completed audit window
+
+	syncMu        sync.Mutex
+	syncedSizes   map[string]int64  // Log count of each template when last stored
+	syncedAliases map[string]string // Aliases already stored
 }
 
 // NewIngestionService creates a new ingestion service.
 func NewIngestionService(ctx context.Context, config Config, logger *zap.Logger) *IngestionService {
-	drainTree := drain.NewDrainTree(config.DrainConfig)
-	redactor := pii.NewRedactor(pii.DefaultRedactorConfig())
+	redactorConfig := pii.DefaultRedactorConfig()
+	redactorConfig.Tokenizer = config.Tokenizer
+	redactor := pii.NewRedactor(redactorConfig)
+	config.DrainConfig.RedactSample = redactor.RedactSample
+	registry := drain.NewRegistry(config.DrainConfig, config.SourceConfigs)
+
+	registry.OnEvict(func(source string, cluster drain.ClusterInfo) {
+		logger.Info("Template evicted",
+			zap.String("source", source),
+			zap.String("template_id", cluster.ID),
+			zap.String("template", cluster.Template),
+			zap.Int64("log_count", cluster.Size),
+		)
+	})
+
+	if config.SnapshotPath != "" {
+		if err := registry.LoadSnapshot(config.SnapshotPath); err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				logger.Warn("Failed to restore Drain snapshot, starting empty",
+					zap.String("path", config.SnapshotPath),
+					zap.Error(err),
+				)
+			}
+		} else {
+			logger.Info("Restored Drain snapshot",
+				zap.String("path", config.SnapshotPath),
+				zap.Int("sources", len(registry.Sources())),
+				zap.Int("templates", registry.ClusterCount()),
+			)
+		}
+	}
 
 	poolConfig := pipeline.PoolConfig{
 		Workers:    config.WorkerCount,
@@ -48,30 +129,61 @@ func NewIngestionService(ctx context.Context, config Config, logger *zap.Logger)
 
 	svc := &IngestionService{
 		config:     config,
-		drainTree:  drainTree,
+		registry:   registry,
 		redactor:   redactor,
 		workerPool: workerPool,
 		logger:     logger,
+		audit:      pii.NewAudit(),
+
+		syncedSizes:   make(map[string]int64),
+		syncedAliases: make(map[string]string),
 	}
 
 	// Start worker pool with handler
 	workerPool.Start(svc.processLog)
 
+	// Assemble multi-line events in front of the pool
+	svc.aggregator = pipeline.NewMultilineAggregator(config.Multiline, config.MultilineSources, workerPool.Submit)
+	svc.aggregator.OnDrop(func(msg *pipeline.Message) {
+		logger.Warn("Log event dropped",
+			zap.String("message_id", msg.ID),
+			zap.String("source", msg.Source),
+			zap.Int("lines", strings.Count(msg.Content, "\n")+1),
+		)
+	})
+	go svc.aggregator.Run(ctx)
+
 	return svc
 }
 
 // processLog is the worker handler for log processing.
 func (s *IngestionService) processLog(ctx context.Context, msg *pipeline.Message) (*pipeline.Result, error) {
+	originalSize := len(msg.Content)
+
+	// JSON and logfmt lines: cluster only the message field
+	attributes, _ := pipeline.Structure(msg)
 	timestamp := msg.Timestamp.UnixNano()
 
-	// Parse log using Drain algorithm
-	result, err := s.drainTree.Parse(msg.Content, timestamp)
+	// Redact secrets while their context is still next to them; once
+	// parsed, a bearer token is just a variable
+	var lineSpans []pii.Span
+	msg.Content, lineSpans = s.redactor.RedactSecrets(msg.Content)
+
+	// Parse log using the Drain tree for its source
+	result, err := s.parseEvent(msg, timestamp)
 	if err != nil {
 		return nil, err
 	}
 
-	// Redact PII
-	redactedVars := s.redactor.RedactVariables(result.Variables)
+	// Redact PII, recording where it was found for the audit report
+	var findings []pii.Finding
+	for _, span := range lineSpans {
+		findings = append(findings, pii.Finding{Field: pii.LineField, Type: span.Type, Start: span.Start, End: span.End})
+	}
+	redactedVars, fieldFindings := s.redactor.RedactFields(result.Variables)
+	findings = append(findings, fieldFindings...)
+	findings = append(findings, redactAttributes(s.redactor, attributes)...)
+	s.audit.Record(msg.Source, result.TemplateID, findings)
 
 	// Create compressed log
 	compressed := &CompressedLog{
@@ -79,9 +191,12 @@ func (s *IngestionService) processLog(ctx context.Context, msg *pipeline.Message
 		TemplateID:    result.TemplateID,
 		Template:      result.Template,
 		Variables:     redactedVars,
+		NumVariables:  drain.NumericVariables(redactedVars),
+		Attributes:    attributes,
+		Metadata:      msg.Metadata,
 		Source:        msg.Source,
 		Timestamp:     msg.Timestamp,
-		OriginalSize:  len(msg.Content),
+		OriginalSize:  originalSize,
 	}
 
 	// In production, this would be stored to ClickHouse
@@ -98,12 +213,69 @@ func (s *IngestionService) processLog(ctx context.Context, msg *pipeline.Message
 	}, nil
 }
 
+// parseEvent parses a log event with the Drain tree for its source. Only the
+// first line of a multi-line event is clustered, keyed by its stack trace
+// signature if it has one, and the remaining lines are kept in the
+// variables so the event can be reconstructed.
+func (s *IngestionService) parseEvent(msg *pipeline.Message, timestamp int64) (*drain.ParseResult, error) {
+	head, body, multiline := strings.Cut(msg.Content, "\n")
+	if !multiline {
+		return s.registry.Parse(msg.Source, msg.Content, timestamp)
+	}
+
+	tree := s.registry.Tree(msg.Source)
+	line := head
+	signature, ok := pipeline.StackSignature(msg.Content, s.config.StackFrames)
+	if ok {
+		line = head + " " + strings.Join(signature, " ")
+	}
+
+	result, err := tree.Parse(line, timestamp)
+	if err != nil {
+		return nil, err
+	}
+	result.Variables[drain.BodyKey] = body
+	if ok {
+		// The tokenizer may split a frame into several tokens
+		result.Variables[drain.SignatureKey] = strconv.Itoa(tree.TokenCount(strings.Join(signature, " ")))
+	}
+	return result, nil
+}
+
+// redactAttributes redacts PII from the string values of attributes in
+// place and returns what was found, by attribute in key order. The layout
+// holds no values and is left alone.
+func redactAttributes(redactor *pii.Redactor, attributes map[string]interface{}) []pii.Finding {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var findings []pii.Finding
+	for _, key := range keys {
+		s, ok := attributes[key].(string)
+		if !ok || key == pipeline.LayoutKey {
+			continue
+		}
+		redacted, spans := redactor.RedactSpans(s)
+		attributes[key] = redacted
+		for _, span := range spans {
+			findings = append(findings, pii.Finding{Field: "attributes." + key, Type: span.Type, Start: span.Start, End: span.End})
+		}
+	}
+	return findings
+}
+
 // CompressedLog represents a compressed log entry.
 type CompressedLog struct {
 	LogID        string
 	TemplateID   string
 	Template     string
 	Variables    map[string]string
+	NumVariables map[string]float64     // Variables that parse as numbers; durations in milliseconds
+	Attributes   map[string]interface{} // Typed fields of structured logs other than the message
+	Metadata     map[string]string      // Format, level, service and timestamp of structured logs
 	Source       string
 	Timestamp    time.Time
 	OriginalSize int
@@ -127,16 +299,41 @@ func (s *IngestionService) StartHTTPServer(ctx context.Context) error {
 	// Metrics
 	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
 		metrics := s.workerPool.GetMetrics()
-		stats := s.drainTree.GetStats()
+		stats := s.registry.GetStats()
+		piiLogs, _, redactionsByType := s.audit.Totals()
+		var redactions int64
+		for _, n := range redactionsByType {
+			redactions += n
+		}
+		byType, _ := json.Marshal(redactionsByType)
 		w.Header().Set("Content-Type", "application/json")
 		response := `{"processed":` + itoa(metrics.Processed) +
 			`,"errors":` + itoa(metrics.Errors) +
 			`,"dropped":` + itoa(metrics.Dropped) +
 			`,"templates":` + itoa(int64(stats.TotalClusters)) +
-			`,"total_logs":` + itoa(stats.TotalLogs) + `}`
+			`,"total_logs":` + itoa(stats.TotalLogs) +
+			`,"template_evictions":` + itoa(stats.Evictions) +
+			`,"drain_memory_bytes":` + itoa(stats.MemoryBytes) +
+			`,"drain_sources":` + itoa(int64(len(s.registry.Sources()))) +
+			`,"pii_logs":` + itoa(piiLogs) +
+			`,"pii_redactions":` + itoa(redactions) +
+			`,"pii_redactions_by_type":` + string(byType) + `}`
 		w.Write([]byte(response))
 	})
 
+	// PII audit: the current window and the last completed one
+	mux.HandleFunc("/pii/audit", func(w http.ResponseWriter, r *http.Request) {
+		current := s.audit.Report()
+		s.auditMu.Lock()
+		previous := s.lastAuditReport
+		s.auditMu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"current":  current,
+			"previous": previous,
+		})
+	})
+
 	// Ingest endpoint
 	mux.HandleFunc("/ingest", s.handleIngest)
 
@@ -184,29 +381,80 @@ func (s *IngestionService) handleIngest(w http.ResponseWriter, r *http.Request)
 		ID:        uuid.New().String(),
 		Content:   log,
 		Source:    source,
+		Stream:    r.FormValue("stream"),
 		Timestamp: time.Now(),
 	}
 
-	if s.workerPool.Submit(msg) {
-		w.WriteHeader(http.StatusAccepted)
-		w.Write([]byte(`{"status":"accepted"}`))
-	} else {
+	if !s.ingest(msg) {
 		w.WriteHeader(http.StatusServiceUnavailable)
 		w.Write([]byte(`{"status":"rejected","reason":"buffer_full"}`))
+		return
 	}
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(`{"status":"accepted"}`))
 }
 
+// maxBatchBytes bounds the body of a batch ingest request.
+const maxBatchBytes = 10 << 20
+
 func (s *IngestionService) handleBatchIngest(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// In production, parse JSON body with multiple logs
+	var req struct {
+		Source string   `json:"source"`
+		Stream string   `json:"stream"`
+		Logs   []string `json:"logs"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBatchBytes)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(req.Logs) == 0 {
+		http.Error(w, "Missing logs", http.StatusBadRequest)
+		return
+	}
+	if req.Source == "" {
+		req.Source = "http"
+	}
+
+	// The batch's lines are consecutive, so they are grouped like the
+	// lines of one multi-line message
+	msg := &pipeline.Message{
+		ID:        uuid.New().String(),
+		Content:   strings.Join(req.Logs, "\n"),
+		Source:    req.Source,
+		Stream:    req.Stream,
+		Timestamp: time.Now(),
+	}
+
+	if !s.ingest(msg) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"status":"rejected","reason":"buffer_full"}`))
+		return
+	}
 	w.WriteHeader(http.StatusAccepted)
 	w.Write([]byte(`{"status":"batch_accepted"}`))
 }
 
+// ingest hands msg to the aggregator and reports whether it was accepted.
+// A message without a stream is grouped on its own and its events reach
+// the worker pool before ingest returns. Lines of a stream may wait for
+// the lines after them; events rejected later are logged by OnDrop.
+func (s *IngestionService) ingest(msg *pipeline.Message) bool {
+	if !s.workerPool.IsHealthy() {
+		return false
+	}
+	if msg.Stream == "" {
+		return s.aggregator.AddComplete(msg)
+	}
+	s.aggregator.Add(msg)
+	return true
+}
+
 // corsMiddleware adds CORS headers to responses
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -246,9 +494,204 @@ func itoa(n int64) string {
 	return string(result)
 }
 
-// Stop gracefully shuts down the service.
+// RunCheckpoints periodically writes Drain snapshots until ctx is done.
+// The final snapshot is written by Stop once the workers have drained.
+func (s *IngestionService) RunCheckpoints(ctx context.Context) {
+	if s.config.SnapshotPath == "" || s.config.SnapshotInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(s.config.SnapshotInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.checkpoint()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// RunPIIAudit closes a PII audit window every PIIAuditInterval until ctx is
+// done. The final window is closed by Stop.
+func (s *IngestionService) RunPIIAudit(ctx context.Context) {
+	if s.config.PIIAuditInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(s.config.PIIAuditInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.flushPIIAudit()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// flushPIIAudit closes the current PII audit window, logging its summary
+// and writing the report to PIIAuditDir if set.
+func (s *IngestionService) flushPIIAudit() {
+	report := s.audit.Flush()
+	s.auditMu.Lock()
+	s.lastAuditReport = &report
+	s.auditMu.Unlock()
+
+	s.logger.Info("PII audit report",
+		zap.Time("since", report.Since),
+		zap.Int64("logs", report.Logs),
+		zap.Int64("pii_logs", report.PIILogs),
+		zap.Float64("redaction_rate", report.RedactionRate),
+		zap.Any("redactions", report.Redactions),
+	)
+
+	if s.config.PIIAuditDir == "" {
+		return
+	}
+	path := filepath.Join(s.config.PIIAuditDir, "pii-audit-"+report.Until.UTC().Format("20060102T150405Z")+".json")
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err == nil {
+		err = os.WriteFile(path, data, 0o640)
+	}
+	if err != nil {
+		s.logger.Error("Failed to write PII audit report", zap.String("path", path), zap.Error(err))
+	}
+}
+
+// RunTemplateSync stores changed templates and aliases every
+// TemplateSyncInterval until ctx is done. The final sync is made by Stop.
+func (s *IngestionService) RunTemplateSync(ctx context.Context) {
+	if s.config.TemplateStore == nil || s.config.TemplateSyncInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(s.config.TemplateSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.syncTemplates(ctx); err != nil {
+				s.logger.Error("Failed to store templates", zap.Error(err))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// syncTemplates stores the templates whose log count changed since the
+// last sync and the aliases of templates retired since then. A retired
+// template is stored under its own ID too, so logs kept under that ID keep
+// the pattern their variables belong to.
+func (s *IngestionService) syncTemplates(ctx context.Context) error {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+
+	var templates []*clickhouse.TemplateRecord
+	sizes := make(map[string]int64)
+	aliases := make(map[string]string)
+	for _, source := range s.registry.Sources() {
+		tree, ok := s.registry.Lookup(source)
+		if !ok {
+			continue
+		}
+		for _, cluster := range tree.GetAllClusters() {
+			info := cluster.Info()
+			if s.syncedSizes[info.ID] == info.Size {
+				continue
+			}
+			sizes[info.ID] = info.Size
+			templates = append(templates, templateRecord(info))
+		}
+		for alias, id := range tree.IDMappings() {
+			if s.syncedAliases[alias] == id {
+				continue
+			}
+			aliases[alias] = id
+			if _, stored := s.syncedAliases[alias]; stored {
+				continue
+			}
+			if pattern, ok := tree.TemplateByID(alias); ok {
+				// Zero times, so a row stored while the ID was current wins
+				templates = append(templates, &clickhouse.TemplateRecord{
+					TemplateID: alias,
+					Pattern:    pattern,
+					FirstSeen:  time.Unix(0, 0),
+					LastSeen:   time.Unix(0, 0),
+				})
+			}
+		}
+	}
+
+	if err := s.config.TemplateStore.InsertTemplates(ctx, templates); err != nil {
+		return err
+	}
+	for id, size := range sizes {
+		s.syncedSizes[id] = size
+	}
+	if err := s.config.TemplateStore.InsertTemplateAliases(ctx, aliases); err != nil {
+		return err
+	}
+	for alias, id := range aliases {
+		s.syncedAliases[alias] = id
+		delete(s.syncedSizes, alias)
+	}
+	return nil
+}
+
+// templateRecord converts a template to its stored form.
+func templateRecord(info drain.ClusterInfo) *clickhouse.TemplateRecord {
+	slotTypes := make(map[string]string, len(info.Schema))
+	for key, slotType := range info.Schema {
+		slotTypes[key] = string(slotType)
+	}
+	return &clickhouse.TemplateRecord{
+		TemplateID: info.ID,
+		Pattern:    info.Template,
+		LogCount:   uint64(info.Size),
+		FirstSeen:  time.Unix(0, info.FirstSeen),
+		LastSeen:   time.Unix(0, info.LastSeen),
+		SlotTypes:  slotTypes,
+	}
+}
+
+// checkpoint writes a single Drain snapshot.
+func (s *IngestionService) checkpoint() {
+	if err := s.registry.SaveSnapshot(s.config.SnapshotPath); err != nil {
+		s.logger.Error("Failed to write Drain snapshot",
+			zap.String("path", s.config.SnapshotPath),
+			zap.Error(err),
+		)
+		return
+	}
+	s.logger.Debug("Wrote Drain snapshot", zap.String("path", s.config.SnapshotPath))
+}
+
+// Stop gracefully shuts down the service. It must be called before the
+// service's context is cancelled, so pending multi-line events still reach
+// the workers and are processed.
 func (s *IngestionService) Stop() {
-	s.workerPool.Stop()
+	s.aggregator.Flush()
+	s.workerPool.Drain()
+	if s.config.SnapshotPath != "" {
+		s.checkpoint()
+	}
+	if s.config.PIIAuditInterval > 0 {
+		s.flushPIIAudit()
+	}
+	if s.config.TemplateStore != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := s.syncTemplates(ctx); err != nil {
+			s.logger.Error("Failed to store templates", zap.Error(err))
+		}
+		cancel()
+	}
 	s.logger.Info("Ingestion service stopped")
 }
 
@@ -257,6 +700,21 @@ func main() {
 	httpPort := flag.String("http-port", "8091", "HTTP server port")
 	workerCount := flag.Int("workers", 100, "Number of worker goroutines")
 	bufferSize := flag.Int("buffer", 10000, "Worker pool buffer size")
+	snapshotPath := flag.String("snapshot-path", "", "File to checkpoint Drain state to (empty disables)")
+	snapshotInterval := flag.Duration("snapshot-interval", time.Minute, "Interval between Drain checkpoints")
+	sourceConfigPath := flag.String("drain-sources", "", "JSON file of per-source Drain config overrides")
+	multilineTimeout := flag.Duration("multiline-timeout", time.Second, "Flush a multi-line event after this long without new lines")
+	multilineMaxLines := flag.Int("multiline-max-lines", 500, "Maximum lines per multi-line event")
+	multilineMaxBytes := flag.Int("multiline-max-bytes", 64*1024, "Maximum bytes per multi-line event")
+	multilineSourcesPath := flag.String("multiline-sources", "", "JSON file of per-source multi-line patterns")
+	stackFrames := flag.Int("stack-frames", 3, "Top stack frames used to key stack trace templates")
+	piiAuditInterval := flag.Duration("pii-audit-interval", time.Hour, "Window of each PII audit report (0 disables reports)")
+	piiAuditDir := flag.String("pii-audit-dir", "", "Directory to write PII audit reports to as JSON (empty only logs them)")
+	clickhouseHost := flag.String("clickhouse-host", "", "ClickHouse host to store templates in (empty disables)")
+	clickhousePort := flag.Int("clickhouse-port", 9000, "ClickHouse native protocol port")
+	clickhouseDatabase := flag.String("clickhouse-database", "logzero", "ClickHouse database")
+	templateSyncInterval := flag.Duration("template-sync-interval", 30*time.Second, "Interval between storing changed templates in ClickHouse")
+	vaultPath := flag.String("pii-vault", "", "File of encrypted PII values behind tokens (requires "+pii.TokenKeyEnv+" and "+pii.VaultKeyEnv+")")
 	flag.Parse()
 
 	// Initialize logger
@@ -266,12 +724,88 @@ func main() {
 	}
 	defer logger.Sync()
 
+	var sourceConfigs map[string]drain.SourceConfig
+	if *sourceConfigPath != "" {
+		sourceConfigs, err = drain.LoadSourceConfigs(*sourceConfigPath)
+		if err != nil {
+			logger.Fatal("Failed to load per-source Drain config", zap.Error(err))
+		}
+	}
+
+	var multilineSources map[string]pipeline.MultilineConfig
+	if *multilineSourcesPath != "" {
+		data, err := os.ReadFile(*multilineSourcesPath)
+		if err == nil {
+			err = json.Unmarshal(data, &multilineSources)
+		}
+		if err != nil {
+			logger.Fatal("Failed to load per-source multi-line config", zap.Error(err))
+		}
+	}
+
+	// Tokenize PII instead of redacting it when a token key is set
+	tokenizer, err := pii.LoadTokenizer(*vaultPath)
+	if err != nil {
+		logger.Fatal("Failed to load PII tokenizer", zap.Error(err))
+	}
+	if tokenizer != nil {
+		defer tokenizer.Close()
+		tokenizer.OnVaultError(func(err error) {
+			logger.Warn("Failed to store PII token in vault", zap.Error(err))
+		})
+	}
+
+	// Store templates and aliases so stored logs can be exported with them
+	var templateStore TemplateStore
+	if *clickhouseHost != "" {
+		chConfig := clickhouse.DefaultConfig()
+		chConfig.Host = *clickhouseHost
+		chConfig.Port = *clickhousePort
+		chConfig.Database = *clickhouseDatabase
+		if user := os.Getenv("CLICKHOUSE_USER"); user != "" {
+			chConfig.Username = user
+		}
+		chConfig.Password = os.Getenv("CLICKHOUSE_PASSWORD")
+
+		client, err := clickhouse.NewClient(chConfig, logger)
+		if err != nil {
+			logger.Fatal("Failed to connect to ClickHouse", zap.Error(err))
+		}
+		defer client.Close()
+		if err := client.InitSchema(context.Background()); err != nil {
+			logger.Fatal("Failed to initialize ClickHouse schema", zap.Error(err))
+		}
+		templateStore = client
+	}
+
+	multiline := pipeline.DefaultMultilineConfig()
+	multiline.FlushTimeout = *multilineTimeout
+	multiline.MaxLines = *multilineMaxLines
+	multiline.MaxBytes = *multilineMaxBytes
+
 	// Create config
 	config := Config{
 		HTTPPort:    *httpPort,
 		WorkerCount: *workerCount,
 		BufferSize:  *bufferSize,
 		DrainConfig: drain.DefaultConfig(),
+
+		SourceConfigs: sourceConfigs,
+
+		Multiline:        multiline,
+		MultilineSources: multilineSources,
+		StackFrames:      *stackFrames,
+
+		SnapshotPath:     *snapshotPath,
+		SnapshotInterval: *snapshotInterval,
+
+		Tokenizer: tokenizer,
+
+		PIIAuditInterval: *piiAuditInterval,
+		PIIAuditDir:      *piiAuditDir,
+
+		TemplateStore:        templateStore,
+		TemplateSyncInterval: *templateSyncInterval,
 	}
 
 	// Create context for graceful shutdown
@@ -292,6 +826,10 @@ func main() {
 		}
 	}()
 
+	go service.RunCheckpoints(ctx)
+	go service.RunPIIAudit(ctx)
+	go service.RunTemplateSync(ctx)
+
 	logger.Info("Ingestion service started",
 		zap.String("http_port", config.HTTPPort),
 		zap.Int("workers", config.WorkerCount),
@@ -300,6 +838,6 @@ func main() {
 	// Wait for shutdown signal
 	<-sigterm
 	logger.Info("Shutting down...")
-	cancel()
 	service.Stop()
+	cancel()
 }
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/log-zero/log-zero/internal/compression/drain"
+	"github.com/log-zero/log-zero/internal/compression/pii"
+	"github.com/log-zero/log-zero/internal/pipeline"
+	"github.com/log-zero/log-zero/internal/storage/clickhouse"
+	"go.uber.org/zap"
+)
+
+// newTestService starts an ingestion service with config, stopped when the
+// test ends.
+func newTestService(t *testing.T, config Config) *IngestionService {
+	t.Helper()
+	if config.DrainConfig.MaxDepth == 0 {
+		config.DrainConfig = drain.DefaultConfig()
+	}
+	config.WorkerCount = 1
+	config.Multiline = pipeline.DefaultMultilineConfig()
+	config.StackFrames = 3
+
+	ctx, cancel := context.WithCancel(context.Background())
+	svc := NewIngestionService(ctx, config, zap.NewNop())
+	t.Cleanup(func() {
+		svc.Stop()
+		cancel()
+	})
+	return svc
+}
+
+func TestParseEvent_SignatureRoundTrip(t *testing.T) {
+	config := Config{DrainConfig: drain.DefaultConfig()}
+	config.DrainConfig.ExtraDelimiter = "."
+	svc := newTestService(t, config)
+
+	msg := &pipeline.Message{
+		Content: "ERROR  Request failed\njava.lang.IllegalStateException: boom\n\tat com.example.Service.handle(Service.java:42)\n\tat com.example.Server.run(Server.java:10)",
+		Source:  "api",
+	}
+	result, err := svc.parseEvent(msg, time.Now().UnixNano())
+	if err != nil {
+		t.Fatalf("parseEvent failed: %v", err)
+	}
+
+	got, err := svc.registry.Tree("api").ReconstructLog(result.TemplateID, result.Variables)
+	if err != nil {
+		t.Fatalf("ReconstructLog failed: %v", err)
+	}
+	if got != msg.Content {
+		t.Errorf("Expected %q, got %q", msg.Content, got)
+	}
+}
+
+func TestProcessLog_RedactsSecretsBeforeParsing(t *testing.T) {
+	svc := newTestService(t, Config{})
+
+	const token = "abc123.def456-ghi"
+	for _, user := range []string{"alice", "bob"} {
+		msg := &pipeline.Message{
+			ID:        user,
+			Content:   "GET /orders user=" + user + " Authorization: Bearer " + token,
+			Source:    "api",
+			Timestamp: time.Now(),
+		}
+		result, err := svc.processLog(context.Background(), msg)
+		if err != nil {
+			t.Fatalf("processLog failed: %v", err)
+		}
+
+		compressed := result.Data.(*CompressedLog)
+		if strings.Contains(compressed.Template, token) {
+			t.Errorf("Expected token redacted from template, got %q", compressed.Template)
+		}
+		for slot, value := range compressed.Variables {
+			if strings.Contains(value, token) {
+				t.Errorf("Expected token redacted from variable %s, got %q", slot, value)
+			}
+		}
+	}
+
+	report := svc.audit.Report()
+	if report.PIILogs != 2 || report.Redactions["auth_header"] != 2 {
+		t.Errorf("Expected 2 auth_header redactions in 2 logs, got %d in %d", report.Redactions["auth_header"], report.PIILogs)
+	}
+	if samples := report.Samples["auth_header"]; len(samples) == 0 || samples[0].Field != pii.LineField {
+		t.Errorf("Expected auth_header samples in field %q, got %+v", pii.LineField, samples)
+	}
+}
+
+func TestHandleIngest_GroupsPerRequest(t *testing.T) {
+	svc := newTestService(t, Config{})
+
+	post := func(handler http.HandlerFunc, body string, form url.Values) int {
+		var req *http.Request
+		if form != nil {
+			req = httptest.NewRequest(http.MethodPost, "/ingest", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			req = httptest.NewRequest(http.MethodPost, "/ingest/batch", strings.NewReader(body))
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w.Code
+	}
+
+	// Lines of different requests without a stream are never joined
+	if code := post(svc.handleIngest, "", url.Values{"log": {"ERROR a failed"}}); code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d", code)
+	}
+	if code := post(svc.handleIngest, "", url.Values{"log": {"\tat com.example.B.run(B.java:1)"}}); code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d", code)
+	}
+	// A batch is grouped like one multi-line message
+	batch := `{"source": "api", "logs": ["ERROR c failed", "java.io.IOException: closed", "\tat com.example.C.run(C.java:1)", "INFO ok"]}`
+	if code := post(svc.handleBatchIngest, batch, nil); code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d", code)
+	}
+
+	var lines []int
+	for i := 0; i < 4; i++ {
+		select {
+		case result := <-svc.workerPool.Results():
+			n := 1
+			if body, ok := result.Data.(*CompressedLog).Variables[drain.BodyKey]; ok {
+				n += strings.Count(body, "\n") + 1
+			}
+			lines = append(lines, n)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected 4 events, got %d", i)
+		}
+	}
+	sort.Ints(lines)
+	if fmt.Sprint(lines) != "[1 1 1 3]" {
+		t.Errorf("Expected events of 1, 1, 1 and 3 lines, got %v", lines)
+	}
+
+	// Once the pool is stopped, single-line events are rejected
+	svc.workerPool.Stop()
+	if code := post(svc.handleIngest, "", url.Values{"log": {"INFO late"}}); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 after the pool stopped, got %d", code)
+	}
+}
+
+// memoryTemplateStore records what it is asked to store.
+type memoryTemplateStore struct {
+	templates map[string]*clickhouse.TemplateRecord
+	aliases   map[string]string
+}
+
+func (m *memoryTemplateStore) InsertTemplates(ctx context.Context, templates []*clickhouse.TemplateRecord) error {
+	for _, t := range templates {
+		m.templates[t.TemplateID] = t
+	}
+	return nil
+}
+
+func (m *memoryTemplateStore) InsertTemplateAliases(ctx context.Context, aliases map[string]string) error {
+	for alias, id := range aliases {
+		m.aliases[alias] = id
+	}
+	return nil
+}
+
+func TestSyncTemplates_StoresRetiredTemplates(t *testing.T) {
+	store := &memoryTemplateStore{
+		templates: make(map[string]*clickhouse.TemplateRecord),
+		aliases:   make(map[string]string),
+	}
+	svc := newTestService(t, Config{TemplateStore: store})
+	timestamp := time.Now().UnixNano()
+
+	first, _ := svc.registry.Parse("api", "session opened for alice", timestamp)
+	if err := svc.syncTemplates(context.Background()); err != nil {
+		t.Fatalf("syncTemplates failed: %v", err)
+	}
+	second, _ := svc.registry.Parse("api", "session opened for bob", timestamp)
+	if err := svc.syncTemplates(context.Background()); err != nil {
+		t.Fatalf("syncTemplates failed: %v", err)
+	}
+
+	if got := store.aliases[first.TemplateID]; got != second.TemplateID {
+		t.Errorf("Expected alias %s -> %s, got %q", first.TemplateID, second.TemplateID, got)
+	}
+	if record := store.templates[second.TemplateID]; record == nil || record.Pattern != "session opened for <*>" || record.LogCount != 2 {
+		t.Errorf("Unexpected current template record %+v", record)
+	}
+	if record := store.templates[first.TemplateID]; record == nil || record.Pattern != "session opened for alice" {
+		t.Errorf("Expected the retired template to keep its pattern, got %+v", record)
+	}
+}
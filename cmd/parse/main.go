@@ -0,0 +1,511 @@
+// Package main runs the Drain and PII redaction pipeline over log files
+// offline, without the ingestion service.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/klauspost/compress/zstd"
+	"github.com/log-zero/log-zero/internal/compression/codec"
+	"github.com/log-zero/log-zero/internal/compression/drain"
+	"github.com/log-zero/log-zero/internal/compression/pii"
+	"github.com/log-zero/log-zero/internal/pipeline"
+)
+
+// maxLineSize bounds a single input line.
+const maxLineSize = 4 * 1024 * 1024
+
+// recordColumns are the columns of the compressed records output.
+var recordColumns = []column{
+	{name: "log_id", kind: stringColumn},
+	{name: "source", kind: stringColumn},
+	{name: "timestamp", kind: timeColumn, optional: true}, // Null when the event has none
+	{name: "template_id", kind: stringColumn},
+	{name: "variables", kind: jsonColumn},
+	{name: "attributes", kind: jsonColumn},
+	{name: "original_size", kind: int64Column},
+	{name: "compressed_size", kind: int64Column},
+}
+
+// templateColumns are the columns of the templates output. Retired
+// template IDs are listed too, with the ID they now resolve to.
+var templateColumns = []column{
+	{name: "template_id", kind: stringColumn},
+	{name: "source", kind: stringColumn},
+	{name: "template", kind: stringColumn},
+	{name: "log_count", kind: int64Column},
+	{name: "first_seen", kind: timeColumn},
+	{name: "last_seen", kind: timeColumn},
+	{name: "slots", kind: jsonColumn},
+	{name: "alias_of", kind: stringColumn},
+}
+
+// Options configures a parse run.
+type Options struct {
+	Format      string
+	OutputDir   string
+	Source      string // Source name for all inputs; empty uses each file's base name
+	Redact      bool
+	Multiline   bool
+	StackFrames int
+	Progress    time.Duration // Interval between progress reports; 0 disables them
+}
+
+// Summary describes a completed run.
+type Summary struct {
+	Events          int64
+	Skipped         int64
+	Templates       int
+	OriginalBytes   int64
+	CompressedBytes int64 // zstd-compressed codec blocks plus the template dictionary
+	Elapsed         time.Duration
+}
+
+// Ratio is the compressed size as a fraction of the original size.
+func (s Summary) Ratio() float64 {
+	if s.OriginalBytes == 0 {
+		return 0
+	}
+	return float64(s.CompressedBytes) / float64(s.OriginalBytes)
+}
+
+// parser holds the state of a run.
+type parser struct {
+	options  Options
+	registry *drain.Registry
+	redactor *pii.Redactor
+	records  tableWriter
+	stderr   io.Writer
+	encoders map[string]*codec.Writer // Codec block of each source, for compressed sizes
+
+	summary    Summary
+	err        error
+	lastReport time.Time
+	start      time.Time
+}
+
+// openInput opens a file, or stdin for "-", and transparently decompresses
+// gzip and zstd content detected by its magic bytes.
+func openInput(path string) (io.ReadCloser, error) {
+	var file io.ReadCloser = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		file = f
+	}
+
+	buffered := bufio.NewReaderSize(file, 1<<20)
+	magic, _ := buffered.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		reader, err := gzip.NewReader(buffered)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("invalid gzip input: %w", err)
+		}
+		return readCloser{Reader: reader, closers: []io.Closer{reader, file}}, nil
+	case bytes.Equal(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		decoder, err := zstd.NewReader(buffered)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("invalid zstd input: %w", err)
+		}
+		rc := decoder.IOReadCloser()
+		return readCloser{Reader: rc, closers: []io.Closer{rc, file}}, nil
+	default:
+		return readCloser{Reader: buffered, closers: []io.Closer{file}}, nil
+	}
+}
+
+// readCloser closes a decompressor and the file beneath it.
+type readCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r readCloser) Close() error {
+	var first error
+	for _, c := range r.closers {
+		if err := c.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// sourceName returns the source for an input path.
+func (p *parser) sourceName(path string) string {
+	if p.options.Source != "" {
+		return p.options.Source
+	}
+	if path == "-" {
+		return drain.DefaultSource
+	}
+	name := filepath.Base(path)
+	for _, ext := range []string{".gz", ".zst", ".log", ".txt"} {
+		name = strings.TrimSuffix(name, ext)
+	}
+	return name
+}
+
+// parseInput reads every line of one input.
+func (p *parser) parseInput(path string) error {
+	input, err := openInput(path)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	source := p.sourceName(path)
+	handle := func(msg *pipeline.Message) bool {
+		if p.err == nil {
+			p.err = p.process(msg)
+		}
+		return p.err == nil
+	}
+
+	var aggregator *pipeline.MultilineAggregator
+	if p.options.Multiline {
+		aggregator = pipeline.NewMultilineAggregator(pipeline.DefaultMultilineConfig(), nil, handle)
+	}
+
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	for n := 1; scanner.Scan(); n++ {
+		// The timestamp is taken from the event itself, if it has one
+		msg := &pipeline.Message{
+			ID:      fmt.Sprintf("%s:%d", path, n),
+			Content: scanner.Text(),
+			Source:  source,
+		}
+		if aggregator != nil {
+			aggregator.Add(msg)
+		} else {
+			handle(msg)
+		}
+		if p.err != nil {
+			return p.err
+		}
+		p.reportProgress(false)
+	}
+	if aggregator != nil {
+		aggregator.Flush()
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+	return p.err
+}
+
+// process parses, redacts and writes one event.
+func (p *parser) process(msg *pipeline.Message) error {
+	originalSize := int64(len(msg.Content))
+	if strings.TrimSpace(msg.Content) == "" {
+		p.summary.Skipped++
+		return nil
+	}
+
+	attributes, _ := pipeline.Structure(msg)
+	if p.options.Redact {
+		// Secrets are only recognizable next to their context, such as
+		// "Bearer", so they are redacted before parsing
+		msg.Content, _ = p.redactor.RedactSecrets(msg.Content)
+	}
+	// Templates are timestamped with the processing time when the event
+	// has no timestamp of its own
+	seen := msg.Timestamp
+	if seen.IsZero() {
+		seen = time.Now()
+	}
+	result, err := p.parseEvent(msg, seen.UnixNano())
+	if err != nil {
+		p.summary.Skipped++
+		return nil
+	}
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp, _ = pipeline.FieldTimestamp(result.Fields)
+	}
+	var recordTime interface{} // Null in the output when unknown
+	if !msg.Timestamp.IsZero() {
+		recordTime = msg.Timestamp
+	}
+
+	variables := result.Variables
+	if p.options.Redact {
+		variables = p.redactor.RedactVariables(variables)
+		for key, value := range attributes {
+			if s, ok := value.(string); ok && key != pipeline.LayoutKey {
+				attributes[key] = p.redactor.Redact(s)
+			}
+		}
+	}
+	if attributes == nil {
+		attributes = map[string]interface{}{}
+	}
+
+	compressedSize := int64(p.encode(msg.Source, &codec.Record{
+		TemplateID: result.TemplateID,
+		Timestamp:  timestampNanos(msg.Timestamp),
+		Variables:  variables,
+	}))
+
+	p.summary.Events++
+	p.summary.OriginalBytes += originalSize
+
+	return p.records.WriteRow([]interface{}{
+		uuid.New().String(),
+		msg.Source,
+		recordTime,
+		result.TemplateID,
+		variables,
+		attributes,
+		originalSize,
+		compressedSize,
+	})
+}
+
+// timestampNanos returns ts as Unix nanoseconds, or 0 if it is unknown.
+func timestampNanos(ts time.Time) int64 {
+	if ts.IsZero() {
+		return 0
+	}
+	return ts.UnixNano()
+}
+
+// encodeBlockRecords is the number of records per codec block.
+const encodeBlockRecords = 4096
+
+// encode adds record to its source's codec block and returns the bytes it
+// took before block compression. Full blocks count towards the compressed
+// size once compressed.
+func (p *parser) encode(source string, record *codec.Record) int {
+	w, ok := p.encoders[source]
+	if !ok {
+		w = codec.NewWriter(codec.DefaultOptions())
+		p.encoders[source] = w
+	}
+	n := w.Write(record)
+	if w.Len() >= encodeBlockRecords {
+		p.summary.CompressedBytes += int64(len(w.Flush()))
+	}
+	return n
+}
+
+// flushEncoders counts the partial codec blocks left at the end of a run.
+func (p *parser) flushEncoders() {
+	for _, w := range p.encoders {
+		p.summary.CompressedBytes += int64(len(w.Flush()))
+	}
+}
+
+// parseEvent parses an event with the Drain tree for its source, keying
+// multi-line events by their first line and stack trace signature as the
+// ingestion service does.
+func (p *parser) parseEvent(msg *pipeline.Message, timestamp int64) (*drain.ParseResult, error) {
+	head, body, multiline := strings.Cut(msg.Content, "\n")
+	if !multiline {
+		return p.registry.Parse(msg.Source, msg.Content, timestamp)
+	}
+
+	tree := p.registry.Tree(msg.Source)
+	line := head
+	signature, ok := pipeline.StackSignature(msg.Content, p.options.StackFrames)
+	if ok {
+		line = head + " " + strings.Join(signature, " ")
+	}
+
+	result, err := tree.Parse(line, timestamp)
+	if err != nil {
+		return nil, err
+	}
+	result.Variables[drain.BodyKey] = body
+	if ok {
+		result.Variables[drain.SignatureKey] = strconv.Itoa(tree.TokenCount(strings.Join(signature, " ")))
+	}
+	return result, nil
+}
+
+// reportProgress writes a progress line to stderr if the report interval
+// has passed, or unconditionally if final is set.
+func (p *parser) reportProgress(final bool) {
+	if p.options.Progress <= 0 && !final {
+		return
+	}
+	now := time.Now()
+	if !final && now.Sub(p.lastReport) < p.options.Progress {
+		return
+	}
+	p.lastReport = now
+
+	elapsed := now.Sub(p.start).Seconds()
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(p.summary.Events) / elapsed
+	}
+	fmt.Fprintf(p.stderr, "parsed %d events (%.0f/s), %d templates, %.1f MB read\n",
+		p.summary.Events, rate, p.registry.ClusterCount(), float64(p.summary.OriginalBytes)/(1<<20))
+}
+
+// writeTemplates writes the final templates of every source, followed by
+// the retired IDs records may still refer to. The template dictionary counts
+// towards the compressed size.
+func (p *parser) writeTemplates(path string) error {
+	templates, err := createTable(p.options.Format, path, templateColumns)
+	if err != nil {
+		return err
+	}
+
+	for _, source := range p.registry.Sources() {
+		tree := p.registry.Tree(source)
+		for _, cluster := range tree.GetAllClusters() {
+			info := cluster.Info()
+			p.summary.CompressedBytes += int64(len(info.ID) + len(info.Template))
+			if err := templates.WriteRow([]interface{}{
+				info.ID,
+				source,
+				info.Template,
+				info.Size,
+				time.Unix(0, info.FirstSeen),
+				time.Unix(0, info.LastSeen),
+				info.Slots,
+				"",
+			}); err != nil {
+				templates.Close()
+				return err
+			}
+		}
+		for alias, id := range tree.IDMappings() {
+			template, _ := tree.TemplateByID(alias)
+			if err := templates.WriteRow([]interface{}{
+				alias, source, template, int64(0), time.Unix(0, 0), time.Unix(0, 0), []string{}, id,
+			}); err != nil {
+				templates.Close()
+				return err
+			}
+		}
+	}
+	return templates.Close()
+}
+
+// Run parses inputs and writes records and templates to the output
+// directory.
+func Run(inputs []string, options Options, config drain.Config, sourceConfigs map[string]drain.SourceConfig, stderr io.Writer) (Summary, error) {
+	redactor := pii.NewRedactor(pii.DefaultRedactorConfig())
+	if options.Redact {
+		config.RedactSample = redactor.RedactSample
+	}
+
+	if err := os.MkdirAll(options.OutputDir, 0o755); err != nil {
+		return Summary{}, err
+	}
+	records, err := createTable(options.Format, filepath.Join(options.OutputDir, "records."+options.Format), recordColumns)
+	if err != nil {
+		return Summary{}, err
+	}
+
+	p := &parser{
+		options:  options,
+		registry: drain.NewRegistry(config, sourceConfigs),
+		redactor: redactor,
+		records:  records,
+		stderr:   stderr,
+		encoders: make(map[string]*codec.Writer),
+		start:    time.Now(),
+	}
+	p.lastReport = p.start
+
+	for _, input := range inputs {
+		if err := p.parseInput(input); err != nil {
+			records.Close()
+			return p.summary, err
+		}
+	}
+	if err := records.Close(); err != nil {
+		return p.summary, err
+	}
+	p.flushEncoders()
+	if err := p.writeTemplates(filepath.Join(options.OutputDir, "templates."+options.Format)); err != nil {
+		return p.summary, err
+	}
+
+	p.summary.Templates = p.registry.ClusterCount()
+	p.summary.Elapsed = time.Since(p.start)
+	if options.Progress > 0 {
+		p.reportProgress(true)
+	}
+	return p.summary, nil
+}
+
+func main() {
+	format := flag.String("format", formatJSONL, "Output format: jsonl, csv or parquet")
+	outputDir := flag.String("out", ".", "Directory to write records and templates to")
+	source := flag.String("source", "", "Source name for all inputs (default: each file's base name)")
+	redact := flag.Bool("redact", true, "Redact PII from variables and attributes")
+	multiline := flag.Bool("multiline", true, "Group stack traces and continuation lines into one event")
+	stackFrames := flag.Int("stack-frames", 3, "Top stack frames used to key stack trace templates")
+	progress := flag.Duration("progress", 5*time.Second, "Interval between progress reports (0 disables)")
+	sourceConfigPath := flag.String("drain-sources", "", "JSON file of per-source Drain config overrides")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [file ...]\n\nReads plain, gzip or zstd log files, or stdin if none (or -) are given.\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	switch *format {
+	case formatJSONL, formatCSV, formatParquet:
+	default:
+		fmt.Fprintf(os.Stderr, "unknown format %q\n", *format)
+		os.Exit(2)
+	}
+
+	var sourceConfigs map[string]drain.SourceConfig
+	if *sourceConfigPath != "" {
+		var err error
+		sourceConfigs, err = drain.LoadSourceConfigs(*sourceConfigPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to load per-source Drain config: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	inputs := flag.Args()
+	if len(inputs) == 0 {
+		inputs = []string{"-"}
+	}
+
+	options := Options{
+		Format:      *format,
+		OutputDir:   *outputDir,
+		Source:      *source,
+		Redact:      *redact,
+		Multiline:   *multiline,
+		StackFrames: *stackFrames,
+		Progress:    *progress,
+	}
+	summary, err := Run(inputs, options, drain.DefaultConfig(), sourceConfigs, os.Stderr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "parse failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("events:           %d\n", summary.Events)
+	fmt.Printf("skipped:          %d\n", summary.Skipped)
+	fmt.Printf("templates:        %d\n", summary.Templates)
+	fmt.Printf("original bytes:   %d\n", summary.OriginalBytes)
+	fmt.Printf("compressed bytes: %d\n", summary.CompressedBytes)
+	fmt.Printf("ratio:            %.3f (%.1fx)\n", summary.Ratio(), 1/max(summary.Ratio(), 1e-9))
+	fmt.Printf("elapsed:          %s\n", summary.Elapsed.Round(time.Millisecond))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/log-zero/log-zero/internal/compression/drain"
+)
+
+// readJSONL reads the rows of a JSONL output file.
+func readJSONL(t *testing.T, path string) []map[string]interface{} {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var rows []map[string]interface{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var row map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func TestRun_Records(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "app.log")
+	lines := []string{
+		"2024-01-15 10:30:00 INFO user alice logged in",
+		"2024-01-15 10:30:05 INFO user bob logged in",
+		"",
+		`{"time":"2024-01-15T10:31:00Z","msg":"cache warmed","entries":12}`,
+		"worker started",
+	}
+	if err := os.WriteFile(input, []byte(strings.Join(lines, "\n")), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	sources := map[string]drain.SourceConfig{
+		"app": {HeaderPattern: `(?P<time>\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}) `},
+	}
+	options := Options{Format: formatJSONL, OutputDir: filepath.Join(dir, "out"), Redact: true, StackFrames: 3}
+	summary, err := Run([]string{input}, options, drain.DefaultConfig(), sources, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Events != 4 || summary.Skipped != 1 {
+		t.Errorf("Expected 4 events and 1 skipped, got %d and %d", summary.Events, summary.Skipped)
+	}
+
+	records := readJSONL(t, filepath.Join(options.OutputDir, "records.jsonl"))
+	if len(records) != 4 {
+		t.Fatalf("Expected 4 records, got %d", len(records))
+	}
+	wantTimes := []interface{}{"2024-01-15T10:30:00Z", "2024-01-15T10:30:05Z", "2024-01-15T10:31:00Z", nil}
+	for i, want := range wantTimes {
+		if records[i]["timestamp"] != want {
+			t.Errorf("Record %d: expected timestamp %v, got %v", i, want, records[i]["timestamp"])
+		}
+		if records[i]["source"] != "app" {
+			t.Errorf("Record %d: expected source app, got %v", i, records[i]["source"])
+		}
+	}
+	if attributes := records[2]["attributes"].(map[string]interface{}); attributes["entries"] != 12.0 {
+		t.Errorf("Expected structured attributes, got %v", attributes)
+	}
+
+	// The first login's template was generalized by the second, so its ID
+	// is listed as an alias of the current one
+	templates := readJSONL(t, filepath.Join(options.OutputDir, "templates.jsonl"))
+	aliases := make(map[interface{}]interface{})
+	current := 0
+	for _, row := range templates {
+		if row["alias_of"] == "" {
+			current++
+		} else {
+			aliases[row["template_id"]] = row["alias_of"]
+		}
+	}
+	if current != 3 || summary.Templates != 3 {
+		t.Errorf("Expected 3 templates, got %d rows and %d in the summary", current, summary.Templates)
+	}
+	if aliases[records[0]["template_id"]] != records[1]["template_id"] {
+		t.Errorf("Expected the first login's template to resolve to the second's, got aliases %v", aliases)
+	}
+}
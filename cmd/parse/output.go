@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Output formats.
+const (
+	formatJSONL   = "jsonl"
+	formatCSV     = "csv"
+	formatParquet = "parquet"
+)
+
+// columnKind is how a column's values are typed in the output.
+type columnKind int
+
+const (
+	stringColumn columnKind = iota
+	int64Column
+	timeColumn // time.Time, written as Unix milliseconds in Parquet
+	jsonColumn // Any value, written as a JSON document in CSV and Parquet
+)
+
+// column is a named, typed output column. Optional columns may hold nil
+// values, written as null or an empty CSV field.
+type column struct {
+	name     string
+	kind     columnKind
+	optional bool
+}
+
+// tableWriter writes rows of values matching a fixed set of columns.
+type tableWriter interface {
+	WriteRow(values []interface{}) error
+	Close() error
+}
+
+// createTable creates path and returns a writer for format.
+func createTable(format, path string, columns []column) (tableWriter, error) {
+	switch format {
+	case formatJSONL:
+		file, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		buf := bufio.NewWriter(file)
+		return &jsonlWriter{file: file, buf: buf, encoder: json.NewEncoder(buf), columns: columns}, nil
+	case formatCSV:
+		file, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		w := &csvWriter{file: file, writer: csv.NewWriter(file), columns: columns}
+		header := make([]string, len(columns))
+		for i, col := range columns {
+			header[i] = col.name
+		}
+		if err := w.writer.Write(header); err != nil {
+			file.Close()
+			return nil, err
+		}
+		return w, nil
+	case formatParquet:
+		return newParquetWriter(path, columns)
+	default:
+		return nil, fmt.Errorf("unknown output format %q", format)
+	}
+}
+
+// jsonlWriter writes one JSON object per row.
+type jsonlWriter struct {
+	file    *os.File
+	buf     *bufio.Writer
+	encoder *json.Encoder
+	columns []column
+}
+
+// WriteRow implements tableWriter.
+func (w *jsonlWriter) WriteRow(values []interface{}) error {
+	row := make(map[string]interface{}, len(w.columns))
+	for i, col := range w.columns {
+		if ts, ok := values[i].(time.Time); ok && col.kind == timeColumn {
+			row[col.name] = ts.Format(time.RFC3339Nano)
+		} else {
+			row[col.name] = values[i]
+		}
+	}
+	return w.encoder.Encode(row)
+}
+
+// Close implements tableWriter.
+func (w *jsonlWriter) Close() error {
+	if err := w.buf.Flush(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// csvWriter writes a header row followed by one record per row. JSON
+// columns are embedded as JSON text.
+type csvWriter struct {
+	file    *os.File
+	writer  *csv.Writer
+	columns []column
+}
+
+// WriteRow implements tableWriter.
+func (w *csvWriter) WriteRow(values []interface{}) error {
+	record := make([]string, len(w.columns))
+	for i, col := range w.columns {
+		record[i] = stringValue(col, values[i])
+	}
+	return w.writer.Write(record)
+}
+
+// Close implements tableWriter.
+func (w *csvWriter) Close() error {
+	w.writer.Flush()
+	if err := w.writer.Error(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// stringValue formats a value of col as text.
+func stringValue(col column, value interface{}) string {
+	switch col.kind {
+	case int64Column:
+		return strconv.FormatInt(int64Value(value), 10)
+	case timeColumn:
+		if ts, ok := value.(time.Time); ok {
+			return ts.Format(time.RFC3339Nano)
+		}
+		return ""
+	case jsonColumn:
+		data, err := json.Marshal(value)
+		if err != nil {
+			return "null"
+		}
+		return string(data)
+	default:
+		s, _ := value.(string)
+		return s
+	}
+}
+
+// int64Value returns value as an integer; times are Unix
+// milliseconds.
+func int64Value(value interface{}) int64 {
+	switch v := value.(type) {
+	case int64:
+		return v
+	case int:
+		return int64(v)
+	case time.Time:
+		return v.UnixMilli()
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "Rewrite golden files")
+
+// testColumns cover every column kind, with an optional time column.
+var testColumns = []column{
+	{name: "id", kind: stringColumn},
+	{name: "size", kind: int64Column},
+	{name: "seen", kind: timeColumn, optional: true},
+	{name: "fields", kind: jsonColumn},
+}
+
+// testRows exercise quoting, null times and nested JSON values.
+var testRows = [][]interface{}{
+	{"a", int64(42), time.Date(2024, 1, 15, 10, 30, 0, 250e6, time.UTC), map[string]string{"user": "alice"}},
+	{"b, \"quoted\"\nline", 7, nil, []string{}},
+	{"", int64(-1), time.Unix(0, 0).UTC(), map[string]interface{}{"n": 1.5, "ok": true}},
+}
+
+// writeTable writes testRows in format and returns the file's contents.
+func writeTable(t *testing.T, format string) []byte {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "table."+format)
+	table, err := createTable(format, path, testColumns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range testRows {
+		if err := table.WriteRow(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := table.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestTableWriter_Golden(t *testing.T) {
+	for _, format := range []string{formatJSONL, formatCSV} {
+		t.Run(format, func(t *testing.T) {
+			got := writeTable(t, format)
+			golden := filepath.Join("testdata", "table."+format)
+			if *update {
+				if err := os.WriteFile(golden, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(want) {
+				t.Errorf("Output differs from %s:\n%s\nwant:\n%s", golden, got, want)
+			}
+		})
+	}
+}
+
+func TestCreateTable_UnknownFormat(t *testing.T) {
+	if _, err := createTable("xml", filepath.Join(t.TempDir(), "table.xml"), testColumns); err == nil {
+		t.Error("Expected unknown format to be rejected")
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Parquet constants, from the parquet-format Thrift definitions.
+const (
+	parquetMagic = "PAR1"
+
+	parquetInt64     = 2
+	parquetByteArray = 6
+
+	parquetRequired = 0
+	parquetOptional = 1
+
+	parquetUTF8            = 0
+	parquetTimestampMillis = 9
+	parquetInt64Converted  = 18
+	parquetJSON            = 19
+
+	parquetPlain = 0
+	parquetRLE   = 3
+
+	parquetDataPage = 0
+	parquetZSTD     = 6
+)
+
+// parquetRowGroupSize is the number of rows buffered per row group.
+const parquetRowGroupSize = 100000
+
+// parquetWriter writes a flat table of columns as a Parquet file, with one
+// PLAIN-encoded, zstd-compressed data page per column chunk. Optional
+// columns carry RLE-encoded definition levels marking their nulls.
+type parquetWriter struct {
+	file    *os.File
+	buf     *bufio.Writer
+	out     *countingWriter
+	columns []column
+	encoder *zstd.Encoder
+
+	values    [][]byte // PLAIN-encoded values of the current row group, by column
+	levels    [][]byte // Definition levels of optional columns: 1 for a value, 0 for null
+	rows      int64
+	totalRows int64
+	rowGroups []parquetRowGroup
+}
+
+// parquetRowGroup records where a written row group's column chunks are.
+type parquetRowGroup struct {
+	rows   int64
+	chunks []parquetChunk
+}
+
+// parquetChunk is the metadata of one written column chunk.
+type parquetChunk struct {
+	offset           int64
+	uncompressedSize int64
+	compressedSize   int64
+}
+
+// countingWriter tracks the number of bytes written, for chunk offsets.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// newParquetWriter creates path and writes the Parquet header.
+func newParquetWriter(path string, columns []column) (*parquetWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	buf := bufio.NewWriterSize(file, 1<<20)
+	w := &parquetWriter{
+		file:    file,
+		buf:     buf,
+		out:     &countingWriter{w: buf},
+		columns: columns,
+		encoder: encoder,
+		values:  make([][]byte, len(columns)),
+		levels:  make([][]byte, len(columns)),
+	}
+	if _, err := io.WriteString(w.out, parquetMagic); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// WriteRow implements tableWriter.
+func (w *parquetWriter) WriteRow(values []interface{}) error {
+	if len(values) != len(w.columns) {
+		return fmt.Errorf("row has %d values for %d columns", len(values), len(w.columns))
+	}
+	for i, col := range w.columns {
+		if col.optional {
+			if values[i] == nil {
+				w.levels[i] = append(w.levels[i], 0)
+				continue
+			}
+			w.levels[i] = append(w.levels[i], 1)
+		}
+		switch col.kind {
+		case int64Column, timeColumn:
+			w.values[i] = binary.LittleEndian.AppendUint64(w.values[i], uint64(int64Value(values[i])))
+		default:
+			s := stringValue(col, values[i])
+			w.values[i] = binary.LittleEndian.AppendUint32(w.values[i], uint32(len(s)))
+			w.values[i] = append(w.values[i], s...)
+		}
+	}
+
+	w.rows++
+	if w.rows >= parquetRowGroupSize {
+		return w.flushRowGroup()
+	}
+	return nil
+}
+
+// flushRowGroup writes the buffered rows as a row group.
+func (w *parquetWriter) flushRowGroup() error {
+	if w.rows == 0 {
+		return nil
+	}
+
+	group := parquetRowGroup{rows: w.rows}
+	for i, col := range w.columns {
+		page := w.values[i]
+		if col.optional {
+			page = append(encodeLevels(w.levels[i]), page...)
+			w.levels[i] = w.levels[i][:0]
+		}
+		compressed := w.encoder.EncodeAll(page, nil)
+
+		var header thriftWriter
+		header.fieldI32(1, parquetDataPage)
+		header.fieldI32(2, int32(len(page)))
+		header.fieldI32(3, int32(len(compressed)))
+		header.fieldStruct(5)
+		header.fieldI32(1, int32(w.rows))
+		header.fieldI32(2, parquetPlain)
+		header.fieldI32(3, parquetRLE)
+		header.fieldI32(4, parquetRLE)
+		header.endStruct()
+		header.endStruct()
+
+		chunk := parquetChunk{
+			offset:           w.out.n,
+			uncompressedSize: int64(header.buf.Len() + len(page)),
+			compressedSize:   int64(header.buf.Len() + len(compressed)),
+		}
+		if _, err := w.out.Write(header.buf.Bytes()); err != nil {
+			return err
+		}
+		if _, err := w.out.Write(compressed); err != nil {
+			return err
+		}
+		group.chunks = append(group.chunks, chunk)
+		w.values[i] = w.values[i][:0]
+	}
+
+	w.rowGroups = append(w.rowGroups, group)
+	w.totalRows += w.rows
+	w.rows = 0
+	return nil
+}
+
+// Close implements tableWriter. It writes the remaining rows and the file
+// footer.
+func (w *parquetWriter) Close() error {
+	defer w.encoder.Close()
+
+	if err := w.writeFooter(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// writeFooter flushes the remaining rows and writes the file metadata.
+func (w *parquetWriter) writeFooter() error {
+	if err := w.flushRowGroup(); err != nil {
+		return err
+	}
+
+	footer := w.fileMetadata()
+	if _, err := w.out.Write(footer); err != nil {
+		return err
+	}
+	if err := binary.Write(w.out, binary.LittleEndian, uint32(len(footer))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w.out, parquetMagic); err != nil {
+		return err
+	}
+	return w.buf.Flush()
+}
+
+// fileMetadata encodes the FileMetaData footer.
+func (w *parquetWriter) fileMetadata() []byte {
+	var t thriftWriter
+	t.fieldI32(1, 1)
+
+	t.fieldList(2, thriftStruct, len(w.columns)+1)
+	t.beginStruct()
+	t.fieldBinary(4, "schema")
+	t.fieldI32(5, int32(len(w.columns)))
+	t.endStruct()
+	for _, col := range w.columns {
+		t.beginStruct()
+		t.fieldI32(1, col.parquetType())
+		t.fieldI32(3, col.repetition())
+		t.fieldBinary(4, col.name)
+		t.fieldI32(6, col.convertedType())
+		t.endStruct()
+	}
+
+	t.fieldI64(3, w.totalRows)
+
+	t.fieldList(4, thriftStruct, len(w.rowGroups))
+	for _, group := range w.rowGroups {
+		t.beginStruct()
+		t.fieldList(1, thriftStruct, len(group.chunks))
+		var total int64
+		for i, chunk := range group.chunks {
+			col := w.columns[i]
+			t.beginStruct()
+			t.fieldI64(2, chunk.offset)
+			t.fieldStruct(3)
+			t.fieldI32(1, col.parquetType())
+			t.fieldList(2, thriftI32, 2)
+			t.writeVarint(zigzag(parquetPlain))
+			t.writeVarint(zigzag(parquetRLE))
+			t.fieldList(3, thriftBinary, 1)
+			t.writeBinary(col.name)
+			t.fieldI32(4, parquetZSTD)
+			t.fieldI64(5, group.rows)
+			t.fieldI64(6, chunk.uncompressedSize)
+			t.fieldI64(7, chunk.compressedSize)
+			t.fieldI64(9, chunk.offset)
+			t.endStruct()
+			t.endStruct()
+			total += chunk.uncompressedSize
+		}
+		t.fieldI64(2, total)
+		t.fieldI64(3, group.rows)
+		t.endStruct()
+	}
+
+	t.fieldBinary(6, "log-zero parse")
+	t.endStruct()
+	return t.buf.Bytes()
+}
+
+// encodeLevels encodes definition levels of bit width 1 as RLE runs,
+// prefixed by their length as data page v1 requires.
+func encodeLevels(levels []byte) []byte {
+	var runs []byte
+	for i := 0; i < len(levels); {
+		j := i
+		for j < len(levels) && levels[j] == levels[i] {
+			j++
+		}
+		runs = binary.AppendUvarint(runs, uint64(j-i)<<1)
+		runs = append(runs, levels[i])
+		i = j
+	}
+	return append(binary.LittleEndian.AppendUint32(nil, uint32(len(runs))), runs...)
+}
+
+// repetition returns the Parquet repetition type of a column.
+func (c column) repetition() int32 {
+	if c.optional {
+		return parquetOptional
+	}
+	return parquetRequired
+}
+
+// parquetType returns the physical Parquet type of a column.
+func (c column) parquetType() int32 {
+	if c.kind == int64Column || c.kind == timeColumn {
+		return parquetInt64
+	}
+	return parquetByteArray
+}
+
+// convertedType returns the Parquet converted (logical) type of a column.
+func (c column) convertedType() int32 {
+	switch c.kind {
+	case timeColumn:
+		return parquetTimestampMillis
+	case jsonColumn:
+		return parquetJSON
+	case int64Column:
+		return parquetInt64Converted
+	default:
+		return parquetUTF8
+	}
+}
+
+// Thrift compact protocol type codes.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes Thrift structs with the compact protocol, which is
+// what Parquet uses for page headers and file metadata.
+type thriftWriter struct {
+	buf       bytes.Buffer
+	lastField []int16 // Last field ID written, per open struct
+	last      int16
+}
+
+// fieldHeader writes a field header using the short delta form when
+// possible.
+func (t *thriftWriter) fieldHeader(id int16, typ byte) {
+	if delta := id - t.last; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		t.buf.WriteByte(typ)
+		t.writeVarint(zigzag(int64(id)))
+	}
+	t.last = id
+}
+
+func (t *thriftWriter) fieldI32(id int16, v int32) {
+	t.fieldHeader(id, thriftI32)
+	t.writeVarint(zigzag(int64(v)))
+}
+
+func (t *thriftWriter) fieldI64(id int16, v int64) {
+	t.fieldHeader(id, thriftI64)
+	t.writeVarint(zigzag(v))
+}
+
+func (t *thriftWriter) fieldBinary(id int16, s string) {
+	t.fieldHeader(id, thriftBinary)
+	t.writeBinary(s)
+}
+
+// fieldStruct starts a struct-valued field; close it with endStruct.
+func (t *thriftWriter) fieldStruct(id int16) {
+	t.fieldHeader(id, thriftStruct)
+	t.beginStruct()
+}
+
+// fieldList writes a list field header; the elements follow.
+func (t *thriftWriter) fieldList(id int16, elemType byte, size int) {
+	t.fieldHeader(id, thriftList)
+	if size < 15 {
+		t.buf.WriteByte(byte(size)<<4 | elemType)
+	} else {
+		t.buf.WriteByte(0xf0 | elemType)
+		t.writeVarint(uint64(size))
+	}
+}
+
+// beginStruct starts a nested struct, such as a list element.
+func (t *thriftWriter) beginStruct() {
+	t.lastField = append(t.lastField, t.last)
+	t.last = 0
+}
+
+// endStruct writes the stop field and returns to the enclosing struct.
+func (t *thriftWriter) endStruct() {
+	t.buf.WriteByte(0)
+	if n := len(t.lastField); n > 0 {
+		t.last = t.lastField[n-1]
+		t.lastField = t.lastField[:n-1]
+	}
+}
+
+func (t *thriftWriter) writeBinary(s string) {
+	t.writeVarint(uint64(len(s)))
+	t.buf.WriteString(s)
+}
+
+func (t *thriftWriter) writeVarint(v uint64) {
+	t.buf.Write(binary.AppendUvarint(nil, v))
+}
+
+// zigzag maps signed integers to unsigned ones for varint encoding.
+func zigzag(v int64) uint64 {
+	return uint64((v << 1) ^ (v >> 63))
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// thriftFields is a decoded Thrift struct, by field ID.
+type thriftFields map[int16]interface{}
+
+// thriftReader decodes the Thrift compact protocol, independently of
+// thriftWriter, so the tests check the encoding against the format.
+type thriftReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *thriftReader) byte() byte {
+	b := r.data[r.pos]
+	r.pos++
+	return b
+}
+
+func (r *thriftReader) varint() uint64 {
+	v, n := binary.Uvarint(r.data[r.pos:])
+	r.pos += n
+	return v
+}
+
+func (r *thriftReader) zigzag() int64 {
+	v := r.varint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (r *thriftReader) readStruct() thriftFields {
+	fields := thriftFields{}
+	var last int16
+	for {
+		header := r.byte()
+		if header == 0 {
+			return fields
+		}
+		id := last + int16(header>>4)
+		if header>>4 == 0 {
+			id = int16(r.zigzag())
+		}
+		last = id
+		fields[id] = r.readValue(header & 0x0f)
+	}
+}
+
+func (r *thriftReader) readValue(typ byte) interface{} {
+	switch typ {
+	case 1, 2:
+		return typ == 1
+	case 4, thriftI32, thriftI64:
+		return r.zigzag()
+	case thriftBinary:
+		n := int(r.varint())
+		s := string(r.data[r.pos : r.pos+n])
+		r.pos += n
+		return s
+	case thriftList:
+		header := r.byte()
+		size := int(header >> 4)
+		if size == 15 {
+			size = int(r.varint())
+		}
+		list := make([]interface{}, size)
+		for i := range list {
+			list[i] = r.readValue(header & 0x0f)
+		}
+		return list
+	case thriftStruct:
+		return r.readStruct()
+	}
+	panic(fmt.Sprintf("unsupported Thrift type %d", typ))
+}
+
+// parquetFile is what readParquet found in a file.
+type parquetFile struct {
+	schema  []thriftFields // Leaf schema elements
+	rows    int64
+	groups  int
+	columns [][]interface{} // Values by column; nil for nulls
+}
+
+// readParquet reads a flat Parquet file written with PLAIN encoding and
+// zstd compression.
+func readParquet(t *testing.T, path string) *parquetFile {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data[:4]) != parquetMagic || string(data[len(data)-4:]) != parquetMagic {
+		t.Fatalf("Missing PAR1 magic")
+	}
+	footerLen := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	footer := &thriftReader{data: data[len(data)-8-footerLen : len(data)-8]}
+	meta := footer.readStruct()
+	if footer.pos != footerLen {
+		t.Fatalf("Footer is %d bytes, decoded %d", footerLen, footer.pos)
+	}
+
+	file := &parquetFile{rows: meta[3].(int64)}
+	schema := meta[2].([]interface{})
+	if root := schema[0].(thriftFields); root[5].(int64) != int64(len(schema)-1) {
+		t.Fatalf("Root schema has %d children for %d columns", root[5], len(schema)-1)
+	}
+	for _, element := range schema[1:] {
+		file.schema = append(file.schema, element.(thriftFields))
+	}
+	file.columns = make([][]interface{}, len(file.schema))
+
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoder.Close()
+
+	for _, g := range meta[4].([]interface{}) {
+		group := g.(thriftFields)
+		file.groups++
+		for i, c := range group[1].([]interface{}) {
+			chunk := c.(thriftFields)[3].(thriftFields)
+			if chunk[4].(int64) != parquetZSTD {
+				t.Fatalf("Column %d: codec %d, want zstd", i, chunk[4])
+			}
+			reader := &thriftReader{data: data, pos: int(chunk[9].(int64))}
+			page := reader.readStruct()
+			compressed := data[reader.pos : reader.pos+int(page[3].(int64))]
+			if int64(reader.pos-int(chunk[9].(int64))+len(compressed)) != chunk[7].(int64) {
+				t.Fatalf("Column %d: chunk size does not match its page", i)
+			}
+			values, err := decoder.DecodeAll(compressed, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			numValues := page[5].(thriftFields)[1].(int64)
+			if numValues != group[3].(int64) || numValues != chunk[5].(int64) {
+				t.Fatalf("Column %d: %d values in a group of %d rows", i, numValues, group[3])
+			}
+			file.columns[i] = append(file.columns[i], decodePage(t, file.schema[i], values, int(numValues))...)
+		}
+	}
+	return file
+}
+
+// decodePage decodes the values of a data page, reading definition levels
+// first for optional columns.
+func decodePage(t *testing.T, element thriftFields, data []byte, n int) []interface{} {
+	t.Helper()
+	defined := make([]bool, n)
+	for i := range defined {
+		defined[i] = true
+	}
+	if element[3].(int64) == parquetOptional {
+		size := int(binary.LittleEndian.Uint32(data))
+		levels := &thriftReader{data: data[4 : 4+size]}
+		row := 0
+		for levels.pos < size {
+			header := levels.varint()
+			if header&1 != 0 {
+				t.Fatal("Unexpected bit-packed definition levels")
+			}
+			value := levels.byte()
+			for j := 0; j < int(header>>1); j++ {
+				defined[row] = value == 1
+				row++
+			}
+		}
+		if row != n {
+			t.Fatalf("Definition levels cover %d of %d rows", row, n)
+		}
+		data = data[4+size:]
+	}
+
+	values := make([]interface{}, n)
+	for i := range values {
+		if !defined[i] {
+			continue
+		}
+		if element[1].(int64) == parquetInt64 {
+			values[i] = int64(binary.LittleEndian.Uint64(data))
+			data = data[8:]
+		} else {
+			size := int(binary.LittleEndian.Uint32(data))
+			values[i] = string(data[4 : 4+size])
+			data = data[4+size:]
+		}
+	}
+	if len(data) != 0 {
+		t.Fatalf("%d bytes left after %d values", len(data), n)
+	}
+	return values
+}
+
+func TestParquetWriter_RoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "table.parquet")
+	table, err := newParquetWriter(path, testColumns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range testRows {
+		if err := table.WriteRow(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := table.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file := readParquet(t, path)
+	if file.rows != int64(len(testRows)) || file.groups != 1 {
+		t.Fatalf("Expected %d rows in 1 group, got %d in %d", len(testRows), file.rows, file.groups)
+	}
+
+	wantSchema := []struct {
+		name       string
+		typ        int64
+		repetition int64
+		converted  int64
+	}{
+		{"id", parquetByteArray, parquetRequired, parquetUTF8},
+		{"size", parquetInt64, parquetRequired, parquetInt64Converted},
+		{"seen", parquetInt64, parquetOptional, parquetTimestampMillis},
+		{"fields", parquetByteArray, parquetRequired, parquetJSON},
+	}
+	for i, want := range wantSchema {
+		got := file.schema[i]
+		if got[4] != want.name || got[1] != want.typ || got[3] != want.repetition || got[6] != want.converted {
+			t.Errorf("Schema element %d = %v, want %+v", i, got, want)
+		}
+	}
+
+	want := [][]interface{}{
+		{"a", "b, \"quoted\"\nline", ""},
+		{int64(42), int64(7), int64(-1)},
+		{time.Date(2024, 1, 15, 10, 30, 0, 250e6, time.UTC).UnixMilli(), nil, int64(0)},
+		{`{"user":"alice"}`, `[]`, `{"n":1.5,"ok":true}`},
+	}
+	for i := range want {
+		if fmt.Sprint(file.columns[i]) != fmt.Sprint(want[i]) {
+			t.Errorf("Column %s = %v, want %v", testColumns[i].name, file.columns[i], want[i])
+		}
+	}
+}
+
+func TestParquetWriter_RowGroups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "table.parquet")
+	columns := []column{{name: "n", kind: int64Column}, {name: "seen", kind: timeColumn, optional: true}}
+	table, err := newParquetWriter(path, columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := parquetRowGroupSize + 10
+	for i := 0; i < rows; i++ {
+		var seen interface{}
+		if i%3 == 0 {
+			seen = time.UnixMilli(int64(i))
+		}
+		if err := table.WriteRow([]interface{}{int64(i), seen}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := table.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file := readParquet(t, path)
+	if file.rows != int64(rows) || file.groups != 2 {
+		t.Fatalf("Expected %d rows in 2 groups, got %d in %d", rows, file.rows, file.groups)
+	}
+	for i := 0; i < rows; i++ {
+		if file.columns[0][i] != int64(i) {
+			t.Fatalf("Row %d: n = %v", i, file.columns[0][i])
+		}
+		if seen := file.columns[1][i]; (i%3 == 0) != (seen != nil) || seen != nil && seen != int64(i) {
+			t.Fatalf("Row %d: seen = %v", i, seen)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Command tune recommends a Drain similarity threshold and tree depth for a
+// source by replaying a sample of its logs under a grid of configurations.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/log-zero/log-zero/internal/compression/drain"
+	"github.com/log-zero/log-zero/internal/compression/tune"
+)
+
+// readLines appends the non-empty lines of r to lines, up to limit.
+func readLines(r io.Reader, lines []string, limit int) ([]string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() && len(lines) < limit {
+		if line := strings.TrimRight(scanner.Text(), "\r"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// parseFloats parses a comma-separated list of numbers.
+func parseFloats(s string) ([]float64, error) {
+	var values []float64
+	for _, field := range strings.Split(s, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", field)
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// parseInts parses a comma-separated list of integers.
+func parseInts(s string) ([]int, error) {
+	var values []int
+	for _, field := range strings.Split(s, ",") {
+		v, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, fmt.Errorf("invalid integer %q", field)
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// joinFloats formats numbers as a comma-separated list, for flag defaults.
+func joinFloats(values []float64) string {
+	fields := make([]string, len(values))
+	for i, v := range values {
+		fields[i] = strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return strings.Join(fields, ",")
+}
+
+// joinInts formats integers as a comma-separated list, for flag defaults.
+func joinInts(values []int) string {
+	fields := make([]string, len(values))
+	for i, v := range values {
+		fields[i] = strconv.Itoa(v)
+	}
+	return strings.Join(fields, ",")
+}
+
+func main() {
+	grid := tune.DefaultGrid()
+	sims := flag.String("sim", joinFloats(grid.SimThresholds), "Comma-separated similarity thresholds to try")
+	depths := flag.String("depth", joinInts(grid.MaxDepths), "Comma-separated tree depths to try")
+	minEntropy := flag.Float64("min-entropy", tune.DefaultMinSlotEntropy, "Minimum entropy in bits of a wildcard slot")
+	sample := flag.Int("sample", 20000, "Maximum number of lines to replay")
+	source := flag.String("source", "", "Source whose per-source Drain config is the starting point")
+	sourceConfigPath := flag.String("drain-sources", "", "JSON file of per-source Drain config overrides")
+	asJSON := flag.Bool("json", false, "Print the report as JSON")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [file ...]\n\nReads log lines from the files, or stdin if none (or -) are given.\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	var err error
+	if grid.SimThresholds, err = parseFloats(*sims); err != nil {
+		fmt.Fprintf(os.Stderr, "-sim: %v\n", err)
+		os.Exit(2)
+	}
+	if grid.MaxDepths, err = parseInts(*depths); err != nil {
+		fmt.Fprintf(os.Stderr, "-depth: %v\n", err)
+		os.Exit(2)
+	}
+
+	var sourceConfigs map[string]drain.SourceConfig
+	if *sourceConfigPath != "" {
+		sourceConfigs, err = drain.LoadSourceConfigs(*sourceConfigPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to load per-source Drain config: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	base := drain.NewRegistry(drain.DefaultConfig(), sourceConfigs).ConfigFor(*source)
+
+	inputs := flag.Args()
+	if len(inputs) == 0 {
+		inputs = []string{"-"}
+	}
+	var lines []string
+	for _, input := range inputs {
+		if input == "-" {
+			lines, err = readLines(os.Stdin, lines, *sample)
+		} else {
+			var file *os.File
+			if file, err = os.Open(input); err == nil {
+				lines, err = readLines(file, lines, *sample)
+				file.Close()
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read %s: %v\n", input, err)
+			os.Exit(1)
+		}
+	}
+
+	report, err := tune.Tune(lines, base, grid, *minEntropy)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "tune failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to encode report: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	fmt.Printf("replayed %d lines; x marks configs with wildcard slots below %.2f bits\n", report.Lines, report.MinSlotEntropy)
+	for _, trial := range report.Trials {
+		fmt.Println(trial)
+	}
+	recommended, _ := json.Marshal(report.Recommended)
+	fmt.Printf("recommended: %s\n", recommended)
+}
@@ -0,0 +1,439 @@
+// Package codec is the binary encoding of compressed log records.
+//
+// A record is a template ID, a timestamp and the variables extracted by
+// Drain. Records are encoded against dictionaries that grow as they are
+// written: template IDs and slot keys are written in full once and then as
+// indexes, timestamps as varint deltas from the previous record, and each
+// slot keeps a dictionary of the values it has taken so repeated values
+// cost a byte or two. Records are grouped into self-contained blocks whose
+// payload may be zstd-compressed.
+//
+// Block layout:
+//
+//	magic "LZB" | version | flags | uvarint max dictionary |
+//	uvarint records | uvarint payload length | payload
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Block header constants.
+const (
+	blockMagic   = "LZB"
+	blockVersion = 1
+
+	flagZstd = 1 << 0
+)
+
+// DefaultMaxDictionary is the default number of values kept per slot
+// dictionary. Slots holding unique values such as request IDs stop adding
+// entries once full and write their values as literals.
+const DefaultMaxDictionary = 1024
+
+// ErrCorrupt is returned when encoded data cannot be decoded.
+var ErrCorrupt = errors.New("codec: corrupt data")
+
+// Record is one compressed log record.
+type Record struct {
+	TemplateID string
+	Timestamp  int64 // Unix nanoseconds
+	Variables  map[string]string
+}
+
+// Options configures block encoding.
+type Options struct {
+	Compress      bool // zstd-compress block payloads
+	MaxDictionary int  // Values kept per slot dictionary; 0 uses DefaultMaxDictionary
+}
+
+// DefaultOptions returns the default block options.
+func DefaultOptions() Options {
+	return Options{
+		Compress:      true,
+		MaxDictionary: DefaultMaxDictionary,
+	}
+}
+
+// dictionary assigns indexes to strings in the order they are first seen.
+type dictionary struct {
+	index   map[string]int
+	entries []string
+	limit   int // Maximum entries; 0 means unbounded
+}
+
+func newDictionary(limit int) *dictionary {
+	return &dictionary{index: make(map[string]int), limit: limit}
+}
+
+// add records s if the dictionary has room.
+func (d *dictionary) add(s string) {
+	if d.limit > 0 && len(d.entries) >= d.limit {
+		return
+	}
+	d.index[s] = len(d.entries)
+	d.entries = append(d.entries, s)
+}
+
+// Encoder encodes records against dictionaries built from the records it
+// has already encoded. A Decoder reading the same sequence of records
+// rebuilds the same dictionaries. The zero value is not usable; use
+// NewEncoder.
+type Encoder struct {
+	maxDictionary int
+	templates     *dictionary
+	keys          *dictionary
+	values        map[string]*dictionary
+	lastTimestamp int64
+	sortedKeys    []string
+}
+
+// NewEncoder returns an Encoder whose slot dictionaries hold at most
+// maxDictionary values; 0 uses DefaultMaxDictionary.
+func NewEncoder(maxDictionary int) *Encoder {
+	if maxDictionary <= 0 {
+		maxDictionary = DefaultMaxDictionary
+	}
+	e := &Encoder{maxDictionary: maxDictionary}
+	e.Reset()
+	return e
+}
+
+// Reset clears the dictionaries, so the next record starts a new sequence.
+func (e *Encoder) Reset() {
+	e.templates = newDictionary(0)
+	e.keys = newDictionary(0)
+	e.values = make(map[string]*dictionary)
+	e.lastTimestamp = 0
+}
+
+// Append appends the encoding of r to dst and returns the extended slice.
+// Variables are written in key order, so equal records encode identically.
+func (e *Encoder) Append(dst []byte, r *Record) []byte {
+	dst = appendEntry(dst, e.templates, r.TemplateID)
+	dst = binary.AppendVarint(dst, r.Timestamp-e.lastTimestamp)
+	e.lastTimestamp = r.Timestamp
+
+	e.sortedKeys = e.sortedKeys[:0]
+	for key := range r.Variables {
+		e.sortedKeys = append(e.sortedKeys, key)
+	}
+	sort.Strings(e.sortedKeys)
+
+	dst = binary.AppendUvarint(dst, uint64(len(e.sortedKeys)))
+	for _, key := range e.sortedKeys {
+		dst = appendEntry(dst, e.keys, key)
+
+		values, ok := e.values[key]
+		if !ok {
+			values = newDictionary(e.maxDictionary)
+			e.values[key] = values
+		}
+		value := r.Variables[key]
+		if i, ok := values.index[value]; ok {
+			dst = binary.AppendUvarint(dst, uint64(i)+1)
+			continue
+		}
+		dst = binary.AppendUvarint(dst, 0)
+		dst = appendString(dst, value)
+		values.add(value)
+	}
+	return dst
+}
+
+// appendEntry writes the index of s in an unbounded dictionary, followed by
+// s itself the first time it is seen.
+func appendEntry(dst []byte, d *dictionary, s string) []byte {
+	if i, ok := d.index[s]; ok {
+		return binary.AppendUvarint(dst, uint64(i))
+	}
+	dst = binary.AppendUvarint(dst, uint64(len(d.entries)))
+	d.add(s)
+	return appendString(dst, s)
+}
+
+func appendString(dst []byte, s string) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(s)))
+	return append(dst, s...)
+}
+
+// Decoder decodes records written by an Encoder with the same dictionary
+// limit. The zero value is not usable; use NewDecoder.
+type Decoder struct {
+	maxDictionary int
+	templates     *dictionary
+	keys          *dictionary
+	values        map[string]*dictionary
+	lastTimestamp int64
+}
+
+// NewDecoder returns a Decoder for records encoded with maxDictionary; 0
+// uses DefaultMaxDictionary.
+func NewDecoder(maxDictionary int) *Decoder {
+	if maxDictionary <= 0 {
+		maxDictionary = DefaultMaxDictionary
+	}
+	d := &Decoder{maxDictionary: maxDictionary}
+	d.Reset()
+	return d
+}
+
+// Reset clears the dictionaries, matching Encoder.Reset.
+func (d *Decoder) Reset() {
+	d.templates = newDictionary(0)
+	d.keys = newDictionary(0)
+	d.values = make(map[string]*dictionary)
+	d.lastTimestamp = 0
+}
+
+// Decode decodes one record from the start of data into r and returns the
+// number of bytes read.
+func (d *Decoder) Decode(data []byte, r *Record) (int, error) {
+	rd := reader{data: data}
+
+	r.TemplateID = rd.entry(d.templates)
+	r.Timestamp = d.lastTimestamp + rd.varint()
+	d.lastTimestamp = r.Timestamp
+
+	n := rd.uvarint()
+	if rd.err == nil && n > uint64(len(data)) {
+		rd.err = ErrCorrupt
+	}
+	r.Variables = make(map[string]string, int(min(n, 64)))
+	for i := uint64(0); i < n && rd.err == nil; i++ {
+		key := rd.entry(d.keys)
+		values, ok := d.values[key]
+		if !ok {
+			values = newDictionary(d.maxDictionary)
+			d.values[key] = values
+		}
+
+		ref := rd.uvarint()
+		if ref == 0 {
+			value := rd.string()
+			if rd.err == nil {
+				r.Variables[key] = value
+				values.add(value)
+			}
+			continue
+		}
+		if ref > uint64(len(values.entries)) {
+			rd.err = ErrCorrupt
+			break
+		}
+		r.Variables[key] = values.entries[ref-1]
+	}
+
+	if rd.err != nil {
+		return 0, rd.err
+	}
+	return rd.pos, nil
+}
+
+// reader reads varints and strings from a byte slice, recording the first
+// error.
+type reader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (rd *reader) uvarint() uint64 {
+	if rd.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(rd.data[rd.pos:])
+	if n <= 0 {
+		rd.err = ErrCorrupt
+		return 0
+	}
+	rd.pos += n
+	return v
+}
+
+func (rd *reader) varint() int64 {
+	if rd.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(rd.data[rd.pos:])
+	if n <= 0 {
+		rd.err = ErrCorrupt
+		return 0
+	}
+	rd.pos += n
+	return v
+}
+
+func (rd *reader) string() string {
+	n := rd.uvarint()
+	if rd.err != nil {
+		return ""
+	}
+	if n > uint64(len(rd.data)-rd.pos) {
+		rd.err = ErrCorrupt
+		return ""
+	}
+	s := string(rd.data[rd.pos : rd.pos+int(n)])
+	rd.pos += int(n)
+	return s
+}
+
+// entry reads a dictionary index, and the string itself if the index is
+// new.
+func (rd *reader) entry(d *dictionary) string {
+	i := rd.uvarint()
+	if rd.err != nil {
+		return ""
+	}
+	switch {
+	case i < uint64(len(d.entries)):
+		return d.entries[i]
+	case i == uint64(len(d.entries)):
+		s := rd.string()
+		if rd.err == nil {
+			d.add(s)
+		}
+		return s
+	default:
+		rd.err = ErrCorrupt
+		return ""
+	}
+}
+
+// The zstd coders are safe for concurrent EncodeAll and DecodeAll calls.
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// Writer groups records into blocks. It is not safe for concurrent use.
+type Writer struct {
+	options Options
+	encoder *Encoder
+	payload []byte
+	records int
+}
+
+// NewWriter returns a Writer producing blocks with options.
+func NewWriter(options Options) *Writer {
+	if options.MaxDictionary <= 0 {
+		options.MaxDictionary = DefaultMaxDictionary
+	}
+	return &Writer{
+		options: options,
+		encoder: NewEncoder(options.MaxDictionary),
+	}
+}
+
+// Write adds r to the current block and returns the number of bytes it
+// took, before block compression.
+func (w *Writer) Write(r *Record) int {
+	before := len(w.payload)
+	w.payload = w.encoder.Append(w.payload, r)
+	w.records++
+	return len(w.payload) - before
+}
+
+// Len returns the number of records in the current block.
+func (w *Writer) Len() int {
+	return w.records
+}
+
+// Size returns the encoded size of the current block's records, before
+// block compression.
+func (w *Writer) Size() int {
+	return len(w.payload)
+}
+
+// Flush returns the current block, or nil if it is empty, and starts a new
+// one with empty dictionaries.
+func (w *Writer) Flush() []byte {
+	if w.records == 0 {
+		return nil
+	}
+
+	var flags byte
+	payload := w.payload
+	if w.options.Compress {
+		compressed := zstdEncoder.EncodeAll(payload, nil)
+		if len(compressed) < len(payload) {
+			payload = compressed
+			flags |= flagZstd
+		}
+	}
+
+	block := make([]byte, 0, len(payload)+16)
+	block = append(block, blockMagic...)
+	block = append(block, blockVersion, flags)
+	block = binary.AppendUvarint(block, uint64(w.options.MaxDictionary))
+	block = binary.AppendUvarint(block, uint64(w.records))
+	block = binary.AppendUvarint(block, uint64(len(payload)))
+	block = append(block, payload...)
+
+	w.payload = w.payload[:0]
+	w.records = 0
+	w.encoder.Reset()
+	return block
+}
+
+// EncodeBlock encodes records as a single block.
+func EncodeBlock(records []Record, options Options) []byte {
+	w := NewWriter(options)
+	for i := range records {
+		w.Write(&records[i])
+	}
+	return w.Flush()
+}
+
+// DecodeBlock decodes a block written by EncodeBlock or Writer.Flush.
+func DecodeBlock(block []byte) ([]Record, error) {
+	if len(block) < len(blockMagic)+2 || !bytes.HasPrefix(block, []byte(blockMagic)) {
+		return nil, fmt.Errorf("%w: missing block header", ErrCorrupt)
+	}
+	if version := block[len(blockMagic)]; version != blockVersion {
+		return nil, fmt.Errorf("codec: unsupported block version %d", version)
+	}
+	flags := block[len(blockMagic)+1]
+
+	rd := reader{data: block, pos: len(blockMagic) + 2}
+	maxDictionary := rd.uvarint()
+	count := rd.uvarint()
+	length := rd.uvarint()
+	if rd.err != nil || maxDictionary == 0 || length != uint64(len(block)-rd.pos) {
+		return nil, fmt.Errorf("%w: invalid block header", ErrCorrupt)
+	}
+
+	payload := block[rd.pos:]
+	if flags&flagZstd != 0 {
+		var err error
+		payload, err = zstdDecoder.DecodeAll(payload, nil)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
+	}
+	// Every record takes at least three bytes
+	if count > uint64(len(payload))/3 {
+		return nil, fmt.Errorf("%w: record count %d exceeds payload", ErrCorrupt, count)
+	}
+
+	decoder := NewDecoder(int(maxDictionary))
+	records := make([]Record, count)
+	pos := 0
+	for i := range records {
+		n, err := decoder.Decode(payload[pos:], &records[i])
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %w", i, err)
+		}
+		pos += n
+	}
+	if pos != len(payload) {
+		return nil, fmt.Errorf("%w: %d trailing bytes", ErrCorrupt, len(payload)-pos)
+	}
+	return records, nil
+}
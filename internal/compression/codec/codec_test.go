@@ -0,0 +1,95 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func sampleRecords(n int) []Record {
+	records := make([]Record, n)
+	start := int64(1_700_000_000_000_000_000)
+	for i := range records {
+		records[i] = Record{
+			TemplateID: fmt.Sprintf("tmpl_%016x", i%3),
+			Timestamp:  start + int64(i)*1_000_000,
+			Variables: map[string]string{
+				"status":  []string{"200", "404", "500"}[i%3],
+				"request": fmt.Sprintf("req-%06d", i),
+			},
+		}
+	}
+	records[1].Variables = map[string]string{}
+	records[2].Timestamp = records[1].Timestamp - 5 // Out of order
+	return records
+}
+
+func TestBlockRoundTrip(t *testing.T) {
+	records := sampleRecords(500)
+	for _, options := range []Options{{}, DefaultOptions(), {Compress: true, MaxDictionary: 2}} {
+		block := EncodeBlock(records, options)
+		decoded, err := DecodeBlock(block)
+		if err != nil {
+			t.Fatalf("DecodeBlock(%+v) failed: %v", options, err)
+		}
+		if !reflect.DeepEqual(decoded, records) {
+			t.Errorf("Round trip with %+v changed records", options)
+		}
+	}
+}
+
+func TestWriter_DictionarySizes(t *testing.T) {
+	w := NewWriter(Options{})
+	first := Record{TemplateID: "tmpl_0123456789abcdef", Timestamp: 1_700_000_000_000_000_000, Variables: map[string]string{"status": "200"}}
+	second := first
+	second.Timestamp += 1000
+
+	n1 := w.Write(&first)
+	n2 := w.Write(&second)
+	// Template index, 2-byte delta, variable count, key index, value index
+	if n2 != 6 || n2 >= n1 {
+		t.Errorf("Expected repeated record to take 6 bytes after %d, got %d", n1, n2)
+	}
+	if w.Len() != 2 || w.Size() != n1+n2 {
+		t.Errorf("Unexpected writer state: %d records, %d bytes", w.Len(), w.Size())
+	}
+
+	block := w.Flush()
+	if w.Len() != 0 || w.Flush() != nil {
+		t.Error("Expected Flush to start an empty block")
+	}
+	// Dictionaries restart with the block
+	if n := w.Write(&second); n != n1 {
+		t.Errorf("Expected %d bytes after flush, got %d", n1, n)
+	}
+	if records, err := DecodeBlock(block); err != nil || len(records) != 2 {
+		t.Errorf("DecodeBlock failed: %v", err)
+	}
+}
+
+func TestDecodeBlock_Corrupt(t *testing.T) {
+	block := EncodeBlock(sampleRecords(50), Options{})
+	for _, data := range [][]byte{
+		nil,
+		[]byte("nope"),
+		block[:len(block)-1],
+		append(append([]byte{}, block...), 0),
+	} {
+		if _, err := DecodeBlock(data); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("Expected ErrCorrupt for %d bytes, got %v", len(data), err)
+		}
+	}
+}
+
+func BenchmarkWriter(b *testing.B) {
+	records := sampleRecords(4096)
+	w := NewWriter(DefaultOptions())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w.Write(&records[i%len(records)])
+		if w.Len() == len(records) {
+			w.Flush()
+		}
+	}
+}
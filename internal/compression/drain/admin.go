@@ -0,0 +1,209 @@
+package drain
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Template administration
+//
+// Drain can over-generalize (two unrelated messages collapse into one
+// template) or under-generalize (one message is spread over several
+// templates). The operations below let an operator correct the tree by
+// hand. IDs retired by a merge resolve to the merged cluster in the same way
+// as IDs retired by generalization.
+
+// MergeClusters merges the clusters with the given IDs into one whose
+// template wildcards every position where their templates differ. The
+// first cluster survives, keeping its pin, and the merged cluster is
+// returned. All templates must have the same number of tokens.
+func (dt *DrainTree) MergeClusters(ids []string) (*LogCluster, error) {
+	dt.delivery.Lock()
+	defer dt.delivery.Unlock()
+	dt.mu.Lock()
+	cluster, err := dt.mergeClusters(ids)
+	events, eventFuncs := dt.takeEvents()
+	dt.mu.Unlock()
+
+	notifyEvents(events, eventFuncs)
+	return cluster, err
+}
+
+// mergeClusters implements MergeClusters. The caller must hold dt.mu for
+// writing.
+func (dt *DrainTree) mergeClusters(ids []string) (*LogCluster, error) {
+	var clusters []*LogCluster
+	seen := make(map[*LogCluster]bool)
+	for _, id := range ids {
+		current, ok := dt.resolveID(id)
+		if !ok {
+			return nil, fmt.Errorf("unknown template %s", id)
+		}
+		cluster := dt.clusters[current]
+		if seen[cluster] {
+			continue
+		}
+		if len(clusters) > 0 && len(cluster.Tokens) != len(clusters[0].Tokens) {
+			return nil, fmt.Errorf("template %s has %d tokens, expected %d", id, len(cluster.Tokens), len(clusters[0].Tokens))
+		}
+		seen[cluster] = true
+		clusters = append(clusters, cluster)
+	}
+	if len(clusters) < 2 {
+		return nil, fmt.Errorf("merge needs at least two distinct templates")
+	}
+
+	target := clusters[0]
+	tokens := append([]string(nil), target.Tokens...)
+	for _, cluster := range clusters[1:] {
+		for i, token := range cluster.Tokens {
+			if tokens[i] != token {
+				tokens[i] = Wildcard
+			}
+		}
+	}
+
+	for _, cluster := range clusters[1:] {
+		dt.absorbCluster(target, cluster)
+		delete(dt.clusters, cluster.ID)
+		dt.aliases[cluster.ID] = target.ID
+		dt.retired[cluster.ID] = cluster.Template
+		target.retiredIDs = append(target.retiredIDs, cluster.retiredIDs...)
+		target.retiredIDs = append(target.retiredIDs, cluster.ID)
+		replaceInTree(cluster, target)
+	}
+
+	target.mu.Lock()
+	oldTemplate := target.Template
+	target.Tokens = tokens
+	target.Template = strings.Join(tokens, " ")
+	dt.refreshSlotNames(target)
+	target.mu.Unlock()
+
+	merged := dt.reidentify(target, oldTemplate)
+	for _, cluster := range clusters[1:] {
+		dt.recordEvent(EventMerged, merged, cluster.ID, cluster.Template)
+	}
+	return merged, nil
+}
+
+// SplitCluster carves a new cluster out of cluster id for logs whose token
+// at position equals value. The position must be a wildcard in the
+// template and value must not itself be masked as a variable. The new
+// cluster starts with no logs at timestamp, takes over the matching sample
+// logs and is preferred over the original for logs it covers.
+func (dt *DrainTree) SplitCluster(id string, position int, value string, timestamp int64) (*LogCluster, error) {
+	dt.delivery.Lock()
+	defer dt.delivery.Unlock()
+	dt.mu.Lock()
+	cluster, err := dt.splitCluster(id, position, value, timestamp)
+	evicted, evictionFuncs := dt.takeEvicted()
+	events, eventFuncs := dt.takeEvents()
+	dt.mu.Unlock()
+
+	notifyEvicted(evicted, evictionFuncs)
+	notifyEvents(events, eventFuncs)
+	return cluster, err
+}
+
+// splitCluster implements SplitCluster. The caller must hold dt.mu for
+// writing.
+func (dt *DrainTree) splitCluster(id string, position int, value string, timestamp int64) (*LogCluster, error) {
+	current, ok := dt.resolveID(id)
+	if !ok {
+		return nil, fmt.Errorf("unknown template %s", id)
+	}
+	original := dt.clusters[current]
+
+	if position < 0 || position >= len(original.Tokens) {
+		return nil, fmt.Errorf("position %d out of range for %d tokens", position, len(original.Tokens))
+	}
+	if original.Tokens[position] != Wildcard {
+		return nil, fmt.Errorf("position %d of template %s is not a wildcard", position, current)
+	}
+	if value == "" || strings.ContainsFunc(value, unicode.IsSpace) || dt.maskToken(value) != "" {
+		return nil, fmt.Errorf("value %q cannot be used as a literal token", value)
+	}
+
+	tokens := append([]string(nil), original.Tokens...)
+	tokens[position] = value
+	newID := dt.generateClusterID(tokens)
+	if _, exists := dt.clusters[newID]; exists {
+		return nil, fmt.Errorf("template %s already exists", newID)
+	}
+
+	cluster := &LogCluster{
+		ID:         newID,
+		Template:   strings.Join(tokens, " "),
+		Tokens:     tokens,
+		FirstSeen:  timestamp,
+		LastSeen:   timestamp,
+		SampleLogs: make([]string, 0, dt.maxSampleLogs),
+	}
+	dt.touch(cluster)
+
+	original.mu.Lock()
+	cluster.nameOverrides = copyOverrides(original, position)
+	dt.refreshSlotNames(cluster)
+	kept := original.SampleLogs[:0]
+	for _, sample := range original.SampleLogs {
+		_, _, message := dt.splitHeader(sample)
+		sampleTokens, _ := dt.tokenizer.Tokenize(message)
+		if len(sampleTokens) == len(tokens) && sampleTokens[position] == value {
+			cluster.SampleLogs = append(cluster.SampleLogs, sample)
+		} else {
+			kept = append(kept, sample)
+		}
+	}
+	original.SampleLogs = kept
+	original.mu.Unlock()
+
+	dt.clusters[newID] = cluster
+	delete(dt.aliases, newID)
+	delete(dt.retired, newID)
+	dt.recordEvent(EventCreated, cluster, original.ID, original.Template)
+
+	// Link the new cluster under its own path and next to the original, so
+	// logs reaching the original's leaves can find it too
+	dt.addToTree(dt.root, cluster, tokens, 1)
+	for _, leaf := range original.leaves {
+		if !containsNode(cluster.leaves, leaf) {
+			addToLeaf(leaf, cluster)
+		}
+	}
+	for _, leaf := range cluster.leaves {
+		dt.enforceLeafLimit(leaf, cluster)
+	}
+	dt.enforceTemplateLimit(cluster)
+
+	return cluster, nil
+}
+
+// containsNode reports whether nodes contains node.
+func containsNode(nodes []*ClusterNode, node *ClusterNode) bool {
+	for _, n := range nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+// PinCluster sets whether cluster id is pinned. A pinned template is never
+// generalized further; logs it does not cover form new clusters instead.
+func (dt *DrainTree) PinCluster(id string, pinned bool) (*LogCluster, error) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+
+	current, ok := dt.resolveID(id)
+	if !ok {
+		return nil, fmt.Errorf("unknown template %s", id)
+	}
+	cluster := dt.clusters[current]
+
+	cluster.mu.Lock()
+	cluster.Pinned = pinned
+	cluster.mu.Unlock()
+	return cluster, nil
+}
@@ -7,22 +7,45 @@ import (
 	"fmt"
 	"hash/fnv"
 	"regexp"
-	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"unicode"
 )
 
 // DrainTree is the main data structure for the Drain algorithm.
 // It maintains a tree of clusters for efficient log template matching.
 type DrainTree struct {
 	root         *ClusterNode
+	source       string
 	clusters     map[string]*LogCluster
+	aliases      map[string]string
+	retired      map[string]string
 	mu           sync.RWMutex
 	maxDepth     int
 	simThreshold float64
 	maxChildren  int
 	maxClusters  int
-	patterns     []*regexp.Regexp
+	maxTemplates int
+	eviction     EvictionPolicy
+
+	maxSampleLogs  int
+	sampleRedactor func(string) string
+
+	clock        atomic.Int64
+	evicted      []ClusterInfo
+	evictions    int64
+	maskingRules []MaskingRule
+	masks        []maskRule
+	placeholders map[string]bool
+	tokenizer    Tokenizer
+	header       *regexp.Regexp
+
+	evictionFuncs []EvictionFunc
+	events        []Event
+	eventFuncs    []EventFunc
+	eventSeq      uint64
+	delivery      sync.Mutex // Taken before mu by changes that queue events, until they are delivered
 }
 
 // ClusterNode represents a node in the Drain tree.
@@ -41,7 +64,21 @@ type LogCluster struct {
 	FirstSeen  int64
 	LastSeen   int64
 	SampleLogs []string
+	Pinned     bool // Never generalized further once set
 	mu         sync.Mutex
+
+	lastAccess int64          // Tree clock value when last matched, for LRU
+	leaves     []*ClusterNode // Leaf nodes referencing this cluster
+	retiredIDs []string       // Retired IDs that resolve to this cluster
+
+	pendingSamples int            // Sample appends claimed but not yet placed
+	sampleClaims   uint64         // Replacement claims made, numbering them
+	slotClaims     map[int]uint64 // Latest replacement claim per sample slot
+
+	slots         map[string]*SlotStats // Observed values per variable slot
+	slotsTemplate string                // Template the slot stats were collected for
+	names         []string              // Variable key of each token, "" for literals
+	nameOverrides map[int]string        // Operator-chosen slot names by token position
 }
 
 // ParseResult contains the result of parsing a log message.
@@ -49,17 +86,38 @@ type ParseResult struct {
 	TemplateID string
 	Template   string
 	Variables  map[string]string
+	Fields     map[string]string   // Named groups matched by Config.HeaderPattern
+	Types      map[string]SlotType // Inferred type of each variable slot
 	IsNew      bool
 }
 
 // Config holds configuration for the Drain algorithm.
 type Config struct {
-	MaxDepth       int     // Maximum depth of the parse tree (default: 4)
-	SimThreshold   float64 // Similarity threshold for template matching (default: 0.5)
-	MaxChildren    int     // Maximum children per node (default: 100)
-	MaxClusters    int     // Maximum clusters per leaf node (default: 20)
-	MaxSampleLogs  int     // Maximum sample logs to keep per template
-	ExtraDelimiter string  // Additional delimiter for tokenization
+	MaxDepth       int                 // Maximum depth of the parse tree (default: 4)
+	SimThreshold   float64             // Similarity threshold for template matching (default: 0.5)
+	MaxChildren    int                 // Maximum children per node (default: 100)
+	MaxClusters    int                 // Maximum clusters per leaf node (default: 20)
+	MaxTemplates   int                 // Maximum clusters in the whole tree (default: unlimited)
+	Eviction       EvictionPolicy      // Which cluster to evict when a limit is hit (default: LRU)
+	MaxSampleLogs  int                 // Maximum sample logs to keep per template
+	RedactSample   func(string) string // Applied to raw lines before they are kept as samples
+	ExtraDelimiter string              // Additional delimiter characters for tokenization
+	MaskingRules   []MaskingRule       // Custom masks, applied before the built-in ones
+	QuotedStrings  bool                // Keep quoted strings together as single tokens
+
+	// HeaderPattern is a regex matched at the start of each line, such as a
+	// timestamp/level/logger prefix. The match is stripped before
+	// clustering and its named groups are returned in ParseResult.Fields.
+	HeaderPattern string
+
+	// Tokenizer overrides the default tokenizer built from ExtraDelimiter
+	// and QuotedStrings.
+	Tokenizer Tokenizer
+
+	// Source is mixed into template IDs so that the same template learned
+	// by trees of different sources gets different IDs. Registry sets it
+	// for every source except DefaultSource.
+	Source string
 }
 
 // DefaultConfig returns the default configuration.
@@ -88,55 +146,44 @@ func NewDrainTree(config Config) *DrainTree {
 		config.MaxClusters = 20
 	}
 
+	masks, placeholders := compileMaskingRules(config.MaskingRules)
+
 	return &DrainTree{
 		root: &ClusterNode{
 			KeyToChildNode: make(map[string]*ClusterNode),
 			Depth:          0,
 		},
+		source:       config.Source,
 		clusters:     make(map[string]*LogCluster),
+		aliases:      make(map[string]string),
+		retired:      make(map[string]string),
 		maxDepth:     config.MaxDepth,
 		simThreshold: config.SimThreshold,
 		maxChildren:  config.MaxChildren,
 		maxClusters:  config.MaxClusters,
-		patterns:     compilePatterns(),
-	}
-}
+		maxTemplates: config.MaxTemplates,
+		eviction:     config.Eviction,
 
-// compilePatterns compiles regex patterns for variable detection.
-func compilePatterns() []*regexp.Regexp {
-	patternStrings := []string{
-		// IP addresses
-		`\b\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}\b`,
-		// UUIDs
-		`\b[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}\b`,
-		// Hex strings (8+ chars)
-		`\b[0-9a-fA-F]{8,}\b`,
-		// Numbers
-		`\b\d+\b`,
-		// File paths
-		`/[^\s]+`,
-		// URLs
-		`https?://[^\s]+`,
-		// Email addresses
-		`[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}`,
-	}
-
-	patterns := make([]*regexp.Regexp, 0, len(patternStrings))
-	for _, p := range patternStrings {
-		if re, err := regexp.Compile(p); err == nil {
-			patterns = append(patterns, re)
-		}
+		maxSampleLogs:  config.MaxSampleLogs,
+		sampleRedactor: config.RedactSample,
+
+		maskingRules: append([]MaskingRule(nil), config.MaskingRules...),
+		masks:        masks,
+		placeholders: placeholders,
+		tokenizer:    NewTokenizer(config),
+		header:       compileHeader(config.HeaderPattern),
 	}
-	return patterns
 }
 
 // Parse processes a log message and returns the template ID and extracted variables.
+//
+// Parse is safe for concurrent use. Logs that match an existing template
+// without changing it are handled under a read lock; the write lock is only
+// taken when a cluster must be created or its template generalized.
 func (dt *DrainTree) Parse(logContent string, timestamp int64) (*ParseResult, error) {
-	dt.mu.Lock()
-	defer dt.mu.Unlock()
-
-	// Tokenize the log content
-	tokens := dt.tokenize(logContent)
+	// Strip the structured header, then tokenize the message
+	header, fields, message := dt.splitHeader(logContent)
+	tokens, separators := dt.tokenizer.Tokenize(message)
 	if len(tokens) == 0 {
 		return nil, fmt.Errorf("empty log content")
 	}
@@ -144,65 +191,121 @@ func (dt *DrainTree) Parse(logContent string, timestamp int64) (*ParseResult, er
 	// Create preprocessed tokens (replace obvious variables)
 	processedTokens := dt.preprocessTokens(tokens)
 
-	// Search for matching cluster in tree
-	cluster := dt.treeSearch(dt.root, processedTokens, 1)
-
+	// Fast path: match an existing template under the read lock
+	var sample sampleClaim
+	match, ok := dt.matchExisting(processedTokens, &sample, timestamp)
 	isNew := false
-	if cluster == nil {
-		// Create new cluster
-		cluster = dt.createCluster(processedTokens, timestamp)
-		isNew = true
-	} else {
-		// Update existing cluster
-		dt.updateCluster(cluster, processedTokens, timestamp)
+	if !ok {
+		match, isNew = dt.insert(processedTokens, &sample, timestamp)
 	}
+	dt.placeSample(sample, logContent)
 
 	// Extract variables
-	variables := dt.extractVariables(cluster.Template, logContent)
+	variables := dt.extractVariables(match.names, tokens, separators)
+	types := dt.observeSlots(match.cluster, match.template, variables)
+	if header != "" {
+		variables[HeaderKey] = header
+	}
 
 	return &ParseResult{
-		TemplateID: cluster.ID,
-		Template:   cluster.Template,
+		TemplateID: match.id,
+		Template:   match.template,
 		Variables:  variables,
+		Fields:     fields,
+		Types:      types,
 		IsNew:      isNew,
 	}, nil
 }
 
-// tokenize splits a log message into tokens.
-func (dt *DrainTree) tokenize(content string) []string {
-	// Split by whitespace
-	tokens := strings.Fields(content)
-	return tokens
+// clusterMatch is a consistent copy of the cluster fields Parse needs,
+// taken while the tree lock was held.
+type clusterMatch struct {
+	cluster  *LogCluster
+	id       string
+	template string
+	names    []string
 }
 
-// preprocessTokens replaces obvious variables with wildcards.
-func (dt *DrainTree) preprocessTokens(tokens []string) []string {
-	result := make([]string, len(tokens))
-	for i, token := range tokens {
-		if dt.isVariable(token) {
-			result[i] = "<*>"
-		} else {
-			result[i] = token
-		}
+// matchExisting looks up tokens under the read lock and records the log
+// against the matching cluster if that does not change its template.
+func (dt *DrainTree) matchExisting(tokens []string, sample *sampleClaim, timestamp int64) (clusterMatch, bool) {
+	dt.mu.RLock()
+	defer dt.mu.RUnlock()
+
+	cluster := dt.treeSearch(dt.root, tokens, 1)
+	if cluster == nil || !coversTokens(cluster.Tokens, tokens) {
+		return clusterMatch{}, false
 	}
-	return result
+
+	cluster.mu.Lock()
+	cluster.Size++
+	if timestamp > cluster.LastSeen {
+		cluster.LastSeen = timestamp
+	}
+	dt.touch(cluster)
+	dt.sampleLog(cluster, sample)
+	cluster.mu.Unlock()
+
+	return clusterMatch{cluster: cluster, id: cluster.ID, template: cluster.Template, names: cluster.names}, true
 }
 
-// isVariable checks if a token is likely a variable.
-func (dt *DrainTree) isVariable(token string) bool {
-	// Check if it's a pure number
-	if _, err := strconv.ParseFloat(token, 64); err == nil {
-		return true
+// insert creates or generalizes a cluster for tokens under the write lock.
+// The tree is searched again since it may have changed since matchExisting.
+func (dt *DrainTree) insert(tokens []string, sample *sampleClaim, timestamp int64) (clusterMatch, bool) {
+	dt.delivery.Lock()
+	defer dt.delivery.Unlock()
+	dt.mu.Lock()
+
+	cluster := dt.treeSearch(dt.root, tokens, 1)
+
+	isNew := false
+	if cluster == nil {
+		// Create new cluster
+		cluster, isNew = dt.createCluster(tokens, sample, timestamp)
+	} else {
+		// Update existing cluster
+		cluster = dt.updateCluster(cluster, tokens, sample, timestamp)
 	}
 
-	// Check against compiled patterns
-	for _, pattern := range dt.patterns {
-		if pattern.MatchString(token) {
-			return true
+	match := clusterMatch{cluster: cluster, id: cluster.ID, template: cluster.Template, names: cluster.names}
+	evicted, evictionFuncs := dt.takeEvicted()
+	events, eventFuncs := dt.takeEvents()
+	dt.mu.Unlock()
+
+	notifyEvicted(evicted, evictionFuncs)
+	notifyEvents(events, eventFuncs)
+	return match, isNew
+}
+
+// coversTokens reports whether template matches tokens without needing to
+// be generalized.
+func coversTokens(template, tokens []string) bool {
+	if len(template) != len(tokens) {
+		return false
+	}
+	for i := range template {
+		if template[i] != tokens[i] && template[i] != "<*>" {
+			return false
 		}
 	}
+	return true
+}
 
-	return false
+// preprocessTokens replaces obvious variables with placeholders.
+func (dt *DrainTree) preprocessTokens(tokens []string) []string {
+	result := make([]string, len(tokens))
+	for i, token := range tokens {
+		// Tokens spanning whitespace (quoted strings) are always variables,
+		// so templates can be split on single spaces
+		if strings.ContainsFunc(token, unicode.IsSpace) {
+			result[i] = Wildcard
+		} else if placeholder := dt.maskToken(token); placeholder != "" {
+			result[i] = placeholder
+		} else {
+			result[i] = token
+		}
+	}
+	return result
 }
 
 // treeSearch traverses the tree to find a matching cluster.
@@ -239,7 +342,9 @@ func (dt *DrainTree) treeSearch(node *ClusterNode, tokens []string, depth int) *
 	return dt.findBestMatch(node.Clusters, tokens)
 }
 
-// findBestMatch finds the best matching cluster from a list.
+// findBestMatch finds the best matching cluster from a list. Ties go to
+// the more specific template, and pinned clusters only match logs they
+// already cover.
 func (dt *DrainTree) findBestMatch(clusters []*LogCluster, tokens []string) *LogCluster {
 	var bestMatch *LogCluster
 	maxSim := 0.0
@@ -248,9 +353,15 @@ func (dt *DrainTree) findBestMatch(clusters []*LogCluster, tokens []string) *Log
 		if len(cluster.Tokens) != len(tokens) {
 			continue
 		}
+		if cluster.Pinned && !coversTokens(cluster.Tokens, tokens) {
+			continue
+		}
 
 		sim := dt.calculateSimilarity(cluster.Tokens, tokens)
-		if sim > maxSim && sim >= dt.simThreshold {
+		if sim < dt.simThreshold || sim < maxSim {
+			continue
+		}
+		if bestMatch == nil || sim > maxSim || wildcardCount(cluster.Tokens) < wildcardCount(bestMatch.Tokens) {
 			maxSim = sim
 			bestMatch = cluster
 		}
@@ -259,6 +370,17 @@ func (dt *DrainTree) findBestMatch(clusters []*LogCluster, tokens []string) *Log
 	return bestMatch
 }
 
+// wildcardCount returns the number of "<*>" tokens in a template.
+func wildcardCount(tokens []string) int {
+	n := 0
+	for _, token := range tokens {
+		if token == Wildcard {
+			n++
+		}
+	}
+	return n
+}
+
 // calculateSimilarity computes the similarity between template and log tokens.
 func (dt *DrainTree) calculateSimilarity(template, log []string) float64 {
 	if len(template) != len(log) {
@@ -275,9 +397,16 @@ func (dt *DrainTree) calculateSimilarity(template, log []string) float64 {
 	return float64(matches) / float64(len(template))
 }
 
-// createCluster creates a new log cluster.
-func (dt *DrainTree) createCluster(tokens []string, timestamp int64) *LogCluster {
+// createCluster creates a new log cluster. If a cluster with the same
+// template already exists elsewhere in the tree it is linked under this
+// path and updated instead, and false is returned.
+func (dt *DrainTree) createCluster(tokens []string, sample *sampleClaim, timestamp int64) (*LogCluster, bool) {
 	id := dt.generateClusterID(tokens)
+	if existing, exists := dt.clusters[id]; exists {
+		leaf := dt.addToTree(dt.root, existing, tokens, 1)
+		dt.enforceLeafLimit(leaf, existing)
+		return dt.updateCluster(existing, tokens, sample, timestamp), false
+	}
 	template := dt.createTemplate(tokens)
 
 	cluster := &LogCluster{
@@ -287,19 +416,34 @@ func (dt *DrainTree) createCluster(tokens []string, timestamp int64) *LogCluster
 		Size:       1,
 		FirstSeen:  timestamp,
 		LastSeen:   timestamp,
-		SampleLogs: make([]string, 0, 5),
+		SampleLogs: make([]string, 0, dt.maxSampleLogs),
 	}
 	copy(cluster.Tokens, tokens)
+	dt.refreshSlotNames(cluster)
+	dt.touch(cluster)
+	dt.sampleLog(cluster, sample)
 
 	dt.clusters[id] = cluster
-	dt.addToTree(dt.root, cluster, tokens, 1)
+	delete(dt.aliases, id)
+	delete(dt.retired, id)
+	dt.recordEvent(EventCreated, cluster, "", "")
+	leaf := dt.addToTree(dt.root, cluster, tokens, 1)
 
-	return cluster
+	dt.enforceLeafLimit(leaf, cluster)
+	dt.enforceTemplateLimit(cluster)
+
+	return cluster, true
 }
 
 // generateClusterID creates a unique ID for a cluster.
+// The ID is derived from the tree's source and the current template only,
+// so it does not depend on the order in which logs were seen.
 func (dt *DrainTree) generateClusterID(tokens []string) string {
 	h := fnv.New64a()
+	if dt.source != "" {
+		h.Write([]byte(dt.source))
+		h.Write([]byte{0})
+	}
 	h.Write([]byte(strings.Join(tokens, " ")))
 	return fmt.Sprintf("tmpl_%x", h.Sum64())
 }
@@ -309,11 +453,12 @@ func (dt *DrainTree) createTemplate(tokens []string) string {
 	return strings.Join(tokens, " ")
 }
 
-// addToTree adds a cluster to the tree.
-func (dt *DrainTree) addToTree(node *ClusterNode, cluster *LogCluster, tokens []string, depth int) {
+// addToTree adds a cluster to the tree and returns the leaf it was added to.
+// Once a node has MaxChildren children, further tokens share its "<*>"
+// child instead of adding new ones.
+func (dt *DrainTree) addToTree(node *ClusterNode, cluster *LogCluster, tokens []string, depth int) *ClusterNode {
 	if depth >= dt.maxDepth || depth > len(tokens) {
-		node.Clusters = append(node.Clusters, cluster)
-		return
+		return addToLeaf(node, cluster)
 	}
 
 	var key string
@@ -324,8 +469,11 @@ func (dt *DrainTree) addToTree(node *ClusterNode, cluster *LogCluster, tokens []
 		if tokenIdx < len(tokens) {
 			key = tokens[tokenIdx]
 		} else {
-			node.Clusters = append(node.Clusters, cluster)
-			return
+			return addToLeaf(node, cluster)
+		}
+
+		if _, exists := node.KeyToChildNode[key]; !exists && len(node.KeyToChildNode) >= dt.maxChildren {
+			key = "<*>"
 		}
 	}
 
@@ -338,45 +486,74 @@ func (dt *DrainTree) addToTree(node *ClusterNode, cluster *LogCluster, tokens []
 		node.KeyToChildNode[key] = childNode
 	}
 
-	dt.addToTree(childNode, cluster, tokens, depth+1)
+	return dt.addToTree(childNode, cluster, tokens, depth+1)
 }
 
-// updateCluster updates an existing cluster with a new log.
-func (dt *DrainTree) updateCluster(cluster *LogCluster, tokens []string, timestamp int64) {
+// addToLeaf appends cluster to a leaf node, recording the leaf on the
+// cluster so it can be unlinked later.
+func addToLeaf(leaf *ClusterNode, cluster *LogCluster) *ClusterNode {
+	leaf.Clusters = append(leaf.Clusters, cluster)
+	cluster.leaves = append(cluster.leaves, leaf)
+	return leaf
+}
+
+// updateCluster updates an existing cluster with a new log and returns the
+// cluster now holding it, which differs from the input if generalizing the
+// template merged it into another cluster. Tokens, Template, ID and Pinned
+// are only ever replaced here, in reidentify and by the admin operations,
+// with dt.mu held for writing, so
+// readers holding dt.mu.RLock may use them without the cluster lock.
+func (dt *DrainTree) updateCluster(cluster *LogCluster, tokens []string, sample *sampleClaim, timestamp int64) *LogCluster {
 	cluster.mu.Lock()
-	defer cluster.mu.Unlock()
 
 	cluster.Size++
-	cluster.LastSeen = timestamp
+	if timestamp > cluster.LastSeen {
+		cluster.LastSeen = timestamp
+	}
+	dt.touch(cluster)
+	dt.sampleLog(cluster, sample)
+	oldTemplate := cluster.Template
 
 	// Update template by generalizing differing positions
+	changed := false
 	newTokens := make([]string, len(cluster.Tokens))
 	for i := range cluster.Tokens {
 		if i < len(tokens) && cluster.Tokens[i] != tokens[i] {
 			newTokens[i] = "<*>"
+			changed = changed || cluster.Tokens[i] != "<*>"
 		} else {
 			newTokens[i] = cluster.Tokens[i]
 		}
 	}
 	cluster.Tokens = newTokens
 	cluster.Template = strings.Join(newTokens, " ")
+	if changed {
+		dt.refreshSlotNames(cluster)
+	}
+	cluster.mu.Unlock()
+
+	if !changed {
+		return cluster
+	}
+	return dt.reidentify(cluster, oldTemplate)
 }
 
-// extractVariables extracts variable values from a log using the template.
-func (dt *DrainTree) extractVariables(template, logContent string) map[string]string {
-	templateTokens := strings.Fields(template)
-	logTokens := strings.Fields(logContent)
+// extractVariables extracts variable values from a log using the slot
+// names of its template. Separators that differ from single spaces are
+// recorded under LayoutKey.
+func (dt *DrainTree) extractVariables(names, logTokens, separators []string) map[string]string {
 	variables := make(map[string]string)
 
-	varCounter := 0
-	for i, token := range templateTokens {
-		if token == "<*>" && i < len(logTokens) {
-			key := fmt.Sprintf("var_%d", varCounter)
-			variables[key] = logTokens[i]
-			varCounter++
+	for i, name := range names {
+		if name != "" && i < len(logTokens) {
+			variables[name] = logTokens[i]
 		}
 	}
 
+	if layout, ok := encodeLayout(separators); ok {
+		variables[LayoutKey] = layout
+	}
+
 	return variables
 }
 
@@ -385,6 +562,10 @@ func (dt *DrainTree) GetCluster(id string) (*LogCluster, bool) {
 	dt.mu.RLock()
 	defer dt.mu.RUnlock()
 
+	id, ok := dt.resolveID(id)
+	if !ok {
+		return nil, false
+	}
 	cluster, exists := dt.clusters[id]
 	return cluster, exists
 }
@@ -413,6 +594,8 @@ type Stats struct {
 	TotalClusters int
 	TotalLogs     int64
 	AverageSize   float64
+	Evictions     int64 // Clusters evicted since the tree was created
+	MemoryBytes   int64 // Approximate memory held by the tree
 }
 
 // GetStats returns statistics about the drain tree.
@@ -422,7 +605,9 @@ func (dt *DrainTree) GetStats() Stats {
 
 	var totalLogs int64
 	for _, cluster := range dt.clusters {
+		cluster.mu.Lock()
 		totalLogs += cluster.Size
+		cluster.mu.Unlock()
 	}
 
 	avgSize := 0.0
@@ -434,5 +619,7 @@ func (dt *DrainTree) GetStats() Stats {
 		TotalClusters: len(dt.clusters),
 		TotalLogs:     totalLogs,
 		AverageSize:   avgSize,
+		Evictions:     dt.evictions,
+		MemoryBytes:   dt.memoryUsage(),
 	}
 }
@@ -1,6 +1,11 @@
 package drain
 
 import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -131,6 +136,451 @@ func TestDrainTree_Stats(t *testing.T) {
 	}
 }
 
+func TestDrainTree_SnapshotRestore(t *testing.T) {
+	config := DefaultConfig()
+	dt := NewDrainTree(config)
+	timestamp := time.Now().UnixNano()
+
+	logs := []string{
+		"Error code 500 at 192.168.1.1",
+		"Error code 404 at 10.0.0.1",
+		"Server started on port 8080",
+	}
+	ids := make([]string, len(logs))
+	for i, log := range logs {
+		result, err := dt.Parse(log, timestamp)
+		if err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+		ids[i] = result.TemplateID
+	}
+
+	path := filepath.Join(t.TempDir(), "drain.snapshot")
+	if err := dt.SaveSnapshot(path); err != nil {
+		t.Fatalf("SaveSnapshot failed: %v", err)
+	}
+
+	restored := NewDrainTree(config)
+	if err := restored.LoadSnapshot(path); err != nil {
+		t.Fatalf("LoadSnapshot failed: %v", err)
+	}
+
+	if restored.ClusterCount() != dt.ClusterCount() {
+		t.Errorf("Expected %d clusters after restore, got %d", dt.ClusterCount(), restored.ClusterCount())
+	}
+	if restored.GetStats().TotalLogs != dt.GetStats().TotalLogs {
+		t.Errorf("Expected %d total logs after restore, got %d", dt.GetStats().TotalLogs, restored.GetStats().TotalLogs)
+	}
+
+	for i, log := range logs {
+		result, err := restored.Parse(log, timestamp)
+		if err != nil {
+			t.Fatalf("Parse after restore failed: %v", err)
+		}
+		if result.IsNew {
+			t.Errorf("Log %d: expected existing template after restore", i)
+		}
+		if result.TemplateID != ids[i] {
+			t.Errorf("Log %d: expected template ID %s, got %s", i, ids[i], result.TemplateID)
+		}
+	}
+}
+
+func TestDrainTree_RestoreRebuildsOnDepthChange(t *testing.T) {
+	dt := NewDrainTree(DefaultConfig())
+	timestamp := time.Now().UnixNano()
+
+	first, err := dt.Parse("Connection timeout after 30 seconds from 10.0.0.5", timestamp)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	config := DefaultConfig()
+	config.MaxDepth = 6
+	restored := NewDrainTree(config)
+	if err := restored.Restore(dt.Snapshot()); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+
+	result, err := restored.Parse("Connection timeout after 45 seconds from 10.0.0.9", timestamp)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if result.TemplateID != first.TemplateID {
+		t.Errorf("Expected template ID %s, got %s", first.TemplateID, result.TemplateID)
+	}
+}
+
+func TestDrainTree_RestoreRejectsUnknownVersion(t *testing.T) {
+	dt := NewDrainTree(DefaultConfig())
+	snap := dt.Snapshot()
+	snap.Version = SnapshotVersion + 1
+
+	if err := dt.Restore(snap); err == nil {
+		t.Error("Expected error restoring unsupported snapshot version")
+	}
+}
+
+func TestDrainTree_RestoreUpgradesVersion1IDs(t *testing.T) {
+	dt := NewDrainTree(DefaultConfig())
+	timestamp := time.Now().UnixNano()
+
+	first, err := dt.Parse("Disk full on volume data", timestamp)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	// Version 1 snapshots carry IDs from an older scheme, and may hold
+	// the same template twice
+	snap := dt.Snapshot()
+	snap.Version = 1
+	duplicate := *snap.Clusters[0]
+	snap.Clusters[0].ID = "cluster_1"
+	duplicate.ID = "cluster_2"
+	duplicate.Size = 4
+	snap.Clusters = append(snap.Clusters, &duplicate)
+	snap.Root = nil
+
+	restored := NewDrainTree(DefaultConfig())
+	if err := restored.Restore(snap); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if restored.ClusterCount() != 1 {
+		t.Fatalf("Expected 1 cluster, got %d", restored.ClusterCount())
+	}
+	for _, oldID := range []string{"cluster_1", "cluster_2"} {
+		cluster, ok := restored.GetCluster(oldID)
+		if !ok || cluster.ID != first.TemplateID {
+			t.Errorf("Expected %s to resolve to %s, got %v", oldID, first.TemplateID, cluster)
+		}
+	}
+	if cluster, _ := restored.GetCluster(first.TemplateID); cluster.Info().Size != 5 {
+		t.Errorf("Expected merged size 5, got %d", cluster.Info().Size)
+	}
+
+	result, err := restored.Parse("Disk full on volume data", timestamp)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if result.TemplateID != first.TemplateID || result.IsNew {
+		t.Errorf("Expected existing template %s, got %s (new %v)", first.TemplateID, result.TemplateID, result.IsNew)
+	}
+}
+
+func TestDrainTree_RestoreRejectsIncompatibleConfig(t *testing.T) {
+	dt := NewDrainTree(DefaultConfig())
+	if _, err := dt.Parse("Error code 500 at 192.168.1.1", time.Now().UnixNano()); err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	snap := dt.Snapshot()
+
+	threshold := DefaultConfig()
+	threshold.SimThreshold = 0.7
+	children := DefaultConfig()
+	children.MaxChildren = 10
+	masking := DefaultConfig()
+	masking.MaskingRules = []MaskingRule{{Name: "ORDER", Pattern: `^ord-\d+$`}}
+
+	for name, config := range map[string]Config{
+		"similarity threshold": threshold,
+		"max children":         children,
+		"masking rules":        masking,
+	} {
+		if err := NewDrainTree(config).Restore(snap); err == nil {
+			t.Errorf("Expected error restoring snapshot with different %s", name)
+		}
+	}
+}
+
+func TestDrainTree_TemplateIDOrderIndependent(t *testing.T) {
+	logs := []string{
+		"Job finished with status ok",
+		"Job finished with status failed",
+	}
+	timestamp := time.Now().UnixNano()
+
+	forward := NewDrainTree(DefaultConfig())
+	var forwardFirst, forwardLast *ParseResult
+	for i, log := range logs {
+		result, err := forward.Parse(log, timestamp)
+		if err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+		if i == 0 {
+			forwardFirst = result
+		}
+		forwardLast = result
+	}
+
+	reverse := NewDrainTree(DefaultConfig())
+	var reverseLast *ParseResult
+	for i := len(logs) - 1; i >= 0; i-- {
+		result, err := reverse.Parse(logs[i], timestamp)
+		if err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+		reverseLast = result
+	}
+
+	if forwardLast.TemplateID != reverseLast.TemplateID {
+		t.Errorf("Expected same template ID for both orders, got %s and %s", forwardLast.TemplateID, reverseLast.TemplateID)
+	}
+
+	current, ok := forward.ResolveID(forwardFirst.TemplateID)
+	if !ok || current != forwardLast.TemplateID {
+		t.Errorf("Expected retired ID %s to resolve to %s, got %s", forwardFirst.TemplateID, forwardLast.TemplateID, current)
+	}
+	if mapped := forward.IDMappings()[forwardFirst.TemplateID]; mapped != forwardLast.TemplateID {
+		t.Errorf("Expected mapping for %s to be %s, got %s", forwardFirst.TemplateID, forwardLast.TemplateID, mapped)
+	}
+	if _, ok := forward.GetCluster(forwardFirst.TemplateID); !ok {
+		t.Error("Expected GetCluster to resolve retired ID")
+	}
+}
+
+func TestDrainTree_ReconstructRoundTrip(t *testing.T) {
+	dt := NewDrainTree(DefaultConfig())
+	timestamp := time.Now().UnixNano()
+
+	logs := []string{
+		"Error code 500 at 192.168.1.1",
+		"Error  code 404\tat 10.0.0.1, retrying",
+		"  Server started on port 8080\n",
+		"Job finished with status ok",
+		"Job finished with status failed",
+	}
+
+	for _, log := range logs {
+		result, err := dt.Parse(log, timestamp)
+		if err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+
+		raw, err := Reconstruct(result.Template, result.Variables)
+		if err != nil {
+			t.Fatalf("Reconstruct failed: %v", err)
+		}
+		if raw != log {
+			t.Errorf("Round trip mismatch: want %q, got %q", log, raw)
+		}
+
+		raw, err = dt.ReconstructLog(result.TemplateID, result.Variables)
+		if err != nil {
+			t.Fatalf("ReconstructLog failed: %v", err)
+		}
+		if raw != log {
+			t.Errorf("Round trip by ID mismatch: want %q, got %q", log, raw)
+		}
+	}
+}
+
+func TestDrainTree_ReconstructRetiredTemplate(t *testing.T) {
+	dt := NewDrainTree(DefaultConfig())
+	timestamp := time.Now().UnixNano()
+
+	first, err := dt.Parse("Job finished with status ok", timestamp)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if _, err := dt.Parse("Job finished with status failed", timestamp); err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	raw, err := dt.ReconstructLog(first.TemplateID, first.Variables)
+	if err != nil {
+		t.Fatalf("ReconstructLog failed: %v", err)
+	}
+	if raw != "Job finished with status ok" {
+		t.Errorf("Expected original line from retired template, got %q", raw)
+	}
+}
+
+func TestReconstruct_MissingVariable(t *testing.T) {
+	if _, err := Reconstruct("Error code <*> at <*>", map[string]string{"var_0": "500"}); err == nil {
+		t.Error("Expected error for missing variable")
+	}
+}
+
+func TestDefaultTokenizer(t *testing.T) {
+	tests := []struct {
+		name      string
+		tokenizer DefaultTokenizer
+		input     string
+		want      []string
+	}{
+		{
+			name:  "Whitespace only",
+			input: "Error connecting to db:5432",
+			want:  []string{"Error", "connecting", "to", "db:5432"},
+		},
+		{
+			name:      "Extra delimiters",
+			tokenizer: DefaultTokenizer{ExtraDelimiters: "=:[]"},
+			input:     "[worker-1] user=alice host=db:5432",
+			want:      []string{"worker-1", "user", "alice", "host", "db", "5432"},
+		},
+		{
+			name:      "Quoted strings",
+			tokenizer: DefaultTokenizer{QuotedStrings: true},
+			input:     `Query "SELECT * FROM users" took 5ms`,
+			want:      []string{"Query", `"SELECT * FROM users"`, "took", "5ms"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, separators := tt.tokenizer.Tokenize(tt.input)
+			if len(tokens) != len(tt.want) {
+				t.Fatalf("Expected tokens %q, got %q", tt.want, tokens)
+			}
+			for i := range tokens {
+				if tokens[i] != tt.want[i] {
+					t.Errorf("Token %d: expected %q, got %q", i, tt.want[i], tokens[i])
+				}
+			}
+			if len(separators) != len(tokens)+1 {
+				t.Fatalf("Expected %d separators, got %d", len(tokens)+1, len(separators))
+			}
+
+			rebuilt := ""
+			for i, token := range tokens {
+				rebuilt += separators[i] + token
+			}
+			rebuilt += separators[len(tokens)]
+			if rebuilt != tt.input {
+				t.Errorf("Expected tokens and separators to rebuild %q, got %q", tt.input, rebuilt)
+			}
+		})
+	}
+}
+
+func TestDrainTree_ExtraDelimiterGroupsKeyValues(t *testing.T) {
+	config := DefaultConfig()
+	config.ExtraDelimiter = "=:"
+	dt := NewDrainTree(config)
+	timestamp := time.Now().UnixNano()
+
+	first, err := dt.Parse("connect host=10.0.0.1:5432 retries=3", timestamp)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	second, err := dt.Parse("connect host=10.0.0.2:6432 retries=5", timestamp)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	if second.IsNew || second.TemplateID != first.TemplateID {
+		t.Errorf("Expected key=value logs to share a template, got %q and %q", first.Template, second.Template)
+	}
+
+	raw, err := Reconstruct(second.Template, second.Variables)
+	if err != nil {
+		t.Fatalf("Reconstruct failed: %v", err)
+	}
+	if raw != "connect host=10.0.0.2:6432 retries=5" {
+		t.Errorf("Unexpected reconstruction %q", raw)
+	}
+}
+
+func TestDrainTree_HeaderPattern(t *testing.T) {
+	config := DefaultConfig()
+	config.HeaderPattern = `(?P<timestamp>\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}) (?P<level>[A-Z]+) \[(?P<logger>[^\]]+)\] `
+	dt := NewDrainTree(config)
+	timestamp := time.Now().UnixNano()
+
+	line := "2024-01-15 10:30:00 ERROR [db.pool] Connection refused"
+	first, err := dt.Parse(line, timestamp)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	second, err := dt.Parse("2024-01-15 10:31:07 ERROR [db.pool] Connection refused", timestamp)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	if first.Template != "Connection refused" {
+		t.Errorf("Expected header to be stripped from template, got %q", first.Template)
+	}
+	if second.IsNew {
+		t.Error("Expected lines differing only in header to share a template")
+	}
+	if first.Fields["level"] != "ERROR" || first.Fields["logger"] != "db.pool" || first.Fields["timestamp"] != "2024-01-15 10:30:00" {
+		t.Errorf("Unexpected header fields: %v", first.Fields)
+	}
+
+	raw, err := Reconstruct(first.Template, first.Variables)
+	if err != nil {
+		t.Fatalf("Reconstruct failed: %v", err)
+	}
+	if raw != line {
+		t.Errorf("Expected %q, got %q", line, raw)
+	}
+}
+
+func TestDrainTree_TypedPlaceholders(t *testing.T) {
+	dt := NewDrainTree(DefaultConfig())
+	timestamp := time.Now().UnixNano()
+
+	result, err := dt.Parse("Error code 500 at 192.168.1.1", timestamp)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	if result.Template != "Error code <NUM> at <IP>" {
+		t.Errorf("Expected typed template, got %q", result.Template)
+	}
+	if result.Variables["code"] != "500" || result.Variables["ip_0"] != "192.168.1.1" {
+		t.Errorf("Expected variables keyed by name or type, got %v", result.Variables)
+	}
+}
+
+func TestDrainTree_CustomMaskingRules(t *testing.T) {
+	config := DefaultConfig()
+	config.MaskingRules = []MaskingRule{
+		{Name: "ORDER", Pattern: `^ORD-[A-Z0-9]+$`},
+		{Name: "POD", Pattern: `^[a-z]+(-[a-z0-9]+)*-[a-z0-9]{5,10}-[a-z0-9]{5}$`},
+	}
+	dt := NewDrainTree(config)
+	timestamp := time.Now().UnixNano()
+
+	first, err := dt.Parse("Order ORD-7F3K2 shipped from api-7d9f8b6c4-xk2p9", timestamp)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	second, err := dt.Parse("Order ORD-A1B2C shipped from api-5c6d7e8f9-ab3cd", timestamp)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	if first.Template != "Order <ORDER> shipped from <POD>" {
+		t.Errorf("Expected custom placeholders, got %q", first.Template)
+	}
+	if second.IsNew {
+		t.Error("Expected masked logs to share a template")
+	}
+	if second.Variables["order"] != "ORD-A1B2C" || second.Variables["pod_0"] != "api-5c6d7e8f9-ab3cd" {
+		t.Errorf("Expected variables keyed by name or custom type, got %v", second.Variables)
+	}
+
+	raw, err := Reconstruct(second.Template, second.Variables)
+	if err != nil {
+		t.Fatalf("Reconstruct failed: %v", err)
+	}
+	if raw != "Order ORD-A1B2C shipped from api-5c6d7e8f9-ab3cd" {
+		t.Errorf("Unexpected reconstruction %q", raw)
+	}
+}
+
+func TestReconstruct_LiteralPlaceholderSyntax(t *testing.T) {
+	raw, err := Reconstruct("Rendered <html> in <NUM> ms", map[string]string{"num_0": "12"})
+	if err != nil {
+		t.Fatalf("Reconstruct failed: %v", err)
+	}
+	if raw != "Rendered <html> in 12 ms" {
+		t.Errorf("Unexpected reconstruction %q", raw)
+	}
+}
+
 func BenchmarkDrainTree_Parse(b *testing.B) {
 	config := DefaultConfig()
 	dt := NewDrainTree(config)
@@ -170,3 +620,761 @@ func BenchmarkDrainTree_ParseParallel(b *testing.B) {
 		}
 	})
 }
+
+func TestDrainTree_LeafEvictionLRU(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxClusters = 2
+	dt := NewDrainTree(config)
+	timestamp := time.Now().UnixNano()
+
+	var evicted []string
+	dt.OnEvict(func(cluster ClusterInfo) {
+		evicted = append(evicted, cluster.Template)
+	})
+
+	// All share length and leading tokens, so they land in the same leaf
+	logs := []string{
+		"cache miss alpha beta gamma",
+		"cache miss delta epsilon zeta",
+		"cache miss alpha beta gamma",
+		"cache miss eta theta iota",
+	}
+	for _, log := range logs {
+		if _, err := dt.Parse(log, timestamp); err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+	}
+
+	if dt.ClusterCount() != 2 {
+		t.Errorf("Expected 2 clusters after eviction, got %d", dt.ClusterCount())
+	}
+	if len(evicted) != 1 || evicted[0] != "cache miss delta epsilon zeta" {
+		t.Errorf("Expected least recently used template to be evicted, got %v", evicted)
+	}
+	if stats := dt.GetStats(); stats.Evictions != 1 {
+		t.Errorf("Expected 1 eviction in stats, got %d", stats.Evictions)
+	}
+}
+
+func TestDrainTree_TemplateLimitLFU(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxTemplates = 2
+	config.Eviction = EvictLFU
+	dt := NewDrainTree(config)
+	timestamp := time.Now().UnixNano()
+
+	for i := 0; i < 3; i++ {
+		dt.Parse("Server started", timestamp)
+	}
+	dt.Parse("Disk full on volume data", timestamp)
+	dt.Parse("Shutdown requested by operator", timestamp)
+
+	if dt.ClusterCount() != 2 {
+		t.Fatalf("Expected 2 clusters, got %d", dt.ClusterCount())
+	}
+	for _, cluster := range dt.GetAllClusters() {
+		if cluster.Template == "Disk full on volume data" {
+			t.Error("Expected least frequently used template to be evicted")
+		}
+	}
+}
+
+func TestDrainTree_MaxChildrenWildcard(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxChildren = 2
+	dt := NewDrainTree(config)
+	timestamp := time.Now().UnixNano()
+
+	for _, log := range []string{"alpha started", "beta started", "gamma started", "delta started"} {
+		if _, err := dt.Parse(log, timestamp); err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+	}
+
+	lengthNode := dt.root.KeyToChildNode["len_2"]
+	if lengthNode == nil {
+		t.Fatal("Expected length node")
+	}
+	if len(lengthNode.KeyToChildNode) > config.MaxChildren+1 {
+		t.Errorf("Expected at most %d children, got %d", config.MaxChildren+1, len(lengthNode.KeyToChildNode))
+	}
+	if _, ok := lengthNode.KeyToChildNode["<*>"]; !ok {
+		t.Error("Expected overflowing tokens to share the wildcard child")
+	}
+
+	if stats := dt.GetStats(); stats.MemoryBytes <= 0 {
+		t.Errorf("Expected positive memory estimate, got %d", stats.MemoryBytes)
+	}
+}
+
+func TestDrainTree_ConcurrentParse(t *testing.T) {
+	dt := NewDrainTree(DefaultConfig())
+	timestamp := time.Now().UnixNano()
+	logs := benchmarkLogs(200)
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				if _, err := dt.Parse(logs[(w+i)%len(logs)], timestamp); err != nil {
+					t.Errorf("Parse failed: %v", err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if stats := dt.GetStats(); stats.TotalLogs != 8*500 {
+		t.Errorf("Expected %d total logs, got %d", 8*500, stats.TotalLogs)
+	}
+}
+
+func TestDrainTree_SampleLogs(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxSampleLogs = 3
+	config.RedactSample = func(line string) string {
+		return strings.ReplaceAll(line, "secret", "[REDACTED]")
+	}
+	dt := NewDrainTree(config)
+	timestamp := time.Now().UnixNano()
+
+	var result *ParseResult
+	for i := 0; i < 100; i++ {
+		var err error
+		result, err = dt.Parse(fmt.Sprintf("User %d logged in with token secret", i), timestamp)
+		if err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+	}
+
+	cluster, ok := dt.GetCluster(result.TemplateID)
+	if !ok {
+		t.Fatalf("Cluster %s not found", result.TemplateID)
+	}
+	info := cluster.Info()
+	if info.Size != 100 {
+		t.Errorf("Expected 100 logs, got %d", info.Size)
+	}
+	if len(info.SampleLogs) != 3 {
+		t.Fatalf("Expected 3 samples, got %d", len(info.SampleLogs))
+	}
+	for _, sample := range info.SampleLogs {
+		if !strings.HasPrefix(sample, "User ") || !strings.HasSuffix(sample, "[REDACTED]") {
+			t.Errorf("Unexpected sample %q", sample)
+		}
+	}
+
+	restored := NewDrainTree(config)
+	if err := restored.Restore(dt.Snapshot()); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	restoredCluster, _ := restored.GetCluster(result.TemplateID)
+	if got := restoredCluster.Samples(); len(got) != 3 {
+		t.Errorf("Expected 3 restored samples, got %d", len(got))
+	}
+}
+
+func TestDrainTree_RedactSampleWithoutLocks(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxSampleLogs = 2
+	var dt *DrainTree
+	redactions := 0
+	config.RedactSample = func(line string) string {
+		redactions++
+		if !dt.mu.TryLock() {
+			t.Error("Expected the tree lock to be free while redacting")
+		} else {
+			dt.mu.Unlock()
+		}
+		for _, cluster := range dt.GetAllClusters() {
+			if !cluster.mu.TryLock() {
+				t.Error("Expected cluster locks to be free while redacting")
+			} else {
+				cluster.mu.Unlock()
+			}
+		}
+		return strings.ReplaceAll(line, "secret", "[REDACTED]")
+	}
+	dt = NewDrainTree(config)
+
+	// A new cluster, a generalized one and plain matches
+	for i := 0; i < 50; i++ {
+		if _, err := dt.Parse(fmt.Sprintf("Token secret issued to user%d", i), 0); err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+	}
+	if redactions < 2 {
+		t.Errorf("Expected at least 2 redactions, got %d", redactions)
+	}
+	for _, cluster := range dt.GetAllClusters() {
+		for _, sample := range cluster.Samples() {
+			if strings.Contains(sample, "secret") {
+				t.Errorf("Unexpected unredacted sample %q", sample)
+			}
+		}
+		if cluster.pendingSamples != 0 {
+			t.Errorf("Expected no pending samples, got %d", cluster.pendingSamples)
+		}
+	}
+}
+
+func TestDrainTree_MergeClusters(t *testing.T) {
+	dt := NewDrainTree(DefaultConfig())
+	timestamp := time.Now().UnixNano()
+
+	started, _ := dt.Parse("Worker alpha started", timestamp)
+	stopped, _ := dt.Parse("Worker beta started", timestamp)
+	if started.TemplateID == stopped.TemplateID {
+		t.Fatalf("Expected two templates before merge")
+	}
+
+	merged, err := dt.MergeClusters([]string{started.TemplateID, stopped.TemplateID})
+	if err != nil {
+		t.Fatalf("MergeClusters failed: %v", err)
+	}
+	if merged.Template != "Worker <*> started" {
+		t.Errorf("Expected merged template %q, got %q", "Worker <*> started", merged.Template)
+	}
+	if merged.Size != 2 {
+		t.Errorf("Expected merged size 2, got %d", merged.Size)
+	}
+	for _, id := range []string{started.TemplateID, stopped.TemplateID} {
+		if current, ok := dt.ResolveID(id); !ok || current != merged.ID {
+			t.Errorf("Expected %s to resolve to %s, got %s", id, merged.ID, current)
+		}
+	}
+
+	result, err := dt.Parse("Worker beta started", timestamp)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if result.TemplateID != merged.ID {
+		t.Errorf("Expected log to match merged template %s, got %s", merged.ID, result.TemplateID)
+	}
+
+	if _, err := dt.MergeClusters([]string{merged.ID}); err == nil {
+		t.Error("Expected error merging a single template")
+	}
+}
+
+func TestDrainTree_SplitCluster(t *testing.T) {
+	dt := NewDrainTree(DefaultConfig())
+	timestamp := time.Now().UnixNano()
+
+	dt.Parse("Cache lookup hit for key", timestamp)
+	result, _ := dt.Parse("Cache lookup miss for key", timestamp)
+	if result.Template != "Cache lookup <*> for key" {
+		t.Fatalf("Unexpected template %q", result.Template)
+	}
+
+	if _, err := dt.SplitCluster(result.TemplateID, 0, "Cache", timestamp); err == nil {
+		t.Error("Expected error splitting on a literal position")
+	}
+
+	split, err := dt.SplitCluster(result.TemplateID, 2, "miss", timestamp)
+	if err != nil {
+		t.Fatalf("SplitCluster failed: %v", err)
+	}
+	if split.Template != "Cache lookup miss for key" {
+		t.Errorf("Unexpected split template %q", split.Template)
+	}
+	if len(split.Samples()) != 1 {
+		t.Errorf("Expected the matching sample to move, got %v", split.Samples())
+	}
+
+	miss, _ := dt.Parse("Cache lookup miss for key", timestamp)
+	if miss.TemplateID != split.ID {
+		t.Errorf("Expected miss to match split template %s, got %s", split.ID, miss.TemplateID)
+	}
+	hit, _ := dt.Parse("Cache lookup hit for key", timestamp)
+	if hit.TemplateID != result.TemplateID {
+		t.Errorf("Expected hit to match original template %s, got %s", result.TemplateID, hit.TemplateID)
+	}
+}
+
+func TestDrainTree_SplitClusterEnforcesTemplateLimit(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxTemplates = 2
+	dt := NewDrainTree(config)
+	timestamp := time.Now().UnixNano()
+
+	dt.Parse("Cache lookup hit for key", timestamp)
+	result, _ := dt.Parse("Cache lookup miss for key", timestamp)
+	dt.Parse("Worker pool resized", timestamp)
+
+	split, err := dt.SplitCluster(result.TemplateID, 2, "miss", timestamp)
+	if err != nil {
+		t.Fatalf("SplitCluster failed: %v", err)
+	}
+	if count := dt.ClusterCount(); count != 2 {
+		t.Errorf("Expected 2 clusters after split, got %d", count)
+	}
+	if _, ok := dt.GetCluster(split.ID); !ok {
+		t.Error("Expected the split template to survive eviction")
+	}
+}
+
+func TestDrainTree_PinCluster(t *testing.T) {
+	dt := NewDrainTree(DefaultConfig())
+	timestamp := time.Now().UnixNano()
+
+	first, _ := dt.Parse("Backup job finished for volume", timestamp)
+	if _, err := dt.PinCluster(first.TemplateID, true); err != nil {
+		t.Fatalf("PinCluster failed: %v", err)
+	}
+
+	second, _ := dt.Parse("Backup job failed for volume", timestamp)
+	if !second.IsNew || second.TemplateID == first.TemplateID {
+		t.Error("Expected pinned template not to be generalized")
+	}
+	if cluster, _ := dt.GetCluster(first.TemplateID); cluster.Template != "Backup job finished for volume" {
+		t.Errorf("Pinned template changed to %q", cluster.Template)
+	}
+
+	restored := NewDrainTree(DefaultConfig())
+	if err := restored.Restore(dt.Snapshot()); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if cluster, _ := restored.GetCluster(first.TemplateID); !cluster.Info().Pinned {
+		t.Error("Expected pin to survive snapshot")
+	}
+}
+
+func TestRegistry_SourceIsolation(t *testing.T) {
+	registry := NewRegistry(DefaultConfig(), map[string]SourceConfig{
+		"strict": {SimThreshold: 0.95},
+	})
+	timestamp := time.Now().UnixNano()
+
+	logs := []string{
+		"Job finished with status ok",
+		"Job finished with status failed",
+	}
+	for _, log := range logs {
+		if _, err := registry.Parse("api", log, timestamp); err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+	}
+
+	// The same line from another source must not reuse the api cluster
+	result, err := registry.Parse("worker", logs[0], timestamp)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if !result.IsNew || result.Template != logs[0] {
+		t.Errorf("Expected a fresh template for worker, got %q (new=%v)", result.Template, result.IsNew)
+	}
+
+	// The strict source does not generalize at the default threshold
+	for _, log := range logs {
+		registry.Parse("strict", log, timestamp)
+	}
+	if count := registry.Tree("strict").ClusterCount(); count != 2 {
+		t.Errorf("Expected 2 clusters for strict source, got %d", count)
+	}
+
+	registry.Parse("", logs[0], timestamp)
+	if sources := registry.Sources(); fmt.Sprint(sources) != "[api default strict worker]" {
+		t.Errorf("Unexpected sources %v", sources)
+	}
+
+	stats := registry.GetStats()
+	if stats.TotalLogs != 6 {
+		t.Errorf("Expected 6 total logs, got %d", stats.TotalLogs)
+	}
+	if stats.TotalClusters != 5 {
+		t.Errorf("Expected 5 total clusters, got %d", stats.TotalClusters)
+	}
+	if bySource := registry.StatsBySource(); bySource["api"].TotalLogs != 2 {
+		t.Errorf("Expected 2 logs for api, got %d", bySource["api"].TotalLogs)
+	}
+
+	// Equal templates in different sources get different IDs
+	twin, _ := registry.Parse("worker", logs[1], timestamp)
+	api, _ := registry.Parse("api", logs[1], timestamp)
+	if twin.Template != api.Template || twin.TemplateID == api.TemplateID {
+		t.Errorf("Expected distinct IDs for %q in api and worker, got %s and %s", twin.Template, api.TemplateID, twin.TemplateID)
+	}
+	if source, _, ok := registry.FindCluster(twin.TemplateID); !ok || source != "worker" {
+		t.Errorf("Expected template %s in source worker, got %q", twin.TemplateID, source)
+	}
+}
+
+func TestRegistry_SnapshotRestore(t *testing.T) {
+	registry := NewRegistry(DefaultConfig(), nil)
+	timestamp := time.Now().UnixNano()
+
+	api, _ := registry.Parse("api", "Request served in 12 ms", timestamp)
+	registry.Parse("worker", "Task queued for retry", timestamp)
+
+	path := filepath.Join(t.TempDir(), "drain.snapshot")
+	if err := registry.SaveSnapshot(path); err != nil {
+		t.Fatalf("SaveSnapshot failed: %v", err)
+	}
+
+	restored := NewRegistry(DefaultConfig(), nil)
+	if err := restored.LoadSnapshot(path); err != nil {
+		t.Fatalf("LoadSnapshot failed: %v", err)
+	}
+	if restored.ClusterCount() != 2 {
+		t.Errorf("Expected 2 clusters after restore, got %d", restored.ClusterCount())
+	}
+	if source, _, ok := restored.FindCluster(api.TemplateID); !ok || source != "api" {
+		t.Errorf("Expected template %s in source api, got %q", api.TemplateID, source)
+	}
+
+	// A single-tree snapshot is loaded into the default source
+	single := NewDrainTree(DefaultConfig())
+	single.Parse("Request served in 12 ms", timestamp)
+	if err := single.SaveSnapshot(path); err != nil {
+		t.Fatalf("SaveSnapshot failed: %v", err)
+	}
+	legacy := NewRegistry(DefaultConfig(), nil)
+	if err := legacy.LoadSnapshot(path); err != nil {
+		t.Fatalf("LoadSnapshot of single tree failed: %v", err)
+	}
+	if tree, ok := legacy.Lookup(DefaultSource); !ok || tree.ClusterCount() != 1 {
+		t.Error("Expected single-tree snapshot in the default source")
+	}
+}
+
+func TestReconstruct_MultilineEvent(t *testing.T) {
+	dt := NewDrainTree(DefaultConfig())
+	timestamp := time.Now().UnixNano()
+
+	head := "ERROR  Request failed"
+	body := "java.lang.IllegalStateException: boom\n\tat com.example.Service.handle(Service.java:42)"
+	signature := []string{"java.lang.IllegalStateException", "com.example.Service.handle"}
+
+	result, err := dt.Parse(head+" "+strings.Join(signature, " "), timestamp)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	result.Variables[BodyKey] = body
+	result.Variables[SignatureKey] = fmt.Sprint(len(signature))
+
+	got, err := Reconstruct(result.Template, result.Variables)
+	if err != nil {
+		t.Fatalf("Reconstruct failed: %v", err)
+	}
+	if want := head + "\n" + body; got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+
+	result.Variables[SignatureKey] = "99"
+	if _, err := Reconstruct(result.Template, result.Variables); err == nil {
+		t.Error("Expected error for signature longer than the template")
+	}
+}
+
+// benchmarkLogs returns n log lines drawn from a handful of templates.
+func benchmarkLogs(n int) []string {
+	formats := []string{
+		"Error connecting to database at 192.168.1.%d:5432",
+		"Request processed in %dms for user abc123",
+		"Memory usage at %d%% on node server-01",
+		"Connection timeout after %ds from 10.0.0.5",
+		"User login succeeded for session %d",
+	}
+	logs := make([]string, n)
+	for i := range logs {
+		logs[i] = fmt.Sprintf(formats[i%len(formats)], i)
+	}
+	return logs
+}
+
+// BenchmarkDrainTree_ParseWorkers measures throughput as the number of
+// concurrent workers grows, as in pipeline.WorkerPool.
+func BenchmarkDrainTree_ParseWorkers(b *testing.B) {
+	logs := benchmarkLogs(1000)
+
+	for _, workers := range []int{1, 2, 4, 8, 16, 32, 100} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			dt := NewDrainTree(DefaultConfig())
+			timestamp := time.Now().UnixNano()
+			for _, log := range logs {
+				dt.Parse(log, timestamp)
+			}
+
+			var next atomic.Int64
+			var wg sync.WaitGroup
+
+			b.ResetTimer()
+			for w := 0; w < workers; w++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						i := next.Add(1) - 1
+						if i >= int64(b.N) {
+							return
+						}
+						dt.Parse(logs[i%int64(len(logs))], timestamp)
+					}
+				}()
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func TestDrainTree_SlotTypes(t *testing.T) {
+	dt := NewDrainTree(DefaultConfig())
+	timestamp := time.Now().UnixNano()
+
+	var result *ParseResult
+	for i := 0; i < 40; i++ {
+		modes := []string{"hot", "cold"}
+		line := fmt.Sprintf("Query %d took %dms mode %s user u%d", i, 10+i, modes[i%2], i)
+		var err error
+		if result, err = dt.Parse(line, timestamp); err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+	}
+
+	if result.Template != "Query <NUM> took <*> mode <*> user <*>" {
+		t.Fatalf("Unexpected template %q", result.Template)
+	}
+	want := map[string]SlotType{
+		"query": SlotInt,
+		"took":  SlotDuration,
+		"mode":  SlotEnum,
+		"user":  SlotString,
+	}
+	for key, slotType := range want {
+		if result.Types[key] != slotType {
+			t.Errorf("Slot %s: expected %s, got %s", key, slotType, result.Types[key])
+		}
+	}
+
+	numeric := NumericVariables(result.Variables)
+	if numeric["query"] != 39 || numeric["took"] != 49 || len(numeric) != 2 {
+		t.Errorf("Unexpected numeric variables %v", numeric)
+	}
+
+	restored := NewDrainTree(DefaultConfig())
+	if err := restored.Restore(dt.Snapshot()); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	schema, ok := restored.Schema(result.TemplateID)
+	if !ok {
+		t.Fatal("Expected schema for restored template")
+	}
+	for key, slotType := range want {
+		if schema[key] != slotType {
+			t.Errorf("Restored slot %s: expected %s, got %s", key, slotType, schema[key])
+		}
+	}
+}
+
+func TestNumericVariables_IgnoresSlotTypes(t *testing.T) {
+	// A slot whose other values are words still stores the numbers, so a
+	// range filter finds them before and after the template is generalized
+	numeric := NumericVariables(map[string]string{
+		"user":  "42",
+		"took":  "1.5s",
+		"mode":  "hot",
+		"score": "NaN",
+		BodyKey: "7",
+	})
+	want := map[string]float64{"user": 42, "took": 1500}
+	if fmt.Sprint(numeric) != fmt.Sprint(want) {
+		t.Errorf("Expected %v, got %v", want, numeric)
+	}
+}
+
+func TestSlotStats_Widening(t *testing.T) {
+	var stats SlotStats
+	for _, value := range []string{"1", "2", "3"} {
+		stats.observe(value)
+	}
+	if stats.Type() != SlotInt {
+		t.Errorf("Expected int, got %s", stats.Type())
+	}
+	stats.observe("2.5")
+	if stats.Type() != SlotFloat {
+		t.Errorf("Expected float, got %s", stats.Type())
+	}
+	stats.observe("n/a")
+	if stats.Type() != SlotString {
+		t.Errorf("Expected string, got %s", stats.Type())
+	}
+
+	var levels SlotStats
+	for i := 0; i < 20; i++ {
+		levels.observe([]string{"INFO", "WARN"}[i%2])
+	}
+	if levels.Type() != SlotEnum {
+		t.Errorf("Expected enum, got %s", levels.Type())
+	}
+	for i := 0; i <= EnumLimit; i++ {
+		levels.observe(fmt.Sprintf("level-%d", i))
+	}
+	if levels.Type() != SlotString {
+		t.Errorf("Expected string after too many values, got %s", levels.Type())
+	}
+}
+
+func TestDrainTree_SlotNames(t *testing.T) {
+	config := DefaultConfig()
+	config.ExtraDelimiter = "="
+	dt := NewDrainTree(config)
+	timestamp := time.Now().UnixNano()
+
+	dt.Parse("Connected user=alice to port 8080 from 10.0.0.1", timestamp)
+	result, err := dt.Parse("Connected user=bob to port 9090 from 10.0.0.2", timestamp)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	want := map[string]string{"user": "bob", "port": "9090", "ip_0": "10.0.0.2"}
+	for key, value := range want {
+		if result.Variables[key] != value {
+			t.Errorf("Variable %s: expected %q, got %v", key, value, result.Variables)
+		}
+	}
+
+	cluster, _ := dt.RenameSlot(result.TemplateID, "ip_0", "client_ip")
+	if cluster == nil {
+		t.Fatal("RenameSlot failed")
+	}
+	if got := fmt.Sprint(cluster.Slots()); got != "[user port client_ip]" {
+		t.Errorf("Unexpected slots %s", got)
+	}
+	if got := fmt.Sprint(cluster.WildcardSlots()); got != "[user]" {
+		t.Errorf("Unexpected wildcard slots %s", got)
+	}
+	if _, err := dt.RenameSlot(result.TemplateID, "user", "port"); err == nil {
+		t.Error("Expected duplicate slot name to be rejected")
+	}
+	if _, err := dt.RenameSlot(result.TemplateID, "user", "User Name"); err == nil {
+		t.Error("Expected invalid slot name to be rejected")
+	}
+
+	renamed, _ := dt.Parse("Connected user=carol to port 7070 from 10.0.0.3", timestamp)
+	if renamed.Variables["client_ip"] != "10.0.0.3" {
+		t.Errorf("Expected renamed slot, got %v", renamed.Variables)
+	}
+
+	// Logs stored under earlier names still reconstruct
+	for _, variables := range []map[string]string{result.Variables, renamed.Variables} {
+		raw, err := dt.ReconstructLog(result.TemplateID, variables)
+		if err != nil {
+			t.Fatalf("ReconstructLog failed: %v", err)
+		}
+		if !strings.HasPrefix(raw, "Connected user=") {
+			t.Errorf("Unexpected reconstruction %q", raw)
+		}
+	}
+
+	restored := NewDrainTree(config)
+	if err := restored.Restore(dt.Snapshot()); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if cluster, _ := restored.GetCluster(result.TemplateID); fmt.Sprint(cluster.Info().Slots) != "[user port client_ip]" {
+		t.Errorf("Expected slot names to survive snapshot, got %v", cluster.Info().Slots)
+	}
+}
+
+func TestReconstruct_PositionalKeys(t *testing.T) {
+	raw, err := Reconstruct("Listening on port <NUM>", map[string]string{"num_0": "8080"})
+	if err != nil {
+		t.Fatalf("Reconstruct failed: %v", err)
+	}
+	if raw != "Listening on port 8080" {
+		t.Errorf("Unexpected reconstruction %q", raw)
+	}
+}
+
+func TestDrainTree_EventsInSeqOrder(t *testing.T) {
+	dt := NewDrainTree(DefaultConfig())
+	var mu sync.Mutex
+	var seqs []uint64
+	dt.OnEvent(func(event Event) {
+		// Give concurrent changes a chance to deliver out of turn
+		time.Sleep(time.Microsecond)
+		mu.Lock()
+		seqs = append(seqs, event.Seq)
+		mu.Unlock()
+	})
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				dt.Parse(fmt.Sprintf("worker%d step%d %s", w, i, strings.Repeat("x ", i%7)), 0)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if len(seqs) == 0 {
+		t.Fatal("Expected events")
+	}
+	for i, seq := range seqs {
+		if seq != uint64(i+1) {
+			t.Fatalf("Event %d: expected seq %d, got %d", i, i+1, seq)
+		}
+	}
+}
+
+func TestDrainTree_Events(t *testing.T) {
+	dt := NewDrainTree(DefaultConfig())
+	var events []Event
+	dt.OnEvent(func(event Event) {
+		events = append(events, event)
+	})
+	timestamp := time.Now().UnixNano()
+
+	first, _ := dt.Parse("session opened for alice", timestamp)
+	second, _ := dt.Parse("session opened for bob", timestamp)
+	dt.Parse("session opened for carol", timestamp)
+	a, _ := dt.Parse("service api started now", timestamp)
+	b, _ := dt.Parse("worker pool stopped later", timestamp)
+	merged, err := dt.MergeClusters([]string{a.TemplateID, b.TemplateID})
+	if err != nil {
+		t.Fatalf("MergeClusters failed: %v", err)
+	}
+
+	want := []Event{
+		{Type: EventCreated, ID: first.TemplateID, Template: "session opened for alice"},
+		{Type: EventUpdated, ID: second.TemplateID, Template: "session opened for <*>", PreviousID: first.TemplateID, PreviousTemplate: "session opened for alice"},
+		{Type: EventCreated, ID: a.TemplateID, Template: "service api started now"},
+		{Type: EventCreated, ID: b.TemplateID, Template: "worker pool stopped later"},
+		{Type: EventUpdated, ID: merged.ID, Template: "<*> <*> <*> <*>", PreviousID: a.TemplateID, PreviousTemplate: "service api started now"},
+		{Type: EventMerged, ID: merged.ID, Template: "<*> <*> <*> <*>", PreviousID: b.TemplateID, PreviousTemplate: "worker pool stopped later"},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("Expected %d events, got %d: %+v", len(want), len(events), events)
+	}
+	for i, event := range events {
+		if event.Seq != uint64(i+1) {
+			t.Errorf("Event %d: expected seq %d, got %d", i, i+1, event.Seq)
+		}
+		event.Seq, event.Size, event.Time = 0, 0, time.Time{}
+		if event != want[i] {
+			t.Errorf("Event %d: expected %+v, got %+v", i, want[i], event)
+		}
+	}
+
+	// Evictions are reported with the evicted cluster's last state
+	config := DefaultConfig()
+	config.MaxTemplates = 1
+	registry := NewRegistry(config, nil)
+	var evicted []Event
+	registry.OnEvent(func(event Event) {
+		if event.Type == EventEvicted {
+			evicted = append(evicted, event)
+		}
+	})
+	registry.Parse("svc", "first message here", timestamp)
+	registry.Parse("svc", "another unrelated line", timestamp)
+	if len(evicted) != 1 || evicted[0].Template != "first message here" || evicted[0].Source != "svc" || evicted[0].Size != 1 {
+		t.Errorf("Unexpected eviction events %+v", evicted)
+	}
+}
@@ -0,0 +1,94 @@
+package drain
+
+import "time"
+
+// EventType is the kind of change a template Event describes.
+type EventType string
+
+const (
+	// EventCreated is sent when a new cluster is created, by a log that
+	// matched no template or by SplitCluster.
+	EventCreated EventType = "created"
+	// EventUpdated is sent when a cluster's template is generalized, which
+	// also changes its ID.
+	EventUpdated EventType = "updated"
+	// EventMerged is sent for each cluster folded into another, either by
+	// MergeClusters or because generalizing it produced an existing template.
+	EventMerged EventType = "merged"
+	// EventEvicted is sent when a cluster is removed to respect a limit.
+	EventEvicted EventType = "evicted"
+)
+
+// Event describes a change to a template. For EventUpdated, Previous* hold
+// the cluster's old ID and template; for EventMerged, the absorbed cluster
+// and for an EventCreated from a split, the cluster split from. ID and
+// Template are the cluster's state after the change, or its last state if
+// it was evicted. Seq numbers a tree's events in the order the changes were
+// made, starting at 1.
+type Event struct {
+	Seq              uint64    `json:"seq"`
+	Type             EventType `json:"type"`
+	Source           string    `json:"source,omitempty"` // Set by Registry
+	ID               string    `json:"id"`
+	Template         string    `json:"template"`
+	PreviousID       string    `json:"previous_id,omitempty"`
+	PreviousTemplate string    `json:"previous_template,omitempty"`
+	Size             int64     `json:"size"`
+	Time             time.Time `json:"time"`
+}
+
+// EventFunc is called with each template event, in Seq order: changes that
+// record events are delivered one at a time. Like EvictionFunc it runs after
+// the tree lock is released, so it may read the tree, but it must not
+// change it or it waits for its own delivery.
+type EventFunc func(event Event)
+
+// OnEvent registers fn to be called with every template event.
+func (dt *DrainTree) OnEvent(fn EventFunc) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	dt.eventFuncs = append(dt.eventFuncs, fn)
+}
+
+// recordEvent queues an event about cluster for delivery once the tree lock
+// is released. previous is the cluster's former ID and template, if any.
+// Nothing is queued without subscribers. The caller must hold dt.mu for
+// writing.
+func (dt *DrainTree) recordEvent(eventType EventType, cluster *LogCluster, previousID, previousTemplate string) {
+	if len(dt.eventFuncs) == 0 {
+		return
+	}
+
+	dt.eventSeq++
+	cluster.mu.Lock()
+	event := Event{
+		Seq:              dt.eventSeq,
+		Type:             eventType,
+		ID:               cluster.ID,
+		Template:         cluster.Template,
+		PreviousID:       previousID,
+		PreviousTemplate: previousTemplate,
+		Size:             cluster.Size,
+		Time:             time.Now(),
+	}
+	cluster.mu.Unlock()
+	dt.events = append(dt.events, event)
+}
+
+// takeEvents returns the events queued since the last call along with the
+// callbacks to notify. The caller must hold dt.mu for writing and, so the
+// events are delivered in order, dt.delivery until it has notified them.
+func (dt *DrainTree) takeEvents() ([]Event, []EventFunc) {
+	events := dt.events
+	dt.events = nil
+	return events, dt.eventFuncs
+}
+
+// notifyEvents runs event callbacks. It must be called without dt.mu.
+func notifyEvents(events []Event, funcs []EventFunc) {
+	for _, event := range events {
+		for _, fn := range funcs {
+			fn(event)
+		}
+	}
+}
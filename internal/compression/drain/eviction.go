@@ -0,0 +1,178 @@
+package drain
+
+import (
+	"unsafe"
+)
+
+// EvictionPolicy selects which cluster is removed when a limit is reached.
+type EvictionPolicy int
+
+const (
+	// EvictLRU removes the least recently matched cluster.
+	EvictLRU EvictionPolicy = iota
+	// EvictLFU removes the cluster with the fewest logs.
+	EvictLFU
+)
+
+// EvictionFunc is called with a copy of each cluster removed from the tree,
+// taken as it was evicted. It runs after the tree lock is released, so it
+// may call back into the tree.
+type EvictionFunc func(cluster ClusterInfo)
+
+// OnEvict registers fn to be called whenever a cluster is evicted.
+func (dt *DrainTree) OnEvict(fn EvictionFunc) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	dt.evictionFuncs = append(dt.evictionFuncs, fn)
+}
+
+// touch marks cluster as just used. The caller must hold cluster.mu.
+func (dt *DrainTree) touch(cluster *LogCluster) {
+	cluster.lastAccess = dt.clock.Add(1)
+}
+
+// pickVictim returns the cluster to evict from candidates under the tree's
+// eviction policy, never choosing keep.
+func (dt *DrainTree) pickVictim(candidates []*LogCluster, keep *LogCluster) *LogCluster {
+	var victim *LogCluster
+	var victimScore int64
+
+	for _, cluster := range candidates {
+		if cluster == keep {
+			continue
+		}
+		cluster.mu.Lock()
+		score := cluster.lastAccess
+		if dt.eviction == EvictLFU {
+			score = cluster.Size
+		}
+		cluster.mu.Unlock()
+
+		if victim == nil || score < victimScore {
+			victim = cluster
+			victimScore = score
+		}
+	}
+
+	return victim
+}
+
+// enforceLeafLimit evicts clusters from leaf until it holds at most
+// maxClusters, sparing keep. The caller must hold dt.mu for writing.
+func (dt *DrainTree) enforceLeafLimit(leaf *ClusterNode, keep *LogCluster) {
+	for len(leaf.Clusters) > dt.maxClusters {
+		victim := dt.pickVictim(leaf.Clusters, keep)
+		if victim == nil {
+			return
+		}
+		dt.evict(victim)
+	}
+}
+
+// enforceTemplateLimit evicts clusters until the tree holds at most
+// maxTemplates, sparing keep. The caller must hold dt.mu for writing.
+func (dt *DrainTree) enforceTemplateLimit(keep *LogCluster) {
+	if dt.maxTemplates <= 0 {
+		return
+	}
+
+	for len(dt.clusters) > dt.maxTemplates {
+		candidates := make([]*LogCluster, 0, len(dt.clusters))
+		for _, cluster := range dt.clusters {
+			candidates = append(candidates, cluster)
+		}
+		victim := dt.pickVictim(candidates, keep)
+		if victim == nil {
+			return
+		}
+		dt.evict(victim)
+	}
+}
+
+// evict removes cluster from the tree along with the aliases and retired
+// templates that resolve to it. The caller must hold dt.mu for writing.
+func (dt *DrainTree) evict(cluster *LogCluster) {
+	for _, leaf := range cluster.leaves {
+		kept := leaf.Clusters[:0]
+		for _, c := range leaf.Clusters {
+			if c != cluster {
+				kept = append(kept, c)
+			}
+		}
+		leaf.Clusters = kept
+	}
+	cluster.leaves = nil
+
+	delete(dt.clusters, cluster.ID)
+	for _, id := range cluster.retiredIDs {
+		delete(dt.aliases, id)
+		delete(dt.retired, id)
+	}
+
+	dt.evicted = append(dt.evicted, cluster.Info())
+	dt.evictions++
+	dt.recordEvent(EventEvicted, cluster, "", "")
+}
+
+// takeEvicted returns the clusters evicted since the last call along with
+// the callbacks to notify. The caller must hold dt.mu for writing.
+func (dt *DrainTree) takeEvicted() ([]ClusterInfo, []EvictionFunc) {
+	evicted := dt.evicted
+	dt.evicted = nil
+	return evicted, dt.evictionFuncs
+}
+
+// notifyEvicted runs eviction callbacks. It must be called without dt.mu.
+func notifyEvicted(evicted []ClusterInfo, funcs []EvictionFunc) {
+	for _, cluster := range evicted {
+		for _, fn := range funcs {
+			fn(cluster)
+		}
+	}
+}
+
+// Approximate per-object overheads used by memoryUsage.
+const (
+	clusterOverhead = int64(unsafe.Sizeof(LogCluster{}))
+	nodeOverhead    = int64(unsafe.Sizeof(ClusterNode{}))
+	stringOverhead  = int64(unsafe.Sizeof(""))
+	pointerSize     = int64(unsafe.Sizeof(uintptr(0)))
+)
+
+// memoryUsage estimates the bytes held by the tree. The caller must hold
+// dt.mu.
+func (dt *DrainTree) memoryUsage() int64 {
+	total := nodeMemory(dt.root)
+
+	for id, cluster := range dt.clusters {
+		cluster.mu.Lock()
+		total += clusterOverhead + stringOverhead + int64(len(id))
+		total += int64(len(cluster.Template))
+		for _, token := range cluster.Tokens {
+			total += stringOverhead + int64(len(token))
+		}
+		for _, sample := range cluster.SampleLogs {
+			total += stringOverhead + int64(len(sample))
+		}
+		cluster.mu.Unlock()
+	}
+
+	for alias, id := range dt.aliases {
+		total += 2*stringOverhead + int64(len(alias)+len(id))
+	}
+	for id, template := range dt.retired {
+		total += 2*stringOverhead + int64(len(id)+len(template))
+	}
+
+	return total
+}
+
+// nodeMemory estimates the bytes held by a node and its descendants.
+func nodeMemory(node *ClusterNode) int64 {
+	total := nodeOverhead + int64(len(node.Clusters))*pointerSize
+	for key, child := range node.KeyToChildNode {
+		total += stringOverhead + int64(len(key)) + pointerSize
+		total += nodeMemory(child)
+	}
+	return total
+}
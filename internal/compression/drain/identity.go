@@ -0,0 +1,128 @@
+package drain
+
+// Template identity
+//
+// A cluster's ID is a hash of its source and current template. When a
+// template is generalized its ID changes, and the previous ID is kept as an
+// alias that resolves to the new one. Two trees of the same source that
+// converge on the same template therefore agree on its ID regardless of the
+// order logs arrived in, trees of different sources never share an ID, and
+// IDs already stored downstream can be reconciled through IDMappings.
+
+// reidentify moves cluster to the ID derived from its current tokens,
+// recording the old ID as an alias and keeping its old template so logs
+// stored under it can still be reconstructed. If another cluster already
+// owns the new ID the two are merged and the surviving cluster is returned.
+func (dt *DrainTree) reidentify(cluster *LogCluster, oldTemplate string) *LogCluster {
+	newID := dt.generateClusterID(cluster.Tokens)
+	oldID := cluster.ID
+	if newID == oldID {
+		return cluster
+	}
+
+	delete(dt.clusters, oldID)
+	dt.aliases[oldID] = newID
+	dt.retired[oldID] = oldTemplate
+
+	if existing, exists := dt.clusters[newID]; exists && existing != cluster {
+		dt.absorbCluster(existing, cluster)
+		existing.retiredIDs = append(existing.retiredIDs, cluster.retiredIDs...)
+		existing.retiredIDs = append(existing.retiredIDs, oldID)
+		replaceInTree(cluster, existing)
+		dt.recordEvent(EventMerged, existing, oldID, oldTemplate)
+		return existing
+	}
+
+	cluster.retiredIDs = append(cluster.retiredIDs, oldID)
+	cluster.mu.Lock()
+	cluster.ID = newID
+	cluster.mu.Unlock()
+	dt.clusters[newID] = cluster
+	delete(dt.aliases, newID)
+	delete(dt.retired, newID)
+	dt.recordEvent(EventUpdated, cluster, oldID, oldTemplate)
+	return cluster
+}
+
+// absorbCluster folds the counters and samples of src into dst.
+func (dt *DrainTree) absorbCluster(dst, src *LogCluster) {
+	dst.mu.Lock()
+	defer dst.mu.Unlock()
+	src.mu.Lock()
+	defer src.mu.Unlock()
+
+	dt.mergeSamples(dst, src, dst.Size, src.Size)
+	dst.Size += src.Size
+	if src.FirstSeen < dst.FirstSeen {
+		dst.FirstSeen = src.FirstSeen
+	}
+	if src.LastSeen > dst.LastSeen {
+		dst.LastSeen = src.LastSeen
+	}
+}
+
+// replaceInTree swaps every leaf reference to old for replacement, dropping
+// the reference instead where replacement is already in the same leaf.
+func replaceInTree(old, replacement *LogCluster) {
+	for _, leaf := range old.leaves {
+		present := false
+		for _, cluster := range leaf.Clusters {
+			if cluster == replacement {
+				present = true
+			}
+		}
+
+		kept := leaf.Clusters[:0]
+		for _, cluster := range leaf.Clusters {
+			if cluster == old {
+				if present {
+					continue
+				}
+				cluster = replacement
+				present = true
+				replacement.leaves = append(replacement.leaves, leaf)
+			}
+			kept = append(kept, cluster)
+		}
+		leaf.Clusters = kept
+	}
+	old.leaves = nil
+}
+
+// resolveID follows the alias chain for id. The caller must hold dt.mu.
+func (dt *DrainTree) resolveID(id string) (string, bool) {
+	for hops := 0; hops <= len(dt.aliases); hops++ {
+		if _, exists := dt.clusters[id]; exists {
+			return id, true
+		}
+		next, ok := dt.aliases[id]
+		if !ok {
+			return "", false
+		}
+		id = next
+	}
+	return "", false
+}
+
+// ResolveID returns the current ID for a template ID that may have been
+// retired by generalization or merging.
+func (dt *DrainTree) ResolveID(id string) (string, bool) {
+	dt.mu.RLock()
+	defer dt.mu.RUnlock()
+	return dt.resolveID(id)
+}
+
+// IDMappings returns every retired template ID mapped to the ID of the
+// cluster that now holds its logs.
+func (dt *DrainTree) IDMappings() map[string]string {
+	dt.mu.RLock()
+	defer dt.mu.RUnlock()
+
+	mappings := make(map[string]string, len(dt.aliases))
+	for alias := range dt.aliases {
+		if current, ok := dt.resolveID(alias); ok {
+			mappings[alias] = current
+		}
+	}
+	return mappings
+}
@@ -0,0 +1,106 @@
+package drain
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Wildcard is the placeholder for template positions that vary without a
+// known type.
+const Wildcard = "<*>"
+
+// MaskingRule names a regex used to recognize variable tokens before
+// clustering. A token matching the rule anywhere is replaced by the typed
+// placeholder "<Name>", and its value is returned keyed by the type.
+type MaskingRule struct {
+	Name    string
+	Pattern string
+}
+
+// NumberRule is the name of the built-in rule for numeric tokens.
+const NumberRule = "NUM"
+
+// DefaultMaskingRules returns the built-in masking rules, in the order they
+// are applied. Numbers are checked before all of them.
+func DefaultMaskingRules() []MaskingRule {
+	return []MaskingRule{
+		{Name: "IP", Pattern: `\b\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}\b`},
+		{Name: "UUID", Pattern: `\b[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}\b`},
+		{Name: "HEX", Pattern: `\b[0-9a-fA-F]{8,}\b`},
+		{Name: NumberRule, Pattern: `\b\d+\b`},
+		{Name: "PATH", Pattern: `/[^\s]+`},
+		{Name: "URL", Pattern: `https?://[^\s]+`},
+		{Name: "EMAIL", Pattern: `[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}`},
+	}
+}
+
+// maskRule is a compiled MaskingRule.
+type maskRule struct {
+	placeholder string
+	re          *regexp.Regexp
+}
+
+// compileMaskingRules compiles custom rules followed by the built-in ones.
+// Rules with an empty name or an invalid pattern are skipped.
+func compileMaskingRules(custom []MaskingRule) ([]maskRule, map[string]bool) {
+	rules := make([]maskRule, 0, len(custom)+len(DefaultMaskingRules()))
+	placeholders := map[string]bool{Wildcard: true}
+
+	for _, rule := range append(append([]MaskingRule{}, custom...), DefaultMaskingRules()...) {
+		if rule.Name == "" || rule.Name == "*" {
+			continue
+		}
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			continue
+		}
+		placeholder := "<" + rule.Name + ">"
+		rules = append(rules, maskRule{placeholder: placeholder, re: re})
+		placeholders[placeholder] = true
+	}
+	placeholders["<"+NumberRule+">"] = true
+
+	return rules, placeholders
+}
+
+// maskToken returns the placeholder for token, or "" if it is not a
+// recognized variable.
+func (dt *DrainTree) maskToken(token string) string {
+	// Check if it's a pure number
+	if _, err := strconv.ParseFloat(token, 64); err == nil {
+		return "<" + NumberRule + ">"
+	}
+
+	// Check against masking rules, first match wins
+	for _, rule := range dt.masks {
+		if rule.re.MatchString(token) {
+			return rule.placeholder
+		}
+	}
+
+	return ""
+}
+
+// isPlaceholder reports whether a template token is a wildcard or a
+// typed placeholder produced by this tree's masking rules.
+func (dt *DrainTree) isPlaceholder(token string) bool {
+	return dt.placeholders[token]
+}
+
+// looksLikePlaceholder reports whether token has placeholder syntax.
+func looksLikePlaceholder(token string) bool {
+	return len(token) > 2 && token[0] == '<' && token[len(token)-1] == '>'
+}
+
+// slotKey returns the variable key for the n-th occurrence of a placeholder
+// in a template: var_0, var_1, ... for wildcards and ip_0, num_1, ... for
+// typed placeholders.
+func slotKey(placeholder string, n int) string {
+	name := "var"
+	if placeholder != Wildcard {
+		name = strings.ToLower(placeholder[1 : len(placeholder)-1])
+	}
+	return fmt.Sprintf("%s_%d", name, n)
+}
@@ -0,0 +1,226 @@
+package drain
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// maxSlotNameLength bounds slot names, derived or chosen by an operator.
+const maxSlotNameLength = 32
+
+// slotNamePattern is the form of a slot name: lower case letters, digits
+// and underscores, starting with a letter.
+var slotNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// slotNameStopwords are words too generic to name the slot after them.
+var slotNameStopwords = map[string]bool{
+	"a": true, "an": true, "the": true, "and": true, "or": true, "as": true,
+	"at": true, "by": true, "for": true, "from": true, "in": true, "into": true,
+	"of": true, "on": true, "to": true, "with": true, "is": true, "was": true,
+	"are": true, "be": true, "been": true,
+}
+
+// neighbourName derives a slot name from the literal token before the
+// slot: "port" from "port <*>", "user" from "user: <*>" or, when "=" is an
+// extra delimiter, from "user=<*>". It returns "" if the token is not a
+// usable name.
+func neighbourName(token string) string {
+	token = strings.TrimRight(token, ":=")
+	token = strings.Trim(token, `"'()[]{}`)
+
+	var b strings.Builder
+	for _, r := range strings.ToLower(token) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_':
+			b.WriteRune(r)
+		case r == '-' || r == '.':
+			b.WriteByte('_')
+		default:
+			return ""
+		}
+	}
+
+	name := strings.Trim(b.String(), "_")
+	if len(name) > maxSlotNameLength || !slotNamePattern.MatchString(name) || slotNameStopwords[name] {
+		return ""
+	}
+	return name
+}
+
+// slotNames returns the variable key of each template token: "" for
+// literals, the operator override for slots that have one, otherwise the
+// name of the literal before the slot, falling back to the positional key
+// (var_0, num_1, ...). Repeated names get a numeric suffix.
+func slotNames(tokens []string, isPlaceholder func(string) bool, overrides map[int]string) []string {
+	names := make([]string, len(tokens))
+	used := make(map[string]bool, len(overrides))
+	for _, name := range overrides {
+		used[name] = true
+	}
+
+	counters := make(map[string]int)
+	for i, token := range tokens {
+		if !isPlaceholder(token) {
+			continue
+		}
+		positional := slotKey(token, counters[token])
+		counters[token]++
+
+		if name, ok := overrides[i]; ok {
+			names[i] = name
+			continue
+		}
+		name := ""
+		if i > 0 && !looksLikePlaceholder(tokens[i-1]) {
+			name = neighbourName(tokens[i-1])
+		}
+		if name == "" {
+			name = positional
+		}
+		for base, n := name, 1; used[name]; n++ {
+			name = fmt.Sprintf("%s_%d", base, n)
+		}
+		used[name] = true
+		names[i] = name
+	}
+	return names
+}
+
+// positionalKeys returns the positional variable key of each template
+// token, or "" for literals. Logs stored before slots were named use
+// these keys.
+func positionalKeys(tokens []string, isPlaceholder func(string) bool) []string {
+	keys := make([]string, len(tokens))
+	counters := make(map[string]int)
+	for i, token := range tokens {
+		if isPlaceholder(token) {
+			keys[i] = slotKey(token, counters[token])
+			counters[token]++
+		}
+	}
+	return keys
+}
+
+// refreshSlotNames recomputes the cached slot names of a cluster after its
+// tokens or overrides changed. The caller must hold cluster.mu.
+func (dt *DrainTree) refreshSlotNames(cluster *LogCluster) {
+	cluster.names = slotNames(cluster.Tokens, dt.isPlaceholder, cluster.nameOverrides)
+}
+
+// Slots returns the variable key of each slot of the cluster's template,
+// in template order.
+func (c *LogCluster) Slots() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.slotList()
+}
+
+// WildcardSlots returns the variable keys of the slots Drain generalized
+// to <*>, as opposed to tokens masked into typed placeholders.
+func (c *LogCluster) WildcardSlots() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var slots []string
+	for i, name := range c.names {
+		if name != "" && i < len(c.Tokens) && c.Tokens[i] == Wildcard {
+			slots = append(slots, name)
+		}
+	}
+	return slots
+}
+
+// slotList returns the non-empty cached slot names. The caller must hold
+// c.mu.
+func (c *LogCluster) slotList() []string {
+	slots := make([]string, 0, len(c.names))
+	for _, name := range c.names {
+		if name != "" {
+			slots = append(slots, name)
+		}
+	}
+	return slots
+}
+
+// RenameSlot overrides the name of a template slot, identified by its
+// current name. An empty name restores the derived name. Logs parsed
+// afterwards carry the new name; logs already stored keep the keys they
+// were stored with.
+func (dt *DrainTree) RenameSlot(id, slot, name string) (*LogCluster, error) {
+	if name != "" && (len(name) > maxSlotNameLength || !slotNamePattern.MatchString(name)) {
+		return nil, fmt.Errorf("invalid slot name %q: use lower case letters, digits and underscores", name)
+	}
+
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+
+	current, ok := dt.resolveID(id)
+	if !ok {
+		return nil, fmt.Errorf("unknown template %s", id)
+	}
+	cluster := dt.clusters[current]
+
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+
+	position := -1
+	for i, existing := range cluster.names {
+		if existing == "" {
+			continue
+		}
+		if existing == slot {
+			position = i
+		} else if existing == name {
+			return nil, fmt.Errorf("template %s already has a slot named %s", current, name)
+		}
+	}
+	if position < 0 {
+		return nil, fmt.Errorf("template %s has no slot %s", current, slot)
+	}
+
+	overrides := make(map[int]string, len(cluster.nameOverrides)+1)
+	for i, n := range cluster.nameOverrides {
+		overrides[i] = n
+	}
+	if name == "" {
+		delete(overrides, position)
+	} else {
+		overrides[position] = name
+	}
+	if len(overrides) == 0 {
+		overrides = nil
+	}
+
+	// Carry the slot statistics over to the new names
+	oldNames := cluster.names
+	cluster.nameOverrides = overrides
+	dt.refreshSlotNames(cluster)
+	if cluster.slots != nil {
+		slots := make(map[string]*SlotStats, len(cluster.slots))
+		for i, oldName := range oldNames {
+			if stats, ok := cluster.slots[oldName]; ok && oldName != "" {
+				slots[cluster.names[i]] = stats
+			}
+		}
+		cluster.slots = slots
+	}
+
+	return cluster, nil
+}
+
+// copyOverrides returns the name overrides of a cluster without those at
+// the given positions. The caller must hold cluster.mu.
+func copyOverrides(cluster *LogCluster, except ...int) map[int]string {
+	if len(cluster.nameOverrides) == 0 {
+		return nil
+	}
+	overrides := make(map[int]string, len(cluster.nameOverrides))
+	for i, name := range cluster.nameOverrides {
+		overrides[i] = name
+	}
+	for _, i := range except {
+		delete(overrides, i)
+	}
+	return overrides
+}
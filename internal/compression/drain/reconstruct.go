@@ -0,0 +1,192 @@
+package drain
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// LayoutKey is the reserved variable key holding the separators of a log
+// line when they are not plain single spaces. It is omitted otherwise.
+const LayoutKey = "_layout"
+
+// BodyKey is the reserved variable key holding the continuation lines of a
+// multi-line event, such as a stack trace, when only its first line was
+// clustered. Reconstruct appends it after a newline.
+const BodyKey = "_body"
+
+// SignatureKey is the reserved variable key holding the number of trailing
+// template tokens that were appended to the first line of a multi-line
+// event to key its template (for example an exception type and top frames).
+// Reconstruct drops them, along with the single space joining them.
+const SignatureKey = "_signature"
+
+// encodeLayout encodes separators for storage. It returns false if the
+// layout is the canonical one (single spaces, nothing leading or trailing).
+func encodeLayout(separators []string) (string, bool) {
+	canonical := true
+	for i, sep := range separators {
+		edge := i == 0 || i == len(separators)-1
+		if (edge && sep != "") || (!edge && sep != " ") {
+			canonical = false
+			break
+		}
+	}
+	if canonical {
+		return "", false
+	}
+
+	data, err := json.Marshal(separators)
+	if err != nil {
+		return "", false
+	}
+	return string(data), true
+}
+
+// decodeLayout decodes separators stored under LayoutKey.
+func decodeLayout(layout string) ([]string, error) {
+	var separators []string
+	if err := json.Unmarshal([]byte(layout), &separators); err != nil {
+		return nil, fmt.Errorf("invalid layout: %w", err)
+	}
+	return separators, nil
+}
+
+// Reconstruct regenerates the original log line from a template and the
+// variables extracted when the line was parsed. Together with Parse it
+// round-trips the line exactly, including whitespace, unless the variables
+// were altered afterwards (for example by PII redaction). Slots are looked
+// up by their derived name and then by positional key, so logs stored
+// before slots were named can be reconstructed too; use
+// DrainTree.ReconstructLog for templates with renamed slots.
+func Reconstruct(template string, variables map[string]string) (string, error) {
+	tokens := strings.Split(template, " ")
+	return reconstruct(tokens, slotKeys(tokens, looksLikePlaceholder, nil), variables)
+}
+
+// slotKeys returns the variable keys a slot may have been stored under, in
+// order of preference: its current name, its derived name and its
+// positional key. Literal tokens have none.
+func slotKeys(tokens []string, isPlaceholder func(string) bool, overrides map[int]string) [][]string {
+	names := slotNames(tokens, isPlaceholder, overrides)
+	derived := names
+	if len(overrides) > 0 {
+		derived = slotNames(tokens, isPlaceholder, nil)
+	}
+	positional := positionalKeys(tokens, isPlaceholder)
+
+	keys := make([][]string, len(tokens))
+	for i, name := range names {
+		if name == "" {
+			continue
+		}
+		keys[i] = []string{name}
+		for _, key := range []string{derived[i], positional[i]} {
+			if key != keys[i][len(keys[i])-1] && key != name {
+				keys[i] = append(keys[i], key)
+			}
+		}
+	}
+	return keys
+}
+
+// reconstruct implements Reconstruct for a tokenized template and the
+// candidate keys of each slot.
+func reconstruct(tokens []string, keys [][]string, variables map[string]string) (string, error) {
+	tokens = append([]string(nil), tokens...)
+	for i, candidates := range keys {
+		if len(candidates) == 0 {
+			continue
+		}
+		found := false
+		for _, key := range candidates {
+			if value, ok := variables[key]; ok {
+				tokens[i] = value
+				found = true
+				break
+			}
+		}
+		if !found && tokens[i] == Wildcard {
+			return "", fmt.Errorf("missing variable %s for template", candidates[0])
+		}
+		// Otherwise a literal token that only looks like a typed placeholder
+	}
+
+	signature := 0
+	if value, ok := variables[SignatureKey]; ok {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 || n > len(tokens) {
+			return "", fmt.Errorf("invalid signature length %q", value)
+		}
+		signature = n
+	}
+
+	var b strings.Builder
+	b.WriteString(variables[HeaderKey])
+
+	kept := tokens[:len(tokens)-signature]
+	layout, ok := variables[LayoutKey]
+	if !ok {
+		b.WriteString(strings.Join(kept, " "))
+	} else {
+		separators, err := decodeLayout(layout)
+		if err != nil {
+			return "", err
+		}
+		if len(separators) != len(tokens)+1 {
+			return "", fmt.Errorf("layout has %d separators for %d tokens", len(separators), len(tokens))
+		}
+
+		for i, token := range kept {
+			b.WriteString(separators[i])
+			b.WriteString(token)
+		}
+		last := separators[len(kept)]
+		if signature > 0 {
+			last = strings.TrimSuffix(last, " ")
+		}
+		b.WriteString(last)
+	}
+
+	if body, ok := variables[BodyKey]; ok {
+		b.WriteString("\n")
+		b.WriteString(body)
+	}
+	return b.String(), nil
+}
+
+// TemplateByID returns the template for a template ID, including IDs that
+// have since been retired by generalization or merging.
+func (dt *DrainTree) TemplateByID(id string) (string, bool) {
+	template, _, ok := dt.lookupTemplate(id)
+	return template, ok
+}
+
+// lookupTemplate returns the template for a template ID and, if it is
+// current, its slot name overrides.
+func (dt *DrainTree) lookupTemplate(id string) (string, map[int]string, bool) {
+	dt.mu.RLock()
+	defer dt.mu.RUnlock()
+
+	if template, ok := dt.retired[id]; ok {
+		return template, nil, true
+	}
+	if cluster, ok := dt.clusters[id]; ok {
+		cluster.mu.Lock()
+		defer cluster.mu.Unlock()
+		return cluster.Template, cluster.nameOverrides, true
+	}
+	return "", nil, false
+}
+
+// ReconstructLog regenerates a log line stored under templateID, using the
+// tree's slot names.
+func (dt *DrainTree) ReconstructLog(templateID string, variables map[string]string) (string, error) {
+	template, overrides, ok := dt.lookupTemplate(templateID)
+	if !ok {
+		return "", fmt.Errorf("unknown template %s", templateID)
+	}
+	tokens := strings.Split(template, " ")
+	return reconstruct(tokens, slotKeys(tokens, dt.isPlaceholder, overrides), variables)
+}
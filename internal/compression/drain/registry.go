@@ -0,0 +1,371 @@
+package drain
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// DefaultSource is the registry key used for logs without a source.
+const DefaultSource = "default"
+
+// SourceConfig overrides parts of the base Config for one source. Zero
+// fields inherit the base value.
+type SourceConfig struct {
+	MaxDepth       int           `json:"max_depth,omitempty"`
+	SimThreshold   float64       `json:"similarity_threshold,omitempty"`
+	MaxChildren    int           `json:"max_children,omitempty"`
+	MaxClusters    int           `json:"max_clusters,omitempty"`
+	MaxTemplates   int           `json:"max_templates,omitempty"`
+	ExtraDelimiter string        `json:"extra_delimiter,omitempty"`
+	HeaderPattern  string        `json:"header_pattern,omitempty"`
+	MaskingRules   []MaskingRule `json:"masking_rules,omitempty"`
+}
+
+// Apply returns base with the non-zero fields of sc applied.
+func (sc SourceConfig) Apply(base Config) Config {
+	if sc.MaxDepth != 0 {
+		base.MaxDepth = sc.MaxDepth
+	}
+	if sc.SimThreshold != 0 {
+		base.SimThreshold = sc.SimThreshold
+	}
+	if sc.MaxChildren != 0 {
+		base.MaxChildren = sc.MaxChildren
+	}
+	if sc.MaxClusters != 0 {
+		base.MaxClusters = sc.MaxClusters
+	}
+	if sc.MaxTemplates != 0 {
+		base.MaxTemplates = sc.MaxTemplates
+	}
+	if sc.ExtraDelimiter != "" {
+		base.ExtraDelimiter = sc.ExtraDelimiter
+	}
+	if sc.HeaderPattern != "" {
+		base.HeaderPattern = sc.HeaderPattern
+	}
+	if len(sc.MaskingRules) > 0 {
+		base.MaskingRules = sc.MaskingRules
+	}
+	return base
+}
+
+// LoadSourceConfigs reads per-source overrides from a JSON file mapping
+// source names to SourceConfig.
+func LoadSourceConfigs(path string) (map[string]SourceConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var configs map[string]SourceConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("invalid source configs: %w", err)
+	}
+	return configs, nil
+}
+
+// SourceEvictionFunc is called with each cluster evicted from a source's
+// tree.
+type SourceEvictionFunc func(source string, cluster ClusterInfo)
+
+// Registry holds one DrainTree per source (or tenant), created on first
+// use, so unrelated services never share clusters.
+type Registry struct {
+	base      Config
+	overrides map[string]SourceConfig
+
+	mu            sync.RWMutex
+	trees         map[string]*DrainTree
+	evictionFuncs []SourceEvictionFunc
+	eventFuncs    []EventFunc
+}
+
+// NewRegistry creates a registry whose trees use base, adjusted by the
+// override for their source if there is one.
+func NewRegistry(base Config, overrides map[string]SourceConfig) *Registry {
+	return &Registry{
+		base:      base,
+		overrides: overrides,
+		trees:     make(map[string]*DrainTree),
+	}
+}
+
+// sourceKey normalizes a source name.
+func sourceKey(source string) string {
+	if source == "" {
+		return DefaultSource
+	}
+	return source
+}
+
+// ConfigFor returns the configuration used for source's tree.
+func (r *Registry) ConfigFor(source string) Config {
+	if override, ok := r.overrides[sourceKey(source)]; ok {
+		return override.Apply(r.base)
+	}
+	return r.base
+}
+
+// Tree returns the tree for source, creating it if needed.
+func (r *Registry) Tree(source string) *DrainTree {
+	key := sourceKey(source)
+
+	r.mu.RLock()
+	tree, ok := r.trees[key]
+	r.mu.RUnlock()
+	if ok {
+		return tree
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if tree, ok := r.trees[key]; ok {
+		return tree
+	}
+	tree = r.newTree(key)
+	r.trees[key] = tree
+	return tree
+}
+
+// Lookup returns the tree for source without creating it.
+func (r *Registry) Lookup(source string) (*DrainTree, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	tree, ok := r.trees[sourceKey(source)]
+	return tree, ok
+}
+
+// newTree builds the tree for key and registers eviction and event
+// callbacks on it. The caller must hold r.mu for writing.
+func (r *Registry) newTree(key string) *DrainTree {
+	config := r.ConfigFor(key)
+	if key != DefaultSource {
+		config.Source = key
+	}
+	tree := NewDrainTree(config)
+	for _, fn := range r.evictionFuncs {
+		tree.OnEvict(sourceEvictionFunc(key, fn))
+	}
+	for _, fn := range r.eventFuncs {
+		tree.OnEvent(sourceEventFunc(key, fn))
+	}
+	return tree
+}
+
+// sourceEvictionFunc binds a SourceEvictionFunc to one source.
+func sourceEvictionFunc(source string, fn SourceEvictionFunc) EvictionFunc {
+	return func(cluster ClusterInfo) {
+		fn(source, cluster)
+	}
+}
+
+// OnEvict registers fn on every current and future tree.
+func (r *Registry) OnEvict(fn SourceEvictionFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.evictionFuncs = append(r.evictionFuncs, fn)
+	for source, tree := range r.trees {
+		tree.OnEvict(sourceEvictionFunc(source, fn))
+	}
+}
+
+// sourceEventFunc binds an EventFunc to one source, setting Event.Source.
+func sourceEventFunc(source string, fn EventFunc) EventFunc {
+	return func(event Event) {
+		event.Source = source
+		fn(event)
+	}
+}
+
+// OnEvent registers fn on every current and future tree. Events carry the
+// source of the tree they came from.
+func (r *Registry) OnEvent(fn EventFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.eventFuncs = append(r.eventFuncs, fn)
+	for source, tree := range r.trees {
+		tree.OnEvent(sourceEventFunc(source, fn))
+	}
+}
+
+// Parse parses a log line with the tree for source.
+func (r *Registry) Parse(source, logContent string, timestamp int64) (*ParseResult, error) {
+	return r.Tree(source).Parse(logContent, timestamp)
+}
+
+// Sources returns the sources that have a tree, sorted.
+func (r *Registry) Sources() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	sources := make([]string, 0, len(r.trees))
+	for source := range r.trees {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	return sources
+}
+
+// snapshotTrees returns a copy of the source to tree map.
+func (r *Registry) snapshotTrees() map[string]*DrainTree {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	trees := make(map[string]*DrainTree, len(r.trees))
+	for source, tree := range r.trees {
+		trees[source] = tree
+	}
+	return trees
+}
+
+// FindCluster looks up a template ID in every tree and returns the source
+// that owns it. Template IDs include the source, so at most one tree
+// matches; sources are searched in sorted order all the same.
+func (r *Registry) FindCluster(id string) (string, *LogCluster, bool) {
+	trees := r.snapshotTrees()
+	for _, source := range r.Sources() {
+		tree, ok := trees[source]
+		if !ok {
+			continue
+		}
+		if cluster, ok := tree.GetCluster(id); ok {
+			return source, cluster, true
+		}
+	}
+	return "", nil, false
+}
+
+// ClusterCount returns the number of clusters across all trees.
+func (r *Registry) ClusterCount() int {
+	count := 0
+	for _, tree := range r.snapshotTrees() {
+		count += tree.ClusterCount()
+	}
+	return count
+}
+
+// StatsBySource returns the statistics of each tree.
+func (r *Registry) StatsBySource() map[string]Stats {
+	trees := r.snapshotTrees()
+	stats := make(map[string]Stats, len(trees))
+	for source, tree := range trees {
+		stats[source] = tree.GetStats()
+	}
+	return stats
+}
+
+// GetStats returns statistics aggregated over all trees.
+func (r *Registry) GetStats() Stats {
+	var total Stats
+	for _, stats := range r.StatsBySource() {
+		total.TotalClusters += stats.TotalClusters
+		total.TotalLogs += stats.TotalLogs
+		total.Evictions += stats.Evictions
+		total.MemoryBytes += stats.MemoryBytes
+	}
+	if total.TotalClusters > 0 {
+		total.AverageSize = float64(total.TotalLogs) / float64(total.TotalClusters)
+	}
+	return total
+}
+
+// RegistrySnapshot is a serializable copy of every tree in a Registry.
+type RegistrySnapshot struct {
+	Version int                  `json:"version"`
+	Sources map[string]*Snapshot `json:"sources"`
+}
+
+// Snapshot captures the state of every tree.
+func (r *Registry) Snapshot() *RegistrySnapshot {
+	trees := r.snapshotTrees()
+	snap := &RegistrySnapshot{
+		Version: SnapshotVersion,
+		Sources: make(map[string]*Snapshot, len(trees)),
+	}
+	for source, tree := range trees {
+		snap.Sources[source] = tree.Snapshot()
+	}
+	return snap
+}
+
+// Restore replaces the registry's trees with those in snap. Trees are
+// rebuilt with the registry's current configuration.
+func (r *Registry) Restore(snap *RegistrySnapshot) error {
+	if snap == nil {
+		return fmt.Errorf("nil snapshot")
+	}
+	if snap.Version < 1 || snap.Version > SnapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", snap.Version)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	trees := make(map[string]*DrainTree, len(snap.Sources))
+	for source, treeSnap := range snap.Sources {
+		tree := r.newTree(source)
+		if err := tree.Restore(treeSnap); err != nil {
+			return fmt.Errorf("source %s: %w", source, err)
+		}
+		trees[source] = tree
+	}
+	r.trees = trees
+	return nil
+}
+
+// ReadRegistrySnapshot decodes a registry snapshot from r. A single-tree
+// Snapshot is accepted too and assigned to DefaultSource.
+func ReadRegistrySnapshot(r io.Reader) (*RegistrySnapshot, error) {
+	var file struct {
+		RegistrySnapshot
+		Root *NodeSnapshot `json:"root"`
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot: %w", err)
+	}
+	if file.Sources != nil || file.Root == nil {
+		return &file.RegistrySnapshot, nil
+	}
+
+	var single Snapshot
+	if err := json.Unmarshal(data, &single); err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot: %w", err)
+	}
+	return &RegistrySnapshot{
+		Version: single.Version,
+		Sources: map[string]*Snapshot{DefaultSource: &single},
+	}, nil
+}
+
+// SaveSnapshot atomically writes a snapshot of every tree to path.
+func (r *Registry) SaveSnapshot(path string) error {
+	return writeFileAtomic(path, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(r.Snapshot())
+	})
+}
+
+// LoadSnapshot restores the registry from the snapshot file at path.
+func (r *Registry) LoadSnapshot(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	snap, err := ReadRegistrySnapshot(f)
+	if err != nil {
+		return err
+	}
+	return r.Restore(snap)
+}
@@ -0,0 +1,129 @@
+package drain
+
+import (
+	"math/rand"
+)
+
+// sampleClaim is a place in a cluster's reservoir of sample logs, claimed
+// for a log by sampleLog and filled by placeSample.
+type sampleClaim struct {
+	cluster *LogCluster // Nil if the log is not sampled
+	slot    int         // Sample to replace, or -1 to append
+	claim   uint64      // Number of the replacement claim
+}
+
+// sampleLog decides whether the log joins the cluster's reservoir of sample
+// logs, recording the decision in sample. Every log seen by the cluster has
+// an equal chance of being retained. The caller must hold cluster.mu and
+// have already counted the log in cluster.Size.
+func (dt *DrainTree) sampleLog(cluster *LogCluster, sample *sampleClaim) {
+	if dt.maxSampleLogs <= 0 {
+		return
+	}
+
+	if len(cluster.SampleLogs)+cluster.pendingSamples < dt.maxSampleLogs {
+		cluster.pendingSamples++
+		*sample = sampleClaim{cluster: cluster, slot: -1}
+		return
+	}
+
+	if j := rand.Int63n(cluster.Size); j < int64(len(cluster.SampleLogs)) {
+		cluster.sampleClaims++
+		if cluster.slotClaims == nil {
+			cluster.slotClaims = make(map[int]uint64)
+		}
+		cluster.slotClaims[int(j)] = cluster.sampleClaims
+		*sample = sampleClaim{cluster: cluster, slot: int(j), claim: cluster.sampleClaims}
+	}
+}
+
+// placeSample redacts line and stores it where sampleLog decided, unless a
+// later log has claimed the same slot since. Redaction is slow, so it runs
+// without the tree or cluster lock held.
+func (dt *DrainTree) placeSample(sample sampleClaim, line string) {
+	if sample.cluster == nil {
+		return
+	}
+	redacted := dt.redactSample(line)
+
+	cluster := sample.cluster
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+
+	if sample.slot < 0 {
+		cluster.pendingSamples--
+		if len(cluster.SampleLogs) < dt.maxSampleLogs {
+			cluster.SampleLogs = append(cluster.SampleLogs, redacted)
+		}
+		return
+	}
+	if sample.slot < len(cluster.SampleLogs) && cluster.slotClaims[sample.slot] == sample.claim {
+		cluster.SampleLogs[sample.slot] = redacted
+		delete(cluster.slotClaims, sample.slot)
+	}
+}
+
+// redactSample applies Config.RedactSample, if set.
+func (dt *DrainTree) redactSample(line string) string {
+	if dt.sampleRedactor == nil {
+		return line
+	}
+	return dt.sampleRedactor(line)
+}
+
+// mergeSamples folds src's samples into dst's reservoir, weighting each
+// side by the number of logs it represents. Sizes are taken before the
+// merge. The caller must hold both cluster locks.
+func (dt *DrainTree) mergeSamples(dst, src *LogCluster, dstSize, srcSize int64) {
+	for _, sample := range src.SampleLogs {
+		if len(dst.SampleLogs) < dt.maxSampleLogs {
+			dst.SampleLogs = append(dst.SampleLogs, sample)
+			continue
+		}
+		if len(dst.SampleLogs) == 0 || dstSize+srcSize == 0 {
+			return
+		}
+		if rand.Int63n(dstSize+srcSize) < srcSize {
+			dst.SampleLogs[rand.Intn(len(dst.SampleLogs))] = sample
+		}
+	}
+}
+
+// ClusterInfo is a point-in-time copy of a LogCluster that is safe to
+// share and serialize.
+type ClusterInfo struct {
+	ID         string              `json:"id"`
+	Template   string              `json:"template"`
+	Size       int64               `json:"log_count"`
+	FirstSeen  int64               `json:"first_seen"`
+	LastSeen   int64               `json:"last_seen"`
+	SampleLogs []string            `json:"sample_logs"`
+	Pinned     bool                `json:"pinned"`
+	Slots      []string            `json:"slots"` // Variable keys in template order
+	Schema     map[string]SlotType `json:"schema"`
+}
+
+// Info returns a copy of the cluster's current state.
+func (c *LogCluster) Info() ClusterInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return ClusterInfo{
+		ID:         c.ID,
+		Template:   c.Template,
+		Size:       c.Size,
+		FirstSeen:  c.FirstSeen,
+		LastSeen:   c.LastSeen,
+		SampleLogs: append([]string{}, c.SampleLogs...),
+		Pinned:     c.Pinned,
+		Slots:      c.slotList(),
+		Schema:     c.schema(),
+	}
+}
+
+// Samples returns a copy of the cluster's sample logs.
+func (c *LogCluster) Samples() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string{}, c.SampleLogs...)
+}
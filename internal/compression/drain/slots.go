@@ -0,0 +1,201 @@
+package drain
+
+import (
+	"math"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SlotType is the inferred type of a template's variable slot.
+type SlotType string
+
+// Slot types, from most to least specific.
+const (
+	SlotInt      SlotType = "int"
+	SlotFloat    SlotType = "float"
+	SlotDuration SlotType = "duration"
+	SlotIP       SlotType = "ip"
+	SlotUUID     SlotType = "uuid"
+	SlotEnum     SlotType = "enum"
+	SlotString   SlotType = "string"
+)
+
+// Enum inference limits. A slot is an enum while it has taken at most
+// EnumLimit distinct values and each was seen EnumMinRepeat times on
+// average.
+const (
+	EnumLimit     = 16
+	EnumMinRepeat = 4
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// SlotStats accumulates the values observed in one variable slot. The
+// inferred type only widens as more values are seen, except that an enum
+// becomes a string once it has too many distinct values.
+type SlotStats struct {
+	Observed  int64            `json:"observed"`
+	Ints      int64            `json:"ints,omitempty"`
+	Floats    int64            `json:"floats,omitempty"`
+	Durations int64            `json:"durations,omitempty"`
+	IPs       int64            `json:"ips,omitempty"`
+	UUIDs     int64            `json:"uuids,omitempty"`
+	Values    map[string]int64 `json:"values,omitempty"` // Distinct values, until there are more than EnumLimit
+	Overflow  bool             `json:"overflow,omitempty"`
+}
+
+// observe records one value.
+func (s *SlotStats) observe(value string) {
+	s.Observed++
+
+	if _, err := strconv.ParseInt(value, 10, 64); err == nil {
+		s.Ints++
+	} else if _, err := strconv.ParseFloat(value, 64); err == nil {
+		s.Floats++
+	} else if _, err := time.ParseDuration(value); err == nil {
+		s.Durations++
+	} else if net.ParseIP(value) != nil {
+		s.IPs++
+	} else if uuidPattern.MatchString(value) {
+		s.UUIDs++
+	}
+
+	if s.Overflow {
+		return
+	}
+	if s.Values == nil {
+		s.Values = make(map[string]int64)
+	}
+	s.Values[value]++
+	if len(s.Values) > EnumLimit {
+		s.Values = nil
+		s.Overflow = true
+	}
+}
+
+// Type returns the type inferred from the values seen so far.
+func (s *SlotStats) Type() SlotType {
+	switch {
+	case s.Observed == 0:
+		return SlotString
+	case s.Ints == s.Observed:
+		return SlotInt
+	case s.Ints+s.Floats == s.Observed:
+		return SlotFloat
+	case s.Durations == s.Observed:
+		return SlotDuration
+	case s.IPs == s.Observed:
+		return SlotIP
+	case s.UUIDs == s.Observed:
+		return SlotUUID
+	case !s.Overflow && s.Observed >= EnumMinRepeat*int64(len(s.Values)):
+		return SlotEnum
+	default:
+		return SlotString
+	}
+}
+
+// clone returns a deep copy of s.
+func (s *SlotStats) clone() *SlotStats {
+	c := *s
+	if s.Values != nil {
+		c.Values = make(map[string]int64, len(s.Values))
+		for value, n := range s.Values {
+			c.Values[value] = n
+		}
+	}
+	return &c
+}
+
+// observeSlots records the variables of a log parsed into cluster and
+// returns the current type of each. Reserved keys are skipped. Stats are
+// dropped whenever the template changes, since slot keys may shift.
+func (dt *DrainTree) observeSlots(cluster *LogCluster, template string, variables map[string]string) map[string]SlotType {
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+
+	if cluster.Template != template {
+		return nil
+	}
+	if cluster.slots == nil || cluster.slotsTemplate != template {
+		cluster.slots = make(map[string]*SlotStats)
+		cluster.slotsTemplate = template
+	}
+
+	types := make(map[string]SlotType, len(variables))
+	for key, value := range variables {
+		if strings.HasPrefix(key, "_") {
+			continue
+		}
+		stats, ok := cluster.slots[key]
+		if !ok {
+			stats = &SlotStats{}
+			cluster.slots[key] = stats
+		}
+		stats.observe(value)
+		types[key] = stats.Type()
+	}
+	return types
+}
+
+// schema returns the inferred type of each slot. The caller must hold
+// cluster.mu.
+func (c *LogCluster) schema() map[string]SlotType {
+	if c.slotsTemplate != c.Template {
+		return map[string]SlotType{}
+	}
+	schema := make(map[string]SlotType, len(c.slots))
+	for key, stats := range c.slots {
+		schema[key] = stats.Type()
+	}
+	return schema
+}
+
+// Schema returns the inferred type of each variable slot of a template.
+func (dt *DrainTree) Schema(id string) (map[string]SlotType, bool) {
+	cluster, ok := dt.GetCluster(id)
+	if !ok {
+		return nil, false
+	}
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+	return cluster.schema(), true
+}
+
+// NumericValue converts a variable to a number for a numeric slot type.
+// Durations are returned in milliseconds.
+func NumericValue(slotType SlotType, value string) (float64, bool) {
+	switch slotType {
+	case SlotInt, SlotFloat:
+		f, err := strconv.ParseFloat(value, 64)
+		return f, err == nil
+	case SlotDuration:
+		d, err := time.ParseDuration(value)
+		return float64(d) / float64(time.Millisecond), err == nil
+	}
+	return 0, false
+}
+
+// NumericVariables returns every variable that parses as a number or a
+// duration, for storage in typed columns. It does not depend on the slot
+// types, which change as a template is generalized, so whether a value is
+// stored is the same for every log. Reserved keys are skipped.
+func NumericVariables(variables map[string]string) map[string]float64 {
+	numeric := make(map[string]float64)
+	for key, value := range variables {
+		if strings.HasPrefix(key, "_") {
+			continue
+		}
+		n, ok := NumericValue(SlotFloat, value)
+		if !ok {
+			n, ok = NumericValue(SlotDuration, value)
+		}
+		if ok && !math.IsNaN(n) && !math.IsInf(n, 0) {
+			numeric[key] = n
+		}
+	}
+	return numeric
+}
@@ -0,0 +1,386 @@
+package drain
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// SnapshotVersion is the current on-disk snapshot format version.
+// Version 2 added aliases, retired templates, pins, slot statistics and
+// masking rules.
+const SnapshotVersion = 2
+
+// Snapshot is a serializable copy of a DrainTree's learned state.
+type Snapshot struct {
+	Version  int                `json:"version"`
+	Config   SnapshotConfig     `json:"config"`
+	Root     *NodeSnapshot      `json:"root"`
+	Clusters []*ClusterSnapshot `json:"clusters"`
+	Aliases  map[string]string  `json:"aliases,omitempty"`
+	Retired  map[string]string  `json:"retired,omitempty"`
+}
+
+// SnapshotConfig records the tree parameters the snapshot was taken with.
+type SnapshotConfig struct {
+	MaxDepth     int     `json:"max_depth"`
+	SimThreshold float64 `json:"sim_threshold"`
+	MaxChildren  int     `json:"max_children"`
+	MaxClusters  int     `json:"max_clusters"`
+
+	MaskingRules []MaskingRule `json:"masking_rules,omitempty"` // Custom rules only
+}
+
+// NodeSnapshot is the serialized form of a ClusterNode.
+// Clusters are referenced by ID.
+type NodeSnapshot struct {
+	Depth    int                      `json:"depth"`
+	Children map[string]*NodeSnapshot `json:"children,omitempty"`
+	Clusters []string                 `json:"clusters,omitempty"`
+}
+
+// ClusterSnapshot is the serialized form of a LogCluster.
+type ClusterSnapshot struct {
+	ID         string                `json:"id"`
+	Template   string                `json:"template"`
+	Tokens     []string              `json:"tokens"`
+	Size       int64                 `json:"size"`
+	FirstSeen  int64                 `json:"first_seen"`
+	LastSeen   int64                 `json:"last_seen"`
+	SampleLogs []string              `json:"sample_logs,omitempty"`
+	Pinned     bool                  `json:"pinned,omitempty"`
+	Slots      map[string]*SlotStats `json:"slots,omitempty"`
+	SlotNames  map[int]string        `json:"slot_names,omitempty"` // Operator overrides by token position
+}
+
+// Snapshot captures the current state of the tree.
+func (dt *DrainTree) Snapshot() *Snapshot {
+	dt.mu.RLock()
+	defer dt.mu.RUnlock()
+
+	snap := &Snapshot{
+		Version: SnapshotVersion,
+		Config: SnapshotConfig{
+			MaxDepth:     dt.maxDepth,
+			SimThreshold: dt.simThreshold,
+			MaxChildren:  dt.maxChildren,
+			MaxClusters:  dt.maxClusters,
+			MaskingRules: append([]MaskingRule(nil), dt.maskingRules...),
+		},
+		Root:     snapshotNode(dt.root),
+		Clusters: make([]*ClusterSnapshot, 0, len(dt.clusters)),
+	}
+
+	for _, cluster := range dt.clusters {
+		snap.Clusters = append(snap.Clusters, snapshotCluster(cluster))
+	}
+
+	if len(dt.aliases) > 0 {
+		snap.Aliases = make(map[string]string, len(dt.aliases))
+		for alias, id := range dt.aliases {
+			snap.Aliases[alias] = id
+		}
+	}
+
+	if len(dt.retired) > 0 {
+		snap.Retired = make(map[string]string, len(dt.retired))
+		for id, template := range dt.retired {
+			snap.Retired[id] = template
+		}
+	}
+
+	return snap
+}
+
+// snapshotNode recursively copies a tree node.
+func snapshotNode(node *ClusterNode) *NodeSnapshot {
+	ns := &NodeSnapshot{Depth: node.Depth}
+
+	if len(node.KeyToChildNode) > 0 {
+		ns.Children = make(map[string]*NodeSnapshot, len(node.KeyToChildNode))
+		for key, child := range node.KeyToChildNode {
+			ns.Children[key] = snapshotNode(child)
+		}
+	}
+
+	for _, cluster := range node.Clusters {
+		ns.Clusters = append(ns.Clusters, cluster.ID)
+	}
+
+	return ns
+}
+
+// snapshotCluster copies a cluster under its lock.
+func snapshotCluster(cluster *LogCluster) *ClusterSnapshot {
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+
+	cs := &ClusterSnapshot{
+		ID:        cluster.ID,
+		Template:  cluster.Template,
+		Tokens:    append([]string(nil), cluster.Tokens...),
+		Size:      cluster.Size,
+		FirstSeen: cluster.FirstSeen,
+		LastSeen:  cluster.LastSeen,
+		Pinned:    cluster.Pinned,
+	}
+	if len(cluster.SampleLogs) > 0 {
+		cs.SampleLogs = append([]string(nil), cluster.SampleLogs...)
+	}
+	if len(cluster.nameOverrides) > 0 {
+		cs.SlotNames = copyOverrides(cluster)
+	}
+	if len(cluster.slots) > 0 && cluster.slotsTemplate == cluster.Template {
+		cs.Slots = make(map[string]*SlotStats, len(cluster.slots))
+		for key, stats := range cluster.slots {
+			cs.Slots[key] = stats.clone()
+		}
+	}
+	return cs
+}
+
+// checkCompatible returns an error if templates learned with the snapshot's
+// configuration would not be valid for this tree. MaxDepth and MaxClusters
+// may differ: the index is rebuilt and limits are enforced on the next
+// insert.
+func (dt *DrainTree) checkCompatible(config SnapshotConfig) error {
+	if config.SimThreshold != dt.simThreshold {
+		return fmt.Errorf("snapshot similarity threshold %v does not match %v", config.SimThreshold, dt.simThreshold)
+	}
+	if config.MaxChildren != dt.maxChildren {
+		return fmt.Errorf("snapshot max children %d does not match %d", config.MaxChildren, dt.maxChildren)
+	}
+	if len(config.MaskingRules) != len(dt.maskingRules) {
+		return fmt.Errorf("snapshot has %d masking rules, tree has %d", len(config.MaskingRules), len(dt.maskingRules))
+	}
+	for i, rule := range config.MaskingRules {
+		if rule != dt.maskingRules[i] {
+			return fmt.Errorf("snapshot masking rule %q does not match %q", rule.Name, dt.maskingRules[i].Name)
+		}
+	}
+	return nil
+}
+
+// Restore replaces the tree's state with the given snapshot.
+// If the snapshot was taken with a different MaxDepth, the tree index is
+// rebuilt from the clusters instead of being copied. Snapshots taken with
+// a different similarity threshold, max children or masking rules are
+// rejected. Version 1 snapshots predate the current ID scheme, so their
+// clusters are given new IDs, with the old ones kept as aliases.
+func (dt *DrainTree) Restore(snap *Snapshot) error {
+	if snap == nil {
+		return fmt.Errorf("nil snapshot")
+	}
+	if snap.Version < 1 || snap.Version > SnapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", snap.Version)
+	}
+	if err := dt.checkCompatible(snap.Config); err != nil {
+		return fmt.Errorf("incompatible snapshot: %w", err)
+	}
+
+	clusters := make(map[string]*LogCluster, len(snap.Clusters))
+	for _, cs := range snap.Clusters {
+		if cs.ID == "" {
+			return fmt.Errorf("snapshot contains cluster without ID")
+		}
+		cluster := &LogCluster{
+			ID:         cs.ID,
+			Template:   cs.Template,
+			Tokens:     append([]string(nil), cs.Tokens...),
+			Size:       cs.Size,
+			FirstSeen:  cs.FirstSeen,
+			LastSeen:   cs.LastSeen,
+			SampleLogs: append(make([]string, 0, len(cs.SampleLogs)), cs.SampleLogs...),
+			Pinned:     cs.Pinned,
+		}
+		for i, name := range cs.SlotNames {
+			if cluster.nameOverrides == nil {
+				cluster.nameOverrides = make(map[int]string, len(cs.SlotNames))
+			}
+			cluster.nameOverrides[i] = name
+		}
+		dt.refreshSlotNames(cluster)
+		if len(cs.Slots) > 0 {
+			cluster.slots = make(map[string]*SlotStats, len(cs.Slots))
+			cluster.slotsTemplate = cs.Template
+			for key, stats := range cs.Slots {
+				if stats != nil {
+					cluster.slots[key] = stats.clone()
+				}
+			}
+		}
+		clusters[cs.ID] = cluster
+	}
+
+	aliases := make(map[string]string, len(snap.Aliases))
+	for alias, id := range snap.Aliases {
+		aliases[alias] = id
+	}
+
+	retired := make(map[string]string, len(snap.Retired))
+	for id, template := range snap.Retired {
+		retired[id] = template
+	}
+
+	rebuild := snap.Root == nil || snap.Config.MaxDepth != dt.maxDepth
+	if snap.Version < 2 {
+		// The tree index references the old IDs, so it is rebuilt too
+		clusters = dt.upgradeIDs(clusters, aliases)
+		rebuild = true
+	}
+
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+
+	var root *ClusterNode
+	if !rebuild {
+		var err error
+		root, err = restoreNode(snap.Root, clusters)
+		if err != nil {
+			return err
+		}
+	} else {
+		root = &ClusterNode{KeyToChildNode: make(map[string]*ClusterNode)}
+		for _, cluster := range clusters {
+			dt.addToTree(root, cluster, cluster.Tokens, 1)
+		}
+	}
+
+	dt.root = root
+	dt.clusters = clusters
+	dt.aliases = aliases
+	dt.retired = retired
+
+	// Rebuild the per-cluster list of retired IDs used by eviction
+	for alias := range aliases {
+		if id, ok := dt.resolveID(alias); ok {
+			clusters[id].retiredIDs = append(clusters[id].retiredIDs, alias)
+		}
+	}
+	return nil
+}
+
+// upgradeIDs gives clusters restored from a version 1 snapshot the IDs the
+// current scheme derives from the source and template, recording each old
+// ID as an alias. Clusters whose templates now share an ID are merged.
+func (dt *DrainTree) upgradeIDs(clusters map[string]*LogCluster, aliases map[string]string) map[string]*LogCluster {
+	oldIDs := make([]string, 0, len(clusters))
+	for oldID := range clusters {
+		oldIDs = append(oldIDs, oldID)
+	}
+	sort.Strings(oldIDs)
+
+	upgraded := make(map[string]*LogCluster, len(clusters))
+	for _, oldID := range oldIDs {
+		cluster := clusters[oldID]
+		id := dt.generateClusterID(cluster.Tokens)
+		if id != oldID {
+			aliases[oldID] = id
+		}
+
+		existing, ok := upgraded[id]
+		if !ok {
+			cluster.ID = id
+			upgraded[id] = cluster
+			continue
+		}
+		dt.mergeSamples(existing, cluster, existing.Size, cluster.Size)
+		existing.Size += cluster.Size
+		if cluster.FirstSeen < existing.FirstSeen {
+			existing.FirstSeen = cluster.FirstSeen
+		}
+		if cluster.LastSeen > existing.LastSeen {
+			existing.LastSeen = cluster.LastSeen
+		}
+		existing.Pinned = existing.Pinned || cluster.Pinned
+	}
+	return upgraded
+}
+
+// restoreNode recursively rebuilds a tree node, resolving cluster IDs.
+func restoreNode(ns *NodeSnapshot, clusters map[string]*LogCluster) (*ClusterNode, error) {
+	node := &ClusterNode{
+		KeyToChildNode: make(map[string]*ClusterNode, len(ns.Children)),
+		Depth:          ns.Depth,
+	}
+
+	for key, childSnap := range ns.Children {
+		child, err := restoreNode(childSnap, clusters)
+		if err != nil {
+			return nil, err
+		}
+		node.KeyToChildNode[key] = child
+	}
+
+	for _, id := range ns.Clusters {
+		cluster, ok := clusters[id]
+		if !ok {
+			return nil, fmt.Errorf("snapshot node references unknown cluster %s", id)
+		}
+		addToLeaf(node, cluster)
+	}
+
+	return node, nil
+}
+
+// WriteSnapshot encodes a snapshot of the tree to w.
+func (dt *DrainTree) WriteSnapshot(w io.Writer) error {
+	return json.NewEncoder(w).Encode(dt.Snapshot())
+}
+
+// ReadSnapshot decodes a snapshot from r.
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	var snap Snapshot
+	if err := json.NewDecoder(r).Decode(&snap); err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot: %w", err)
+	}
+	return &snap, nil
+}
+
+// SaveSnapshot atomically writes a snapshot of the tree to path.
+func (dt *DrainTree) SaveSnapshot(path string) error {
+	return writeFileAtomic(path, dt.WriteSnapshot)
+}
+
+// writeFileAtomic writes a snapshot file with write, syncing it to a
+// temporary file first and renaming it over path so readers never see a
+// partial snapshot.
+func writeFileAtomic(path string, write func(io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close snapshot: %w", err)
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadSnapshot restores the tree from the snapshot file at path.
+func (dt *DrainTree) LoadSnapshot(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	snap, err := ReadSnapshot(f)
+	if err != nil {
+		return err
+	}
+	return dt.Restore(snap)
+}
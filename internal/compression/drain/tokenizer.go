@@ -0,0 +1,131 @@
+package drain
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Tokenizer splits a log message into tokens for clustering.
+type Tokenizer interface {
+	// Tokenize returns the tokens of content and the separators around
+	// them. There is one more separator than tokens (leading and trailing
+	// included), so interleaving the two yields content again.
+	Tokenize(content string) (tokens []string, separators []string)
+}
+
+// DefaultTokenizer splits on whitespace and any extra delimiter characters,
+// optionally keeping quoted strings together as single tokens.
+type DefaultTokenizer struct {
+	ExtraDelimiters string // Characters treated as separators besides whitespace
+	QuotedStrings   bool   // Keep "..." and '...' as one token
+}
+
+// NewTokenizer returns the tokenizer described by config.
+func NewTokenizer(config Config) Tokenizer {
+	if config.Tokenizer != nil {
+		return config.Tokenizer
+	}
+	return &DefaultTokenizer{
+		ExtraDelimiters: config.ExtraDelimiter,
+		QuotedStrings:   config.QuotedStrings,
+	}
+}
+
+// Tokenize implements Tokenizer.
+func (t *DefaultTokenizer) Tokenize(content string) ([]string, []string) {
+	var tokens, separators []string
+	start := 0
+	inToken := false
+	var quote rune
+
+	for i, r := range content {
+		if quote != 0 {
+			if r == quote {
+				quote = 0
+			}
+			continue
+		}
+		if t.isDelimiter(r) {
+			if inToken {
+				tokens = append(tokens, content[start:i])
+				start = i
+				inToken = false
+			}
+			continue
+		}
+		if !inToken {
+			separators = append(separators, content[start:i])
+			start = i
+			inToken = true
+			if t.QuotedStrings && (r == '"' || r == '\'') {
+				quote = r
+			}
+		}
+	}
+
+	if inToken {
+		tokens = append(tokens, content[start:])
+		separators = append(separators, "")
+	} else {
+		separators = append(separators, content[start:])
+	}
+	return tokens, separators
+}
+
+// TokenCount returns the number of tokens the tree's tokenizer splits
+// content into. Callers that append tokens to a line before parsing it use
+// it to record SignatureKey.
+func (dt *DrainTree) TokenCount(content string) int {
+	tokens, _ := dt.tokenizer.Tokenize(content)
+	return len(tokens)
+}
+
+// isDelimiter reports whether r separates tokens.
+func (t *DefaultTokenizer) isDelimiter(r rune) bool {
+	return unicode.IsSpace(r) || (t.ExtraDelimiters != "" && strings.ContainsRune(t.ExtraDelimiters, r))
+}
+
+// HeaderKey is the reserved variable key holding the raw header prefix
+// stripped from a log line, so the line can be reconstructed.
+const HeaderKey = "_header"
+
+// compileHeader compiles the configured header pattern, anchoring it to the
+// start of the line. Invalid patterns disable header handling.
+func compileHeader(pattern string) *regexp.Regexp {
+	if pattern == "" {
+		return nil
+	}
+	if !strings.HasPrefix(pattern, "^") {
+		pattern = "^(?:" + pattern + ")"
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil
+	}
+	return re
+}
+
+// splitHeader strips the structured prefix (timestamp, level, logger, ...)
+// from content. It returns the raw header, its named fields and the rest of
+// the line. Lines that do not match are returned unchanged.
+func (dt *DrainTree) splitHeader(content string) (string, map[string]string, string) {
+	if dt.header == nil {
+		return "", nil, content
+	}
+
+	match := dt.header.FindStringSubmatchIndex(content)
+	if match == nil || match[1] == 0 {
+		return "", nil, content
+	}
+
+	fields := make(map[string]string)
+	for i, name := range dt.header.SubexpNames() {
+		if name == "" || match[2*i] < 0 {
+			continue
+		}
+		fields[name] = content[match[2*i]:match[2*i+1]]
+	}
+
+	return content[:match[1]], fields, content[match[1]:]
+}
@@ -0,0 +1,323 @@
+// Package eval measures Drain parsing quality against labeled log datasets
+// in the LogHub format, so changes to the similarity threshold, tree depth
+// or masking rules can be compared on real data.
+package eval
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/log-zero/log-zero/internal/compression/drain"
+)
+
+// Sample is one labeled log message.
+type Sample struct {
+	Content  string // Message without its header, as fed to Drain
+	EventID  string // Ground-truth template ID
+	Template string // Ground-truth template, with <*> for variables
+}
+
+// Dataset is a named set of labeled log messages.
+type Dataset struct {
+	Name    string
+	Samples []Sample
+}
+
+// LoadCSV reads a LogHub structured CSV such as HDFS_2k.log_structured.csv.
+// The dataset is named after the file.
+func LoadCSV(path string) (*Dataset, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	name := filepath.Base(path)
+	for _, suffix := range []string{".csv", "_structured", ".log", "_full", "_2k"} {
+		name = strings.TrimSuffix(name, suffix)
+	}
+	return ReadCSV(name, file)
+}
+
+// ReadCSV reads a LogHub structured CSV. It needs a Content column and an
+// EventId or EventTemplate column; rows are grouped by EventId when present
+// and by EventTemplate otherwise.
+func ReadCSV(name string, r io.Reader) (*Dataset, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, col := range header {
+		columns[strings.TrimSpace(strings.TrimPrefix(col, "\ufeff"))] = i
+	}
+
+	content, ok := columns["Content"]
+	if !ok {
+		return nil, fmt.Errorf("missing Content column")
+	}
+	eventID, hasID := columns["EventId"]
+	template, hasTemplate := columns["EventTemplate"]
+	if !hasID && !hasTemplate {
+		return nil, fmt.Errorf("missing EventId or EventTemplate column")
+	}
+
+	field := func(record []string, i int, ok bool) string {
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return record[i]
+	}
+
+	dataset := &Dataset{Name: name}
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		sample := Sample{
+			Content:  field(record, content, true),
+			EventID:  field(record, eventID, hasID),
+			Template: field(record, template, hasTemplate),
+		}
+		if sample.EventID == "" {
+			sample.EventID = sample.Template
+		}
+		dataset.Samples = append(dataset.Samples, sample)
+	}
+
+	if len(dataset.Samples) == 0 {
+		return nil, fmt.Errorf("dataset %s has no rows", name)
+	}
+	return dataset, nil
+}
+
+// Result holds the accuracy and speed of Drain on a dataset.
+//
+// Grouping accuracy is the fraction of messages whose predicted group holds
+// exactly the messages of their true group. Parsing accuracy is the fraction
+// whose final template equals the true template once every placeholder is
+// written as <*>. Precision, recall and F1 are computed over pairs of
+// messages placed in the same group.
+type Result struct {
+	Dataset          string        `json:"dataset"`
+	Lines            int           `json:"lines"`
+	Errors           int           `json:"errors"` // Messages Drain rejected, such as empty ones
+	Templates        int           `json:"templates"`
+	TrueTemplates    int           `json:"true_templates"`
+	GroupingAccuracy float64       `json:"grouping_accuracy"`
+	ParsingAccuracy  float64       `json:"parsing_accuracy"`
+	Precision        float64       `json:"precision"`
+	Recall           float64       `json:"recall"`
+	F1               float64       `json:"f1"`
+	Duration         time.Duration `json:"duration_ns"`
+	Throughput       float64       `json:"throughput"` // Messages per second
+}
+
+// String formats the result as one summary line.
+func (r *Result) String() string {
+	return fmt.Sprintf("%-12s lines=%d templates=%d/%d GA=%.4f PA=%.4f P=%.4f R=%.4f F1=%.4f %.0f lines/s",
+		r.Dataset, r.Lines, r.Templates, r.TrueTemplates, r.GroupingAccuracy, r.ParsingAccuracy,
+		r.Precision, r.Recall, r.F1, r.Throughput)
+}
+
+// Evaluate parses every message of dataset with a new DrainTree built from
+// config and scores the final templates against the labels.
+func Evaluate(dataset *Dataset, config drain.Config) *Result {
+	dt := drain.NewDrainTree(config)
+
+	predicted := make([]string, len(dataset.Samples))
+	errors := 0
+	start := time.Now()
+	for i, sample := range dataset.Samples {
+		result, err := dt.Parse(sample.Content, int64(i))
+		if err != nil {
+			errors++
+			predicted[i] = fmt.Sprintf("error_%d", i)
+			continue
+		}
+		predicted[i] = result.TemplateID
+	}
+	duration := time.Since(start)
+
+	// Score against the final templates; clusters generalized or merged
+	// since a message was parsed are found through their aliases
+	templates := make(map[string]string)
+	for i, id := range predicted {
+		if current, ok := dt.ResolveID(id); ok {
+			predicted[i] = current
+		}
+		if _, ok := templates[predicted[i]]; !ok {
+			if cluster, ok := dt.GetCluster(predicted[i]); ok {
+				templates[predicted[i]] = cluster.Info().Template
+			}
+		}
+	}
+
+	result := &Result{
+		Dataset:  dataset.Name,
+		Lines:    len(dataset.Samples),
+		Errors:   errors,
+		Duration: duration,
+	}
+	if seconds := duration.Seconds(); seconds > 0 {
+		result.Throughput = float64(len(dataset.Samples)) / seconds
+	}
+	scoreGroups(result, dataset, predicted)
+
+	correct := 0
+	for i, sample := range dataset.Samples {
+		if template, ok := templates[predicted[i]]; ok && normalizeTemplate(template) == normalizeTemplate(sample.Template) {
+			correct++
+		}
+	}
+	result.ParsingAccuracy = float64(correct) / float64(len(dataset.Samples))
+	return result
+}
+
+// scoreGroups fills in the grouping accuracy and pairwise scores.
+func scoreGroups(result *Result, dataset *Dataset, predicted []string) {
+	predictedSize := make(map[string]int)
+	trueSize := make(map[string]int)
+	type pair struct{ predicted, truth string }
+	overlap := make(map[pair]int)
+	truthsOf := make(map[string]map[string]bool)
+
+	for i, sample := range dataset.Samples {
+		predictedSize[predicted[i]]++
+		trueSize[sample.EventID]++
+		overlap[pair{predicted[i], sample.EventID}]++
+		if truthsOf[predicted[i]] == nil {
+			truthsOf[predicted[i]] = make(map[string]bool)
+		}
+		truthsOf[predicted[i]][sample.EventID] = true
+	}
+	result.Templates = len(predictedSize)
+	result.TrueTemplates = len(trueSize)
+
+	// A predicted group is correct if it is exactly one true group
+	correct := 0
+	for id, size := range predictedSize {
+		if len(truthsOf[id]) != 1 {
+			continue
+		}
+		for truth := range truthsOf[id] {
+			if trueSize[truth] == size {
+				correct += size
+			}
+		}
+	}
+	result.GroupingAccuracy = float64(correct) / float64(len(dataset.Samples))
+
+	var predictedPairs, truePairs, correctPairs float64
+	for _, n := range predictedSize {
+		predictedPairs += pairs(n)
+	}
+	for _, n := range trueSize {
+		truePairs += pairs(n)
+	}
+	for _, n := range overlap {
+		correctPairs += pairs(n)
+	}
+	if predictedPairs > 0 {
+		result.Precision = correctPairs / predictedPairs
+	}
+	if truePairs > 0 {
+		result.Recall = correctPairs / truePairs
+	}
+	if result.Precision+result.Recall > 0 {
+		result.F1 = 2 * result.Precision * result.Recall / (result.Precision + result.Recall)
+	}
+}
+
+// pairs returns the number of unordered pairs among n messages.
+func pairs(n int) float64 {
+	return float64(n) * float64(n-1) / 2
+}
+
+// normalizeTemplate writes every placeholder, typed or not, as <*> and
+// collapses whitespace, so Drain templates compare with LogHub labels.
+func normalizeTemplate(template string) string {
+	tokens := strings.Fields(template)
+	for i, token := range tokens {
+		if len(token) > 2 && token[0] == '<' && token[len(token)-1] == '>' {
+			tokens[i] = drain.Wildcard
+		}
+	}
+	return strings.Join(tokens, " ")
+}
+
+// EvaluateAll evaluates each dataset with config.
+func EvaluateAll(datasets []*Dataset, config drain.Config) []*Result {
+	results := make([]*Result, 0, len(datasets))
+	for _, dataset := range datasets {
+		results = append(results, Evaluate(dataset, config))
+	}
+	return results
+}
+
+// LoadDir loads every *_structured.csv file in dir, sorted by name.
+func LoadDir(dir string) ([]*Dataset, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*_structured.csv"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no *_structured.csv files in %s", dir)
+	}
+
+	datasets := make([]*Dataset, 0, len(paths))
+	for _, path := range paths {
+		dataset, err := LoadCSV(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		datasets = append(datasets, dataset)
+	}
+	return datasets, nil
+}
+
+// Mean averages the scores of several results, weighting datasets equally
+// as LogHub benchmarks do.
+func Mean(results []*Result) *Result {
+	mean := &Result{Dataset: "average"}
+	if len(results) == 0 {
+		return mean
+	}
+	var duration time.Duration
+	for _, r := range results {
+		mean.Lines += r.Lines
+		mean.Errors += r.Errors
+		mean.Templates += r.Templates
+		mean.TrueTemplates += r.TrueTemplates
+		mean.GroupingAccuracy += r.GroupingAccuracy
+		mean.ParsingAccuracy += r.ParsingAccuracy
+		mean.Precision += r.Precision
+		mean.Recall += r.Recall
+		mean.F1 += r.F1
+		duration += r.Duration
+	}
+	n := float64(len(results))
+	mean.GroupingAccuracy /= n
+	mean.ParsingAccuracy /= n
+	mean.Precision /= n
+	mean.Recall /= n
+	mean.F1 /= n
+	mean.Duration = duration
+	if seconds := duration.Seconds(); seconds > 0 {
+		mean.Throughput = float64(mean.Lines) / seconds
+	}
+	return mean
+}
@@ -0,0 +1,83 @@
+package eval
+
+import (
+	"math"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/log-zero/log-zero/internal/compression/drain"
+)
+
+func TestEvaluate_Sample(t *testing.T) {
+	dataset, err := LoadCSV("testdata/Sample_2k.log_structured.csv")
+	if err != nil {
+		t.Fatalf("LoadCSV failed: %v", err)
+	}
+	if dataset.Name != "Sample" || len(dataset.Samples) != 12 {
+		t.Fatalf("Unexpected dataset %q with %d samples", dataset.Name, len(dataset.Samples))
+	}
+
+	result := Evaluate(dataset, drain.DefaultConfig())
+	t.Log(result)
+	if result.TrueTemplates != 5 {
+		t.Errorf("Expected 5 true templates, got %d", result.TrueTemplates)
+	}
+	if result.GroupingAccuracy != 1 || result.F1 != 1 {
+		t.Errorf("Expected perfect grouping on the sample, got %s", result)
+	}
+}
+
+func TestScoreGroups(t *testing.T) {
+	dataset := &Dataset{Samples: []Sample{
+		{EventID: "A"}, {EventID: "A"}, {EventID: "A"},
+		{EventID: "B"}, {EventID: "B"},
+		{EventID: "C"},
+	}}
+	// A is split in two and B is merged with C
+	predicted := []string{"x", "x", "y", "z", "z", "z"}
+
+	result := &Result{}
+	scoreGroups(result, dataset, predicted)
+
+	if result.GroupingAccuracy != 0 {
+		t.Errorf("Expected grouping accuracy 0, got %v", result.GroupingAccuracy)
+	}
+	// Predicted pairs: x=1, z=3; true pairs: A=3, B=1; correct: x/A=1, z/B=1
+	if math.Abs(result.Precision-0.5) > 1e-9 || math.Abs(result.Recall-0.5) > 1e-9 {
+		t.Errorf("Expected precision and recall 0.5, got %v and %v", result.Precision, result.Recall)
+	}
+}
+
+func TestReadCSV_MissingColumns(t *testing.T) {
+	if _, err := ReadCSV("bad", strings.NewReader("LineId,Content\n1,hello\n")); err == nil {
+		t.Error("Expected error for CSV without labels")
+	}
+}
+
+func TestNormalizeTemplate(t *testing.T) {
+	if got := normalizeTemplate("Error  <NUM> at <IP> for <*>"); got != "Error <*> at <*> for <*>" {
+		t.Errorf("Unexpected normalized template %q", got)
+	}
+}
+
+// TestLogHub evaluates every *_structured.csv in $LOGHUB_DIR, for example
+// the 2k-line LogHub samples:
+//
+//	LOGHUB_DIR=/data/loghub go test ./internal/compression/eval -run LogHub -v
+func TestLogHub(t *testing.T) {
+	dir := os.Getenv("LOGHUB_DIR")
+	if dir == "" {
+		t.Skip("LOGHUB_DIR not set")
+	}
+	datasets, err := LoadDir(dir)
+	if err != nil {
+		t.Fatalf("LoadDir failed: %v", err)
+	}
+
+	results := EvaluateAll(datasets, drain.DefaultConfig())
+	for _, result := range results {
+		t.Log(result)
+	}
+	t.Log(Mean(results))
+}
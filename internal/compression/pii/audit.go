@@ -0,0 +1,293 @@
+package pii
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Finding is a redaction in one field of a log. It records where PII was
+// found, never the value.
+type Finding struct {
+	Field string `json:"field"` // Variable slot, attribute or LineField
+	Type  string `json:"type"`
+	Start int    `json:"start"` // Byte offsets in the original field value
+	End   int    `json:"end"`
+}
+
+// LineField is the Field of findings in a raw line, redacted before it
+// was parsed into variables.
+const LineField = "line"
+
+// RedactFields redacts the values of fields like RedactVariables and also
+// returns what was found, by field in key order.
+func (r *Redactor) RedactFields(fields map[string]string) (map[string]string, []Finding) {
+	if !r.enabled {
+		return fields, nil
+	}
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := make(map[string]string, len(fields))
+	var findings []Finding
+	for _, key := range keys {
+		redacted, spans := r.RedactSpans(fields[key])
+		result[key] = redacted
+		for _, span := range spans {
+			findings = append(findings, Finding{Field: key, Type: span.Type, Start: span.Start, End: span.End})
+		}
+	}
+	return result, findings
+}
+
+// Audit limits. Templates beyond maxAuditTemplates in a window are counted
+// in their source's totals but not ranked.
+const (
+	maxAuditTemplates = 10000
+	auditTopTemplates = 20
+	auditSamples      = 5 // Sample positions kept per type
+)
+
+// Audit counts redactions per source, type and template for compliance
+// reports. It is safe for concurrent use. Counters cover the window since
+// the last Flush, except Totals which cover the Audit's lifetime.
+type Audit struct {
+	mu        sync.Mutex
+	since     time.Time
+	sources   map[string]*auditCounts
+	templates map[auditTemplateKey]*auditCounts
+	samples   map[string][]AuditSample
+
+	totalLogs       int64
+	totalPIILogs    int64
+	totalRedactions map[string]int64
+}
+
+type auditTemplateKey struct {
+	source     string
+	templateID string
+}
+
+// auditCounts are the counters of one source or template.
+type auditCounts struct {
+	logs       int64
+	piiLogs    int64
+	redactions map[string]int64
+}
+
+func (c *auditCounts) add(findings []Finding) {
+	c.logs++
+	if len(findings) == 0 {
+		return
+	}
+	c.piiLogs++
+	if c.redactions == nil {
+		c.redactions = make(map[string]int64)
+	}
+	for _, f := range findings {
+		c.redactions[f.Type]++
+	}
+}
+
+// NewAudit creates an empty audit.
+func NewAudit() *Audit {
+	a := &Audit{totalRedactions: make(map[string]int64)}
+	a.reset(time.Now())
+	return a
+}
+
+func (a *Audit) reset(now time.Time) {
+	a.since = now
+	a.sources = make(map[string]*auditCounts)
+	a.templates = make(map[auditTemplateKey]*auditCounts)
+	a.samples = make(map[string][]AuditSample)
+}
+
+// Record counts one log of source parsed into templateID and the
+// redactions made in it, which may be none.
+func (a *Audit) Record(source, templateID string, findings []Finding) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	counts, ok := a.sources[source]
+	if !ok {
+		counts = &auditCounts{}
+		a.sources[source] = counts
+	}
+	counts.add(findings)
+
+	a.totalLogs++
+	if len(findings) == 0 {
+		return
+	}
+	a.totalPIILogs++
+	for _, f := range findings {
+		a.totalRedactions[f.Type]++
+	}
+
+	key := auditTemplateKey{source, templateID}
+	template, ok := a.templates[key]
+	if !ok && len(a.templates) < maxAuditTemplates {
+		template = &auditCounts{}
+		a.templates[key] = template
+	}
+	if template != nil {
+		template.add(findings)
+	}
+
+	now := time.Now()
+	for _, f := range findings {
+		if len(a.samples[f.Type]) < auditSamples {
+			a.samples[f.Type] = append(a.samples[f.Type], AuditSample{
+				Source:     source,
+				TemplateID: templateID,
+				Field:      f.Field,
+				Start:      f.Start,
+				End:        f.End,
+				Time:       now,
+			})
+		}
+	}
+}
+
+// AuditReport summarizes redactions over a window. RedactionRate is the
+// fraction of logs with at least one redaction.
+type AuditReport struct {
+	Since         time.Time                `json:"since"`
+	Until         time.Time                `json:"until"`
+	Logs          int64                    `json:"logs"`
+	PIILogs       int64                    `json:"pii_logs"`
+	RedactionRate float64                  `json:"redaction_rate"`
+	Redactions    map[string]int64         `json:"redactions"` // By type
+	Sources       []AuditSourceReport      `json:"sources"`
+	TopTemplates  []AuditTemplateReport    `json:"top_templates"`
+	Samples       map[string][]AuditSample `json:"samples"` // By type
+}
+
+// AuditSourceReport is the redaction summary of one source.
+type AuditSourceReport struct {
+	Source        string           `json:"source"`
+	Logs          int64            `json:"logs"`
+	PIILogs       int64            `json:"pii_logs"`
+	RedactionRate float64          `json:"redaction_rate"`
+	Redactions    map[string]int64 `json:"redactions"`
+}
+
+// AuditTemplateReport is the redaction summary of one template.
+type AuditTemplateReport struct {
+	Source     string           `json:"source"`
+	TemplateID string           `json:"template_id"`
+	PIILogs    int64            `json:"pii_logs"`
+	Redactions map[string]int64 `json:"redactions"`
+}
+
+// AuditSample is where a redaction was made, for reviewing detectors
+// without exposing what was redacted.
+type AuditSample struct {
+	Source     string    `json:"source"`
+	TemplateID string    `json:"template_id"`
+	Field      string    `json:"field"`
+	Start      int       `json:"start"`
+	End        int       `json:"end"`
+	Time       time.Time `json:"time"`
+}
+
+// Report returns the report of the current window.
+func (a *Audit) Report() AuditReport {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.report(time.Now())
+}
+
+// Flush returns the report of the current window and starts a new one.
+func (a *Audit) Flush() AuditReport {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	report := a.report(now)
+	a.reset(now)
+	return report
+}
+
+// Totals returns the number of logs, logs with PII and redactions by type
+// recorded since the audit was created.
+func (a *Audit) Totals() (logs, piiLogs int64, redactions map[string]int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.totalLogs, a.totalPIILogs, copyCounts(a.totalRedactions)
+}
+
+// report builds the current window's report. The caller must hold a.mu.
+func (a *Audit) report(now time.Time) AuditReport {
+	report := AuditReport{
+		Since:        a.since,
+		Until:        now,
+		Redactions:   make(map[string]int64),
+		Sources:      make([]AuditSourceReport, 0, len(a.sources)),
+		TopTemplates: make([]AuditTemplateReport, 0, auditTopTemplates),
+		Samples:      make(map[string][]AuditSample, len(a.samples)),
+	}
+
+	for source, counts := range a.sources {
+		report.Logs += counts.logs
+		report.PIILogs += counts.piiLogs
+		for piiType, n := range counts.redactions {
+			report.Redactions[piiType] += n
+		}
+		report.Sources = append(report.Sources, AuditSourceReport{
+			Source:        source,
+			Logs:          counts.logs,
+			PIILogs:       counts.piiLogs,
+			RedactionRate: rate(counts.piiLogs, counts.logs),
+			Redactions:    copyCounts(counts.redactions),
+		})
+	}
+	report.RedactionRate = rate(report.PIILogs, report.Logs)
+	sort.Slice(report.Sources, func(i, j int) bool { return report.Sources[i].Source < report.Sources[j].Source })
+
+	for key, counts := range a.templates {
+		report.TopTemplates = append(report.TopTemplates, AuditTemplateReport{
+			Source:     key.source,
+			TemplateID: key.templateID,
+			PIILogs:    counts.piiLogs,
+			Redactions: copyCounts(counts.redactions),
+		})
+	}
+	sort.Slice(report.TopTemplates, func(i, j int) bool {
+		a, b := report.TopTemplates[i], report.TopTemplates[j]
+		if a.PIILogs != b.PIILogs {
+			return a.PIILogs > b.PIILogs
+		}
+		if a.Source != b.Source {
+			return a.Source < b.Source
+		}
+		return a.TemplateID < b.TemplateID
+	})
+	if len(report.TopTemplates) > auditTopTemplates {
+		report.TopTemplates = report.TopTemplates[:auditTopTemplates]
+	}
+
+	for piiType, samples := range a.samples {
+		report.Samples[piiType] = append([]AuditSample(nil), samples...)
+	}
+	return report
+}
+
+func rate(n, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) / float64(total)
+}
+
+func copyCounts(counts map[string]int64) map[string]int64 {
+	result := make(map[string]int64, len(counts))
+	for k, v := range counts {
+		result[k] = v
+	}
+	return result
+}
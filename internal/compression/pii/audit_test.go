@@ -0,0 +1,84 @@
+package pii
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestRedactFields(t *testing.T) {
+	redactor := NewRedactor(DefaultRedactorConfig())
+
+	redacted, findings := redactor.RedactFields(map[string]string{
+		"user":   "bob@example.com",
+		"status": "200",
+		"auth":   "password=hunter2",
+	})
+	if redacted["user"] != "[EMAIL_REDACTED]" || redacted["status"] != "200" || redacted["auth"] != "password=[PASSWORD_REDACTED]" {
+		t.Errorf("Unexpected redacted fields %v", redacted)
+	}
+
+	want := []Finding{
+		{Field: "auth", Type: "password", Start: 9, End: 16},
+		{Field: "user", Type: "email", Start: 0, End: 15},
+	}
+	if len(findings) != len(want) {
+		t.Fatalf("RedactFields findings = %+v, want %+v", findings, want)
+	}
+	for i := range want {
+		if findings[i] != want[i] {
+			t.Errorf("Finding %d = %+v, want %+v", i, findings[i], want[i])
+		}
+	}
+}
+
+func TestAudit_Report(t *testing.T) {
+	audit := NewAudit()
+	email := []Finding{{Field: "user", Type: "email", Start: 0, End: 15}}
+	both := []Finding{email[0], {Field: "card", Type: "credit_card", Start: 5, End: 24}}
+
+	for i := 0; i < 6; i++ {
+		audit.Record("payments", "tmpl_pay", both)
+	}
+	for i := 0; i < 2; i++ {
+		audit.Record("auth", "tmpl_login", email)
+	}
+	for i := 0; i < 12; i++ {
+		audit.Record("auth", "tmpl_health", nil)
+	}
+
+	report := audit.Report()
+	if report.Logs != 20 || report.PIILogs != 8 || report.RedactionRate != 0.4 {
+		t.Errorf("Unexpected totals: %d logs, %d with PII, rate %v", report.Logs, report.PIILogs, report.RedactionRate)
+	}
+	if report.Redactions["email"] != 8 || report.Redactions["credit_card"] != 6 {
+		t.Errorf("Unexpected redactions by type %v", report.Redactions)
+	}
+
+	if len(report.Sources) != 2 || report.Sources[0].Source != "auth" || report.Sources[0].PIILogs != 2 || report.Sources[0].Logs != 14 {
+		t.Errorf("Unexpected source reports %+v", report.Sources)
+	}
+	if len(report.TopTemplates) != 2 || report.TopTemplates[0].TemplateID != "tmpl_pay" || report.TopTemplates[1].TemplateID != "tmpl_login" {
+		t.Errorf("Unexpected top templates %+v", report.TopTemplates)
+	}
+	if len(report.Samples["email"]) != auditSamples || report.Samples["email"][0].Field != "user" {
+		t.Errorf("Unexpected email samples %+v", report.Samples["email"])
+	}
+
+	// Reports carry positions, never values
+	data, _ := json.Marshal(report)
+	if strings.Contains(string(data), "example.com") || !strings.Contains(string(data), `"start":5`) {
+		t.Errorf("Unexpected report JSON %s", data)
+	}
+
+	flushed := audit.Flush()
+	if flushed.Logs != 20 {
+		t.Errorf("Expected Flush to return the window, got %d logs", flushed.Logs)
+	}
+	if next := audit.Report(); next.Logs != 0 || len(next.TopTemplates) != 0 || !next.Since.Equal(flushed.Until) {
+		t.Errorf("Expected Flush to start a new window, got %+v", next)
+	}
+	if logs, piiLogs, redactions := audit.Totals(); logs != 20 || piiLogs != 8 || redactions["credit_card"] != 6 {
+		t.Errorf("Totals = %d, %d, %v", logs, piiLogs, redactions)
+	}
+}
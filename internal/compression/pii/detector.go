@@ -0,0 +1,388 @@
+package pii
+
+import (
+	"math/big"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Match is a PII value found in text.
+type Match struct {
+	Type       string  `json:"type"`
+	Start      int     `json:"start"` // Byte offsets of the value in the text
+	End        int     `json:"end"`
+	Value      string  `json:"value"`
+	Confidence float64 `json:"confidence"` // 0 to 1
+}
+
+// Detector finds one type of PII in text. Detectors report every
+// plausible value with a confidence; callers decide which to act on.
+type Detector interface {
+	Type() string
+	Detect(text string) []Match
+}
+
+// regexDetector finds candidates with a pattern and scores each with
+// validate, which returns 0 for candidates that are not PII.
+type regexDetector struct {
+	piiType  string
+	pattern  *regexp.Regexp
+	group    int // Submatch holding the value, 0 for the whole match
+	validate func(candidate string) float64
+	bounded  bool // Reject candidates that are part of a longer token
+}
+
+func (d *regexDetector) Type() string {
+	return d.piiType
+}
+
+func (d *regexDetector) Detect(text string) []Match {
+	var matches []Match
+	for _, loc := range d.pattern.FindAllStringSubmatchIndex(text, -1) {
+		start, end := loc[2*d.group], loc[2*d.group+1]
+		if start < 0 {
+			continue
+		}
+		if d.bounded && !isBounded(text, start, end) {
+			continue
+		}
+		value := text[start:end]
+		confidence := 1.0
+		if d.validate != nil {
+			confidence = d.validate(value)
+		}
+		if confidence > 0 {
+			matches = append(matches, Match{Type: d.piiType, Start: start, End: end, Value: value, Confidence: confidence})
+		}
+	}
+	return matches
+}
+
+// isBounded reports whether text[start:end] stands alone rather than being
+// part of a longer identifier, number or dotted/dashed sequence such as a
+// version string.
+func isBounded(text string, start, end int) bool {
+	if start > 0 {
+		prev := text[start-1]
+		if isWordByte(prev) || (prev == '.' || prev == '-') && start > 1 && isDigit(text[start-2]) {
+			return false
+		}
+	}
+	if end < len(text) {
+		next := text[end]
+		if isWordByte(next) || (next == '.' || next == '-') && end+1 < len(text) && isDigit(text[end+1]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isWordByte(b byte) bool {
+	return b == '_' || isDigit(b) || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z'
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
+
+// digits returns the decimal digits of s.
+func digits(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+// EmailDetector finds email addresses.
+func EmailDetector() Detector {
+	return &regexDetector{
+		piiType: "email",
+		pattern: regexp.MustCompile(`[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}`),
+		validate: func(candidate string) float64 {
+			local, domain, _ := strings.Cut(candidate, "@")
+			if strings.HasPrefix(local, ".") || strings.HasSuffix(local, ".") || strings.Contains(domain, "..") {
+				return 0
+			}
+			return 0.9
+		},
+	}
+}
+
+// PhoneDetector finds phone numbers. Numbers in E.164 form (+ and country
+// code) are checked for length; others must be valid North American
+// numbers. Bare ten-digit runs score low, as they are usually IDs.
+func PhoneDetector() Detector {
+	return &regexDetector{
+		piiType:  "phone",
+		pattern:  regexp.MustCompile(`\+1[-.\s]?\(?\d{3}\)?[-.\s]?\d{3}[-.\s]?\d{4}|\+[1-9]\d{0,2}(?:[-.\s]?\(?\d{1,4}\)?){2,5}|\(?\d{3}\)?[-.\s]?\d{3}[-.\s]?\d{4}`),
+		validate: validatePhone,
+		bounded:  true,
+	}
+}
+
+func validatePhone(candidate string) float64 {
+	number := digits(candidate)
+	if strings.HasPrefix(candidate, "+") {
+		if strings.HasPrefix(number, "1") {
+			if len(number) != 11 || !validNANP(number[1:]) {
+				return 0
+			}
+			return 0.9
+		}
+		if len(number) < 8 || len(number) > 15 {
+			return 0
+		}
+		return 0.8
+	}
+
+	if len(number) != 10 || !validNANP(number) {
+		return 0
+	}
+	if number == candidate {
+		return 0.3 // Unformatted, as likely an ID as a phone number
+	}
+	return 0.8
+}
+
+// validNANP reports whether a ten-digit number is a valid North American
+// number: area code and exchange start with 2-9 and the area code is not
+// an N11 service code.
+func validNANP(number string) bool {
+	return number[0] >= '2' && number[3] >= '2' && !(number[1] == '1' && number[2] == '1')
+}
+
+// SSNDetector finds US Social Security numbers, rejecting the area, group
+// and serial numbers that are never issued.
+func SSNDetector() Detector {
+	return &regexDetector{
+		piiType:  "ssn",
+		pattern:  regexp.MustCompile(`\d{3}-\d{2}-\d{4}`),
+		validate: validateSSN,
+		bounded:  true,
+	}
+}
+
+func validateSSN(candidate string) float64 {
+	area, group, serial := candidate[:3], candidate[4:6], candidate[7:]
+	if area == "000" || area == "666" || area[0] == '9' || group == "00" || serial == "0000" {
+		return 0
+	}
+	return 0.9
+}
+
+// CreditCardDetector finds payment card numbers: 13 to 19 digits,
+// optionally grouped by spaces or dashes, with a known issuer prefix and a
+// valid Luhn checksum.
+func CreditCardDetector() Detector {
+	return &creditCardDetector{regexDetector{
+		piiType:  "credit_card",
+		pattern:  regexp.MustCompile(`\d(?:[ -]?\d){12,18}`),
+		validate: validateCreditCard,
+		bounded:  true,
+	}}
+}
+
+// creditCardDetector is a regexDetector that, when a run of digit groups
+// is not a card as a whole, tries the shorter runs of 13 to 19 digits
+// within it that start and end on group boundaries, so a card followed or
+// preceded by another number is still found.
+type creditCardDetector struct {
+	regexDetector
+}
+
+func (d *creditCardDetector) Detect(text string) []Match {
+	var matches []Match
+	for _, loc := range d.pattern.FindAllStringIndex(text, -1) {
+		if m, ok := d.card(text, loc[0], loc[1]); ok {
+			matches = append(matches, m)
+		}
+	}
+	return matches
+}
+
+// card returns the longest, then earliest, card number in text[start:end]
+// that starts and ends on a group boundary.
+func (d *creditCardDetector) card(text string, start, end int) (Match, bool) {
+	var starts, ends []int
+	for i := start; i < end; i++ {
+		if i == start || !isDigit(text[i-1]) {
+			starts = append(starts, i)
+		}
+		if i == end-1 || !isDigit(text[i+1]) {
+			ends = append(ends, i+1)
+		}
+	}
+
+	var best Match
+	found := false
+	for _, s := range starts {
+		for _, e := range ends {
+			if e <= s || found && e-s <= best.End-best.Start {
+				continue
+			}
+			n := len(digits(text[s:e]))
+			if n < 13 || n > 19 || !isBounded(text, s, e) {
+				continue
+			}
+			if confidence := d.validate(text[s:e]); confidence > 0 {
+				best = Match{Type: d.piiType, Start: s, End: e, Value: text[s:e], Confidence: confidence}
+				found = true
+			}
+		}
+	}
+	return best, found
+}
+
+func validateCreditCard(candidate string) float64 {
+	// Separators, if any, must be all spaces or all dashes
+	if strings.Contains(candidate, " ") && strings.Contains(candidate, "-") {
+		return 0
+	}
+	number := digits(candidate)
+	if !knownCardPrefix(number) || !luhnValid(number) {
+		return 0
+	}
+	if number == candidate {
+		return 0.8
+	}
+	return 0.95
+}
+
+// knownCardPrefix reports whether number has the prefix and length of a
+// major card network.
+func knownCardPrefix(number string) bool {
+	n := len(number)
+	prefix := func(length int) int {
+		v := 0
+		for _, c := range number[:length] {
+			v = v*10 + int(c-'0')
+		}
+		return v
+	}
+	switch {
+	case number[0] == '4': // Visa
+		return n == 13 || n == 16 || n == 19
+	case prefix(2) >= 51 && prefix(2) <= 55, prefix(4) >= 2221 && prefix(4) <= 2720: // Mastercard
+		return n == 16
+	case prefix(2) == 34 || prefix(2) == 37: // American Express
+		return n == 15
+	case prefix(4) == 6011, prefix(2) == 65, prefix(3) >= 644 && prefix(3) <= 649: // Discover
+		return n >= 16
+	case prefix(4) >= 3528 && prefix(4) <= 3589: // JCB
+		return n >= 16
+	case prefix(2) == 36, prefix(3) >= 300 && prefix(3) <= 305: // Diners Club
+		return n >= 14
+	case prefix(2) == 62: // UnionPay
+		return n >= 16
+	}
+	return false
+}
+
+// luhnValid reports whether a digit string has a valid Luhn checksum.
+func luhnValid(number string) bool {
+	sum := 0
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		d := int(number[i] - '0')
+		if double {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// IBANDetector finds international bank account numbers, validated by
+// their mod-97 checksum and, for common countries, their length.
+func IBANDetector() Detector {
+	return &regexDetector{
+		piiType:  "iban",
+		pattern:  regexp.MustCompile(`[A-Z]{2}\d{2}(?: ?[A-Z0-9]{4}){2,7}(?: ?[A-Z0-9]{1,3})?`),
+		validate: validateIBAN,
+		bounded:  true,
+	}
+}
+
+// ibanLengths is the IBAN length of common countries.
+var ibanLengths = map[string]int{
+	"AD": 24, "AT": 20, "BE": 16, "CH": 21, "CZ": 24, "DE": 22, "DK": 18,
+	"ES": 24, "FI": 18, "FR": 27, "GB": 22, "IE": 22, "IT": 27, "LU": 20,
+	"NL": 18, "NO": 15, "PL": 28, "PT": 25, "SE": 24,
+}
+
+func validateIBAN(candidate string) float64 {
+	iban := strings.ReplaceAll(candidate, " ", "")
+	if len(iban) < 15 || len(iban) > 34 || !ibanChecksumValid(iban) {
+		return 0
+	}
+	length, known := ibanLengths[iban[:2]]
+	if !known {
+		return 0.7
+	}
+	if len(iban) != length {
+		return 0
+	}
+	return 0.95
+}
+
+// ibanChecksumValid reports whether iban, moved country code and check
+// digits last and with letters as numbers from 10, is 1 mod 97.
+func ibanChecksumValid(iban string) bool {
+	var numeric strings.Builder
+	for _, c := range iban[4:] + iban[:4] {
+		switch {
+		case c >= '0' && c <= '9':
+			numeric.WriteRune(c)
+		case c >= 'A' && c <= 'Z':
+			numeric.WriteString(strconv.Itoa(int(c-'A') + 10))
+		default:
+			return false
+		}
+	}
+	n, ok := new(big.Int).SetString(numeric.String(), 10)
+	return ok && new(big.Int).Mod(n, big.NewInt(97)).Int64() == 1
+}
+
+// IPv4Detector finds IPv4 addresses.
+func IPv4Detector() Detector {
+	return &regexDetector{
+		piiType: "ipv4",
+		pattern: regexp.MustCompile(`\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}`),
+		validate: func(candidate string) float64 {
+			if ip := net.ParseIP(candidate); ip == nil || ip.To4() == nil {
+				return 0
+			}
+			return 0.9
+		},
+		bounded: true,
+	}
+}
+
+// IPv6Detector finds IPv6 addresses, including compressed forms and ones
+// ending in an IPv4 address.
+func IPv6Detector() Detector {
+	return &regexDetector{
+		piiType: "ipv6",
+		pattern: regexp.MustCompile(`[0-9a-fA-F]{0,4}(?::[0-9a-fA-F]{0,4}){2,7}(?:\.\d{1,3}\.\d{1,3}\.\d{1,3})?`),
+		validate: func(candidate string) float64 {
+			if strings.Count(candidate, ":") < 2 || strings.Trim(candidate, ":") == "" || net.ParseIP(candidate) == nil {
+				return 0
+			}
+			return 0.9
+		},
+		bounded: true,
+	}
+}
+
+// RegexDetector finds values of piiType matching pattern, with full
+// confidence.
+func RegexDetector(piiType string, pattern *regexp.Regexp) Detector {
+	return &regexDetector{piiType: piiType, pattern: pattern}
+}
@@ -0,0 +1,141 @@
+package pii
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDetectors_TruePositives(t *testing.T) {
+	tests := []struct {
+		detector Detector
+		text     string
+		want     string
+	}{
+		{EmailDetector(), "login failed for alice.smith@example.co.uk", "alice.smith@example.co.uk"},
+		{CreditCardDetector(), "charge card=4111 1111 1111 1111 declined", "4111 1111 1111 1111"},
+		{CreditCardDetector(), "card 5500-0000-0000-0004", "5500-0000-0000-0004"},
+		{CreditCardDetector(), "amex 378282246310005 ok", "378282246310005"},
+		{CreditCardDetector(), "discover=6011111111111117", "6011111111111117"},
+		{CreditCardDetector(), "card 4111111111111111 42", "4111111111111111"},
+		{CreditCardDetector(), "retry 3 4111 1111 1111 1111 failed", "4111 1111 1111 1111"},
+		{IBANDetector(), "payout to GB82 WEST 1234 5698 7654 32 queued", "GB82 WEST 1234 5698 7654 32"},
+		{IBANDetector(), "iban=DE89370400440532013000", "DE89370400440532013000"},
+		{IBANDetector(), "FR1420041010050500013M02606", "FR1420041010050500013M02606"},
+		{SSNDetector(), "ssn 536-22-1234 verified", "536-22-1234"},
+		{PhoneDetector(), "call +1 415-555-0123 now", "+1 415-555-0123"},
+		{PhoneDetector(), "phone: (415) 555-0123", "(415) 555-0123"},
+		{PhoneDetector(), "contact +44 20 7946 0958", "+44 20 7946 0958"},
+		{PhoneDetector(), "sms to 415.555.0123 sent", "415.555.0123"},
+		{IPv4Detector(), "client 192.168.1.20 connected", "192.168.1.20"},
+		{IPv6Detector(), "from 2001:db8::8a2e:370:7334 port", "2001:db8::8a2e:370:7334"},
+	}
+
+	for _, tt := range tests {
+		matches := tt.detector.Detect(tt.text)
+		if len(matches) != 1 || matches[0].Value != tt.want {
+			t.Errorf("%s.Detect(%q) = %+v, want %q", tt.detector.Type(), tt.text, matches, tt.want)
+			continue
+		}
+		m := matches[0]
+		if tt.text[m.Start:m.End] != m.Value || m.Confidence < DefaultMinConfidence {
+			t.Errorf("%s.Detect(%q): bad span or confidence %+v", tt.detector.Type(), tt.text, m)
+		}
+	}
+}
+
+// falsePositives are log fragments with numbers shaped like PII that the
+// default redactor must leave alone.
+var falsePositives = []string{
+	"order 4532015112830367 shipped",     // 16 digits, bad Luhn
+	"order_id=1234567812345678 created",  // No card network prefix
+	"trace 1700000000123456 span 42",     // Timestamp-based ID
+	"ts=1700000000123 latency=12ms",      // Unix milliseconds
+	"ts=1700000000 status=200",           // Unix seconds
+	"request 1234567890 completed",       // NANP area code can't start with 1
+	"job 4155550123 finished",            // Bare ten digits score low
+	"build 000-12-3456 promoted",         // SSN area 000
+	"ticket 666-45-6789 closed",          // SSN area 666
+	"ref 912-34-5678 archived",           // SSN area 9xx
+	"version 10.2.3.4.5 deployed",        // Dotted version, not an IP
+	"release 2024-01-15 10:30:00 tagged", // Date and time
+	"uuid 550e8400-e29b-41d4-a716-446655440000",
+	"sha 3f9a1c2b8d7e6f5041112222333344445555",
+	"account GB82WEST12345698765433 bad", // IBAN with a bad checksum
+	"std::vector<int> resized",
+}
+
+func TestRedactor_FalsePositives(t *testing.T) {
+	config := DefaultRedactorConfig()
+	config.RedactIPv4 = true
+	config.RedactIPv6 = true
+	redactor := NewRedactor(config)
+
+	for _, text := range falsePositives {
+		if got := redactor.Redact(text); got != text {
+			t.Errorf("Redact(%q) = %q, want unchanged", text, got)
+		}
+		if found := redactor.Detect(text); len(found) != 0 {
+			t.Errorf("Detect(%q) = %+v, want nothing", text, found)
+		}
+	}
+}
+
+func TestRedactor_Redact(t *testing.T) {
+	redactor := NewRedactor(DefaultRedactorConfig())
+
+	got := redactor.Redact("user bob@example.com paid with 4111-1111-1111-1111 from (415) 555-0123, order 4532015112830367")
+	want := "user [EMAIL_REDACTED] paid with [CC_REDACTED] from [PHONE_REDACTED], order 4532015112830367"
+	if got != want {
+		t.Errorf("Redact = %q, want %q", got, want)
+	}
+
+	types := redactor.DetectPII("ssn 536-22-1234 iban DE89370400440532013000")
+	if strings.Join(types, ",") != "iban,ssn" {
+		t.Errorf("DetectPII = %v, want [iban ssn]", types)
+	}
+}
+
+func TestRedactor_MinConfidence(t *testing.T) {
+	config := DefaultRedactorConfig()
+	text := "callback 4155550123"
+	if got := NewRedactor(config).Redact(text); got != text {
+		t.Errorf("Expected bare ten digits to be kept at default confidence, got %q", got)
+	}
+
+	config.MinConfidence = 0.1
+	if got := NewRedactor(config).Redact(text); got != "callback [PHONE_REDACTED]" {
+		t.Errorf("Expected bare ten digits to be redacted at low confidence, got %q", got)
+	}
+}
+
+func TestRedactor_CustomDetectors(t *testing.T) {
+	config := DefaultRedactorConfig()
+	config.CustomPatterns = map[string]string{"employee_id": `\bEMP-\d{6}\b`}
+	redactor := NewRedactor(config)
+
+	if got := redactor.Redact("approved by EMP-123456"); got != "approved by [REDACTED]" {
+		t.Errorf("Redact = %q", got)
+	}
+}
+
+func TestLuhnAndIBAN(t *testing.T) {
+	for number, want := range map[string]bool{
+		"4111111111111111": true,
+		"5105105105105100": true,
+		"4111111111111112": false,
+		"1234567812345678": false,
+	} {
+		if luhnValid(number) != want {
+			t.Errorf("luhnValid(%s) = %v, want %v", number, !want, want)
+		}
+	}
+	for iban, want := range map[string]bool{
+		"GB82WEST12345698765432": true,
+		"GB82WEST12345698765433": false,
+		"NL91ABNA0417164300":     true,
+	} {
+		if ibanChecksumValid(iban) != want {
+			t.Errorf("ibanChecksumValid(%s) = %v, want %v", iban, !want, want)
+		}
+	}
+}
@@ -3,13 +3,16 @@ package pii
 
 import (
 	"regexp"
+	"sort"
 	"strings"
 )
 
 // Redactor handles PII redaction in log content.
 type Redactor struct {
-	patterns map[string]*regexp.Regexp
-	enabled  bool
+	detectors     []Detector
+	minConfidence float64
+	tokenizer     *Tokenizer
+	enabled       bool
 }
 
 // RedactorConfig configures which PII types to redact.
@@ -18,11 +21,35 @@ type RedactorConfig struct {
 	RedactPhones      bool
 	RedactSSN         bool
 	RedactCreditCards bool
+	RedactIBANs       bool
 	RedactIPv4        bool
 	RedactIPv6        bool
 	CustomPatterns    map[string]string
+
+	// Secrets. These are always replaced by placeholders, even with a
+	// Tokenizer.
+	RedactCloudCredentials bool
+	RedactJWTs             bool
+	RedactAuthHeaders      bool
+	RedactPasswords        bool
+	RedactPrivateKeys      bool
+	RedactHighEntropy      bool // Random-looking strings of unknown format
+
+	// Detectors are run after the built-in ones, for PII types of their own.
+	Detectors []Detector
+
+	// MinConfidence is the confidence a match needs to be redacted.
+	MinConfidence float64
+
+	// Tokenizer, if set, replaces PII with deterministic tokens instead of
+	// fixed placeholders.
+	Tokenizer *Tokenizer
 }
 
+// DefaultMinConfidence skips matches that are as likely to be IDs, such as
+// unformatted ten-digit numbers.
+const DefaultMinConfidence = 0.5
+
 // DefaultRedactorConfig returns a configuration that redacts common PII.
 func DefaultRedactorConfig() RedactorConfig {
 	return RedactorConfig{
@@ -30,51 +57,86 @@ func DefaultRedactorConfig() RedactorConfig {
 		RedactPhones:      true,
 		RedactSSN:         true,
 		RedactCreditCards: true,
+		RedactIBANs:       true,
 		RedactIPv4:        false, // Often needed for debugging
 		RedactIPv6:        false,
+
+		RedactCloudCredentials: true,
+		RedactJWTs:             true,
+		RedactAuthHeaders:      true,
+		RedactPasswords:        true,
+		RedactPrivateKeys:      true,
+		RedactHighEntropy:      false, // Also matches some opaque IDs
+
+		MinConfidence: DefaultMinConfidence,
 	}
 }
 
 // NewRedactor creates a new PII redactor with the given configuration.
 func NewRedactor(config RedactorConfig) *Redactor {
-	patterns := make(map[string]*regexp.Regexp)
+	var detectors []Detector
 
-	if config.RedactEmails {
-		patterns["email"] = regexp.MustCompile(`[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}`)
+	// Detectors are in priority order for overlapping matches, so types
+	// whose values can contain another type's (key blocks, headers holding
+	// JWTs, IPv6 addresses holding IPv4 ones) come first
+	if config.RedactPrivateKeys {
+		detectors = append(detectors, PrivateKeyDetector())
 	}
-
-	if config.RedactPhones {
-		// Matches various phone formats
-		patterns["phone"] = regexp.MustCompile(`\b(?:\+?1[-.\s]?)?\(?\d{3}\)?[-.\s]?\d{3}[-.\s]?\d{4}\b`)
+	if config.RedactAuthHeaders {
+		detectors = append(detectors, AuthHeaderDetector())
 	}
-
-	if config.RedactSSN {
-		patterns["ssn"] = regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`)
+	if config.RedactJWTs {
+		detectors = append(detectors, JWTDetector())
+	}
+	if config.RedactCloudCredentials {
+		detectors = append(detectors, CloudCredentialDetector())
+	}
+	if config.RedactPasswords {
+		detectors = append(detectors, PasswordDetector())
+	}
+	if config.RedactEmails {
+		detectors = append(detectors, EmailDetector())
+	}
+	if config.RedactIBANs {
+		detectors = append(detectors, IBANDetector())
 	}
-
 	if config.RedactCreditCards {
-		// Matches common credit card formats
-		patterns["credit_card"] = regexp.MustCompile(`\b(?:\d{4}[-\s]?){3}\d{4}\b`)
+		detectors = append(detectors, CreditCardDetector())
 	}
-
-	if config.RedactIPv4 {
-		patterns["ipv4"] = regexp.MustCompile(`\b\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}\b`)
+	if config.RedactSSN {
+		detectors = append(detectors, SSNDetector())
+	}
+	if config.RedactPhones {
+		detectors = append(detectors, PhoneDetector())
 	}
-
 	if config.RedactIPv6 {
-		patterns["ipv6"] = regexp.MustCompile(`\b(?:[0-9a-fA-F]{1,4}:){7}[0-9a-fA-F]{1,4}\b`)
+		detectors = append(detectors, IPv6Detector())
+	}
+	if config.RedactIPv4 {
+		detectors = append(detectors, IPv4Detector())
 	}
 
 	// Add custom patterns
-	for name, pattern := range config.CustomPatterns {
-		if re, err := regexp.Compile(pattern); err == nil {
-			patterns[name] = re
+	names := make([]string, 0, len(config.CustomPatterns))
+	for name := range config.CustomPatterns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if re, err := regexp.Compile(config.CustomPatterns[name]); err == nil {
+			detectors = append(detectors, RegexDetector(name, re))
 		}
 	}
+	detectors = append(detectors, config.Detectors...)
+	if config.RedactHighEntropy {
+		detectors = append(detectors, HighEntropyDetector())
+	}
 
 	return &Redactor{
-		patterns: patterns,
-		enabled:  true,
+		detectors:     detectors,
+		minConfidence: config.MinConfidence,
+		tokenizer:     config.Tokenizer,
+		enabled:       true,
 	}
 }
 
@@ -84,26 +146,161 @@ var placeholders = map[string]string{
 	"phone":       "[PHONE_REDACTED]",
 	"ssn":         "[SSN_REDACTED]",
 	"credit_card": "[CC_REDACTED]",
+	"iban":        "[IBAN_REDACTED]",
 	"ipv4":        "[IPV4_REDACTED]",
 	"ipv6":        "[IPV6_REDACTED]",
+
+	"cloud_credential": "[CREDENTIAL_REDACTED]",
+	"jwt":              "[JWT_REDACTED]",
+	"auth_header":      "[AUTH_REDACTED]",
+	"password":         "[PASSWORD_REDACTED]",
+	"private_key":      "[PRIVATE_KEY_REDACTED]",
+	"high_entropy":     "[SECRET_REDACTED]",
 }
 
-// Redact replaces PII in the given text with placeholders.
+// Span is a region of text replaced by Redact. Start and End are byte
+// offsets in the original text, OutputStart and OutputEnd in the result.
+type Span struct {
+	Match
+	Replacement string `json:"replacement"`
+	OutputStart int    `json:"output_start"`
+	OutputEnd   int    `json:"output_end"`
+}
+
+// Redact replaces PII in the given text with placeholders, or with tokens
+// if the redactor has a Tokenizer.
 func (r *Redactor) Redact(text string) string {
+	result, _ := r.RedactSpans(text)
+	return result
+}
+
+// RedactSample redacts text like Redact without storing token values in
+// the vault, for samples and previews that are not kept as log data.
+func (r *Redactor) RedactSample(text string) string {
+	result, _ := r.redactSpans(text, false)
+	return result
+}
+
+// RedactSpans redacts text like Redact and also returns the replaced
+// spans in text order. All detectors run over the original text and each
+// region is replaced once, so the result does not depend on how detectors'
+// matches overlap.
+func (r *Redactor) RedactSpans(text string) (string, []Span) {
+	return r.redactSpans(text, true)
+}
+
+// redactSpans implements RedactSpans, storing token values in the vault
+// if store is set.
+func (r *Redactor) redactSpans(text string, store bool) (string, []Span) {
 	if !r.enabled {
-		return text
+		return text, nil
+	}
+	return r.replace(text, r.Detect(text), store)
+}
+
+// replace replaces matches, in text order and not overlapping, with their
+// placeholders or tokens.
+func (r *Redactor) replace(text string, matches []Match, store bool) (string, []Span) {
+	if len(matches) == 0 {
+		return text, nil
 	}
 
-	result := text
-	for piiType, pattern := range r.patterns {
-		placeholder := placeholders[piiType]
-		if placeholder == "" {
-			placeholder = "[REDACTED]"
+	var b strings.Builder
+	spans := make([]Span, len(matches))
+	last := 0
+	for i, m := range matches {
+		b.WriteString(text[last:m.Start])
+		replacement := r.replacement(m, store)
+		spans[i] = Span{
+			Match:       m,
+			Replacement: replacement,
+			OutputStart: b.Len(),
+			OutputEnd:   b.Len() + len(replacement),
 		}
-		result = pattern.ReplaceAllString(result, placeholder)
+		b.WriteString(replacement)
+		last = m.End
 	}
+	b.WriteString(text[last:])
 
-	return result
+	return b.String(), spans
+}
+
+// accepted returns the matches confident enough to redact, skipping
+// tokens left by an earlier redaction.
+func (r *Redactor) accepted(matches []Match) []Match {
+	kept := matches[:0]
+	for _, m := range matches {
+		if m.Confidence >= r.minConfidence && !IsToken(m.Value) {
+			kept = append(kept, m)
+		}
+	}
+	return kept
+}
+
+// replacement returns the placeholder or token for a match, storing the
+// value behind a token in the vault if store is set.
+func (r *Redactor) replacement(m Match, store bool) string {
+	if r.tokenizer != nil && !IsSecretType(m.Type) {
+		if !store {
+			return r.tokenizer.pseudonym(m.Type, m.Value)
+		}
+		return r.tokenizer.Token(m.Type, m.Value)
+	}
+	if placeholder := placeholders[m.Type]; placeholder != "" {
+		return placeholder
+	}
+	return "[REDACTED]"
+}
+
+// Detect returns the PII in text that Redact would replace, in text order.
+// Where matches overlap, the one from the earlier detector wins, then the
+// longer one, then the one starting first.
+func (r *Redactor) Detect(text string) []Match {
+	return r.detect(text, false)
+}
+
+// detect implements Detect, running only the secret detectors if
+// secretsOnly is set.
+func (r *Redactor) detect(text string, secretsOnly bool) []Match {
+	type candidate struct {
+		Match
+		priority int
+	}
+	var candidates []candidate
+	for priority, detector := range r.detectors {
+		if secretsOnly && !IsSecretType(detector.Type()) {
+			continue
+		}
+		for _, m := range r.accepted(detector.Detect(text)) {
+			candidates = append(candidates, candidate{m, priority})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.priority != b.priority {
+			return a.priority < b.priority
+		}
+		if a.End-a.Start != b.End-b.Start {
+			return a.End-a.Start > b.End-b.Start
+		}
+		return a.Start < b.Start
+	})
+
+	var found []Match
+	for _, c := range candidates {
+		overlaps := false
+		for _, m := range found {
+			if c.Start < m.End && m.Start < c.End {
+				overlaps = true
+				break
+			}
+		}
+		if !overlaps {
+			found = append(found, c.Match)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].Start < found[j].Start })
+	return found
 }
 
 // RedactVariables redacts PII from a map of variables.
@@ -139,9 +336,9 @@ func (r *Redactor) IsEnabled() bool {
 func (r *Redactor) DetectPII(text string) []string {
 	var found []string
 
-	for piiType, pattern := range r.patterns {
-		if pattern.MatchString(text) {
-			found = append(found, piiType)
+	for _, detector := range r.detectors {
+		if len(r.accepted(detector.Detect(text))) > 0 {
+			found = append(found, detector.Type())
 		}
 	}
 
@@ -0,0 +1,241 @@
+package pii
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// secretTypes are the PII types that are credentials rather than personal
+// data. They are always replaced by placeholders, never tokenized, so a
+// vault never holds live secrets.
+var secretTypes = map[string]bool{
+	"cloud_credential": true,
+	"jwt":              true,
+	"auth_header":      true,
+	"password":         true,
+	"private_key":      true,
+	"high_entropy":     true,
+}
+
+// IsSecretType reports whether piiType is a credential type.
+func IsSecretType(piiType string) bool {
+	return secretTypes[piiType]
+}
+
+// RedactSecrets replaces only the credentials in text with placeholders
+// and returns the replaced spans. Use it on raw lines before they are
+// parsed into templates and variables, which separates a credential from
+// the context, such as "Bearer", that identifies it.
+func (r *Redactor) RedactSecrets(text string) (string, []Span) {
+	if !r.enabled {
+		return text, nil
+	}
+	return r.replace(text, r.detect(text, true), false)
+}
+
+// multiDetector combines detectors of one type, reporting their matches in
+// text order.
+type multiDetector struct {
+	piiType   string
+	detectors []Detector
+}
+
+func (d *multiDetector) Type() string {
+	return d.piiType
+}
+
+func (d *multiDetector) Detect(text string) []Match {
+	var matches []Match
+	for _, detector := range d.detectors {
+		matches = append(matches, detector.Detect(text)...)
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].Start < matches[j].Start })
+
+	// Drop matches inside an earlier one, such as a key ID also matched as
+	// part of a longer credential
+	kept := matches[:0]
+	end := -1
+	for _, m := range matches {
+		if m.Start < end {
+			continue
+		}
+		kept = append(kept, m)
+		end = m.End
+	}
+	return kept
+}
+
+// CloudCredentialDetector finds cloud and SaaS credentials: AWS access key
+// IDs and secret keys, Google API keys, Azure storage keys and SAS
+// signatures, and GitHub, Slack and Stripe tokens.
+func CloudCredentialDetector() Detector {
+	detector := func(pattern string, group int, confidence float64) Detector {
+		return &regexDetector{
+			piiType:  "cloud_credential",
+			pattern:  regexp.MustCompile(pattern),
+			group:    group,
+			validate: func(string) float64 { return confidence },
+			bounded:  group == 0,
+		}
+	}
+	return &multiDetector{
+		piiType: "cloud_credential",
+		detectors: []Detector{
+			detector(`(?:AKIA|ASIA|AGPA|AIDA|AROA|ANPA|ANVA|AIPA)[0-9A-Z]{16}`, 0, 0.95),
+			detector(`(?i)aws_?secret_?access_?key["']?\s*[=:]\s*["']?([A-Za-z0-9/+]{40})`, 1, 0.95),
+			detector(`AIza[0-9A-Za-z_-]{35}`, 0, 0.95),
+			detector(`(?i)AccountKey=([A-Za-z0-9+/]{86}==)`, 1, 0.95),
+			detector(`[?&]sig=([A-Za-z0-9%+/]{40,}(?:%3D|=)*)`, 1, 0.9),
+			detector(`gh[pousr]_[A-Za-z0-9]{36,255}`, 0, 0.95),
+			detector(`xox[abposr]-[A-Za-z0-9-]{10,}`, 0, 0.95),
+			detector(`[sr]k_live_[0-9a-zA-Z]{24,}`, 0, 0.95),
+		},
+	}
+}
+
+// JWTDetector finds JSON Web Tokens whose header decodes to JSON naming an
+// algorithm.
+func JWTDetector() Detector {
+	return &regexDetector{
+		piiType:  "jwt",
+		pattern:  regexp.MustCompile(`eyJ[A-Za-z0-9_-]{5,}\.eyJ[A-Za-z0-9_-]{5,}\.[A-Za-z0-9_-]*`),
+		validate: validateJWT,
+		bounded:  true,
+	}
+}
+
+func validateJWT(candidate string) float64 {
+	encoded, _, _ := strings.Cut(candidate, ".")
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return 0
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if json.Unmarshal(data, &header) != nil || header.Alg == "" {
+		return 0
+	}
+	return 0.95
+}
+
+// AuthHeaderDetector finds the credentials of Authorization headers and
+// bare bearer tokens, leaving the header name and scheme readable.
+func AuthHeaderDetector() Detector {
+	return &multiDetector{
+		piiType: "auth_header",
+		detectors: []Detector{
+			&regexDetector{
+				piiType:  "auth_header",
+				pattern:  regexp.MustCompile(`(?i)\b(?:proxy-)?authorization["']?\s*[:=]\s*["']?(?:bearer|basic|token|digest|negotiate|apikey)\s+([A-Za-z0-9._~+/=-]+)`),
+				group:    1,
+				validate: validateSecretValue(0.95),
+			},
+			&regexDetector{
+				piiType:  "auth_header",
+				pattern:  regexp.MustCompile(`(?i)\bbearer\s+([A-Za-z0-9._~+/-]{16,}=*)`),
+				group:    1,
+				validate: validateSecretValue(0.8),
+			},
+		},
+	}
+}
+
+// PasswordDetector finds the values of password=, secret:, api_key= style
+// key/value pairs and passwords in URLs.
+func PasswordDetector() Detector {
+	return &multiDetector{
+		piiType: "password",
+		detectors: []Detector{
+			&regexDetector{
+				piiType:  "password",
+				pattern:  regexp.MustCompile(`(?i)\b(?:password|passwd|pwd|pass|passphrase|secret|client_?secret|api_?key|(?:access|refresh|auth|api)_?token)["']?\s*[=:]\s*["']?([^\s"'&,;\[\]{}][^\s"'&,;\]{}]*)`),
+				group:    1,
+				validate: validateSecretValue(0.9),
+			},
+			&regexDetector{
+				piiType:  "password",
+				pattern:  regexp.MustCompile(`\b[a-zA-Z][a-zA-Z0-9+.-]*://[^/\s:@]+:([^/\s@]+)@`),
+				group:    1,
+				validate: validateSecretValue(0.95),
+			},
+		},
+	}
+}
+
+// validateSecretValue accepts a secret value with the given confidence
+// unless it is already masked or a placeholder.
+func validateSecretValue(confidence float64) func(string) float64 {
+	return func(value string) float64 {
+		if strings.Trim(value, "*xX•") == "" || strings.EqualFold(value, "null") || strings.EqualFold(value, "redacted") {
+			return 0
+		}
+		return confidence
+	}
+}
+
+// PrivateKeyDetector finds PEM private key blocks, including ones cut off
+// before their END line.
+func PrivateKeyDetector() Detector {
+	return &regexDetector{
+		piiType: "private_key",
+		pattern: regexp.MustCompile(`-----BEGIN (?:[A-Z0-9]+ )*PRIVATE KEY-----(?:[\s\S]*?-----END (?:[A-Z0-9]+ )*PRIVATE KEY-----|[A-Za-z0-9+/=\s:,-]*)`),
+	}
+}
+
+// minSecretEntropy returns the Shannon entropy in bits per character a
+// string of length n needs to look random. Random base64 strings score
+// close to log2(n) when short and 5 to 6 when long, while identifiers,
+// hex IDs and UUIDs score well below.
+func minSecretEntropy(n int) float64 {
+	return math.Min(0.85*math.Log2(float64(n)), 4.5)
+}
+
+// HighEntropyDetector finds long random-looking strings that are likely
+// secrets of unknown format. It skips hex strings, which in logs are
+// usually trace IDs and hashes.
+func HighEntropyDetector() Detector {
+	return &regexDetector{
+		piiType:  "high_entropy",
+		pattern:  regexp.MustCompile(`[A-Za-z0-9+/_-]{24,}={0,2}`),
+		validate: validateHighEntropy,
+		bounded:  true,
+	}
+}
+
+func validateHighEntropy(candidate string) float64 {
+	var upper, lower, digit bool
+	for _, c := range candidate {
+		switch {
+		case c >= 'A' && c <= 'Z':
+			upper = true
+		case c >= 'a' && c <= 'z':
+			lower = true
+		case c >= '0' && c <= '9':
+			digit = true
+		}
+	}
+	if !(upper && lower && digit) || shannonEntropy(candidate) < minSecretEntropy(len(candidate)) {
+		return 0
+	}
+	return 0.6
+}
+
+// shannonEntropy returns the entropy of s in bits per character.
+func shannonEntropy(s string) float64 {
+	counts := make(map[rune]int)
+	for _, c := range s {
+		counts[c]++
+	}
+	entropy := 0.0
+	n := float64(len(s))
+	for _, count := range counts {
+		p := float64(count) / n
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
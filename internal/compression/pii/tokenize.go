@@ -0,0 +1,280 @@
+package pii
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Environment variables read by LoadTokenizer. Keys are hex-encoded.
+const (
+	TokenKeyEnv = "LOGZERO_PII_TOKEN_KEY"
+	VaultKeyEnv = "LOGZERO_PII_VAULT_KEY"
+)
+
+// MinTokenKeySize is the minimum HMAC key size in bytes.
+const MinTokenKeySize = 16
+
+// tokenHexLen is the number of hex digits of the HMAC kept in a token.
+// 64 bits keeps collisions unlikely for billions of distinct values.
+const tokenHexLen = 16
+
+// vaultQueueSize is the number of values that may wait to be written to
+// the vault. Values arriving while the queue is full are not stored.
+const vaultQueueSize = 4096
+
+// vaultBatchSize is the most values written to the vault at once.
+const vaultBatchSize = 256
+
+// tokenPattern matches tokens produced by a Tokenizer.
+var tokenPattern = regexp.MustCompile(`\[[A-Z0-9_]+_[0-9a-f]{16}\]`)
+
+// Token prefixes by PII type; other types use their upper-cased name.
+var tokenPrefixes = map[string]string{
+	"email":       "EMAIL",
+	"phone":       "PHONE",
+	"ssn":         "SSN",
+	"credit_card": "CC",
+	"iban":        "IBAN",
+	"ipv4":        "IPV4",
+	"ipv6":        "IPV6",
+}
+
+// Tokenizer replaces PII values with deterministic pseudonyms: a keyed
+// HMAC of the value, so the same email always becomes the same token and
+// occurrences can be counted and correlated without revealing it. Tokens
+// look like [EMAIL_3f9a1c2b8d7e6f50]. With a Vault, the original values
+// are kept encrypted so authorized users can reverse tokens. Values are
+// written to the vault in batches in the background, so a token may not be
+// revealable until Flush returns.
+type Tokenizer struct {
+	key     []byte
+	vault   *Vault
+	onError func(err error)
+
+	closeMu sync.RWMutex
+	closed  bool
+	pending chan vaultRecord
+	queued  sync.Map // Tokens sent to the vault writer and not yet written
+	done    chan struct{}
+}
+
+// NewTokenizer creates a tokenizer with the given HMAC key. vault may be
+// nil, in which case tokens cannot be reversed.
+func NewTokenizer(key []byte, vault *Vault) (*Tokenizer, error) {
+	if len(key) < MinTokenKeySize {
+		return nil, fmt.Errorf("token key must be at least %d bytes, got %d", MinTokenKeySize, len(key))
+	}
+	t := &Tokenizer{key: append([]byte(nil), key...), vault: vault}
+	if vault != nil {
+		t.pending = make(chan vaultRecord, vaultQueueSize)
+		t.done = make(chan struct{})
+		go t.writeVault()
+	}
+	return t, nil
+}
+
+// LoadTokenizer creates a tokenizer from the key in LOGZERO_PII_TOKEN_KEY,
+// with a vault at vaultPath encrypted with LOGZERO_PII_VAULT_KEY if
+// vaultPath is not empty. It returns nil without error when no token key
+// is set.
+func LoadTokenizer(vaultPath string) (*Tokenizer, error) {
+	encoded := os.Getenv(TokenKeyEnv)
+	if encoded == "" {
+		if vaultPath != "" {
+			return nil, fmt.Errorf("a PII vault requires %s", TokenKeyEnv)
+		}
+		return nil, nil
+	}
+	key, err := hex.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", TokenKeyEnv, err)
+	}
+
+	var vault *Vault
+	if vaultPath != "" {
+		vaultKey, err := hex.DecodeString(os.Getenv(VaultKeyEnv))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", VaultKeyEnv, err)
+		}
+		if vault, err = OpenVault(vaultPath, vaultKey); err != nil {
+			return nil, err
+		}
+	}
+
+	tokenizer, err := NewTokenizer(key, vault)
+	if err != nil {
+		if vault != nil {
+			vault.Close()
+		}
+		return nil, err
+	}
+	return tokenizer, nil
+}
+
+// OnVaultError registers fn to be called when a value cannot be stored in
+// the vault. The token is still used, but cannot be reversed.
+func (t *Tokenizer) OnVaultError(fn func(err error)) {
+	t.onError = fn
+}
+
+// Vault returns the tokenizer's vault, or nil.
+func (t *Tokenizer) Vault() *Vault {
+	return t.vault
+}
+
+// Token returns the pseudonym of a value of the given PII type, queueing
+// the value to be stored in the vault if there is one.
+func (t *Tokenizer) Token(piiType, value string) string {
+	token := t.pseudonym(piiType, value)
+	if t.vault != nil {
+		t.store(vaultRecord{token: token, piiType: piiType, value: value})
+	}
+	return token
+}
+
+// pseudonym returns the token of a value without storing it.
+func (t *Tokenizer) pseudonym(piiType, value string) string {
+	mac := hmac.New(sha256.New, t.key)
+	mac.Write([]byte(piiType))
+	mac.Write([]byte{0})
+	mac.Write([]byte(value))
+	return "[" + tokenPrefix(piiType) + "_" + hex.EncodeToString(mac.Sum(nil))[:tokenHexLen] + "]"
+}
+
+// store queues a value for the vault writer unless the vault holds it or it
+// is already queued. It does not block: when the queue is full the value is
+// dropped and reported to the error callback.
+func (t *Tokenizer) store(record vaultRecord) {
+	if t.vault.has(record.token) {
+		return
+	}
+	if _, ok := t.queued.LoadOrStore(record.token, struct{}{}); ok {
+		return
+	}
+
+	t.closeMu.RLock()
+	defer t.closeMu.RUnlock()
+	if t.closed {
+		t.queued.Delete(record.token)
+		return
+	}
+	select {
+	case t.pending <- record:
+	default:
+		t.queued.Delete(record.token)
+		t.reportError(fmt.Errorf("vault write queue full, %s not stored", record.token))
+	}
+}
+
+// writeVault writes queued values to the vault in batches until the
+// queue is closed.
+func (t *Tokenizer) writeVault() {
+	defer close(t.done)
+	for record := range t.pending {
+		batch := []vaultRecord{record}
+	collect:
+		for len(batch) < vaultBatchSize {
+			select {
+			case record, ok := <-t.pending:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, record)
+			default:
+				break collect
+			}
+		}
+
+		var records []vaultRecord
+		var flushed []chan struct{}
+		for _, record := range batch {
+			if record.flushed != nil {
+				flushed = append(flushed, record.flushed)
+			} else {
+				records = append(records, record)
+			}
+		}
+		if len(records) > 0 {
+			// Written values are found in the vault from now on; values
+			// that failed may be queued again by a later Token call
+			err := t.vault.putBatch(records)
+			for _, record := range records {
+				t.queued.Delete(record.token)
+			}
+			if err != nil {
+				t.reportError(err)
+			}
+		}
+		for _, ch := range flushed {
+			close(ch)
+		}
+	}
+}
+
+// reportError passes err to the error callback, if any.
+func (t *Tokenizer) reportError(err error) {
+	if t.onError != nil {
+		t.onError(err)
+	}
+}
+
+// Flush waits until the values queued before it are written to the vault.
+func (t *Tokenizer) Flush() {
+	if t.vault == nil {
+		return
+	}
+	t.closeMu.RLock()
+	if t.closed {
+		t.closeMu.RUnlock()
+		return
+	}
+	flushed := make(chan struct{})
+	t.pending <- vaultRecord{flushed: flushed}
+	t.closeMu.RUnlock()
+	<-flushed
+}
+
+// Close writes the queued values to the vault and closes it, if any.
+func (t *Tokenizer) Close() error {
+	if t.vault == nil {
+		return nil
+	}
+	t.closeMu.Lock()
+	if t.closed {
+		t.closeMu.Unlock()
+		return nil
+	}
+	t.closed = true
+	close(t.pending)
+	t.closeMu.Unlock()
+
+	<-t.done
+	return t.vault.Close()
+}
+
+// IsToken reports whether s is a token produced by a Tokenizer.
+func IsToken(s string) bool {
+	return len(s) > tokenHexLen+3 && tokenPattern.FindString(s) == s
+}
+
+// tokenPrefix returns the token prefix of a PII type.
+func tokenPrefix(piiType string) string {
+	if prefix, ok := tokenPrefixes[piiType]; ok {
+		return prefix
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		}
+		return '_'
+	}, piiType)
+}
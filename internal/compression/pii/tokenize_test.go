@@ -0,0 +1,204 @@
+package pii
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var (
+	testTokenKey = []byte("0123456789abcdef0123456789abcdef")
+	testVaultKey = bytes.Repeat([]byte{7}, VaultKeySize)
+)
+
+func TestTokenizer_Deterministic(t *testing.T) {
+	tokenizer, err := NewTokenizer(testTokenKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := NewTokenizer([]byte("another key of 16+ bytes"), nil)
+
+	token := tokenizer.Token("email", "alice@example.com")
+	if !IsToken(token) || !strings.HasPrefix(token, "[EMAIL_") {
+		t.Errorf("Unexpected token %q", token)
+	}
+	if tokenizer.Token("email", "alice@example.com") != token {
+		t.Error("Expected the same value to give the same token")
+	}
+	if tokenizer.Token("email", "bob@example.com") == token {
+		t.Error("Expected different values to give different tokens")
+	}
+	if other.Token("email", "alice@example.com") == token {
+		t.Error("Expected a different key to give a different token")
+	}
+	if got := tokenizer.Token("api key", "x"); !strings.HasPrefix(got, "[API_KEY_") {
+		t.Errorf("Expected custom type prefix API_KEY, got %q", got)
+	}
+
+	if _, err := NewTokenizer([]byte("short"), nil); err == nil {
+		t.Error("Expected short key to be rejected")
+	}
+}
+
+func TestRedactor_Tokenize(t *testing.T) {
+	tokenizer, _ := NewTokenizer(testTokenKey, nil)
+	config := DefaultRedactorConfig()
+	config.Tokenizer = tokenizer
+	redactor := NewRedactor(config)
+
+	first := redactor.Redact("500 error for alice@example.com")
+	second := redactor.Redact("500 error for alice@example.com")
+	third := redactor.Redact("500 error for bob@example.com")
+
+	if strings.Contains(first, "alice") {
+		t.Errorf("Email not tokenized: %q", first)
+	}
+	if first != second {
+		t.Errorf("Expected stable tokens, got %q and %q", first, second)
+	}
+	if first == third {
+		t.Error("Expected different users to get different tokens")
+	}
+	if redactor.Redact(first) != first {
+		t.Errorf("Expected tokens to survive redaction, got %q", redactor.Redact(first))
+	}
+}
+
+func TestVault_Reveal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pii.vault")
+	vault, err := OpenVault(path, testVaultKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenizer, _ := NewTokenizer(testTokenKey, vault)
+	token := tokenizer.Token("email", "alice@example.com")
+	tokenizer.Token("email", "alice@example.com")
+	tokenizer.Flush()
+
+	value, piiType, err := vault.Reveal(token)
+	if err != nil || value != "alice@example.com" || piiType != "email" {
+		t.Errorf("Reveal = %q, %q, %v", value, piiType, err)
+	}
+	if vault.Len() != 1 {
+		t.Errorf("Expected repeated value to be stored once, got %d entries", vault.Len())
+	}
+	if _, _, err := vault.Reveal("[EMAIL_0000000000000000]"); !errors.Is(err, ErrUnknownToken) {
+		t.Errorf("Expected ErrUnknownToken, got %v", err)
+	}
+
+	data, _ := os.ReadFile(path)
+	if bytes.Contains(data, []byte("alice")) {
+		t.Error("Vault file contains the plaintext value")
+	}
+
+	// A second process appending to the same vault
+	writer, err := OpenVault(path, testVaultKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := NewTokenizer(testTokenKey, writer)
+	bobToken := other.Token("email", "bob@example.com")
+	other.Close()
+
+	if value, _, err := vault.Reveal(bobToken); err != nil || value != "bob@example.com" {
+		t.Errorf("Expected vault to pick up appended entry, got %q, %v", value, err)
+	}
+	vault.Close()
+
+	wrongKey, err := OpenVault(path, bytes.Repeat([]byte{8}, VaultKeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wrongKey.Close()
+	if _, _, err := wrongKey.Reveal(token); err == nil {
+		t.Error("Expected Reveal with the wrong key to fail")
+	}
+}
+
+func TestRedactor_RedactSampleSkipsVault(t *testing.T) {
+	vault, err := OpenVault(filepath.Join(t.TempDir(), "pii.vault"), testVaultKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenizer, _ := NewTokenizer(testTokenKey, vault)
+	defer tokenizer.Close()
+	config := DefaultRedactorConfig()
+	config.Tokenizer = tokenizer
+	redactor := NewRedactor(config)
+
+	sample := redactor.RedactSample("500 error for alice@example.com")
+	tokenizer.Flush()
+	if vault.Len() != 0 {
+		t.Errorf("Expected sample redaction to leave the vault empty, got %d entries", vault.Len())
+	}
+
+	if got := redactor.Redact("500 error for alice@example.com"); got != sample {
+		t.Errorf("Expected the sample to use the same token, got %q and %q", sample, got)
+	}
+	tokenizer.Flush()
+	if vault.Len() != 1 {
+		t.Errorf("Expected Redact to store the value, got %d entries", vault.Len())
+	}
+}
+
+func TestTokenizer_CloseWritesQueuedValues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pii.vault")
+	vault, err := OpenVault(path, testVaultKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenizer, _ := NewTokenizer(testTokenKey, vault)
+	var tokens []string
+	for i := 0; i < 100; i++ {
+		tokens = append(tokens, tokenizer.Token("email", fmt.Sprintf("user%d@example.com", i)))
+	}
+	if err := tokenizer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenVault(path, testVaultKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if reopened.Len() != len(tokens) {
+		t.Errorf("Expected %d entries after Close, got %d", len(tokens), reopened.Len())
+	}
+	if value, _, err := reopened.Reveal(tokens[42]); err != nil || value != "user42@example.com" {
+		t.Errorf("Reveal = %q, %v", value, err)
+	}
+}
+
+func TestTokenizer_ForgetsWrittenTokens(t *testing.T) {
+	vault, err := OpenVault(filepath.Join(t.TempDir(), "pii.vault"), testVaultKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenizer, _ := NewTokenizer(testTokenKey, vault)
+	defer tokenizer.Close()
+
+	for i := 0; i < 100; i++ {
+		tokenizer.Token("email", fmt.Sprintf("user%d@example.com", i))
+	}
+	tokenizer.Flush()
+
+	// Written tokens are looked up in the vault, not remembered
+	queued := 0
+	tokenizer.queued.Range(func(_, _ interface{}) bool {
+		queued++
+		return true
+	})
+	if queued != 0 {
+		t.Errorf("Expected no queued tokens after Flush, got %d", queued)
+	}
+
+	tokenizer.Token("email", "user7@example.com")
+	tokenizer.Flush()
+	if vault.Len() != 100 {
+		t.Errorf("Expected 100 entries, got %d", vault.Len())
+	}
+}
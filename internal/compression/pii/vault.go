@@ -0,0 +1,207 @@
+package pii
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrUnknownToken is returned by Vault.Reveal for tokens it does not hold.
+var ErrUnknownToken = errors.New("unknown token")
+
+// VaultKeySize is the size in bytes of a vault encryption key (AES-256).
+const VaultKeySize = 32
+
+// vaultEntry is one line of a vault file. Data is the nonce followed by
+// the AES-GCM ciphertext of the value, sealed with the token as
+// additional data so entries cannot be swapped between tokens.
+type vaultEntry struct {
+	Token   string    `json:"token"`
+	Type    string    `json:"type"`
+	Data    []byte    `json:"data"`
+	Created time.Time `json:"created"`
+}
+
+// Vault keeps the values behind tokens encrypted in a local append-only
+// file, one JSON entry per line. Several processes may append to the same
+// vault; Reveal rereads the file for tokens it has not seen.
+type Vault struct {
+	mu      sync.RWMutex
+	file    *os.File
+	aead    cipher.AEAD
+	entries map[string]vaultEntry
+	offset  int64 // Bytes of the file loaded into entries
+}
+
+// OpenVault opens or creates the vault at path, encrypted with key.
+func OpenVault(path string, key []byte) (*Vault, error) {
+	if len(key) != VaultKeySize {
+		return nil, fmt.Errorf("vault key must be %d bytes, got %d", VaultKeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open vault: %w", err)
+	}
+	v := &Vault{
+		file:    file,
+		aead:    aead,
+		entries: make(map[string]vaultEntry),
+	}
+	if err := v.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return v, nil
+}
+
+// load reads entries appended to the file since the last load. A partial
+// last line, from a write in progress, is left for the next load. The
+// caller must hold v.mu.
+func (v *Vault) load() error {
+	reader := bufio.NewReader(io.NewSectionReader(v.file, v.offset, 1<<62))
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read vault: %w", err)
+		}
+
+		var entry vaultEntry
+		if err := json.Unmarshal(bytes.TrimSpace(line), &entry); err != nil {
+			return fmt.Errorf("corrupt vault entry at offset %d: %w", v.offset, err)
+		}
+		v.entries[entry.Token] = entry
+		v.offset += int64(len(line))
+	}
+}
+
+// vaultRecord is a value waiting to be stored in a vault. A record with
+// flushed set carries no value; the writer closes flushed once the records
+// queued before it are stored.
+type vaultRecord struct {
+	token   string
+	piiType string
+	value   string
+	flushed chan struct{}
+}
+
+// Put stores the value behind token unless the vault already holds it.
+func (v *Vault) Put(token, piiType, value string) error {
+	return v.putBatch([]vaultRecord{{token: token, piiType: piiType, value: value}})
+}
+
+// putBatch stores the values the vault does not already hold with a
+// single write.
+func (v *Vault) putBatch(records []vaultRecord) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	var buf bytes.Buffer
+	added := make(map[string]vaultEntry, len(records))
+	now := time.Now().UTC()
+	for _, record := range records {
+		if _, ok := v.entries[record.token]; ok {
+			continue
+		}
+		if _, ok := added[record.token]; ok {
+			continue
+		}
+
+		nonce := make([]byte, v.aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+		entry := vaultEntry{
+			Token:   record.token,
+			Type:    record.piiType,
+			Data:    v.aead.Seal(nonce, nonce, []byte(record.value), []byte(record.token)),
+			Created: now,
+		}
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+		added[record.token] = entry
+	}
+	if buf.Len() == 0 {
+		return nil
+	}
+
+	// The lines are read back by the next load, along with any lines other
+	// processes appended before them.
+	if _, err := v.file.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write vault: %w", err)
+	}
+	for token, entry := range added {
+		v.entries[token] = entry
+	}
+	return nil
+}
+
+// Reveal returns the value and PII type behind token.
+func (v *Vault) Reveal(token string) (value, piiType string, err error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	entry, ok := v.entries[token]
+	if !ok {
+		if err := v.load(); err != nil {
+			return "", "", err
+		}
+		if entry, ok = v.entries[token]; !ok {
+			return "", "", ErrUnknownToken
+		}
+	}
+
+	size := v.aead.NonceSize()
+	if len(entry.Data) < size {
+		return "", "", fmt.Errorf("corrupt vault entry for %s", token)
+	}
+	plaintext, err := v.aead.Open(nil, entry.Data[:size], entry.Data[size:], []byte(token))
+	if err != nil {
+		return "", "", fmt.Errorf("failed to decrypt vault entry for %s: %w", token, err)
+	}
+	return string(plaintext), entry.Type, nil
+}
+
+// Len returns the number of tokens the vault holds.
+func (v *Vault) Len() int {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return len(v.entries)
+}
+
+// has reports whether the vault holds token, without rereading the file.
+func (v *Vault) has(token string) bool {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	_, ok := v.entries[token]
+	return ok
+}
+
+// Close closes the vault file.
+func (v *Vault) Close() error {
+	return v.file.Close()
+}
@@ -0,0 +1,242 @@
+// Package tune recommends Drain parameters for a source by replaying a
+// sample of its logs under a grid of configurations.
+//
+// Fewer templates means better compression, but a threshold that is too
+// loose merges unrelated messages: words that should have told templates
+// apart turn into <*> slots that take only a handful of values. The tuner
+// measures the Shannon entropy of each slot's values and picks the
+// configuration with the fewest templates that has no such low-entropy
+// wildcard slots.
+package tune
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/log-zero/log-zero/internal/compression/drain"
+)
+
+// DefaultMinSlotEntropy is the default minimum entropy of a wildcard slot,
+// in bits. A slot alternating evenly between two words scores 1, one
+// spread over three words about 1.58.
+const DefaultMinSlotEntropy = 1.5
+
+// minSlotObservations is the number of values a slot needs before its
+// entropy is judged; entropy over n values is at most log2(n).
+const minSlotObservations = 8
+
+// Grid is the set of parameter values to try. Every combination is
+// replayed.
+type Grid struct {
+	SimThresholds []float64 `json:"similarity_thresholds"`
+	MaxDepths     []int     `json:"max_depths"`
+}
+
+// DefaultGrid returns the grid used when none is given.
+func DefaultGrid() Grid {
+	return Grid{
+		SimThresholds: []float64{0.3, 0.4, 0.5, 0.6, 0.7, 0.8},
+		MaxDepths:     []int{3, 4, 5, 6},
+	}
+}
+
+// Validate reports whether every grid value is usable by DrainTree.
+func (g Grid) Validate() error {
+	if len(g.SimThresholds) == 0 || len(g.MaxDepths) == 0 {
+		return fmt.Errorf("grid needs at least one similarity threshold and one depth")
+	}
+	for _, sim := range g.SimThresholds {
+		if sim <= 0 || sim > 1 {
+			return fmt.Errorf("similarity threshold %v out of range (0, 1]", sim)
+		}
+	}
+	for _, depth := range g.MaxDepths {
+		if depth < 3 {
+			return fmt.Errorf("depth %d below minimum of 3", depth)
+		}
+	}
+	return nil
+}
+
+// Trial is the outcome of replaying the sample under one configuration.
+type Trial struct {
+	SimThreshold    float64       `json:"similarity_threshold"`
+	MaxDepth        int           `json:"max_depth"`
+	Templates       int           `json:"templates"`
+	Slots           int           `json:"slots"`
+	SlotEntropy     float64       `json:"slot_entropy"`      // Mean bits per slot value, weighted by occurrences
+	LowEntropySlots int           `json:"low_entropy_slots"` // Wildcard slots below the minimum entropy
+	Acceptable      bool          `json:"acceptable"`
+	Duration        time.Duration `json:"duration_ns"`
+}
+
+// String formats the trial as one summary line.
+func (t Trial) String() string {
+	mark := " "
+	if !t.Acceptable {
+		mark = "x"
+	}
+	return fmt.Sprintf("%s sim=%.2f depth=%d templates=%d slots=%d entropy=%.3f low=%d",
+		mark, t.SimThreshold, t.MaxDepth, t.Templates, t.Slots, t.SlotEntropy, t.LowEntropySlots)
+}
+
+// Report is the result of a tuning run.
+type Report struct {
+	Lines          int                `json:"lines"`
+	MinSlotEntropy float64            `json:"min_slot_entropy"`
+	Trials         []Trial            `json:"trials"`
+	Best           Trial              `json:"best"`
+	Recommended    drain.SourceConfig `json:"recommended"` // Ready to use as a per-source override
+}
+
+// Tune replays lines under every configuration of grid, starting from base
+// so masking rules, delimiters and header patterns match the source, and
+// recommends the best one. A minSlotEntropy of zero uses
+// DefaultMinSlotEntropy.
+func Tune(lines []string, base drain.Config, grid Grid, minSlotEntropy float64) (*Report, error) {
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("no log lines to replay")
+	}
+	if err := grid.Validate(); err != nil {
+		return nil, err
+	}
+	if minSlotEntropy == 0 {
+		minSlotEntropy = DefaultMinSlotEntropy
+	}
+
+	report := &Report{Lines: len(lines), MinSlotEntropy: minSlotEntropy}
+	for _, depth := range grid.MaxDepths {
+		for _, sim := range grid.SimThresholds {
+			config := base
+			config.MaxDepth = depth
+			config.SimThreshold = sim
+			// The replay is throwaway; keep samples and limits out of the way
+			config.MaxSampleLogs = 0
+			config.RedactSample = nil
+			config.MaxTemplates = 0
+
+			report.Trials = append(report.Trials, replay(lines, config, minSlotEntropy))
+		}
+	}
+
+	report.Best = pick(report.Trials)
+	report.Recommended = drain.SourceConfig{
+		MaxDepth:     report.Best.MaxDepth,
+		SimThreshold: report.Best.SimThreshold,
+	}
+	return report, nil
+}
+
+// replay parses lines twice with a new tree: once to let templates settle,
+// then again to collect the values each final slot takes.
+func replay(lines []string, config drain.Config, minSlotEntropy float64) Trial {
+	start := time.Now()
+	dt := drain.NewDrainTree(config)
+	for i, line := range lines {
+		dt.Parse(line, int64(i))
+	}
+
+	type slot struct{ template, key string }
+	values := make(map[slot]map[string]int)
+	for i, line := range lines {
+		result, err := dt.Parse(line, int64(len(lines)+i))
+		if err != nil {
+			continue
+		}
+		id := result.TemplateID
+		for key, value := range result.Variables {
+			if strings.HasPrefix(key, "_") {
+				continue
+			}
+			s := slot{id, key}
+			if values[s] == nil {
+				values[s] = make(map[string]int)
+			}
+			values[s][value]++
+		}
+	}
+
+	wildcards := make(map[slot]bool)
+	for _, cluster := range dt.GetAllClusters() {
+		for _, key := range cluster.WildcardSlots() {
+			wildcards[slot{cluster.ID, key}] = true
+		}
+	}
+
+	// Clusters generalized during the second pass are found through their
+	// aliases, so slots of the same final template are pooled
+	merged := make(map[slot]map[string]int, len(values))
+	for s, counts := range values {
+		if current, ok := dt.ResolveID(s.template); ok {
+			s.template = current
+		}
+		if merged[s] == nil {
+			merged[s] = counts
+			continue
+		}
+		for value, n := range counts {
+			merged[s][value] += n
+		}
+	}
+
+	trial := Trial{
+		SimThreshold: config.SimThreshold,
+		MaxDepth:     config.MaxDepth,
+		Templates:    dt.ClusterCount(),
+		Slots:        len(merged),
+	}
+	var bits, total float64
+	for s, counts := range merged {
+		h, n := entropy(counts)
+		bits += h * n
+		total += n
+		if wildcards[s] && n >= minSlotObservations && h < minSlotEntropy {
+			trial.LowEntropySlots++
+		}
+	}
+	if total > 0 {
+		trial.SlotEntropy = bits / total
+	}
+	trial.Acceptable = trial.LowEntropySlots == 0
+	trial.Duration = time.Since(start)
+	return trial
+}
+
+// entropy returns the Shannon entropy in bits of a value distribution and
+// the number of values observed.
+func entropy(counts map[string]int) (float64, float64) {
+	var n float64
+	for _, c := range counts {
+		n += float64(c)
+	}
+	var h float64
+	for _, c := range counts {
+		p := float64(c) / n
+		h -= p * math.Log2(p)
+	}
+	return h, n
+}
+
+// pick returns the trial with the fewest low-entropy wildcard slots, then
+// the fewest templates, preferring higher slot entropy and then a shallower
+// tree on ties.
+func pick(trials []Trial) Trial {
+	ranked := append([]Trial{}, trials...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		a, b := ranked[i], ranked[j]
+		if a.LowEntropySlots != b.LowEntropySlots {
+			return a.LowEntropySlots < b.LowEntropySlots
+		}
+		if a.Templates != b.Templates {
+			return a.Templates < b.Templates
+		}
+		if a.SlotEntropy != b.SlotEntropy {
+			return a.SlotEntropy > b.SlotEntropy
+		}
+		return a.MaxDepth < b.MaxDepth
+	})
+	return ranked[0]
+}
@@ -0,0 +1,77 @@
+package tune
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/log-zero/log-zero/internal/compression/drain"
+)
+
+// sampleLines returns logs from a few services whose templates differ in
+// one or two words, so loose thresholds merge them.
+func sampleLines() []string {
+	var lines []string
+	users := []string{"alice", "bob", "carol", "dave", "erin", "frank", "grace", "heidi"}
+	for i := 0; i < 200; i++ {
+		user := users[i%len(users)]
+		lines = append(lines,
+			fmt.Sprintf("session opened for user %s from 10.0.%d.%d", user, i%7, i%250),
+			fmt.Sprintf("session closed for user %s after %dms", user, 100+i*13),
+			fmt.Sprintf("cache miss for key order:%d shard %d", i*31, i%4),
+			fmt.Sprintf("cache hit for key order:%d shard %d", i*17, i%4),
+		)
+	}
+	return lines
+}
+
+func TestTune(t *testing.T) {
+	report, err := Tune(sampleLines(), drain.DefaultConfig(), DefaultGrid(), 0)
+	if err != nil {
+		t.Fatalf("Tune failed: %v", err)
+	}
+	for _, trial := range report.Trials {
+		t.Log(trial)
+	}
+
+	grid := DefaultGrid()
+	if len(report.Trials) != len(grid.SimThresholds)*len(grid.MaxDepths) {
+		t.Fatalf("Expected one trial per grid point, got %d", len(report.Trials))
+	}
+	if !report.Best.Acceptable {
+		t.Fatalf("Expected an acceptable recommendation, got %s", report.Best)
+	}
+	// A depth-3 tree only looks at the first token, so opened/closed and
+	// hit/miss end up sharing templates with two-valued wildcard slots
+	if report.Trials[0].Acceptable {
+		t.Errorf("Expected the depth-3 trial to be rejected, got %s", report.Trials[0])
+	}
+	if report.Best.Templates != 4 || report.Best.MaxDepth != 4 {
+		t.Errorf("Expected 4 templates at depth 4, got %s", report.Best)
+	}
+	for _, trial := range report.Trials {
+		if trial.Acceptable && trial.Templates < report.Best.Templates {
+			t.Errorf("Trial %s has fewer templates than the recommendation %s", trial, report.Best)
+		}
+	}
+	if report.Recommended.SimThreshold != report.Best.SimThreshold || report.Recommended.MaxDepth != report.Best.MaxDepth {
+		t.Errorf("Recommended config %+v does not match best trial %s", report.Recommended, report.Best)
+	}
+}
+
+func TestTune_Errors(t *testing.T) {
+	if _, err := Tune(nil, drain.DefaultConfig(), DefaultGrid(), 0); err == nil {
+		t.Error("Expected error for empty sample")
+	}
+	if _, err := Tune([]string{"a b c"}, drain.DefaultConfig(), Grid{SimThresholds: []float64{1.5}, MaxDepths: []int{4}}, 0); err == nil {
+		t.Error("Expected error for out-of-range threshold")
+	}
+}
+
+func TestEntropy(t *testing.T) {
+	if h, n := entropy(map[string]int{"a": 5, "b": 5}); h != 1 || n != 10 {
+		t.Errorf("Expected 1 bit over 10 values, got %v over %v", h, n)
+	}
+	if h, _ := entropy(map[string]int{"a": 7}); h != 0 {
+		t.Errorf("Expected 0 bits for a constant, got %v", h)
+	}
+}
@@ -47,6 +47,14 @@ type CompressedLog struct {
 	Variables      map[string]string `json:"variables"`
 	OriginalSize   int               `json:"original_size"`
 	CompressedSize int               `json:"compressed_size"`
+
+	// Attributes holds the typed fields of a structured (JSON or logfmt)
+	// log other than its message.
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+
+	// NumericVariables holds the variables that parse as numbers, for
+	// range filters. Durations are in milliseconds.
+	NumericVariables map[string]float64 `json:"numeric_variables,omitempty"`
 }
 
 // Validate validates the compressed log.
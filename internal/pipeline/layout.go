@@ -0,0 +1,227 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// LayoutKey is the reserved attribute under which Structure records how a
+// structured line was written, so Rebuild can regenerate it.
+const LayoutKey = "_layout"
+
+// layout is the text of a structured line around its message and attribute
+// values: key order, separators and quoting. The other well-known fields,
+// such as the timestamp, are kept as written.
+type layout struct {
+	Format string       `json:"format"`
+	Parts  []layoutPart `json:"parts"`
+}
+
+// layoutPart is literal text, the message, or an attribute value.
+type layoutPart struct {
+	Text    string `json:"t,omitempty"`
+	Field   string `json:"f,omitempty"` // Attribute key
+	Message bool   `json:"m,omitempty"`
+	Quoted  bool   `json:"q,omitempty"` // JSON string or double-quoted logfmt value
+}
+
+// leaf is the position of a scalar or array value in a structured line.
+type leaf struct {
+	key        string // Dotted for nested JSON objects
+	start, end int
+	quoted     bool
+}
+
+// newLayout records the layout of content given its values, the attributes
+// left after the well-known fields were taken, and the message key. It
+// returns "" for lines that cannot be rebuilt, such as JSON with duplicate
+// keys.
+func newLayout(format, content string, leaves []leaf, attributes map[string]interface{}, messageKey string) string {
+	l := layout{Format: format}
+	seen := make(map[string]bool, len(leaves))
+	pos := 0
+	for _, v := range leaves {
+		if seen[v.key] {
+			return ""
+		}
+		seen[v.key] = true
+
+		l.text(content[pos:v.start])
+		raw := content[v.start:v.end]
+		value, attribute := attributes[v.key]
+		switch {
+		case v.key == messageKey:
+			l.Parts = append(l.Parts, layoutPart{Message: true, Quoted: v.quoted})
+		case attribute && (v.quoted || encodeValue(format, value, false) == raw && !inexact(value)):
+			l.Parts = append(l.Parts, layoutPart{Field: v.key, Quoted: v.quoted})
+		default:
+			// Well-known fields, and numbers written in another form
+			// such as 1.50 or too large to survive storage as JSON
+			l.text(raw)
+		}
+		pos = v.end
+	}
+	l.text(content[pos:])
+
+	data, err := json.Marshal(l)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// inexact reports whether an integer loses precision as a float64, as
+// attributes decoded from stored JSON are.
+func inexact(value interface{}) bool {
+	n, ok := value.(int64)
+	return ok && (n > 1<<53 || n < -1<<53)
+}
+
+// text appends literal text, merging it with preceding text.
+func (l *layout) text(s string) {
+	if s == "" {
+		return
+	}
+	if n := len(l.Parts); n > 0 && l.Parts[n-1].Text != "" {
+		l.Parts[n-1].Text += s
+		return
+	}
+	l.Parts = append(l.Parts, layoutPart{Text: s})
+}
+
+// Rebuild regenerates a structured line from its message and the attributes
+// returned by Structure, which include the layout under LayoutKey. Values
+// redacted since stay redacted, and string escapes are normalized.
+func Rebuild(message string, attributes map[string]interface{}) (string, error) {
+	encoded, ok := attributes[LayoutKey].(string)
+	if !ok {
+		return "", fmt.Errorf("no %s attribute", LayoutKey)
+	}
+	var l layout
+	if err := json.Unmarshal([]byte(encoded), &l); err != nil {
+		return "", fmt.Errorf("invalid layout: %w", err)
+	}
+
+	var b strings.Builder
+	for _, part := range l.Parts {
+		switch {
+		case part.Message:
+			b.WriteString(encodeValue(l.Format, message, part.Quoted))
+		case part.Field != "":
+			value, ok := attributes[part.Field]
+			if !ok {
+				return "", fmt.Errorf("missing attribute %q", part.Field)
+			}
+			b.WriteString(encodeValue(l.Format, value, part.Quoted))
+		default:
+			b.WriteString(part.Text)
+		}
+	}
+	return b.String(), nil
+}
+
+// encodeValue writes a value the way format would. Unquoted strings are
+// numbers or booleans formatted by takeString, or bare logfmt values, which
+// are quoted if redaction made them need it.
+func encodeValue(format string, value interface{}, quoted bool) string {
+	s, isString := value.(string)
+	if format == FormatJSON {
+		if isString && !quoted {
+			return s
+		}
+		var b strings.Builder
+		encoder := json.NewEncoder(&b)
+		encoder.SetEscapeHTML(false)
+		if err := encoder.Encode(value); err != nil {
+			return formatValue(value)
+		}
+		return strings.TrimSuffix(b.String(), "\n")
+	}
+
+	s = formatValue(value)
+	if quoted || s == "" || strings.ContainsAny(s, " \"=\n\t") {
+		return quoteLogfmt(s)
+	}
+	return s
+}
+
+// quoteLogfmt double-quotes s, escaping what readQuoted unescapes.
+func quoteLogfmt(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\', '"':
+			b.WriteByte('\\')
+			b.WriteByte(s[i])
+		case '\n':
+			b.WriteString(`\n`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// jsonLeaves finds the values of a JSON object in order, descending into
+// nested objects. Arrays are single values, as in parseJSONFields.
+func jsonLeaves(content string) ([]leaf, bool) {
+	decoder := json.NewDecoder(strings.NewReader(content))
+	decoder.UseNumber()
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return nil, false
+	}
+
+	var leaves []leaf
+	prefixes := []string{""} // Key paths of the open objects
+	for len(prefixes) > 0 {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, false
+		}
+		if token == json.Delim('}') {
+			prefixes = prefixes[:len(prefixes)-1]
+			continue
+		}
+		key, ok := token.(string)
+		if !ok {
+			return nil, false
+		}
+		if prefix := prefixes[len(prefixes)-1]; prefix != "" {
+			key = prefix + "." + key
+		}
+
+		// The value starts after the colon following the key
+		start := int(decoder.InputOffset())
+		for start < len(content) && strings.IndexByte(" \t\r\n:", content[start]) >= 0 {
+			start++
+		}
+		if token, err = decoder.Token(); err != nil {
+			return nil, false
+		}
+		switch token {
+		case json.Delim('{'):
+			prefixes = append(prefixes, key)
+			continue
+		case json.Delim('['):
+			for depth := 1; depth > 0; {
+				if token, err = decoder.Token(); err != nil {
+					return nil, false
+				}
+				switch token {
+				case json.Delim('['), json.Delim('{'):
+					depth++
+				case json.Delim(']'), json.Delim('}'):
+					depth--
+				}
+			}
+		}
+		_, quoted := token.(string)
+		leaves = append(leaves, leaf{key: key, start: start, end: int(decoder.InputOffset()), quoted: quoted})
+	}
+	return leaves, true
+}
@@ -0,0 +1,89 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/log-zero/log-zero/internal/compression/drain"
+)
+
+func TestRebuild_RoundTrip(t *testing.T) {
+	lines := []string{
+		`{"ts":"2024-05-01T12:00:00.5Z","level":"error","msg":"payment failed for order 42","service":"billing","http":{"status":502,"latency":1.25},"retry":true,"user":"bob"}`,
+		`{ "message" : "cache <warm> & ready", "tags": ["a", 1], "empty": {}, "note": null, "ratio": 1.50, "big": 12345678901234567 }`,
+		`{"event":42,"path":"C:\\temp\\x","quote":"say \"hi\""}`,
+		`time=1714564800 level=info msg="user \"bob\" logged in" duration=0.3 attempts=2 ok=true`,
+		`  ts=2024-05-01T12:00:00Z msg=started  path=/api/v1 retry=007 note="a\tb"`,
+	}
+	for _, line := range lines {
+		msg := &Message{Content: line}
+		attributes, ok := Structure(msg)
+		if !ok {
+			t.Fatalf("Expected %q to be structured", line)
+		}
+
+		// Cluster the message and store the attributes as JSON
+		tree := drain.NewDrainTree(drain.DefaultConfig())
+		result, err := tree.Parse(msg.Content, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		message, err := drain.Reconstruct(result.Template, result.Variables)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := json.Marshal(attributes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var stored map[string]interface{}
+		if err := json.Unmarshal(data, &stored); err != nil {
+			t.Fatal(err)
+		}
+
+		rebuilt, err := Rebuild(message, stored)
+		if err != nil {
+			t.Fatalf("Rebuild(%q): %v", line, err)
+		}
+		if rebuilt != line {
+			t.Errorf("Expected %q, got %q", line, rebuilt)
+		}
+	}
+}
+
+func TestRebuild_RedactedValues(t *testing.T) {
+	msg := &Message{Content: `level=warn msg=denied user=bob@example.com attempts=3`}
+	attributes, ok := Structure(msg)
+	if !ok {
+		t.Fatal("Expected message to be structured")
+	}
+	attributes["user"] = "<EMAIL redacted>"
+
+	rebuilt, err := Rebuild("access denied", attributes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `level=warn msg="access denied" user="<EMAIL redacted>" attempts=3`
+	if rebuilt != want {
+		t.Errorf("Expected %q, got %q", want, rebuilt)
+	}
+
+	delete(attributes, "user")
+	if _, err := Rebuild("denied", attributes); err == nil {
+		t.Error("Expected an error for a missing attribute")
+	}
+	if _, err := Rebuild("denied", map[string]interface{}{}); err == nil {
+		t.Error("Expected an error without a layout")
+	}
+}
+
+func TestStructure_NoLayoutForDuplicateKeys(t *testing.T) {
+	msg := &Message{Content: `{"msg":"first","user":"a","user":"b"}`}
+	attributes, ok := Structure(msg)
+	if !ok {
+		t.Fatal("Expected message to be structured")
+	}
+	if _, ok := attributes[LayoutKey]; ok {
+		t.Error("Expected no layout when a key repeats")
+	}
+}
@@ -0,0 +1,365 @@
+package pipeline
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultContinuationPattern matches the continuation lines of Java stack
+// traces, Python tracebacks and Go panics.
+const DefaultContinuationPattern = `^(\s|$|Caused by:|Suppressed:|\.\.\. \d+ more|Traceback \(|goroutine \d+ \[|created by |exit status \d+)`
+
+// DefaultHeaderPattern matches exception lines, such as
+// "java.io.IOException: closed" or Python's final "ValueError: bad input",
+// and package-qualified Go function frames. These also occur as ordinary
+// log lines, so they only continue an event in stack trace context.
+const DefaultHeaderPattern = `^([\w$.]+(Exception|Error|Throwable)(:|$)|[\w/.-]+\.[\w*().]+\(.*\)$)`
+
+// MultilineConfig configures how the lines of a source are grouped into
+// events.
+type MultilineConfig struct {
+	// StartPattern matches the first line of an event. When set, every
+	// line that does not match it continues the current event.
+	StartPattern string `json:"start_pattern,omitempty"`
+
+	// ContinuationPattern matches lines that continue the current event.
+	// It is checked before StartPattern.
+	ContinuationPattern string `json:"continuation_pattern,omitempty"`
+
+	// HeaderPattern matches lines that continue the current event only
+	// when it already has continuation lines, or when the line after them
+	// continues it, such as an exception followed by its stack frames.
+	// Otherwise they start a new event.
+	HeaderPattern string `json:"header_pattern,omitempty"`
+
+	FlushTimeout time.Duration `json:"flush_timeout,omitempty"` // Emit a pending event after this long without new lines
+	MaxLines     int           `json:"max_lines,omitempty"`     // Emit an event once it has this many lines
+	MaxBytes     int           `json:"max_bytes,omitempty"`     // Emit an event before it grows past this size
+}
+
+// DefaultMultilineConfig returns sensible defaults.
+func DefaultMultilineConfig() MultilineConfig {
+	return MultilineConfig{
+		ContinuationPattern: DefaultContinuationPattern,
+		HeaderPattern:       DefaultHeaderPattern,
+		FlushTimeout:        time.Second,
+		MaxLines:            500,
+		MaxBytes:            64 * 1024,
+	}
+}
+
+// multilineRule is a compiled MultilineConfig.
+type multilineRule struct {
+	config       MultilineConfig
+	start        *regexp.Regexp
+	continuation *regexp.Regexp
+	header       *regexp.Regexp
+}
+
+// compileMultilineRule compiles config, filling unset limits from the
+// defaults. Invalid patterns are ignored.
+func compileMultilineRule(config MultilineConfig) *multilineRule {
+	defaults := DefaultMultilineConfig()
+	if config.FlushTimeout <= 0 {
+		config.FlushTimeout = defaults.FlushTimeout
+	}
+	if config.MaxLines <= 0 {
+		config.MaxLines = defaults.MaxLines
+	}
+	if config.MaxBytes <= 0 {
+		config.MaxBytes = defaults.MaxBytes
+	}
+
+	rule := &multilineRule{config: config}
+	if config.StartPattern != "" {
+		rule.start, _ = regexp.Compile(config.StartPattern)
+	}
+	if config.ContinuationPattern != "" {
+		rule.continuation, _ = regexp.Compile(config.ContinuationPattern)
+	}
+	if config.HeaderPattern != "" {
+		rule.header, _ = regexp.Compile(config.HeaderPattern)
+	}
+	return rule
+}
+
+// continues reports whether line belongs to the event before it.
+func (r *multilineRule) continues(line string) bool {
+	if r.continuation != nil && r.continuation.MatchString(line) {
+		return true
+	}
+	if r.start != nil {
+		return !r.start.MatchString(line)
+	}
+	return false
+}
+
+// isHeader reports whether line continues the event before it only in
+// stack trace context.
+func (r *multilineRule) isHeader(line string) bool {
+	return r.header != nil && r.header.MatchString(line)
+}
+
+// pendingEvent is an event still receiving lines.
+type pendingEvent struct {
+	msg      *Message
+	lines    []string
+	size     int
+	lastLine time.Time
+
+	// held is a header line waiting for the next line to decide whether
+	// it continues this event or starts its own.
+	held *pendingEvent
+}
+
+// MultilineAggregator groups consecutive lines from the same source and
+// stream into single events, such as a log line followed by its stack
+// trace, before they are handed on for parsing.
+type MultilineAggregator struct {
+	rules    map[string]*multilineRule
+	fallback *multilineRule
+	emit     func(*Message) bool
+	onDrop   func(*Message)
+
+	mu      sync.Mutex
+	pending map[streamKey]*pendingEvent
+}
+
+// streamKey identifies the producer whose lines a pending event groups.
+type streamKey struct {
+	source string
+	stream string
+}
+
+// NewMultilineAggregator creates an aggregator that passes completed events
+// to emit. Sources without an entry in perSource use config.
+func NewMultilineAggregator(config MultilineConfig, perSource map[string]MultilineConfig, emit func(*Message) bool) *MultilineAggregator {
+	rules := make(map[string]*multilineRule, len(perSource))
+	for source, sourceConfig := range perSource {
+		rules[source] = compileMultilineRule(sourceConfig)
+	}
+
+	return &MultilineAggregator{
+		rules:    rules,
+		fallback: compileMultilineRule(config),
+		emit:     emit,
+		pending:  make(map[streamKey]*pendingEvent),
+	}
+}
+
+// OnDrop sets a function called with each completed event that emit
+// rejects. It must be set before lines are added.
+func (a *MultilineAggregator) OnDrop(fn func(*Message)) {
+	a.onDrop = fn
+}
+
+// rule returns the rule for source.
+func (a *MultilineAggregator) rule(source string) *multilineRule {
+	if rule, ok := a.rules[source]; ok {
+		return rule
+	}
+	return a.fallback
+}
+
+// Add feeds one line to the aggregator, to be grouped with the lines before
+// and after it from the same source and stream. A message holding several
+// lines is split first. The line is always buffered; events it completes
+// that cannot be emitted are passed to the OnDrop function.
+func (a *MultilineAggregator) Add(msg *Message) {
+	key := streamKey{msg.Source, msg.Stream}
+
+	a.mu.Lock()
+	event, ready := a.group(a.pending[key], msg)
+	if event != nil {
+		a.pending[key] = event
+	}
+	a.mu.Unlock()
+
+	a.emitAll(ready)
+}
+
+// AddComplete groups the lines of msg among themselves only and emits
+// every resulting event at once, reporting whether all were accepted.
+// Use it for messages from producers without a stream, whose lines must
+// not be joined with other producers'.
+func (a *MultilineAggregator) AddComplete(msg *Message) bool {
+	event, ready := a.group(nil, msg)
+	if event != nil {
+		ready = append(ready, event.messages()...)
+	}
+	return a.emitAll(ready)
+}
+
+// group feeds the lines of msg to event, which may be nil, and returns the
+// event still receiving lines and the events completed.
+func (a *MultilineAggregator) group(event *pendingEvent, msg *Message) (*pendingEvent, []*Message) {
+	rule := a.rule(msg.Source)
+	now := time.Now()
+
+	var ready []*Message
+	for i, line := range strings.Split(msg.Content, "\n") {
+		var done []*Message
+		event, done = event.add(rule, msg, i, line, now)
+		ready = append(ready, done...)
+	}
+	return event, ready
+}
+
+// add feeds line i of msg to the event e, which may be nil, and returns the
+// event now receiving lines and the events the line completed.
+func (e *pendingEvent) add(rule *multilineRule, msg *Message, i int, line string, now time.Time) (*pendingEvent, []*Message) {
+	if e == nil && strings.TrimSpace(line) == "" {
+		return nil, nil
+	}
+
+	var ready []*Message
+	if e != nil && e.held != nil {
+		held := e.held
+		e.held = nil
+		if rule.continues(line) && !e.full(rule, held.lines[0]) {
+			e.append(held.lines[0], now)
+		} else {
+			ready = append(ready, e.message())
+			e = held
+		}
+	}
+
+	if e != nil {
+		switch {
+		case rule.continues(line) && !e.full(rule, line):
+			e.append(line, now)
+			return e, ready
+		case rule.isHeader(line) && !e.full(rule, line):
+			if len(e.lines) > 1 {
+				e.append(line, now)
+			} else {
+				e.held = newPendingEvent(msg, i, line, now)
+				e.lastLine = now
+			}
+			return e, ready
+		}
+		ready = append(ready, e.message())
+	}
+	return newPendingEvent(msg, i, line, now), ready
+}
+
+// newPendingEvent starts an event at line i of msg.
+func newPendingEvent(msg *Message, i int, line string, now time.Time) *pendingEvent {
+	first := *msg
+	if i > 0 {
+		first.ID = msg.ID + "-" + strconv.Itoa(i)
+	}
+	return &pendingEvent{
+		msg:      &first,
+		lines:    []string{line},
+		size:     len(line),
+		lastLine: now,
+	}
+}
+
+// append adds a line to the event.
+func (e *pendingEvent) append(line string, now time.Time) {
+	e.lines = append(e.lines, line)
+	e.size += len(line) + 1
+	e.lastLine = now
+}
+
+// full reports whether adding line would push the event past its limits.
+func (e *pendingEvent) full(rule *multilineRule, line string) bool {
+	return len(e.lines) >= rule.config.MaxLines || e.size+len(line)+1 > rule.config.MaxBytes
+}
+
+// message returns the completed event.
+func (e *pendingEvent) message() *Message {
+	msg := *e.msg
+	msg.Content = strings.Join(e.lines, "\n")
+	return &msg
+}
+
+// messages returns the completed event followed by its held line, if any.
+func (e *pendingEvent) messages() []*Message {
+	if e.held == nil {
+		return []*Message{e.message()}
+	}
+	return []*Message{e.message(), e.held.message()}
+}
+
+// FlushExpired emits events that have not received a line within their
+// flush timeout.
+func (a *MultilineAggregator) FlushExpired() bool {
+	now := time.Now()
+
+	var ready []*Message
+	a.mu.Lock()
+	for key, event := range a.pending {
+		if now.Sub(event.lastLine) >= a.rule(key.source).config.FlushTimeout {
+			ready = append(ready, event.messages()...)
+			delete(a.pending, key)
+		}
+	}
+	a.mu.Unlock()
+
+	return a.emitAll(ready)
+}
+
+// Flush emits every pending event.
+func (a *MultilineAggregator) Flush() bool {
+	var ready []*Message
+	a.mu.Lock()
+	for key, event := range a.pending {
+		ready = append(ready, event.messages()...)
+		delete(a.pending, key)
+	}
+	a.mu.Unlock()
+
+	return a.emitAll(ready)
+}
+
+// Pending returns the number of events still receiving lines.
+func (a *MultilineAggregator) Pending() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.pending)
+}
+
+// emitAll passes events on in order, reporting whether all were accepted.
+// Rejected events are passed to the OnDrop function.
+func (a *MultilineAggregator) emitAll(events []*Message) bool {
+	ok := true
+	for _, msg := range events {
+		if !a.emit(msg) {
+			ok = false
+			if a.onDrop != nil {
+				a.onDrop(msg)
+			}
+		}
+	}
+	return ok
+}
+
+// Run flushes expired events until ctx is done. Events still pending then
+// are left for Flush.
+func (a *MultilineAggregator) Run(ctx context.Context) {
+	interval := a.fallback.config.FlushTimeout
+	for _, rule := range a.rules {
+		if rule.config.FlushTimeout < interval {
+			interval = rule.config.FlushTimeout
+		}
+	}
+
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			a.FlushExpired()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
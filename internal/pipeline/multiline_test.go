@@ -0,0 +1,264 @@
+package pipeline
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// collect returns an emit function that records events.
+func collect(events *[]*Message) func(*Message) bool {
+	return func(msg *Message) bool {
+		*events = append(*events, msg)
+		return true
+	}
+}
+
+// feed adds each line as its own message from source.
+func feed(a *MultilineAggregator, source string, lines []string) {
+	for i, line := range lines {
+		a.Add(&Message{ID: fmt.Sprint(i), Content: line, Source: source, Timestamp: time.Now()})
+	}
+}
+
+func TestMultilineAggregator_StackTraces(t *testing.T) {
+	tests := []struct {
+		name      string
+		lines     []string
+		wantLines []int
+	}{
+		{
+			name: "Java",
+			lines: []string{
+				"ERROR Request failed",
+				"java.lang.IllegalStateException: boom",
+				"\tat com.example.Service.handle(Service.java:42)",
+				"\tat com.example.Server.run(Server.java:10)",
+				"Caused by: java.io.IOException: closed",
+				"\t... 2 more",
+				"INFO Request served",
+			},
+			wantLines: []int{6, 1},
+		},
+		{
+			name: "Python",
+			lines: []string{
+				"ERROR Job failed",
+				"Traceback (most recent call last):",
+				`  File "/app/jobs/run.py", line 10, in main`,
+				"    run()",
+				"ValueError: bad input",
+				"INFO Job retried",
+			},
+			wantLines: []int{5, 1},
+		},
+		{
+			name: "Go",
+			lines: []string{
+				"panic: runtime error: index out of range",
+				"",
+				"goroutine 1 [running]:",
+				"main.main()",
+				"\t/app/main.go:5 +0x1d",
+				"exit status 2",
+				"server started",
+			},
+			wantLines: []int{6, 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var events []*Message
+			a := NewMultilineAggregator(DefaultMultilineConfig(), nil, collect(&events))
+			feed(a, "app", tt.lines)
+			a.Flush()
+
+			if len(events) != len(tt.wantLines) {
+				t.Fatalf("Expected %d events, got %d", len(tt.wantLines), len(events))
+			}
+			for i, want := range tt.wantLines {
+				if got := strings.Count(events[i].Content, "\n") + 1; got != want {
+					t.Errorf("Event %d: expected %d lines, got %d", i, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestMultilineAggregator_StandaloneHeaderLines(t *testing.T) {
+	var events []*Message
+	a := NewMultilineAggregator(DefaultMultilineConfig(), nil, collect(&events))
+	feed(a, "app", []string{
+		"INFO request served",
+		"ValidationError: bad input",
+		"init(config)",
+		"config.load(path)",
+		"INFO request served",
+	})
+	a.Flush()
+
+	if len(events) != 5 {
+		var got []string
+		for _, event := range events {
+			got = append(got, event.Content)
+		}
+		t.Errorf("Expected every line to be its own event, got %q", got)
+	}
+}
+
+func TestMultilineAggregator_Streams(t *testing.T) {
+	var events []*Message
+	a := NewMultilineAggregator(DefaultMultilineConfig(), nil, collect(&events))
+
+	// Two producers of one source interleave their lines
+	add := func(stream, line string) {
+		a.Add(&Message{ID: stream, Content: line, Source: "http", Stream: stream})
+	}
+	add("a", "ERROR a failed")
+	add("b", "ERROR b failed")
+	add("a", "\tat com.example.A.run(A.java:1)")
+	add("b", "\tat com.example.B.run(B.java:1)")
+	a.Flush()
+
+	got := make(map[string]string)
+	for _, event := range events {
+		got[event.Stream] = event.Content
+	}
+	if len(events) != 2 || got["a"] != "ERROR a failed\n\tat com.example.A.run(A.java:1)" || got["b"] != "ERROR b failed\n\tat com.example.B.run(B.java:1)" {
+		t.Errorf("Expected one event per stream, got %q", got)
+	}
+}
+
+func TestMultilineAggregator_AddComplete(t *testing.T) {
+	var events []*Message
+	a := NewMultilineAggregator(DefaultMultilineConfig(), nil, collect(&events))
+
+	ok := a.AddComplete(&Message{ID: "1", Content: "ERROR failed\njava.io.IOException: closed", Source: "http"})
+	if !ok || len(events) != 2 || a.Pending() != 0 {
+		t.Fatalf("Expected two events emitted at once, got %d events and %d pending", len(events), a.Pending())
+	}
+	if events[0].Content != "ERROR failed" || events[1].Content != "java.io.IOException: closed" || events[1].ID != "1-1" {
+		t.Errorf("Unexpected events %+v %+v", events[0], events[1])
+	}
+
+	rejecting := NewMultilineAggregator(DefaultMultilineConfig(), nil, func(*Message) bool { return false })
+	if rejecting.AddComplete(&Message{ID: "2", Content: "INFO ok", Source: "http"}) {
+		t.Error("Expected AddComplete to report the rejected event")
+	}
+}
+
+func TestMultilineAggregator_StartPatternAndLimits(t *testing.T) {
+	var events []*Message
+	a := NewMultilineAggregator(DefaultMultilineConfig(), map[string]MultilineConfig{
+		"db": {StartPattern: `^\d{4}-\d{2}-\d{2} `, MaxLines: 3},
+	}, collect(&events))
+
+	feed(a, "db", []string{
+		"2024-01-01 query slow",
+		"SELECT *",
+		"FROM users",
+		"WHERE id = 1",
+		"2024-01-01 query done",
+	})
+	feed(a, "api", []string{"request one", "request two"})
+	a.Flush()
+
+	var db []string
+	for _, event := range events {
+		if event.Source == "db" {
+			db = append(db, event.Content)
+		}
+	}
+	want := []string{
+		"2024-01-01 query slow\nSELECT *\nFROM users",
+		"WHERE id = 1",
+		"2024-01-01 query done",
+	}
+	if fmt.Sprint(db) != fmt.Sprint(want) {
+		t.Errorf("Expected db events %q, got %q", want, db)
+	}
+	if len(events) != len(want)+2 {
+		t.Errorf("Expected api lines to stay separate, got %d events", len(events))
+	}
+}
+
+func TestMultilineAggregator_FlushTimeout(t *testing.T) {
+	var events []*Message
+	config := DefaultMultilineConfig()
+	config.FlushTimeout = 10 * time.Millisecond
+	a := NewMultilineAggregator(config, nil, collect(&events))
+
+	feed(a, "app", []string{"ERROR failed", "\tat com.example.Main.main(Main.java:3)"})
+	a.FlushExpired()
+	if len(events) != 0 {
+		t.Fatalf("Expected event to stay pending, got %d events", len(events))
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	a.FlushExpired()
+	if len(events) != 1 || a.Pending() != 0 {
+		t.Errorf("Expected expired event to be flushed, got %d events and %d pending", len(events), a.Pending())
+	}
+}
+
+func TestMultilineAggregator_OnDrop(t *testing.T) {
+	a := NewMultilineAggregator(DefaultMultilineConfig(), nil, func(*Message) bool { return false })
+	var dropped []*Message
+	a.OnDrop(func(msg *Message) {
+		dropped = append(dropped, msg)
+	})
+
+	feed(a, "app", []string{"ERROR failed", "\tat com.example.Main.main(Main.java:3)", "INFO next"})
+	if len(dropped) != 1 || dropped[0].ID != "0" || !strings.Contains(dropped[0].Content, "Main.java") {
+		t.Fatalf("Expected the completed event to be dropped, got %v", dropped)
+	}
+
+	if a.Flush() {
+		t.Error("Expected Flush to report the rejected event")
+	}
+	if len(dropped) != 2 || dropped[1].ID != "2" {
+		t.Errorf("Expected the pending event to be dropped on flush, got %v", dropped)
+	}
+}
+
+func TestStackSignature(t *testing.T) {
+	tests := []struct {
+		name  string
+		event string
+		want  string
+	}{
+		{
+			name:  "Java",
+			event: "ERROR failed\njava.lang.IllegalStateException: boom\n\tat com.example.Service.handle(Service.java:42)\n\tat com.example.Server.run(Server.java:10)\n\tat java.lang.Thread.run(Thread.java:750)",
+			want:  "[java.lang.IllegalStateException com.example.Service.handle com.example.Server.run]",
+		},
+		{
+			name:  "Python",
+			event: "ERROR failed\nTraceback (most recent call last):\n  File \"/app/run.py\", line 10, in main\n    run()\n  File \"/app/jobs.py\", line 3, in run\n    parse()\nValueError: bad input",
+			want:  "[ValueError jobs.run run.main]",
+		},
+		{
+			name:  "Go",
+			event: "panic: boom\n\ngoroutine 1 [running]:\nmain.(*Server).handle(0xc000010000)\n\t/app/server.go:12 +0x1d\nmain.main.func1()\n\t/app/main.go:5 +0x1d",
+			want:  "[panic main.(*Server).handle main.main]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signature, ok := StackSignature(tt.event, 2)
+			if !ok {
+				t.Fatal("Expected a stack trace")
+			}
+			if got := fmt.Sprint(signature); got != tt.want {
+				t.Errorf("Expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+
+	if _, ok := StackSignature("INFO first\nINFO second", 2); ok {
+		t.Error("Expected no stack trace in plain lines")
+	}
+}
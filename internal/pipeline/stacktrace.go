@@ -0,0 +1,134 @@
+package pipeline
+
+import (
+	"path"
+	"regexp"
+	"strings"
+)
+
+var (
+	javaFrame     = regexp.MustCompile(`^\s+at\s+([\w$.<>]+)\(`)
+	javaException = regexp.MustCompile(`(?:^|\s)([\w$]+(?:\.[\w$]+)*(?:Exception|Error|Throwable))(?::|$)`)
+	pythonFrame   = regexp.MustCompile(`^\s+File "([^"]+)", line \d+, in (\S+)`)
+	pythonError   = regexp.MustCompile(`^([A-Za-z_][\w.]*)(?::|$)`)
+	goFrame       = regexp.MustCompile(`^([\w./*()-]+)\(.*\)$`)
+	goPanic       = regexp.MustCompile(`^panic: `)
+	goClosure     = regexp.MustCompile(`\.func\d+(\.\d+)*$`)
+)
+
+// StackSignature identifies the stack trace in a multi-line event by its
+// exception type followed by its top frames, innermost first, with line
+// numbers and paths removed. It returns false if the event holds no
+// recognizable stack trace.
+func StackSignature(event string, frames int) ([]string, bool) {
+	lines := strings.Split(event, "\n")
+	for _, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "Traceback ("):
+			return pythonSignature(lines, frames)
+		case goPanic.MatchString(line):
+			return goSignature(lines, frames)
+		case javaFrame.MatchString(line):
+			return javaSignature(lines, frames)
+		}
+	}
+	return nil, false
+}
+
+// javaSignature handles Java and other JVM stack traces. The exception is
+// the last one named before the first frame, so "Caused by" chains key on
+// the outermost exception.
+func javaSignature(lines []string, frames int) ([]string, bool) {
+	var exception string
+	var signature []string
+	for _, line := range lines {
+		if m := javaFrame.FindStringSubmatch(line); m != nil {
+			if exception == "" {
+				return nil, false
+			}
+			if len(signature) < frames {
+				signature = append(signature, m[1])
+			}
+			continue
+		}
+		if len(signature) > 0 {
+			break
+		}
+		if m := javaException.FindStringSubmatch(line); m != nil {
+			exception = m[1]
+		}
+	}
+	if exception == "" {
+		return nil, false
+	}
+	return append([]string{exception}, signature...), true
+}
+
+// pythonSignature handles Python tracebacks, whose innermost frame is
+// printed last.
+func pythonSignature(lines []string, frames int) ([]string, bool) {
+	var stack []string
+	var exception string
+	inTraceback := false
+	for _, line := range lines {
+		if strings.HasPrefix(line, "Traceback (") {
+			inTraceback = true
+			stack = stack[:0]
+			continue
+		}
+		if !inTraceback {
+			continue
+		}
+		if m := pythonFrame.FindStringSubmatch(line); m != nil {
+			module := strings.TrimSuffix(path.Base(m[1]), ".py")
+			stack = append(stack, module+"."+m[2])
+			continue
+		}
+		if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			continue
+		}
+		if m := pythonError.FindStringSubmatch(line); m != nil {
+			exception = m[1]
+			inTraceback = false
+		}
+	}
+	if exception == "" {
+		return nil, false
+	}
+
+	signature := []string{exception}
+	for i := len(stack) - 1; i >= 0 && len(signature) <= frames; i-- {
+		signature = append(signature, stack[i])
+	}
+	return signature, true
+}
+
+// goSignature handles Go panics. Only the panicking goroutine is used.
+func goSignature(lines []string, frames int) ([]string, bool) {
+	signature := []string{"panic"}
+	inGoroutine := false
+	for _, line := range lines {
+		if strings.HasPrefix(line, "goroutine ") {
+			if inGoroutine {
+				break
+			}
+			inGoroutine = true
+			continue
+		}
+		if !inGoroutine || strings.HasPrefix(line, "\t") {
+			continue
+		}
+		m := goFrame.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		if strings.HasPrefix(m[1], "panic") || strings.HasPrefix(m[1], "runtime.") {
+			continue
+		}
+		signature = append(signature, goClosure.ReplaceAllString(m[1], ""))
+		if len(signature) > frames {
+			break
+		}
+	}
+	return signature, inGoroutine
+}
@@ -0,0 +1,364 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Log formats recognized by ParseStructured.
+const (
+	FormatJSON   = "json"
+	FormatLogfmt = "logfmt"
+)
+
+// Message metadata keys set by Structure.
+const (
+	MetaFormat    = "format"
+	MetaTimestamp = "timestamp"
+	MetaLevel     = "level"
+	MetaService   = "service"
+)
+
+// Well-known field names, in order of preference.
+var (
+	timestampKeys = []string{"timestamp", "@timestamp", "time", "ts", "datetime"}
+	levelKeys     = []string{"level", "lvl", "severity", "log.level"}
+	messageKeys   = []string{"message", "msg", "@message", "event"}
+	serviceKeys   = []string{"service", "service.name", "app", "application"}
+)
+
+// StructuredLog is a JSON or logfmt log line split into its well-known
+// fields and the remaining attributes.
+type StructuredLog struct {
+	Format     string
+	Timestamp  time.Time // Zero if the line has no parseable timestamp
+	Level      string
+	Message    string
+	Service    string
+	Attributes map[string]interface{} // Typed values keyed by field name; nested objects use dotted keys
+	Layout     string                 // Encoded layout for Rebuild; empty if the line cannot be rebuilt
+}
+
+// ParseStructured detects a JSON object or logfmt line and splits it into
+// fields. Lines without a message field are not treated as structured.
+func ParseStructured(content string) (*StructuredLog, bool) {
+	trimmed := strings.TrimSpace(content)
+
+	var fields map[string]interface{}
+	var leaves []leaf
+	var format string
+	if strings.HasPrefix(trimmed, "{") {
+		var ok bool
+		if fields, ok = parseJSONFields(trimmed); !ok {
+			return nil, false
+		}
+		leaves, _ = jsonLeaves(trimmed)
+		format = FormatJSON
+	} else {
+		var ok bool
+		if fields, leaves, ok = parseLogfmt(trimmed); !ok {
+			return nil, false
+		}
+		format = FormatLogfmt
+	}
+
+	messageKey, message, ok := takeString(fields, messageKeys)
+	if !ok {
+		return nil, false
+	}
+
+	log := &StructuredLog{
+		Format:  format,
+		Message: message,
+	}
+	_, log.Level, _ = takeString(fields, levelKeys)
+	_, log.Service, _ = takeString(fields, serviceKeys)
+	for _, key := range timestampKeys {
+		value, exists := fields[key]
+		if !exists {
+			continue
+		}
+		if ts, ok := parseTimestamp(value); ok {
+			log.Timestamp = ts
+			delete(fields, key)
+			break
+		}
+	}
+	log.Attributes = fields
+
+	// Offsets of leaves are in the trimmed line
+	if _, reserved := fields[LayoutKey]; leaves != nil && !reserved {
+		lead := strings.Index(content, trimmed)
+		for i := range leaves {
+			leaves[i].start += lead
+			leaves[i].end += lead
+		}
+		log.Layout = newLayout(format, content, leaves, fields, messageKey)
+	}
+	return log, true
+}
+
+// Structure parses msg.Content as a structured log. If it is one, the
+// message field replaces msg.Content, the well-known fields are recorded in
+// msg.Metadata (and the timestamp in msg.Timestamp), and the remaining
+// attributes are returned, with the layout of the line under LayoutKey so
+// Rebuild can regenerate it.
+func Structure(msg *Message) (map[string]interface{}, bool) {
+	log, ok := ParseStructured(msg.Content)
+	if !ok {
+		return nil, false
+	}
+
+	if msg.Metadata == nil {
+		msg.Metadata = make(map[string]string)
+	}
+	msg.Metadata[MetaFormat] = log.Format
+	if !log.Timestamp.IsZero() {
+		msg.Timestamp = log.Timestamp
+		msg.Metadata[MetaTimestamp] = log.Timestamp.Format(time.RFC3339Nano)
+	}
+	if log.Level != "" {
+		msg.Metadata[MetaLevel] = log.Level
+	}
+	if log.Service != "" {
+		msg.Metadata[MetaService] = log.Service
+	}
+	msg.Content = log.Message
+	if log.Layout != "" {
+		log.Attributes[LayoutKey] = log.Layout
+	}
+
+	return log.Attributes, true
+}
+
+// takeString removes and returns the first of keys present in fields,
+// formatted as a string, along with its key.
+func takeString(fields map[string]interface{}, keys []string) (string, string, bool) {
+	for _, key := range keys {
+		value, exists := fields[key]
+		if !exists {
+			continue
+		}
+		delete(fields, key)
+		if s, ok := value.(string); ok {
+			return key, s, true
+		}
+		return key, formatValue(value), true
+	}
+	return "", "", false
+}
+
+// formatValue renders a typed attribute value as text.
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+}
+
+// parseJSONFields decodes a JSON object, flattening nested objects into
+// dotted keys. Integers decode as int64 and other numbers as float64.
+func parseJSONFields(content string) (map[string]interface{}, bool) {
+	decoder := json.NewDecoder(strings.NewReader(content))
+	decoder.UseNumber()
+
+	var object map[string]interface{}
+	if err := decoder.Decode(&object); err != nil || decoder.More() {
+		return nil, false
+	}
+
+	fields := make(map[string]interface{}, len(object))
+	flattenJSON("", object, fields)
+	return fields, true
+}
+
+// flattenJSON copies object into fields under prefix.
+func flattenJSON(prefix string, object map[string]interface{}, fields map[string]interface{}) {
+	for key, value := range object {
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		switch v := value.(type) {
+		case map[string]interface{}:
+			flattenJSON(key, v, fields)
+		case json.Number:
+			if n, err := v.Int64(); err == nil {
+				fields[key] = n
+			} else if f, err := v.Float64(); err == nil {
+				fields[key] = f
+			} else {
+				fields[key] = v.String()
+			}
+		default:
+			fields[key] = v
+		}
+	}
+}
+
+// parseLogfmt decodes a logfmt line such as `level=info msg="user login"
+// user_id=42`. Every token must be a key=value pair and at least two are
+// required, so plain text is not mistaken for logfmt. Unquoted values are
+// typed as int64, float64 or bool where they parse as one. The positions
+// of the values are returned in order.
+func parseLogfmt(content string) (map[string]interface{}, []leaf, bool) {
+	fields := make(map[string]interface{})
+	var leaves []leaf
+	pairs := 0
+
+	for i := 0; i < len(content); {
+		for i < len(content) && content[i] == ' ' {
+			i++
+		}
+		if i == len(content) {
+			break
+		}
+
+		start := i
+		for i < len(content) && content[i] != '=' && content[i] != ' ' {
+			i++
+		}
+		key := content[start:i]
+		if key == "" || i == len(content) || content[i] != '=' || !validLogfmtKey(key) {
+			return nil, nil, false
+		}
+		i++
+
+		start = i
+		quoted := i < len(content) && content[i] == '"'
+		if quoted {
+			value, n, ok := readQuoted(content[i:])
+			if !ok {
+				return nil, nil, false
+			}
+			fields[key] = value
+			i += n
+		} else {
+			for i < len(content) && content[i] != ' ' {
+				i++
+			}
+			fields[key] = typedValue(content[start:i])
+		}
+		leaves = append(leaves, leaf{key: key, start: start, end: i, quoted: quoted})
+		pairs++
+	}
+
+	return fields, leaves, pairs >= 2
+}
+
+// validLogfmtKey reports whether key looks like a logfmt key.
+func validLogfmtKey(key string) bool {
+	for _, r := range key {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '.' && r != '-' && r != '@' {
+			return false
+		}
+	}
+	return true
+}
+
+// readQuoted reads a double-quoted string at the start of s, returning the
+// unquoted value and the number of bytes consumed.
+func readQuoted(s string) (string, int, bool) {
+	var b bytes.Buffer
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				switch s[i] {
+				case 'n':
+					b.WriteByte('\n')
+				case 't':
+					b.WriteByte('\t')
+				default:
+					b.WriteByte(s[i])
+				}
+			}
+		case '"':
+			return b.String(), i + 1, true
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return "", 0, false
+}
+
+// typedValue converts an unquoted logfmt value to its natural type.
+func typedValue(s string) interface{} {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f
+	}
+	if s == "true" || s == "false" {
+		return s == "true"
+	}
+	return s
+}
+
+// FieldTimestamp returns the timestamp among fields, such as the named
+// groups of a Drain header pattern, looking for the same keys as in
+// structured logs.
+func FieldTimestamp(fields map[string]string) (time.Time, bool) {
+	for _, key := range timestampKeys {
+		if value, ok := fields[key]; ok {
+			if ts, ok := parseTimestamp(value); ok {
+				return ts, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// parseTimestamp interprets a timestamp field. Strings may be RFC 3339 or
+// "2006-01-02 15:04:05"; numbers are Unix time in seconds, milliseconds,
+// microseconds or nanoseconds depending on their magnitude.
+func parseTimestamp(value interface{}) (time.Time, bool) {
+	switch v := value.(type) {
+	case string:
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05.999999999", "2006-01-02T15:04:05.999999999"} {
+			if ts, err := time.Parse(layout, v); err == nil {
+				return ts, true
+			}
+		}
+		if n, err := strconv.ParseFloat(v, 64); err == nil {
+			return parseTimestamp(n)
+		}
+	case int64:
+		switch {
+		case v <= 0:
+			return time.Time{}, false
+		case v < 1e11:
+			return time.Unix(v, 0), true
+		case v < 1e14:
+			return time.UnixMilli(v), true
+		case v < 1e17:
+			return time.UnixMicro(v), true
+		default:
+			return time.Unix(0, v), true
+		}
+	case float64:
+		if v < 1e11 {
+			sec, frac := math.Modf(v)
+			return parseTimestamp(int64(sec)*1e9 + int64(frac*1e9))
+		}
+		return parseTimestamp(int64(v))
+	}
+	return time.Time{}, false
+}
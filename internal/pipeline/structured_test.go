@@ -0,0 +1,99 @@
+package pipeline
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseStructured_JSON(t *testing.T) {
+	line := `{"ts":"2024-05-01T12:00:00.5Z","level":"error","msg":"payment failed for order 42","service":"billing","http":{"status":502,"latency":1.25},"retry":true,"user":"bob"}`
+
+	log, ok := ParseStructured(line)
+	if !ok {
+		t.Fatal("Expected JSON line to be structured")
+	}
+	if log.Format != FormatJSON || log.Message != "payment failed for order 42" {
+		t.Errorf("Unexpected format %q or message %q", log.Format, log.Message)
+	}
+	if log.Level != "error" || log.Service != "billing" {
+		t.Errorf("Unexpected level %q or service %q", log.Level, log.Service)
+	}
+	if want := time.Date(2024, 5, 1, 12, 0, 0, 5e8, time.UTC); !log.Timestamp.Equal(want) {
+		t.Errorf("Expected timestamp %v, got %v", want, log.Timestamp)
+	}
+
+	want := map[string]interface{}{
+		"http.status":  int64(502),
+		"http.latency": 1.25,
+		"retry":        true,
+		"user":         "bob",
+	}
+	if len(log.Attributes) != len(want) {
+		t.Errorf("Expected %d attributes, got %v", len(want), log.Attributes)
+	}
+	for key, value := range want {
+		if log.Attributes[key] != value {
+			t.Errorf("Attribute %s: expected %#v, got %#v", key, value, log.Attributes[key])
+		}
+	}
+}
+
+func TestParseStructured_Logfmt(t *testing.T) {
+	log, ok := ParseStructured(`time=1714564800 level=info msg="user \"bob\" logged in" duration=0.3 attempts=2`)
+	if !ok {
+		t.Fatal("Expected logfmt line to be structured")
+	}
+	if log.Format != FormatLogfmt || log.Message != `user "bob" logged in` {
+		t.Errorf("Unexpected format %q or message %q", log.Format, log.Message)
+	}
+	if !log.Timestamp.Equal(time.Unix(1714564800, 0)) {
+		t.Errorf("Unexpected timestamp %v", log.Timestamp)
+	}
+	if log.Attributes["duration"] != 0.3 || log.Attributes["attempts"] != int64(2) {
+		t.Errorf("Unexpected attributes %v", log.Attributes)
+	}
+}
+
+func TestParseStructured_PlainText(t *testing.T) {
+	for _, line := range []string{
+		"User bob logged in from 10.0.0.1",
+		"retry=3 after failure",
+		`{"level":"info","status":"ok"}`,
+		`{"msg":"truncated"`,
+	} {
+		if _, ok := ParseStructured(line); ok {
+			t.Errorf("Expected %q not to be structured", line)
+		}
+	}
+}
+
+func TestStructure(t *testing.T) {
+	msg := &Message{Content: `{"message":"cache warmed","level":"info","app":"web"}`, Timestamp: time.Unix(1, 0)}
+
+	attributes, ok := Structure(msg)
+	if !ok {
+		t.Fatal("Expected message to be structured")
+	}
+	if msg.Content != "cache warmed" {
+		t.Errorf("Expected content to be the message field, got %q", msg.Content)
+	}
+	if msg.Metadata[MetaLevel] != "info" || msg.Metadata[MetaService] != "web" || msg.Metadata[MetaFormat] != FormatJSON {
+		t.Errorf("Unexpected metadata %v", msg.Metadata)
+	}
+	if !msg.Timestamp.Equal(time.Unix(1, 0)) {
+		t.Error("Expected timestamp to be kept when the line has none")
+	}
+	if len(attributes) != 1 || attributes[LayoutKey] == nil {
+		t.Errorf("Expected only the layout attribute, got %v", attributes)
+	}
+}
+
+func TestFieldTimestamp(t *testing.T) {
+	ts, ok := FieldTimestamp(map[string]string{"level": "INFO", "time": "2024-01-15 10:30:00.250"})
+	if !ok || !ts.Equal(time.Date(2024, 1, 15, 10, 30, 0, 250e6, time.UTC)) {
+		t.Errorf("Expected header timestamp, got %v, %v", ts, ok)
+	}
+	if _, ok := FieldTimestamp(map[string]string{"level": "INFO"}); ok {
+		t.Error("Expected no timestamp without a timestamp field")
+	}
+}
@@ -14,6 +14,7 @@ type Message struct {
 	ID        string
 	Content   string
 	Source    string
+	Stream    string // Producer within the source, such as a file or connection
 	Timestamp time.Time
 	Metadata  map[string]string
 }
@@ -41,6 +42,9 @@ type WorkerPool struct {
 	logger      *zap.Logger
 	metrics     *PoolMetrics
 	bufferSize  int
+	closeMu     sync.RWMutex
+	closed      bool
+	stopOnce    sync.Once
 }
 
 // PoolMetrics tracks worker pool statistics.
@@ -111,7 +115,10 @@ func (wp *WorkerPool) worker(id int) {
 
 	for {
 		select {
-		case msg := <-wp.tasks:
+		case msg, ok := <-wp.tasks:
+			if !ok {
+				return
+			}
 			if msg == nil {
 				continue
 			}
@@ -160,6 +167,12 @@ func (wp *WorkerPool) worker(id int) {
 
 // Submit adds a message to the processing queue.
 func (wp *WorkerPool) Submit(msg *Message) bool {
+	wp.closeMu.RLock()
+	defer wp.closeMu.RUnlock()
+	if wp.closed {
+		return false
+	}
+
 	select {
 	case wp.tasks <- msg:
 		return true
@@ -180,6 +193,12 @@ func (wp *WorkerPool) Submit(msg *Message) bool {
 
 // SubmitBlocking adds a message to the queue, blocking if full.
 func (wp *WorkerPool) SubmitBlocking(msg *Message) bool {
+	wp.closeMu.RLock()
+	defer wp.closeMu.RUnlock()
+	if wp.closed {
+		return false
+	}
+
 	select {
 	case wp.tasks <- msg:
 		return true
@@ -193,19 +212,41 @@ func (wp *WorkerPool) Results() <-chan *Result {
 	return wp.results
 }
 
-// Stop gracefully shuts down the worker pool.
+// Stop gracefully shuts down the worker pool. Messages still queued are
+// discarded; use Drain to process them first.
 func (wp *WorkerPool) Stop() {
 	wp.cancel()
 	wp.wg.Wait()
-	close(wp.tasks)
-	close(wp.results)
+	wp.closeTasks()
 
-	if wp.logger != nil {
-		wp.logger.Info("Worker pool stopped",
-			zap.Int64("processed", wp.metrics.Processed),
-			zap.Int64("errors", wp.metrics.Errors),
-			zap.Int64("dropped", wp.metrics.Dropped),
-		)
+	wp.stopOnce.Do(func() {
+		close(wp.results)
+
+		if wp.logger != nil {
+			wp.logger.Info("Worker pool stopped",
+				zap.Int64("processed", wp.metrics.Processed),
+				zap.Int64("errors", wp.metrics.Errors),
+				zap.Int64("dropped", wp.metrics.Dropped),
+			)
+		}
+	})
+}
+
+// Drain stops accepting messages, waits for the workers to process every
+// message already queued and then stops the pool.
+func (wp *WorkerPool) Drain() {
+	wp.closeTasks()
+	wp.wg.Wait()
+	wp.Stop()
+}
+
+// closeTasks closes the queue, after which Submit rejects messages.
+func (wp *WorkerPool) closeTasks() {
+	wp.closeMu.Lock()
+	defer wp.closeMu.Unlock()
+	if !wp.closed {
+		wp.closed = true
+		close(wp.tasks)
 	}
 }
 
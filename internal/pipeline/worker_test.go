@@ -0,0 +1,35 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkerPool_DrainProcessesQueued(t *testing.T) {
+	wp := NewWorkerPool(context.Background(), PoolConfig{Workers: 2, BufferSize: 100})
+
+	var processed atomic.Int64
+	wp.Start(func(ctx context.Context, msg *Message) (*Result, error) {
+		time.Sleep(time.Millisecond)
+		processed.Add(1)
+		return &Result{MessageID: msg.ID, Success: true}, nil
+	})
+
+	for i := 0; i < 50; i++ {
+		if !wp.Submit(&Message{ID: fmt.Sprint(i)}) {
+			t.Fatalf("Submit %d rejected", i)
+		}
+	}
+	wp.Drain()
+
+	if n := processed.Load(); n != 50 {
+		t.Errorf("Expected 50 messages processed before stopping, got %d", n)
+	}
+	if wp.Submit(&Message{ID: "late"}) {
+		t.Error("Expected Submit to be rejected after Drain")
+	}
+	wp.Stop()
+}
@@ -0,0 +1,581 @@
+// Package archive stores compressed logs in self-contained columnar files
+// for cold storage, so logs past the ClickHouse TTL can still be searched.
+//
+// Records are grouped by source and template into blocks. Within a block
+// rows are sorted by time and stored column by column: timestamps and
+// sizes as varint deltas, strings dictionary-encoded when they repeat, and
+// one column per variable slot. Each block is zstd-compressed. A footer
+// indexes every block by source, template and time range, so scans only
+// read the blocks a filter can match.
+//
+// File layout:
+//
+//	magic "LZA" | version | block ... | index | uint64 index length | magic "LZA"
+package archive
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/log-zero/log-zero/internal/models"
+)
+
+const (
+	magic   = "LZA"
+	version = 1
+
+	// trailerSize is the index length and closing magic at the end of a file.
+	trailerSize = 8 + len(magic)
+)
+
+// ErrCorrupt is returned when an archive cannot be decoded.
+var ErrCorrupt = errors.New("archive: corrupt data")
+
+// ErrStop may be returned by a scan callback to end the scan early without
+// an error.
+var ErrStop = errors.New("archive: stop scan")
+
+// Options configures a Writer.
+type Options struct {
+	BlockRows       int // Rows per block (default: 8192)
+	MaxBufferedRows int // Rows buffered across all groups before every group is flushed (default: 1M)
+}
+
+// DefaultOptions returns the default writer options.
+func DefaultOptions() Options {
+	return Options{
+		BlockRows:       8192,
+		MaxBufferedRows: 1 << 20,
+	}
+}
+
+// BlockInfo is the index entry of one block.
+type BlockInfo struct {
+	Source     string
+	TemplateID string
+	Template   string
+	MinTime    int64 // Unix nanoseconds
+	MaxTime    int64
+	Rows       int
+	Offset     int64
+	Length     int64
+}
+
+// groupKey identifies the logs that share blocks.
+type groupKey struct {
+	source     string
+	templateID string
+}
+
+// group buffers the rows of one source and template until a block is full.
+type group struct {
+	template string
+	rows     []*models.CompressedLog
+}
+
+// The zstd coders are safe for concurrent EncodeAll and DecodeAll calls.
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBetterCompression))
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// Writer writes an archive file. It is not safe for concurrent use.
+type Writer struct {
+	file     *os.File
+	buf      *bufio.Writer
+	offset   int64
+	options  Options
+	groups   map[groupKey]*group
+	buffered int
+	index    []BlockInfo
+	closed   bool
+}
+
+// Create creates an archive at path, replacing any existing file.
+func Create(path string, options Options) (*Writer, error) {
+	defaults := DefaultOptions()
+	if options.BlockRows <= 0 {
+		options.BlockRows = defaults.BlockRows
+	}
+	if options.MaxBufferedRows <= 0 {
+		options.MaxBufferedRows = defaults.MaxBufferedRows
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := &Writer{
+		file:    file,
+		buf:     bufio.NewWriterSize(file, 1<<20),
+		options: options,
+		groups:  make(map[groupKey]*group),
+	}
+	if err := w.write(append([]byte(magic), version)); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// write writes p and advances the file offset.
+func (w *Writer) write(p []byte) error {
+	n, err := w.buf.Write(p)
+	w.offset += int64(n)
+	return err
+}
+
+// Write adds a log to the archive. The log must not be modified until the
+// writer is closed.
+func (w *Writer) Write(log *models.CompressedLog) error {
+	if w.closed {
+		return fmt.Errorf("archive: write to closed writer")
+	}
+
+	key := groupKey{source: log.Source, templateID: log.TemplateID}
+	g, ok := w.groups[key]
+	if !ok {
+		g = &group{template: log.Template}
+		w.groups[key] = g
+	}
+	g.rows = append(g.rows, log)
+	w.buffered++
+
+	if len(g.rows) >= w.options.BlockRows {
+		if err := w.flushGroup(key, g); err != nil {
+			return err
+		}
+	}
+	if w.buffered >= w.options.MaxBufferedRows {
+		return w.flushAll()
+	}
+	return nil
+}
+
+// flushAll writes a block for every group with buffered rows, in a stable
+// order.
+func (w *Writer) flushAll() error {
+	keys := make([]groupKey, 0, len(w.groups))
+	for key := range w.groups {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].source != keys[j].source {
+			return keys[i].source < keys[j].source
+		}
+		return keys[i].templateID < keys[j].templateID
+	})
+
+	for _, key := range keys {
+		if err := w.flushGroup(key, w.groups[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flushGroup writes the buffered rows of g as one block.
+func (w *Writer) flushGroup(key groupKey, g *group) error {
+	if len(g.rows) == 0 {
+		return nil
+	}
+	rows := g.rows
+	sort.SliceStable(rows, func(i, j int) bool {
+		return rows[i].Timestamp.Before(rows[j].Timestamp)
+	})
+
+	block, err := encodeBlock(rows)
+	if err != nil {
+		return err
+	}
+	compressed := zstdEncoder.EncodeAll(block, nil)
+
+	info := BlockInfo{
+		Source:     key.source,
+		TemplateID: key.templateID,
+		Template:   g.template,
+		MinTime:    rows[0].Timestamp.UnixNano(),
+		MaxTime:    rows[len(rows)-1].Timestamp.UnixNano(),
+		Rows:       len(rows),
+		Offset:     w.offset,
+		Length:     int64(len(compressed)),
+	}
+	if err := w.write(compressed); err != nil {
+		return err
+	}
+	w.index = append(w.index, info)
+
+	w.buffered -= len(rows)
+	delete(w.groups, key)
+	return nil
+}
+
+// encodeBlock encodes rows, already sorted by time, column by column.
+func encodeBlock(rows []*models.CompressedLog) ([]byte, error) {
+	n := len(rows)
+	timestamps := make([]int64, n)
+	ids := make([]string, n)
+	originalSizes := make([]int64, n)
+	compressedSizes := make([]int64, n)
+	attributes := make([]string, n)
+	slots := make(map[string]bool)
+	numeric := make(map[string]bool)
+
+	for i, row := range rows {
+		timestamps[i] = row.Timestamp.UnixNano()
+		ids[i] = row.LogID
+		originalSizes[i] = int64(row.OriginalSize)
+		compressedSizes[i] = int64(row.CompressedSize)
+		if len(row.Attributes) > 0 {
+			data, err := json.Marshal(row.Attributes)
+			if err != nil {
+				return nil, fmt.Errorf("archive: log %s attributes: %w", row.LogID, err)
+			}
+			attributes[i] = string(data)
+		}
+		for key := range row.Variables {
+			slots[key] = true
+		}
+		for key := range row.NumericVariables {
+			numeric[key] = true
+		}
+	}
+
+	block := binary.AppendUvarint(nil, uint64(n))
+	block = appendInts(block, timestamps)
+	block = appendStrings(block, ids)
+	block = appendInts(block, originalSizes)
+	block = appendInts(block, compressedSizes)
+	block = appendStrings(block, attributes)
+
+	present := make([]bool, n)
+	block = binary.AppendUvarint(block, uint64(len(slots)))
+	for _, key := range sortedKeys(slots) {
+		var values []string
+		for i, row := range rows {
+			value, ok := row.Variables[key]
+			present[i] = ok
+			if ok {
+				values = append(values, value)
+			}
+		}
+		block = appendString(block, key)
+		block = appendPresence(block, present)
+		block = appendStrings(block, values)
+	}
+
+	block = binary.AppendUvarint(block, uint64(len(numeric)))
+	for _, key := range sortedKeys(numeric) {
+		var values []float64
+		for i, row := range rows {
+			value, ok := row.NumericVariables[key]
+			present[i] = ok
+			if ok {
+				values = append(values, value)
+			}
+		}
+		block = appendString(block, key)
+		block = appendPresence(block, present)
+		block = appendFloats(block, values)
+	}
+	return block, nil
+}
+
+// Close flushes the remaining rows, writes the index and closes the file.
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	if err := w.finish(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// finish writes the remaining blocks and the index footer.
+func (w *Writer) finish() error {
+	if err := w.flushAll(); err != nil {
+		return err
+	}
+
+	index := binary.AppendUvarint(nil, uint64(len(w.index)))
+	for _, info := range w.index {
+		index = appendString(index, info.Source)
+		index = appendString(index, info.TemplateID)
+		index = appendString(index, info.Template)
+		index = binary.AppendVarint(index, info.MinTime)
+		index = binary.AppendVarint(index, info.MaxTime)
+		index = binary.AppendUvarint(index, uint64(info.Rows))
+		index = binary.AppendUvarint(index, uint64(info.Offset))
+		index = binary.AppendUvarint(index, uint64(info.Length))
+	}
+
+	if err := w.write(index); err != nil {
+		return err
+	}
+	if err := w.write(binary.LittleEndian.AppendUint64(nil, uint64(len(index)))); err != nil {
+		return err
+	}
+	if err := w.write([]byte(magic)); err != nil {
+		return err
+	}
+	return w.buf.Flush()
+}
+
+// Reader reads an archive file. It is safe for concurrent scans.
+type Reader struct {
+	file  *os.File
+	index []BlockInfo
+}
+
+// Open opens an archive and reads its index.
+func Open(path string) (*Reader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	index, err := readIndex(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &Reader{file: file, index: index}, nil
+}
+
+// readIndex checks the header and trailer of an archive and decodes its
+// index.
+func readIndex(file *os.File) ([]BlockInfo, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := stat.Size()
+	headerSize := int64(len(magic) + 1)
+	if size < headerSize+int64(trailerSize) {
+		return nil, fmt.Errorf("%w: file too short", ErrCorrupt)
+	}
+
+	header := make([]byte, headerSize)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	if string(header[:len(magic)]) != magic {
+		return nil, fmt.Errorf("%w: not an archive", ErrCorrupt)
+	}
+	if header[len(magic)] != version {
+		return nil, fmt.Errorf("archive: unsupported version %d", header[len(magic)])
+	}
+
+	trailer := make([]byte, trailerSize)
+	if _, err := file.ReadAt(trailer, size-int64(trailerSize)); err != nil {
+		return nil, err
+	}
+	if string(trailer[8:]) != magic {
+		return nil, fmt.Errorf("%w: missing index, archive may be incomplete", ErrCorrupt)
+	}
+	indexLength := binary.LittleEndian.Uint64(trailer)
+	indexEnd := size - int64(trailerSize)
+	if indexLength > uint64(indexEnd-headerSize) {
+		return nil, fmt.Errorf("%w: invalid index length", ErrCorrupt)
+	}
+
+	data := make([]byte, indexLength)
+	if _, err := file.ReadAt(data, indexEnd-int64(indexLength)); err != nil {
+		return nil, err
+	}
+
+	d := &decoder{data: data}
+	index := make([]BlockInfo, d.count(8))
+	for i := range index {
+		info := &index[i]
+		info.Source = d.string()
+		info.TemplateID = d.string()
+		info.Template = d.string()
+		info.MinTime = d.varint()
+		info.MaxTime = d.varint()
+		info.Rows = int(d.uvarint())
+		info.Offset = int64(d.uvarint())
+		info.Length = int64(d.uvarint())
+		if d.err == nil && (info.Offset < headerSize || info.Length < 0 || info.Offset+info.Length > indexEnd-int64(indexLength)) {
+			return nil, fmt.Errorf("%w: block %d out of bounds", ErrCorrupt, i)
+		}
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return index, nil
+}
+
+// Blocks returns the index of the archive.
+func (r *Reader) Blocks() []BlockInfo {
+	return append([]BlockInfo{}, r.index...)
+}
+
+// Close closes the archive file.
+func (r *Reader) Close() error {
+	return r.file.Close()
+}
+
+// Filter selects logs in a scan. Zero fields match everything.
+type Filter struct {
+	Start       time.Time // Inclusive
+	End         time.Time // Inclusive
+	TemplateIDs []string
+	Sources     []string
+}
+
+// matchesBlock reports whether any row of a block may match f.
+func (f *Filter) matchesBlock(info *BlockInfo) bool {
+	if !f.Start.IsZero() && info.MaxTime < f.Start.UnixNano() {
+		return false
+	}
+	if !f.End.IsZero() && info.MinTime > f.End.UnixNano() {
+		return false
+	}
+	return contains(f.TemplateIDs, info.TemplateID) && contains(f.Sources, info.Source)
+}
+
+// matchesTime reports whether a row timestamp is within f.
+func (f *Filter) matchesTime(ts int64) bool {
+	return (f.Start.IsZero() || ts >= f.Start.UnixNano()) && (f.End.IsZero() || ts <= f.End.UnixNano())
+}
+
+// contains reports whether values is empty or holds value.
+func contains(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Scan calls fn with every log matching filter, block by block in file
+// order and by time within a block. It stops at the first error fn
+// returns, which is returned unless it is ErrStop.
+func (r *Reader) Scan(filter Filter, fn func(log *models.CompressedLog) error) error {
+	for i := range r.index {
+		info := &r.index[i]
+		if !filter.matchesBlock(info) {
+			continue
+		}
+
+		logs, err := r.readBlock(info)
+		if err != nil {
+			return fmt.Errorf("block %d: %w", i, err)
+		}
+		for _, log := range logs {
+			if !filter.matchesTime(log.Timestamp.UnixNano()) {
+				continue
+			}
+			if err := fn(log); err != nil {
+				if errors.Is(err, ErrStop) {
+					return nil
+				}
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readBlock reads and decodes one block.
+func (r *Reader) readBlock(info *BlockInfo) ([]*models.CompressedLog, error) {
+	compressed := make([]byte, info.Length)
+	if _, err := r.file.ReadAt(compressed, info.Offset); err != nil && err != io.EOF {
+		return nil, err
+	}
+	data, err := zstdDecoder.DecodeAll(compressed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	return decodeBlock(data, info)
+}
+
+// decodeBlock decodes the rows of a block encoded by encodeBlock.
+func decodeBlock(data []byte, info *BlockInfo) ([]*models.CompressedLog, error) {
+	d := &decoder{data: data}
+	n := d.count(1)
+	if d.err == nil && n != info.Rows {
+		return nil, fmt.Errorf("%w: block has %d rows, index says %d", ErrCorrupt, n, info.Rows)
+	}
+
+	timestamps := d.ints(n)
+	ids := d.strings(n)
+	originalSizes := d.ints(n)
+	compressedSizes := d.ints(n)
+	attributes := d.strings(n)
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	logs := make([]*models.CompressedLog, n)
+	for i := range logs {
+		logs[i] = &models.CompressedLog{
+			LogID:          ids[i],
+			TemplateID:     info.TemplateID,
+			Template:       info.Template,
+			Timestamp:      time.Unix(0, timestamps[i]).UTC(),
+			Source:         info.Source,
+			Variables:      make(map[string]string),
+			OriginalSize:   int(originalSizes[i]),
+			CompressedSize: int(compressedSizes[i]),
+		}
+		if attributes[i] != "" {
+			if err := json.Unmarshal([]byte(attributes[i]), &logs[i].Attributes); err != nil {
+				return nil, fmt.Errorf("%w: log %s attributes: %v", ErrCorrupt, ids[i], err)
+			}
+		}
+	}
+
+	for slots := d.count(2); slots > 0 && d.err == nil; slots-- {
+		key := d.string()
+		present, count := d.presence(n)
+		values := d.strings(count)
+		j := 0
+		for i, ok := range present {
+			if ok && j < len(values) {
+				logs[i].Variables[key] = values[j]
+				j++
+			}
+		}
+	}
+
+	for numeric := d.count(2); numeric > 0 && d.err == nil; numeric-- {
+		key := d.string()
+		present, count := d.presence(n)
+		values := d.floats(count)
+		j := 0
+		for i, ok := range present {
+			if ok && j < len(values) {
+				if logs[i].NumericVariables == nil {
+					logs[i].NumericVariables = make(map[string]float64)
+				}
+				logs[i].NumericVariables[key] = values[j]
+				j++
+			}
+		}
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+	if d.pos != len(data) {
+		return nil, fmt.Errorf("%w: %d trailing bytes in block", ErrCorrupt, len(data)-d.pos)
+	}
+	return logs, nil
+}
@@ -0,0 +1,181 @@
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/log-zero/log-zero/internal/models"
+)
+
+func sampleLogs(n int) []*models.CompressedLog {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	logs := make([]*models.CompressedLog, n)
+	for i := range logs {
+		log := &models.CompressedLog{
+			LogID:          fmt.Sprintf("log-%05d", i),
+			TemplateID:     fmt.Sprintf("tmpl_%d", i%3),
+			Template:       fmt.Sprintf("request <*> took <NUM> ms variant %d", i%3),
+			Timestamp:      start.Add(time.Duration(n-i) * time.Second), // Reverse order
+			Source:         []string{"api", "worker"}[i%2],
+			Variables:      map[string]string{"path": []string{"/a", "/b"}[i%2], "took": fmt.Sprint(i)},
+			OriginalSize:   100 + i,
+			CompressedSize: 10 + i%7,
+		}
+		log.NumericVariables = map[string]float64{"took": float64(i)}
+		if i%5 == 0 {
+			log.Variables["retry"] = "true"
+			log.Attributes = map[string]interface{}{"user": "alice", "attempt": float64(i)}
+		}
+		logs[i] = log
+	}
+	return logs
+}
+
+func writeArchive(t *testing.T, logs []*models.CompressedLog, options Options) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "logs.lza")
+	w, err := Create(path, options)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	for _, log := range logs {
+		if err := w.Write(log); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	return path
+}
+
+func TestArchive_RoundTrip(t *testing.T) {
+	logs := sampleLogs(1000)
+	path := writeArchive(t, logs, Options{BlockRows: 100})
+
+	r, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer r.Close()
+
+	// 6 source/template groups of about 167 rows, in blocks of 100
+	if blocks := len(r.Blocks()); blocks != 12 {
+		t.Errorf("Expected 12 blocks, got %d", blocks)
+	}
+
+	byID := make(map[string]*models.CompressedLog)
+	var last time.Time
+	var lastBlock string
+	err = r.Scan(Filter{}, func(log *models.CompressedLog) error {
+		block := log.Source + log.TemplateID
+		if block == lastBlock && log.Timestamp.Before(last) {
+			t.Errorf("Rows of a block out of time order at %s", log.LogID)
+		}
+		last, lastBlock = log.Timestamp, block
+		byID[log.LogID] = log
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	if len(byID) != len(logs) {
+		t.Fatalf("Expected %d logs, got %d", len(logs), len(byID))
+	}
+	for _, want := range logs {
+		got := byID[want.LogID]
+		if !got.Timestamp.Equal(want.Timestamp) || got.TemplateID != want.TemplateID || got.Template != want.Template ||
+			got.Source != want.Source || got.OriginalSize != want.OriginalSize || got.CompressedSize != want.CompressedSize ||
+			!reflect.DeepEqual(got.Variables, want.Variables) || !reflect.DeepEqual(got.NumericVariables, want.NumericVariables) ||
+			!reflect.DeepEqual(got.Attributes, want.Attributes) {
+			t.Fatalf("Log %s changed:\nwant %+v\ngot  %+v", want.LogID, want, got)
+		}
+	}
+
+	info, _ := os.Stat(path)
+	t.Logf("%d logs in %d bytes", len(logs), info.Size())
+}
+
+func TestArchive_FilteredScan(t *testing.T) {
+	logs := sampleLogs(300)
+	path := writeArchive(t, logs, DefaultOptions())
+	r, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer r.Close()
+
+	start := time.Date(2026, 1, 1, 0, 1, 0, 0, time.UTC)
+	filter := Filter{
+		Start:       start,
+		End:         start.Add(time.Minute),
+		TemplateIDs: []string{"tmpl_1"},
+		Sources:     []string{"worker"},
+	}
+
+	want := 0
+	for _, log := range logs {
+		if log.TemplateID == "tmpl_1" && log.Source == "worker" && !log.Timestamp.Before(filter.Start) && !log.Timestamp.After(filter.End) {
+			want++
+		}
+	}
+	got := 0
+	err = r.Scan(filter, func(log *models.CompressedLog) error {
+		if log.TemplateID != "tmpl_1" || log.Source != "worker" || log.Timestamp.Before(filter.Start) || log.Timestamp.After(filter.End) {
+			t.Errorf("Log %s does not match the filter", log.LogID)
+		}
+		got++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	if want == 0 || got != want {
+		t.Errorf("Expected %d logs, got %d", want, got)
+	}
+
+	// ErrStop ends the scan without an error
+	seen := 0
+	err = r.Scan(Filter{}, func(*models.CompressedLog) error {
+		seen++
+		return ErrStop
+	})
+	if err != nil || seen != 1 {
+		t.Errorf("Expected ErrStop to end the scan after 1 log, got %d and %v", seen, err)
+	}
+}
+
+func TestArchive_Corrupt(t *testing.T) {
+	path := writeArchive(t, sampleLogs(50), DefaultOptions())
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	truncated := filepath.Join(t.TempDir(), "truncated.lza")
+	os.WriteFile(truncated, data[:len(data)-20], 0o644)
+	if _, err := Open(truncated); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Expected ErrCorrupt for a truncated archive, got %v", err)
+	}
+
+	// Damage the first block; the index still opens but the scan fails
+	damaged := filepath.Join(t.TempDir(), "damaged.lza")
+	copied := append([]byte{}, data...)
+	for i := 4; i < 24; i++ {
+		copied[i] ^= 0xff
+	}
+	os.WriteFile(damaged, copied, 0o644)
+	r, err := Open(damaged)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer r.Close()
+	if err := r.Scan(Filter{}, func(*models.CompressedLog) error { return nil }); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Expected ErrCorrupt scanning a damaged block, got %v", err)
+	}
+}
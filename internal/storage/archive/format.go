@@ -0,0 +1,252 @@
+package archive
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Column encodings
+
+// String column modes.
+const (
+	stringPlain      = 0 // Each value as length and bytes
+	stringDictionary = 1 // Distinct values once, then an index per row
+)
+
+// appendStrings appends a string column, dictionary-encoded when values
+// repeat enough for it to pay off.
+func appendStrings(dst []byte, values []string) []byte {
+	index := make(map[string]int)
+	var distinct []string
+	for _, v := range values {
+		if _, ok := index[v]; !ok {
+			index[v] = len(distinct)
+			distinct = append(distinct, v)
+		}
+	}
+
+	if len(distinct)*2 > len(values) {
+		dst = append(dst, stringPlain)
+		for _, v := range values {
+			dst = appendString(dst, v)
+		}
+		return dst
+	}
+
+	dst = append(dst, stringDictionary)
+	dst = binary.AppendUvarint(dst, uint64(len(distinct)))
+	for _, v := range distinct {
+		dst = appendString(dst, v)
+	}
+	for _, v := range values {
+		dst = binary.AppendUvarint(dst, uint64(index[v]))
+	}
+	return dst
+}
+
+// appendInts appends an integer column as varint deltas from the previous
+// value.
+func appendInts(dst []byte, values []int64) []byte {
+	var last int64
+	for _, v := range values {
+		dst = binary.AppendVarint(dst, v-last)
+		last = v
+	}
+	return dst
+}
+
+// appendFloats appends a float column as little-endian IEEE 754 values.
+func appendFloats(dst []byte, values []float64) []byte {
+	for _, v := range values {
+		dst = binary.LittleEndian.AppendUint64(dst, math.Float64bits(v))
+	}
+	return dst
+}
+
+// appendPresence appends which of n rows have a value: a single 1 when all
+// do, otherwise 0 followed by a bitmap.
+func appendPresence(dst []byte, present []bool) []byte {
+	all := true
+	for _, p := range present {
+		all = all && p
+	}
+	if all {
+		return append(dst, 1)
+	}
+
+	dst = append(dst, 0)
+	bitmap := make([]byte, (len(present)+7)/8)
+	for i, p := range present {
+		if p {
+			bitmap[i/8] |= 1 << (i % 8)
+		}
+	}
+	return append(dst, bitmap...)
+}
+
+func appendString(dst []byte, s string) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(s)))
+	return append(dst, s...)
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// decoder reads the encodings above from a byte slice, recording the first
+// error.
+type decoder struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (d *decoder) fail() {
+	if d.err == nil {
+		d.err = fmt.Errorf("%w at offset %d", ErrCorrupt, d.pos)
+	}
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil || d.pos >= len(d.data) {
+		d.fail()
+		return 0
+	}
+	b := d.data[d.pos]
+	d.pos++
+	return b
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data[d.pos:])
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.pos += n
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.data[d.pos:])
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.pos += n
+	return v
+}
+
+// count reads a length that must not exceed the remaining bytes divided by
+// the minimum encoded size of one element.
+func (d *decoder) count(minSize int) int {
+	n := d.uvarint()
+	if d.err == nil && n > uint64((len(d.data)-d.pos)/minSize) {
+		d.fail()
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) string() string {
+	n := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if n > uint64(len(d.data)-d.pos) {
+		d.fail()
+		return ""
+	}
+	s := string(d.data[d.pos : d.pos+int(n)])
+	d.pos += int(n)
+	return s
+}
+
+func (d *decoder) strings(n int) []string {
+	values := make([]string, n)
+	switch d.byte() {
+	case stringPlain:
+		for i := range values {
+			values[i] = d.string()
+		}
+	case stringDictionary:
+		distinct := make([]string, d.count(1))
+		for i := range distinct {
+			distinct[i] = d.string()
+		}
+		for i := range values {
+			j := d.uvarint()
+			if j >= uint64(len(distinct)) {
+				d.fail()
+				return values
+			}
+			values[i] = distinct[j]
+		}
+	default:
+		d.fail()
+	}
+	return values
+}
+
+func (d *decoder) ints(n int) []int64 {
+	values := make([]int64, n)
+	var last int64
+	for i := range values {
+		last += d.varint()
+		values[i] = last
+	}
+	return values
+}
+
+func (d *decoder) floats(n int) []float64 {
+	values := make([]float64, n)
+	if d.err != nil || n*8 > len(d.data)-d.pos {
+		d.fail()
+		return values
+	}
+	for i := range values {
+		values[i] = math.Float64frombits(binary.LittleEndian.Uint64(d.data[d.pos:]))
+		d.pos += 8
+	}
+	return values
+}
+
+// presence reads a presence column for n rows and returns it with the
+// number of rows present.
+func (d *decoder) presence(n int) ([]bool, int) {
+	present := make([]bool, n)
+	if d.byte() == 1 {
+		for i := range present {
+			present[i] = true
+		}
+		return present, n
+	}
+	size := (n + 7) / 8
+	if d.err != nil || size > len(d.data)-d.pos {
+		d.fail()
+		return present, 0
+	}
+	count := 0
+	for i := range present {
+		present[i] = d.data[d.pos+i/8]&(1<<(i%8)) != 0
+		if present[i] {
+			count++
+		}
+	}
+	d.pos += size
+	return present, count
+}
@@ -8,6 +8,8 @@ import (
 
 	"github.com/ClickHouse/clickhouse-go/v2"
 	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/log-zero/log-zero/internal/models"
+	"github.com/log-zero/log-zero/internal/storage/archive"
 	"go.uber.org/zap"
 )
 
@@ -76,7 +78,8 @@ func NewClient(config Config, logger *zap.Logger) (*Client, error) {
 
 // InitSchema creates the required tables.
 func (c *Client) InitSchema(ctx context.Context) error {
-	// Create compressed_logs table
+	// Create compressed_logs table. Rows expire after 90 days; use
+	// ExportArchive to copy them to an archive file before then.
 	logsTable := `
 		CREATE TABLE IF NOT EXISTS compressed_logs (
 			log_id UUID,
@@ -84,6 +87,7 @@ func (c *Client) InitSchema(ctx context.Context) error {
 			template_id String,
 			source String,
 			variables Map(String, String),
+			num_variables Map(String, Float64),
 			original_size UInt32,
 			compressed_size UInt32,
 			created_at DateTime DEFAULT now()
@@ -104,6 +108,7 @@ func (c *Client) InitSchema(ctx context.Context) error {
 			log_count UInt64,
 			first_seen DateTime64(3),
 			last_seen DateTime64(3),
+			slot_types Map(String, String),
 			created_at DateTime DEFAULT now()
 		) ENGINE = ReplacingMergeTree(last_seen)
 		ORDER BY template_id
@@ -112,6 +117,30 @@ func (c *Client) InitSchema(ctx context.Context) error {
 		return fmt.Errorf("failed to create templates table: %w", err)
 	}
 
+	// Add typed variable columns to tables created before slot type inference
+	for _, alter := range []string{
+		`ALTER TABLE compressed_logs ADD COLUMN IF NOT EXISTS num_variables Map(String, Float64) AFTER variables`,
+		`ALTER TABLE templates ADD COLUMN IF NOT EXISTS slot_types Map(String, String) AFTER last_seen`,
+	} {
+		if err := c.conn.Exec(ctx, alter); err != nil {
+			return fmt.Errorf("failed to add typed variable column: %w", err)
+		}
+	}
+
+	// Create template aliases table. Drain retires a template ID when the
+	// template is generalized or merged; this maps old IDs to current ones.
+	aliasesTable := `
+		CREATE TABLE IF NOT EXISTS template_aliases (
+			alias_id String,
+			template_id String,
+			created_at DateTime DEFAULT now()
+		) ENGINE = ReplacingMergeTree(created_at)
+		ORDER BY alias_id
+	`
+	if err := c.conn.Exec(ctx, aliasesTable); err != nil {
+		return fmt.Errorf("failed to create template_aliases table: %w", err)
+	}
+
 	// Create aggregation materialized view
 	aggregationsView := `
 		CREATE MATERIALIZED VIEW IF NOT EXISTS logs_by_template_mv
@@ -142,6 +171,7 @@ type CompressedLog struct {
 	TemplateID     string
 	Source         string
 	Variables      map[string]string
+	NumVariables   map[string]float64 // Variables that parse as numbers; durations in milliseconds
 	OriginalSize   uint32
 	CompressedSize uint32
 }
@@ -149,8 +179,8 @@ type CompressedLog struct {
 // InsertLog inserts a compressed log.
 func (c *Client) InsertLog(ctx context.Context, log *CompressedLog) error {
 	query := `
-		INSERT INTO compressed_logs (log_id, timestamp, template_id, source, variables, original_size, compressed_size)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO compressed_logs (log_id, timestamp, template_id, source, variables, num_variables, original_size, compressed_size)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
 	`
 	return c.conn.Exec(ctx, query,
 		log.LogID,
@@ -158,6 +188,7 @@ func (c *Client) InsertLog(ctx context.Context, log *CompressedLog) error {
 		log.TemplateID,
 		log.Source,
 		log.Variables,
+		numVariables(log),
 		log.OriginalSize,
 		log.CompressedSize,
 	)
@@ -166,7 +197,7 @@ func (c *Client) InsertLog(ctx context.Context, log *CompressedLog) error {
 // InsertLogsBatch inserts multiple logs in a batch.
 func (c *Client) InsertLogsBatch(ctx context.Context, logs []*CompressedLog) error {
 	batch, err := c.conn.PrepareBatch(ctx, `
-		INSERT INTO compressed_logs (log_id, timestamp, template_id, source, variables, original_size, compressed_size)
+		INSERT INTO compressed_logs (log_id, timestamp, template_id, source, variables, num_variables, original_size, compressed_size)
 	`)
 	if err != nil {
 		return fmt.Errorf("failed to prepare batch: %w", err)
@@ -179,6 +210,7 @@ func (c *Client) InsertLogsBatch(ctx context.Context, logs []*CompressedLog) err
 			log.TemplateID,
 			log.Source,
 			log.Variables,
+			numVariables(log),
 			log.OriginalSize,
 			log.CompressedSize,
 		); err != nil {
@@ -189,28 +221,111 @@ func (c *Client) InsertLogsBatch(ctx context.Context, logs []*CompressedLog) err
 	return batch.Send()
 }
 
+// numVariables returns the numeric variables of log, never nil.
+func numVariables(log *CompressedLog) map[string]float64 {
+	if log.NumVariables == nil {
+		return map[string]float64{}
+	}
+	return log.NumVariables
+}
+
+// TemplateRecord is a row of the templates table.
+type TemplateRecord struct {
+	TemplateID string
+	Pattern    string
+	LogCount   uint64
+	FirstSeen  time.Time
+	LastSeen   time.Time
+	SlotTypes  map[string]string // Inferred type of each variable slot
+}
+
+// InsertTemplates records templates and their slot schemas. Newer rows
+// replace older ones for the same template ID.
+func (c *Client) InsertTemplates(ctx context.Context, templates []*TemplateRecord) error {
+	if len(templates) == 0 {
+		return nil
+	}
+
+	batch, err := c.conn.PrepareBatch(ctx, `
+		INSERT INTO templates (template_id, pattern, log_count, first_seen, last_seen, slot_types)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare batch: %w", err)
+	}
+
+	for _, t := range templates {
+		slotTypes := t.SlotTypes
+		if slotTypes == nil {
+			slotTypes = map[string]string{}
+		}
+		if err := batch.Append(t.TemplateID, t.Pattern, t.LogCount, t.FirstSeen, t.LastSeen, slotTypes); err != nil {
+			return fmt.Errorf("failed to append template: %w", err)
+		}
+	}
+
+	return batch.Send()
+}
+
+// InsertTemplateAliases records retired template IDs and the IDs they
+// now resolve to.
+func (c *Client) InsertTemplateAliases(ctx context.Context, aliases map[string]string) error {
+	if len(aliases) == 0 {
+		return nil
+	}
+
+	batch, err := c.conn.PrepareBatch(ctx, `
+		INSERT INTO template_aliases (alias_id, template_id)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare batch: %w", err)
+	}
+
+	for alias, templateID := range aliases {
+		if err := batch.Append(alias, templateID); err != nil {
+			return fmt.Errorf("failed to append alias: %w", err)
+		}
+	}
+
+	return batch.Send()
+}
+
+// VariableFilter compares a numeric variable slot, such as latency > 500.
+// Logs without the slot never match.
+type VariableFilter struct {
+	Key   string
+	Op    string // One of =, !=, <, <=, >, >=
+	Value float64
+}
+
+// filterOps is the set of comparison operators a VariableFilter may use.
+var filterOps = map[string]bool{
+	"=": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true,
+}
+
 // QueryRequest holds query parameters.
 type QueryRequest struct {
-	TemplateID string
-	Source     string
-	StartTime  time.Time
-	EndTime    time.Time
-	Limit      int
-	Offset     int
+	TemplateID      string
+	Source          string
+	StartTime       time.Time
+	EndTime         time.Time
+	VariableFilters []VariableFilter
+	Limit           int
+	Offset          int
 }
 
 // QueryLogs queries compressed logs.
 func (c *Client) QueryLogs(ctx context.Context, req *QueryRequest) ([]*CompressedLog, error) {
 	query := `
-		SELECT log_id, timestamp, template_id, source, variables, original_size, compressed_size
+		SELECT log_id, timestamp, template_id, source, variables, num_variables, original_size, compressed_size
 		FROM compressed_logs
 		WHERE 1=1
 	`
 	args := make([]interface{}, 0)
 
 	if req.TemplateID != "" {
-		query += " AND template_id = ?"
-		args = append(args, req.TemplateID)
+		// Match logs stored under any retired ID of the template as well
+		query += " AND (template_id = ? OR template_id IN (SELECT alias_id FROM template_aliases FINAL WHERE template_id = ?))"
+		args = append(args, req.TemplateID, req.TemplateID)
 	}
 	if req.Source != "" {
 		query += " AND source = ?"
@@ -224,6 +339,13 @@ func (c *Client) QueryLogs(ctx context.Context, req *QueryRequest) ([]*Compresse
 		query += " AND timestamp <= ?"
 		args = append(args, req.EndTime)
 	}
+	for _, filter := range req.VariableFilters {
+		if !filterOps[filter.Op] {
+			return nil, fmt.Errorf("invalid variable filter operator %q", filter.Op)
+		}
+		query += fmt.Sprintf(" AND mapContains(num_variables, ?) AND num_variables[?] %s ?", filter.Op)
+		args = append(args, filter.Key, filter.Key, filter.Value)
+	}
 
 	query += " ORDER BY timestamp DESC"
 
@@ -249,6 +371,7 @@ func (c *Client) QueryLogs(ctx context.Context, req *QueryRequest) ([]*Compresse
 			&log.TemplateID,
 			&log.Source,
 			&log.Variables,
+			&log.NumVariables,
 			&log.OriginalSize,
 			&log.CompressedSize,
 		); err != nil {
@@ -260,6 +383,125 @@ func (c *Client) QueryLogs(ctx context.Context, req *QueryRequest) ([]*Compresse
 	return logs, nil
 }
 
+// ExportArchive writes the logs in the time window of req to an archive,
+// with their template patterns, and returns how many were written. Source
+// and TemplateID narrow the export; Limit and Offset are ignored. Rows are
+// streamed, so windows larger than memory can be exported.
+//
+// A log stored under a template ID without a templates row, because the
+// ID was retired by generalization or merging before it was recorded, gets
+// the pattern of the template its alias resolves to.
+func (c *Client) ExportArchive(ctx context.Context, req *QueryRequest, w *archive.Writer) (int, error) {
+	patterns, err := c.templatePatterns(ctx)
+	if err != nil {
+		return 0, err
+	}
+	aliases, err := c.templateAliases(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	query := `
+		SELECT log_id, timestamp, template_id, source, variables, num_variables, original_size, compressed_size
+		FROM compressed_logs
+		WHERE 1=1
+	`
+	args := make([]interface{}, 0)
+
+	if req.TemplateID != "" {
+		// Match logs stored under any retired ID of the template as well
+		query += " AND (template_id = ? OR template_id IN (SELECT alias_id FROM template_aliases FINAL WHERE template_id = ?))"
+		args = append(args, req.TemplateID, req.TemplateID)
+	}
+	if req.Source != "" {
+		query += " AND source = ?"
+		args = append(args, req.Source)
+	}
+	if !req.StartTime.IsZero() {
+		query += " AND timestamp >= ?"
+		args = append(args, req.StartTime)
+	}
+	if !req.EndTime.IsZero() {
+		query += " AND timestamp <= ?"
+		args = append(args, req.EndTime)
+	}
+
+	rows, err := c.conn.Query(ctx, query, args...)
+	if err != nil {
+		return 0, fmt.Errorf("query failed: %w", err)
+	}
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		var (
+			log                          models.CompressedLog
+			originalSize, compressedSize uint32
+		)
+		if err := rows.Scan(
+			&log.LogID,
+			&log.Timestamp,
+			&log.TemplateID,
+			&log.Source,
+			&log.Variables,
+			&log.NumericVariables,
+			&originalSize,
+			&compressedSize,
+		); err != nil {
+			return count, fmt.Errorf("scan failed: %w", err)
+		}
+		log.Template = resolvePattern(patterns, aliases, log.TemplateID)
+		log.OriginalSize = int(originalSize)
+		log.CompressedSize = int(compressedSize)
+		if err := w.Write(&log); err != nil {
+			return count, fmt.Errorf("failed to write archive: %w", err)
+		}
+		count++
+	}
+
+	return count, rows.Err()
+}
+
+// resolvePattern returns the pattern recorded for templateID, or else the
+// pattern of the template its alias resolves to.
+func resolvePattern(patterns, aliases map[string]string, templateID string) string {
+	if pattern, ok := patterns[templateID]; ok {
+		return pattern
+	}
+	return patterns[aliases[templateID]]
+}
+
+// templatePatterns returns the pattern of every recorded template ID.
+func (c *Client) templatePatterns(ctx context.Context) (map[string]string, error) {
+	return c.queryStringMap(ctx, "SELECT template_id, pattern FROM templates FINAL")
+}
+
+// templateAliases returns every retired template ID mapped to its current
+// ID.
+func (c *Client) templateAliases(ctx context.Context) (map[string]string, error) {
+	return c.queryStringMap(ctx, "SELECT alias_id, template_id FROM template_aliases FINAL")
+}
+
+// queryStringMap runs a query selecting two string columns and returns the
+// rows as a map from the first to the second.
+func (c *Client) queryStringMap(ctx context.Context, query string) (map[string]string, error) {
+	rows, err := c.conn.Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %w", err)
+	}
+	defer rows.Close()
+
+	values := make(map[string]string)
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, fmt.Errorf("scan failed: %w", err)
+		}
+		values[key] = value
+	}
+	return values, rows.Err()
+}
+
 // GetCompressionStats returns compression statistics.
 type CompressionStats struct {
 	TotalLogs           int64
@@ -0,0 +1,122 @@
+package clickhouse
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/log-zero/log-zero/internal/models"
+	"github.com/log-zero/log-zero/internal/storage/archive"
+	"go.uber.org/zap"
+)
+
+// fakeConn answers queries with canned rows, chosen by the table the query
+// reads from.
+type fakeConn struct {
+	driver.Conn
+	tables map[string][][]interface{}
+}
+
+func (c *fakeConn) Query(ctx context.Context, query string, args ...interface{}) (driver.Rows, error) {
+	fields := strings.Fields(query[strings.Index(query, "FROM"):])
+	rows, ok := c.tables[fields[1]]
+	if !ok {
+		return nil, fmt.Errorf("unexpected query %q", query)
+	}
+	return &fakeRows{rows: rows, next: -1}, nil
+}
+
+// fakeRows iterates canned rows, assigning each column to the pointer
+// passed to Scan at the same position.
+type fakeRows struct {
+	driver.Rows
+	rows [][]interface{}
+	next int
+}
+
+func (r *fakeRows) Next() bool {
+	r.next++
+	return r.next < len(r.rows)
+}
+
+func (r *fakeRows) Scan(dest ...interface{}) error {
+	row := r.rows[r.next]
+	if len(dest) != len(row) {
+		return fmt.Errorf("scan of %d columns into %d values", len(row), len(dest))
+	}
+	for i, value := range row {
+		reflect.ValueOf(dest[i]).Elem().Set(reflect.ValueOf(value))
+	}
+	return nil
+}
+
+func (r *fakeRows) Close() error { return nil }
+func (r *fakeRows) Err() error   { return nil }
+
+func TestExportArchive_RetiredTemplateID(t *testing.T) {
+	at := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	logRow := func(id, templateID string, variables map[string]string) []interface{} {
+		return []interface{}{id, at, templateID, "api", variables, map[string]float64{}, uint32(40), uint32(12)}
+	}
+	conn := &fakeConn{tables: map[string][][]interface{}{
+		"templates": {
+			{"tmpl_current", "session opened for <*>"},
+			{"tmpl_recorded", "session closed for alice"},
+		},
+		"template_aliases": {
+			{"tmpl_retired", "tmpl_current"},
+			{"tmpl_recorded", "tmpl_closed"},
+		},
+		"compressed_logs": {
+			logRow("log-1", "tmpl_current", map[string]string{"var_0": "bob"}),
+			logRow("log-2", "tmpl_retired", map[string]string{"var_0": "carol"}),
+			logRow("log-3", "tmpl_recorded", map[string]string{}),
+		},
+	}}
+	client := &Client{conn: conn, logger: zap.NewNop()}
+
+	path := filepath.Join(t.TempDir(), "logs.lza")
+	w, err := archive.Create(path, archive.DefaultOptions())
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	count, err := client.ExportArchive(context.Background(), &QueryRequest{}, w)
+	if err != nil {
+		t.Fatalf("ExportArchive failed: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if count != 3 {
+		t.Fatalf("Expected 3 logs exported, got %d", count)
+	}
+
+	reader, err := archive.Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer reader.Close()
+
+	patterns := make(map[string]string)
+	err = reader.Scan(archive.Filter{}, func(log *models.CompressedLog) error {
+		patterns[log.LogID] = log.Template
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+
+	want := map[string]string{
+		"log-1": "session opened for <*>",
+		"log-2": "session opened for <*>",   // Resolved through its alias
+		"log-3": "session closed for alice", // Its own pattern wins over the alias
+	}
+	if !reflect.DeepEqual(patterns, want) {
+		t.Errorf("Expected patterns %v, got %v", want, patterns)
+	}
+}
@@ -13,6 +13,7 @@ CREATE TABLE IF NOT EXISTS compressed_logs (
     template_id String,
     source String,
     variables Map(String, String),
+    num_variables Map(String, Float64),
     original_size UInt32,
     compressed_size UInt32,
     created_at DateTime DEFAULT now()
@@ -29,10 +30,19 @@ CREATE TABLE IF NOT EXISTS templates (
     log_count UInt64,
     first_seen DateTime64(3),
     last_seen DateTime64(3),
+    slot_types Map(String, String),
     created_at DateTime DEFAULT now()
 ) ENGINE = ReplacingMergeTree(last_seen)
 ORDER BY template_id;
 
+-- Template aliases: retired template IDs mapped to their current IDs
+CREATE TABLE IF NOT EXISTS template_aliases (
+    alias_id String,
+    template_id String,
+    created_at DateTime DEFAULT now()
+) ENGINE = ReplacingMergeTree(created_at)
+ORDER BY alias_id;
+
 -- Aggregation materialized view for analytics
 CREATE MATERIALIZED VIEW IF NOT EXISTS logs_by_template_hourly
 ENGINE = SummingMergeTree()
@@ -63,4 +73,5 @@ GROUP BY source, minute;
 
 -- Sample queries for verification
 -- SELECT template_id, count() as cnt FROM compressed_logs GROUP BY template_id ORDER BY cnt DESC LIMIT 10;
+-- SELECT log_id, variables FROM compressed_logs WHERE mapContains(num_variables, 'latency') AND num_variables['latency'] > 500;
 -- SELECT source, sum(log_count) as total, sum(total_original_size) as orig, sum(total_compressed_size) as comp FROM logs_by_template_hourly GROUP BY source;